@@ -0,0 +1,380 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Обработка видеофайлов из командной строки без запуска веб-сервиса
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"mp4Parser/mp4"
+)
+
+// errUsage ошибка - неверный синтаксис вызова команды
+var errUsage = errors.New("неверные аргументы команды")
+
+// command описание команды, доступной из командной строки
+type command struct {
+	usage string                    // синтаксис вызова
+	descr string                    // назначение команды
+	run   func(args []string) error // обработчик команды
+}
+
+// commands команды, доступные из командной строки
+var commands = map[string]command{
+	"faststart": {
+		usage: "faststart <входной файл> <выходной файл>",
+		descr: "перенос блока moov в начало файла для прогрессивного воспроизведения",
+		run:   runFaststart,
+	},
+	"edit": {
+		usage: "edit [-title <название>] [-description <описание>] [-cover <файл JPEG/PNG>] [-created <RFC3339>] [-rotation <градусы>] <файл> [<выходной файл>]",
+		descr: "изменение метаданных без перекодирования (без выходного файла - изменение на месте)",
+		run:   runEdit,
+	},
+	"scrub": {
+		usage: "scrub [-keep <категории через запятую: location,device,owner,xmp>] <входной файл> <выходной файл>",
+		descr: "удаление персональных данных (координаты, сведения об устройстве и владельце, XMP), отчет выводится в формате JSON",
+		run:   runScrub,
+	},
+	"fragment": {
+		usage: "fragment [-duration <продолжительность сегмента, например 4s>] [-sidx] <входной файл> <выходной файл или каталог>",
+		descr: "фрагментация (CMAF/fMP4): в файл - init-сегмент и все медиасегменты, в каталог - init.mp4 и segment-N.m4s",
+		run:   runFragment,
+	},
+	"defragment": {
+		usage: "defragment <входной файл> <выходной файл>",
+		descr: "сборка фрагментированного файла (fMP4) в обычный MP4 с единым блоком mdat",
+		run:   runDefragment,
+	},
+	"extract": {
+		usage: "extract -tracks <идентификаторы или типы дорожек через запятую: 1,2,video,audio> <входной файл> <выходной файл>",
+		descr: "копирование выбранных дорожек в отдельный файл MP4 (только звук - M4A)",
+		run:   runExtract,
+	},
+	"export": {
+		usage: "export [-track <идентификатор дорожки>] <входной файл> <выходной файл>",
+		descr: "выгрузка элементарного потока: H.264/HEVC в формате Annex B, AAC с заголовками ADTS",
+		run:   runExport,
+	},
+	"trim": {
+		usage: "trim -start <время, например 00:10> [-end <время, например 01:30>] <входной файл> <выходной файл>",
+		descr: "вырезание фрагмента без перекодирования (с ближайшего предшествующего ключевого кадра, воспроизведение - точно с начала фрагмента)",
+		run:   runTrim,
+	},
+	"concat": {
+		usage: "concat <выходной файл> <входной файл> <входной файл>...",
+		descr: "склеивание файлов с одинаковыми дорожками и параметрами сжатия без перекодирования",
+		run:   runConcat,
+	},
+	"validate": {
+		usage: "validate <файл>",
+		descr: "проверка структуры файла, перечень всех найденных проблем выводится в формате JSON (при ошибках - код завершения 1)",
+		run:   runValidate,
+	},
+	"recover": {
+		usage: "recover -reference <исправный файл с того же устройства> <поврежденный файл> <выходной файл>",
+		descr: "восстановление файла без описания контейнера (moov), например после прерывания записи; отчет выводится в формате JSON",
+		run:   runRecover,
+	},
+}
+
+// runCommand выполнение команды, переданной в аргументах командной строки
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return fmt.Errorf("неизвестная команда %q", args[0])
+	}
+	err := cmd.run(args[1:])
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("%w, использование: %s", err, cmd.usage)
+	}
+	return err
+}
+
+// printUsage вывод списка доступных команд
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Команды:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", commands[name].usage, commands[name].descr)
+	}
+}
+
+// convertFile чтение входного файла и запись результата преобразования в выходной файл,
+// при ошибке выходной файл удаляется
+func convertFile(in, out string, convert func(r *os.File, w io.Writer) error) (err error) {
+	if filepath.Clean(in) == filepath.Clean(out) {
+		return fmt.Errorf("входной и выходной файлы совпадают: %s", in)
+	}
+	r, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+	return convert(r, w)
+}
+
+// runFaststart перенос блока moov в начало файла
+func runFaststart(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return convertFile(args[0], args[1], func(r *os.File, w io.Writer) error {
+		return mp4.Faststart(r, w)
+	})
+}
+
+// runEdit изменение метаданных файла
+func runEdit(args []string) error {
+	var e mp4.MetadataEdit
+	flags := flag.NewFlagSet("edit", flag.ContinueOnError)
+	flags.Func("title", "название", func(v string) error {
+		e.Title = &v
+		return nil
+	})
+	flags.Func("description", "описание", func(v string) error {
+		e.Description = &v
+		return nil
+	})
+	flags.Func("cover", "файл обложки", func(v string) (err error) {
+		e.CoverArt, err = os.ReadFile(v)
+		return err
+	})
+	flags.Func("created", "время создания", func(v string) error {
+		t, err := time.Parse(time.RFC3339, v)
+		e.Created = &t
+		return err
+	})
+	flags.Func("rotation", "угол поворота", func(v string) error {
+		var degrees int
+		_, err := fmt.Sscan(v, &degrees)
+		e.Rotation = &degrees
+		return err
+	})
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	var f mp4.VideoFile
+	switch flags.NArg() {
+	case 1:
+		return f.EditFile(flags.Arg(0), e)
+	case 2:
+		return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+			return f.Edit(r, w, e)
+		})
+	}
+	return errUsage
+}
+
+// runScrub удаление персональных данных из файла
+func runScrub(args []string) error {
+	policy := mp4.DefaultScrubPolicy
+	flags := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	flags.Func("keep", "сохраняемые категории сведений", func(v string) error {
+		for _, category := range strings.Split(v, ",") {
+			if err := policy.Keep(strings.TrimSpace(category)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+		report, err := mp4.Scrub(r, w, policy)
+		if err != nil {
+			return err
+		}
+		return printJSON(report)
+	})
+}
+
+// printJSON вывод результата команды в стандартный поток вывода в формате JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runFragment фрагментация файла
+func runFragment(args []string) error {
+	var opts mp4.FragmentOptions
+	flags := flag.NewFlagSet("fragment", flag.ContinueOnError)
+	flags.DurationVar(&opts.SegmentDuration, "duration", mp4.DefaultSegmentDuration, "продолжительность сегмента")
+	flags.BoolVar(&opts.SegmentIndex, "sidx", false, "добавлять индекс сегментов")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	in, out := flags.Arg(0), flags.Arg(1)
+	if info, err := os.Stat(out); err != nil || !info.IsDir() {
+		return convertFile(in, out, func(r *os.File, w io.Writer) error {
+			return mp4.Fragment(r, w, opts)
+		})
+	}
+	return convertFile(in, filepath.Join(out, "init.mp4"), func(r *os.File, w io.Writer) error {
+		return mp4.FragmentSegments(r, w, func(number int) (io.WriteCloser, error) {
+			return os.Create(filepath.Join(out, fmt.Sprintf("segment-%d.m4s", number)))
+		}, opts)
+	})
+}
+
+// runDefragment сборка фрагментированного файла в обычный
+func runDefragment(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return convertFile(args[0], args[1], func(r *os.File, w io.Writer) error {
+		return mp4.Defragment(r, w)
+	})
+}
+
+// runExtract извлечение выбранных дорожек
+func runExtract(args []string) error {
+	var sel mp4.TrackSelection
+	flags := flag.NewFlagSet("extract", flag.ContinueOnError)
+	flags.Func("tracks", "идентификаторы или типы дорожек", sel.Add)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || len(sel.IDs)+len(sel.Kinds) == 0 {
+		return errUsage
+	}
+	return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+		return mp4.Extract(r, w, sel)
+	})
+}
+
+// runExport выгрузка элементарного потока дорожки
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	trackID := flags.Uint("track", 0, "идентификатор дорожки (по умолчанию - первая дорожка поддерживаемого формата)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+		return mp4.ExportStream(r, w, uint32(*trackID))
+	})
+}
+
+// runTrim вырезание фрагмента по времени
+func runTrim(args []string) error {
+	var start, end time.Duration
+	flags := flag.NewFlagSet("trim", flag.ContinueOnError)
+	timecode := func(d *time.Duration) func(string) error {
+		return func(v string) (err error) {
+			*d, err = mp4.ParseTimecode(v)
+			return err
+		}
+	}
+	flags.Func("start", "начало фрагмента", timecode(&start))
+	flags.Func("end", "конец фрагмента (по умолчанию - конец файла)", timecode(&end))
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+		return mp4.Trim(r, w, start, end)
+	})
+}
+
+// runConcat склеивание файлов
+func runConcat(args []string) (err error) {
+	if len(args) < 3 {
+		return errUsage
+	}
+	out := args[0]
+	var inputs []io.ReadSeeker
+	for _, in := range args[1:] {
+		if filepath.Clean(in) == filepath.Clean(out) {
+			return fmt.Errorf("входной и выходной файлы совпадают: %s", in)
+		}
+		r, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		inputs = append(inputs, r)
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+	return mp4.Concat(w, inputs...)
+}
+
+// runValidate проверка структуры файла
+func runValidate(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	r, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	report, err := mp4.Validate(r)
+	if err != nil {
+		return err
+	}
+	if err = printJSON(report); err != nil {
+		return err
+	}
+	if !report.Valid {
+		return mp4.ErrValidationFailed
+	}
+	return nil
+}
+
+// runRecover восстановление поврежденного файла по исправному
+func runRecover(args []string) error {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	reference := flags.String("reference", "", "исправный файл, записанный тем же устройством")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || *reference == "" {
+		return errUsage
+	}
+	ref, err := os.Open(*reference)
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+	return convertFile(flags.Arg(0), flags.Arg(1), func(r *os.File, w io.Writer) error {
+		report, err := mp4.Recover(r, ref, w)
+		if err != nil {
+			return err
+		}
+		return printJSON(report)
+	})
+}
@@ -8,9 +8,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mp4Parser/mp4"
 )
 
 // инициализования лога для ошибок
@@ -37,7 +43,7 @@ func initLog(filePath string) error {
 }
 func parseVideoInForm(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
-		var fileInfo VideoFile
+		var fileInfo mp4.VideoFile
 		var data []byte
 		res.Header().Set("Content-Type", "text/json")
 		err := fileInfo.Open(req.Body)
@@ -46,11 +52,6 @@ func parseVideoInForm(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		defer req.Body.Close()
-		err = fileInfo.Parse()
-		if err != nil {
-			sendError(res, err)
-			return
-		}
 		data, err = fileInfo.ToJSON()
 		if err != nil {
 			sendError(res, err)
@@ -61,8 +62,275 @@ func parseVideoInForm(res http.ResponseWriter, req *http.Request) {
 		res.WriteHeader(http.StatusBadRequest)
 	}
 }
+
+// faststartVideoInForm перенос блока moov в начало видеофайла, переданного в теле HTTP POST запроса,
+// в ответ возвращается преобразованный файл
+func faststartVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+	file, err := spoolRequestBody(req.Body)
+	if err != nil {
+		sendError(res, err)
+		return
+	}
+	defer removeTempFile(file)
+	sendConverted(res, func(w io.Writer) error {
+		return mp4.Faststart(file, w)
+	})
+}
+
+// scrubVideoInForm удаление персональных данных из видеофайла, переданного в теле HTTP POST запроса
+// Категории сохраняемых сведений передаются в параметре keep через запятую (location, device, owner, xmp),
+// в ответ возвращается очищенный файл, количество удаленных блоков по категориям - в заголовке X-Scrub-Report
+func scrubVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+	policy := mp4.DefaultScrubPolicy
+	if keep := req.URL.Query().Get("keep"); keep != "" {
+		for _, category := range strings.Split(keep, ",") {
+			if err := policy.Keep(strings.TrimSpace(category)); err != nil {
+				sendError(res, err)
+				return
+			}
+		}
+	}
+	file, err := spoolRequestBody(req.Body)
+	if err != nil {
+		sendError(res, err)
+		return
+	}
+	defer removeTempFile(file)
+	sendConverted(res, func(w io.Writer) error {
+		report, err := mp4.Scrub(file, w, policy)
+		if err != nil {
+			return err
+		}
+		// заголовки отправляются вместе с файлом после завершения очистки
+		res.Header().Set("X-Scrub-Report", report.Summary())
+		return nil
+	})
+}
+
+// extractVideoInForm извлечение медиадорожек из видеофайла, переданного в теле HTTP POST запроса
+// Дорожки передаются в параметре tracks через запятую (идентификаторы или типы: video, audio, ...),
+// в ответ возвращается файл только с выбранными дорожками
+func extractVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+	var sel mp4.TrackSelection
+	if err := sel.Add(req.URL.Query().Get("tracks")); err != nil {
+		sendError(res, err)
+		return
+	}
+	if len(sel.IDs)+len(sel.Kinds) == 0 {
+		sendError(res, mp4.ErrTrackNotFound)
+		return
+	}
+	file, err := spoolRequestBody(req.Body)
+	if err != nil {
+		sendError(res, err)
+		return
+	}
+	defer removeTempFile(file)
+	sendConverted(res, func(w io.Writer) error {
+		return mp4.Extract(file, w, sel)
+	})
+}
+
+// trimVideoInForm вырезание фрагмента видеофайла, переданного в теле HTTP POST запроса
+// Границы фрагмента передаются в параметрах start и end (секунды или [чч:]мм:сс), без end - до конца файла
+func trimVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+	var start, end time.Duration
+	query := req.URL.Query()
+	for name, d := range map[string]*time.Duration{"start": &start, "end": &end} {
+		if v := query.Get(name); v != "" {
+			var err error
+			if *d, err = mp4.ParseTimecode(v); err != nil {
+				sendError(res, err)
+				return
+			}
+		}
+	}
+	file, err := spoolRequestBody(req.Body)
+	if err != nil {
+		sendError(res, err)
+		return
+	}
+	defer removeTempFile(file)
+	sendConverted(res, func(w io.Writer) error {
+		return mp4.Trim(file, w, start, end)
+	})
+}
+
+// gopVideoInForm анализ групп кадров (GOP) видеодорожек файла, переданного в теле HTTP POST запроса,
+// в ответ возвращаются ключевые кадры и сведения о группах кадров каждой видеодорожки в формате JSON
+func gopVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if gops, ok := analyzeRequestBody(res, req, func(file io.ReadSeeker) (interface{}, error) {
+		return mp4.AnalyzeGOP(file)
+	}); ok {
+		sendJSON(res, gops)
+	}
+}
+
+// validateVideoInForm проверка структуры файла, переданного в теле HTTP POST запроса,
+// в ответ возвращается перечень всех найденных проблем в формате JSON
+func validateVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if report, ok := analyzeRequestBody(res, req, func(file io.ReadSeeker) (interface{}, error) {
+		return mp4.Validate(file)
+	}); ok {
+		sendJSON(res, report)
+	}
+}
+
+// streamingVideoInForm анализ пригодности к прогрессивному воспроизведению файла, переданного в теле
+// HTTP POST запроса: расположение moov, чередование данных дорожек и расхождение их времени в формате JSON
+func streamingVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if info, ok := analyzeRequestBody(res, req, func(file io.ReadSeeker) (interface{}, error) {
+		return mp4.AnalyzeStreaming(file)
+	}); ok {
+		sendJSON(res, info)
+	}
+}
+
+// bitrateVideoInForm битрейт дорожек и всего файла во времени для файла, переданного в теле HTTP POST запроса
+// Окно расчета передается в параметре window (секунды или продолжительность Go, по умолчанию 1s),
+// при format=csv ответ возвращается в формате CSV, иначе - в формате JSON
+func bitrateVideoInForm(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	window := mp4.DefaultBitrateWindow
+	query := req.URL.Query()
+	if v := query.Get("window"); v != "" {
+		var err error
+		if window, err = mp4.ParseTimecode(v); err != nil {
+			sendError(res, err)
+			return
+		}
+	}
+	result, ok := analyzeRequestBody(res, req, func(file io.ReadSeeker) (interface{}, error) {
+		return mp4.AnalyzeBitrate(file, window)
+	})
+	if !ok {
+		return
+	}
+	if query.Get("format") == "csv" {
+		res.Header().Set("Content-Type", "text/csv")
+		if err := result.(*mp4.BitrateReport).WriteCSV(res); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendJSON(res, result)
+}
+
+// spoolRequestBody сохранение тела запроса во временный файл для произвольного доступа к его содержимому
+func spoolRequestBody(body io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "mp4Parser-*.mp4")
+	if err != nil {
+		return nil, mp4.NewAPIError("ошибка на стороне сервера", err)
+	}
+	if _, err = io.Copy(file, body); err != nil {
+		removeTempFile(file)
+		return nil, mp4.NewAPIError("ошибка при получении файла", err)
+	}
+	return file, nil
+}
+
+// analyzeRequestBody сохранение тела запроса во временный файл и его анализ; при ошибке она отправляется
+// в ответ и возвращается ok = false
+func analyzeRequestBody(res http.ResponseWriter, req *http.Request, analyze func(file io.ReadSeeker) (interface{}, error)) (result interface{}, ok bool) {
+	defer req.Body.Close()
+	file, err := spoolRequestBody(req.Body)
+	if err != nil {
+		sendError(res, err)
+		return nil, false
+	}
+	defer removeTempFile(file)
+	if result, err = analyze(file); err != nil {
+		sendError(res, err)
+		return nil, false
+	}
+	return result, true
+}
+
+// sendJSON отправка результата анализа в формате JSON
+func sendJSON(res http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		sendError(res, mp4.NewAPIError("ошибка на стороне сервера", err))
+		return
+	}
+	res.Header().Set("Content-Type", "text/json")
+	if _, err = res.Write(data); err != nil {
+		log.Println(err)
+	}
+}
+
+// sendConverted запись преобразованного файла во временный файл и его отправка в ответ только после
+// успешного завершения преобразования, чтобы ошибка не дописывалась к уже отправленной части файла
+func sendConverted(res http.ResponseWriter, convert func(w io.Writer) error) {
+	out, err := os.CreateTemp("", "mp4Parser-*.mp4")
+	if err != nil {
+		sendError(res, mp4.NewAPIError("ошибка на стороне сервера", err))
+		return
+	}
+	defer removeTempFile(out)
+	if err = convert(out); err != nil {
+		sendError(res, err)
+		return
+	}
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendError(res, mp4.NewAPIError("ошибка на стороне сервера", err))
+		return
+	}
+	res.Header().Set("Content-Type", "video/mp4")
+	res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err = io.Copy(res, out); err != nil {
+		log.Println(err)
+	}
+}
+
+// removeTempFile закрытие и удаление временного файла
+func removeTempFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
 func sendError(w http.ResponseWriter, e error) {
 	log.Printf(e.Error())
+	w.Header().Set("Content-Type", "text/json")
 	data, err := json.Marshal(e)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -72,10 +340,26 @@ func sendError(w http.ResponseWriter, e error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		// обработка файла из командной строки без запуска веб-сервиса
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, mp4.DescribeError(err))
+			os.Exit(1)
+		}
+		return
+	}
 	err := initLog("logs/errors.log")
 	if err != nil {
 		log.Fatalln(err)
 	}
 	http.HandleFunc("/api/mp4Meta", parseVideoInForm)
+	http.HandleFunc("/api/mp4Faststart", faststartVideoInForm)
+	http.HandleFunc("/api/mp4Scrub", scrubVideoInForm)
+	http.HandleFunc("/api/mp4Extract", extractVideoInForm)
+	http.HandleFunc("/api/mp4Trim", trimVideoInForm)
+	http.HandleFunc("/api/mp4GOP", gopVideoInForm)
+	http.HandleFunc("/api/mp4Bitrate", bitrateVideoInForm)
+	http.HandleFunc("/api/mp4Streaming", streamingVideoInForm)
+	http.HandleFunc("/api/mp4Validate", validateVideoInForm)
 	http.ListenAndServe(":4000", nil)
 }
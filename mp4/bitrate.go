@@ -0,0 +1,155 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Битрейт дорожек и файла во времени по таблицам сэмплов: ряд значений по окнам и пиковый битрейт
+package mp4
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultBitrateWindow окно расчета битрейта по умолчанию
+const DefaultBitrateWindow = time.Second
+
+// minBitrateWindow наименьшее окно расчета битрейта
+const minBitrateWindow = 10 * time.Millisecond
+
+// maxBitrateWindows наибольшее количество окон в ряду (время сэмплов задается файлом и может быть сколь угодно большим)
+const maxBitrateWindows = 100000
+
+// BitrateSeries битрейт дорожки (или всего файла) во времени
+type BitrateSeries struct {
+	TrackID        uint32   `json:",omitempty"` // идентификатор дорожки (0 - все дорожки файла)
+	Handler        string   `json:",omitempty"` // тип дорожки ('vide', 'soun', ...)
+	Average        uint64   // средний битрейт (бит/с)
+	MaxRolling     uint64   // наибольший битрейт в скользящем окне (бит/с)
+	MaxRollingTime float64  // начало скользящего окна с наибольшим битрейтом (сек)
+	Values         []uint64 // битрейт в последовательных окнах начиная с 0 (бит/с)
+}
+
+// BitrateReport битрейт дорожек и всего файла во времени
+type BitrateReport struct {
+	Window  float64         // окно расчета (сек)
+	Overall BitrateSeries   // все дорожки файла
+	Tracks  []BitrateSeries // отдельные дорожки
+}
+
+// bitrateSample время и размер сэмпла
+type bitrateSample struct {
+	time float64 // время декодирования (сек)
+	size uint32  // размер (байт)
+}
+
+// AnalyzeBitrate расчет битрейта дорожек и всего файла (в том числе фрагментированного) по окнам
+// продолжительностью window
+func AnalyzeBitrate(r io.ReadSeeker, window time.Duration) (*BitrateReport, error) {
+	if window < minBitrateWindow {
+		return nil, ErrBitrateWindow
+	}
+	m, err := readMovieFile(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &BitrateReport{Window: window.Seconds()}
+	var all []bitrateSample
+	var duration float64
+	for _, t := range m.tracks {
+		samples := make([]bitrateSample, len(t.Samples))
+		for i, s := range t.Samples {
+			samples[i] = bitrateSample{time: float64(s.DTS) / float64(t.TimeScale), size: s.Size}
+		}
+		// время декодирования фрагментов (tfdt) может идти не по порядку
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].time < samples[j].time })
+		if n := len(samples); n > 0 && samples[n-1].time/report.Window >= maxBitrateWindows {
+			return nil, ErrBitrateTooLong
+		}
+		if d := float64(t.duration()) / float64(t.TimeScale); d > duration {
+			duration = d
+		}
+		all = append(all, samples...)
+		series := bitrateSeries(samples, float64(t.duration())/float64(t.TimeScale), report.Window)
+		series.TrackID, series.Handler = t.ID, t.Handler
+		report.Tracks = append(report.Tracks, series)
+	}
+	if len(all) == 0 {
+		return nil, ErrNoSamples
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].time < all[j].time })
+	report.Overall = bitrateSeries(all, duration, report.Window)
+	// ряды дорожек дополняются до длины ряда файла, чтобы значения с одним номером относились к одному окну
+	for i := range report.Tracks {
+		for len(report.Tracks[i].Values) < len(report.Overall.Values) {
+			report.Tracks[i].Values = append(report.Tracks[i].Values, 0)
+		}
+	}
+	return report, nil
+}
+
+// bitrateSeries битрейт по окнам и в скользящем окне для сэмплов, упорядоченных по времени
+func bitrateSeries(samples []bitrateSample, duration, window float64) BitrateSeries {
+	var series BitrateSeries
+	if len(samples) == 0 {
+		return series
+	}
+	// ряд охватывает время от 0 до последнего сэмпла, продолжительность нужна только для среднего битрейта
+	last := samples[len(samples)-1].time
+	if last >= duration {
+		duration = last + window
+	}
+	series.Values = make([]uint64, int(last/window)+1)
+	var total, rolling uint64
+	first := 0
+	for _, s := range samples {
+		series.Values[int(s.time/window)] += uint64(s.size) * 8
+		total += uint64(s.size) * 8
+		// скользящее окно, заканчивающееся текущим сэмплом
+		rolling += uint64(s.size) * 8
+		for samples[first].time <= s.time-window {
+			rolling -= uint64(samples[first].size) * 8
+			first++
+		}
+		if rolling > series.MaxRolling {
+			series.MaxRolling, series.MaxRollingTime = rolling, samples[first].time
+		}
+	}
+	for i := range series.Values {
+		series.Values[i] = uint64(float64(series.Values[i]) / window)
+	}
+	series.MaxRolling = uint64(float64(series.MaxRolling) / window)
+	if duration > 0 {
+		series.Average = uint64(float64(total) / duration)
+	}
+	return series
+}
+
+// WriteCSV запись битрейта в формате CSV: начало окна (сек), битрейт файла и каждой дорожки (бит/с)
+func (report *BitrateReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	header := []string{"time", "total"}
+	for _, t := range report.Tracks {
+		header = append(header, fmt.Sprintf("track %d (%s)", t.TrackID, t.Handler))
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for i, value := range report.Overall.Values {
+		row := []string{
+			strconv.FormatFloat(float64(i)*report.Window, 'f', -1, 64),
+			strconv.FormatUint(value, 10),
+		}
+		for _, t := range report.Tracks {
+			row = append(row, strconv.FormatUint(t.Values[i], 10))
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
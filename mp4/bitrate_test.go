@@ -0,0 +1,86 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка расчета битрейта во времени
+package mp4
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBitrateSeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []bitrateSample
+		duration float64
+		window   float64
+		want     BitrateSeries
+	}{
+		{
+			name:     "без сэмплов",
+			duration: 1, window: 1,
+		},
+		{
+			name:     "постоянный битрейт",
+			samples:  []bitrateSample{{0, 100}, {0.5, 100}, {1, 100}, {1.5, 100}},
+			duration: 2, window: 1,
+			want: BitrateSeries{Average: 1600, MaxRolling: 1600, Values: []uint64{1600, 1600}},
+		},
+		{
+			// всплеск на границе окон: в скользящем окне с 0,75 сек битрейт выше, чем в любом из окон ряда
+			name:     "всплеск на границе окон",
+			samples:  []bitrateSample{{0, 10}, {0.75, 100}, {1.25, 100}, {2.5, 10}},
+			duration: 3, window: 1,
+			want: BitrateSeries{Average: 586, MaxRolling: 1600, MaxRollingTime: 0.75, Values: []uint64{880, 800, 80}},
+		},
+		{
+			// сэмпл позже продолжительности дорожки продлевает ряд до своего окна
+			name:     "сэмпл после окончания",
+			samples:  []bitrateSample{{0, 10}, {2, 10}},
+			duration: 1, window: 1,
+			want: BitrateSeries{Average: 53, MaxRolling: 80, Values: []uint64{80, 0, 80}},
+		},
+		{
+			name:     "окно меньше секунды",
+			samples:  []bitrateSample{{0, 50}, {0.25, 50}},
+			duration: 1, window: 0.5,
+			want: BitrateSeries{Average: 800, MaxRolling: 1600, Values: []uint64{1600}},
+		},
+	}
+	for _, test := range tests {
+		if got := bitrateSeries(test.samples, test.duration, test.window); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: %+v вместо %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAnalyzeBitrate(t *testing.T) {
+	data := testMovie(t)
+	if _, err := AnalyzeBitrate(bytes.NewReader(data), time.Millisecond); err != ErrBitrateWindow {
+		t.Fatalf("ошибка %v вместо %v", err, ErrBitrateWindow)
+	}
+	report, err := AnalyzeBitrate(bytes.NewReader(data), DefaultBitrateWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Window != 1 || len(report.Tracks) != 2 || len(report.Overall.Values) == 0 {
+		t.Fatalf("отчет %+v", report)
+	}
+	// ряды дорожек выровнены по ряду файла
+	for _, series := range report.Tracks {
+		if len(series.Values) != len(report.Overall.Values) {
+			t.Fatalf("дорожка %d: %d значений вместо %d", series.TrackID, len(series.Values), len(report.Overall.Values))
+		}
+	}
+	var csv bytes.Buffer
+	if err := report.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(csv.Bytes(), []byte("\n")); lines != len(report.Overall.Values)+1 {
+		t.Fatalf("%d строк CSV вместо %d", lines, len(report.Overall.Values)+1)
+	}
+}
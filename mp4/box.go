@@ -0,0 +1,458 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Дерево блоков файла: чтение, изменение и обратная сериализация в байты
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+)
+
+// boxHeader описание заголовка блока
+type boxHeader struct {
+	Type       string // наименование блока
+	Offset     int64  // позиция начала блока относительно начала файла (байт)
+	Size       int64  // размер блока вместе с заголовком (байт)
+	HeaderSize int64  // размер заголовка (8 байт, либо 16 байт для блоков с 64-битным размером)
+	toEnd      bool   // размер блока указан как 0x0 - блок продолжается до конца файла
+}
+
+// Box блок файла (узел дерева блоков)
+// Блок может быть либо листом (содержимое хранится в Data как есть),
+// либо контейнером (содержимое - это Prefix и следующие за ним дочерние блоки Children).
+// Блоки верхнего уровня, не являющиеся контейнерами (например, mdat), в память не загружаются,
+// их содержимое копируется из исходного файла непосредственно при записи
+type Box struct {
+	Type      string      // наименование блока
+	Prefix    []byte      // данные контейнера, предшествующие дочерним блокам (версия и флаги, количество записей и т.д.)
+	Data      []byte      // содержимое блока-листа (без заголовка)
+	Children  []*Box      // дочерние блоки контейнера
+	container bool        // блок является контейнером
+	large     bool        // в исходном файле заголовок блока содержал 64-битный размер
+	toEnd     bool        // в исходном файле размер блока был указан как 0x0 (до конца файла)
+	offset    int64       // позиция блока в исходном файле (-1 для созданных блоков)
+	size      int64       // размер блока в исходном файле (байт)
+	src       io.ReaderAt // исходный файл, из которого копируется незагруженное содержимое блока
+}
+
+// containerBoxes блоки-контейнеры и возможные размеры данных, предшествующих дочерним блокам (байт)
+var containerBoxes = map[string][]int{
+	"moov": {0}, "trak": {0}, "edts": {0}, "mdia": {0}, "minf": {0}, "dinf": {0}, "stbl": {0},
+	"mvex": {0}, "moof": {0}, "traf": {0}, "mfra": {0}, "udta": {0}, "tref": {0}, "ilst": {0},
+	"sinf": {0}, "schi": {0}, "iprp": {0}, "ipco": {0}, "gmhd": {0}, "wave": {0},
+	// в MP4 блок meta имеет версию и флаги, в QuickTime - нет
+	"meta": {4, 0},
+	"dref": {8},
+	"stsd": {8},
+}
+
+// visualSampleEntries описания сэмплов видеопотоков
+var visualSampleEntries = map[string]bool{
+	"avc1": true, "avc2": true, "avc3": true, "avc4": true, "hvc1": true, "hev1": true, "dvh1": true, "dvhe": true,
+	"mp4v": true, "encv": true, "av01": true, "vp08": true, "vp09": true, "s263": true, "jpeg": true,
+	"mjpa": true, "mjpb": true, "apch": true, "apcn": true, "apcs": true, "apco": true, "ap4h": true, "ap4x": true,
+	"AVdn": true, "AVdh": true,
+}
+
+// audioSampleEntries описания сэмплов аудиопотоков
+var audioSampleEntries = map[string]bool{
+	"mp4a": true, "enca": true, "ac-3": true, "ec-3": true, "Opus": true, "fLaC": true, "alac": true,
+	"lpcm": true, "sowt": true, "twos": true, "in24": true, "in32": true, "fl32": true, "fl64": true,
+	"raw ": true, "samr": true, "sawb": true, "ulaw": true, "alaw": true, ".mp3": true,
+}
+
+// NewBox создание блока-листа
+func NewBox(name string, data []byte) *Box {
+	return &Box{Type: name, Data: data, offset: -1}
+}
+
+// NewContainer создание блока-контейнера
+func NewContainer(name string, prefix []byte, children ...*Box) *Box {
+	return &Box{Type: name, Prefix: prefix, Children: children, container: true, offset: -1}
+}
+
+// readBoxHeader чтение заголовка блока, начинающегося с позиции offset,
+// end - позиция, за которую блок выходить не может
+func readBoxHeader(r io.ReaderAt, offset, end int64) (h boxHeader, err error) {
+	var temp = make([]byte, 16)
+	if end-offset < headerBlockSize {
+		return h, ErrFileIsNotValid
+	}
+	if _, err = r.ReadAt(temp[:headerBlockSize], offset); err != nil {
+		return h, ErrFileIsNotValid
+	}
+	h.Type = string(temp[4:8])
+	h.Offset = offset
+	h.HeaderSize = headerBlockSize
+	switch size := binary.BigEndian.Uint32(temp[:4]); size {
+	case 0x1:
+		// размер блока хранится в 8 байтах сразу за наименованием
+		if _, err = r.ReadAt(temp[headerBlockSize:16], offset+headerBlockSize); err != nil {
+			return h, ErrFileIsNotValid
+		}
+		h.Size = int64(binary.BigEndian.Uint64(temp[headerBlockSize:16]))
+		h.HeaderSize = 16
+	case 0x0:
+		// блок продолжается до конца файла
+		h.Size = end - offset
+		h.toEnd = true
+	default:
+		h.Size = int64(size)
+	}
+	if h.Size < h.HeaderSize || h.Size > end-offset {
+		return h, ErrFileIsNotValid
+	}
+	return h, nil
+}
+
+// appendBoxHeader добавление заголовка блока с содержимым размером payloadSize байт,
+// 64-битный размер используется только если размер блока не помещается в 32 бита
+func appendBoxHeader(buf []byte, name string, payloadSize int64) []byte {
+	if payloadSize+headerBlockSize <= math.MaxUint32 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(payloadSize+headerBlockSize))
+		return append(buf, name...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, 0x1)
+	buf = append(buf, name...)
+	return binary.BigEndian.AppendUint64(buf, uint64(payloadSize+16))
+}
+
+// readTopLevelBoxes получение списка заголовков блоков верхнего уровня
+func readTopLevelBoxes(r io.ReaderAt, size int64) (boxes []boxHeader, err error) {
+	for offset := int64(0); offset < size; {
+		var h boxHeader
+		h, err = readBoxHeader(r, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, h)
+		offset += h.Size
+	}
+	return boxes, nil
+}
+
+// ReadBoxes чтение дерева блоков файла
+// Контейнеры верхнего уровня загружаются в память и разбираются полностью,
+// остальные блоки верхнего уровня остаются в исходном файле до момента записи
+func ReadBoxes(r io.ReadSeeker) ([]*Box, error) {
+	src, size, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+	return readBoxTree(src, size)
+}
+
+// readBoxTree чтение дерева блоков из источника с произвольным доступом
+func readBoxTree(src io.ReaderAt, size int64) ([]*Box, error) {
+	headers, err := readTopLevelBoxes(src, size)
+	if err != nil {
+		return nil, err
+	}
+	boxes := make([]*Box, 0, len(headers))
+	for _, h := range headers {
+		b := &Box{Type: h.Type, large: h.HeaderSize == 16, toEnd: h.toEnd, offset: h.Offset, size: h.Size}
+		if _, ok := containerBoxes[h.Type]; ok {
+			data := make([]byte, h.Size-h.HeaderSize)
+			if _, err = src.ReadAt(data, h.Offset+h.HeaderSize); err != nil {
+				return nil, NewAPIError("ошибка чтения блока "+h.Type, err)
+			}
+			b.parsePayload(data, "")
+		} else {
+			b.src = src
+		}
+		boxes = append(boxes, b)
+	}
+	return boxes, nil
+}
+
+// parseBoxes разбор последовательности блоков, полностью занимающей data;
+// ok = false, если блоки не укладываются в data без остатка
+func parseBoxes(data []byte, parent string) (boxes []*Box, ok bool) {
+	r := bytes.NewReader(data)
+	for offset := int64(0); offset < int64(len(data)); {
+		h, err := readBoxHeader(r, offset, int64(len(data)))
+		if err != nil || h.toEnd {
+			return nil, false
+		}
+		b := &Box{Type: h.Type, large: h.HeaderSize == 16, offset: -1, size: h.Size}
+		b.parsePayload(data[offset+h.HeaderSize:offset+h.Size], parent)
+		boxes = append(boxes, b)
+		offset += h.Size
+	}
+	return boxes, true
+}
+
+// parsePayload разбор содержимого блока: если блок известен как контейнер и его содержимое
+// без остатка разбирается на дочерние блоки - он становится контейнером, иначе - листом
+func (b *Box) parsePayload(data []byte, parent string) {
+	for _, prefix := range b.prefixSizes(data, parent) {
+		if prefix > len(data) {
+			continue
+		}
+		if children, ok := parseBoxes(data[prefix:], b.Type); ok {
+			b.container = true
+			b.Prefix = data[:prefix]
+			b.Children = children
+			return
+		}
+	}
+	b.Data = data
+}
+
+// prefixSizes возможные размеры данных контейнера, предшествующих дочерним блокам
+func (b *Box) prefixSizes(data []byte, parent string) []int {
+	if sizes, ok := containerBoxes[b.Type]; ok {
+		return sizes
+	}
+	switch {
+	case parent == "ilst":
+		// элементы списка тегов iTunes содержат блоки data
+		return []int{0}
+	case parent == "stsd" && visualSampleEntries[b.Type]:
+		return []int{78}
+	case parent == "stsd" && audioSampleEntries[b.Type] && len(data) >= 10:
+		// размер описания аудиосэмпла QuickTime зависит от версии
+		switch binary.BigEndian.Uint16(data[8:10]) {
+		case 1:
+			return []int{44}
+		case 2:
+			return []int{64}
+		}
+		return []int{28}
+	}
+	return nil
+}
+
+// IsContainer является ли блок контейнером
+func (b *Box) IsContainer() bool {
+	return b.container
+}
+
+// payloadSize размер содержимого блока без заголовка (байт)
+func (b *Box) payloadSize() int64 {
+	if b.container {
+		size := int64(len(b.Prefix))
+		for _, c := range b.Children {
+			size += c.Size()
+		}
+		return size
+	}
+	if b.Data == nil && b.src != nil {
+		return b.size - b.headerSizeIn()
+	}
+	return int64(len(b.Data))
+}
+
+// headerSizeIn размер заголовка блока в исходном файле
+func (b *Box) headerSizeIn() int64 {
+	if b.large {
+		return 16
+	}
+	return headerBlockSize
+}
+
+// headerSize размер заголовка блока при записи: 64-битный размер используется,
+// если он был в исходном файле или размер блока не помещается в 32 бита
+func (b *Box) headerSize() int64 {
+	if b.large || b.payloadSize()+headerBlockSize > math.MaxUint32 {
+		return 16
+	}
+	return headerBlockSize
+}
+
+// Size полный размер блока вместе с заголовком (байт)
+func (b *Box) Size() int64 {
+	return b.headerSize() + b.payloadSize()
+}
+
+// Payload содержимое блока без заголовка
+func (b *Box) Payload() ([]byte, error) {
+	if b.container {
+		var buf bytes.Buffer
+		buf.Write(b.Prefix)
+		for _, c := range b.Children {
+			if _, err := c.WriteTo(&buf); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	if b.Data == nil && b.src != nil {
+		data := make([]byte, b.payloadSize())
+		if _, err := b.src.ReadAt(data, b.offset+b.headerSizeIn()); err != nil {
+			return nil, NewAPIError("ошибка чтения блока "+b.Type, err)
+		}
+		return data, nil
+	}
+	return b.Data, nil
+}
+
+// SetData замена содержимого блока, блок становится листом
+func (b *Box) SetData(data []byte) {
+	b.Data = data
+	b.Prefix = nil
+	b.Children = nil
+	b.container = false
+	b.src = nil
+}
+
+// Child первый дочерний блок с указанным наименованием
+func (b *Box) Child(name string) *Box {
+	for _, c := range b.Children {
+		if c.Type == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Find поиск блока по пути из наименований, разделенных символом '/', например "mdia/minf/stbl"
+func (b *Box) Find(path string) *Box {
+	cur := b
+	for _, name := range strings.Split(path, "/") {
+		if cur = cur.Child(name); cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// FindAll поиск всех блоков по пути из наименований, разделенных символом '/'
+func (b *Box) FindAll(path string) []*Box {
+	name, rest, nested := strings.Cut(path, "/")
+	var found []*Box
+	for _, c := range b.Children {
+		if c.Type != name {
+			continue
+		}
+		if nested {
+			found = append(found, c.FindAll(rest)...)
+		} else {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// Remove удаление дочерних блоков с указанным наименованием, возвращает количество удаленных блоков
+func (b *Box) Remove(name string) int {
+	kept := b.Children[:0]
+	for _, c := range b.Children {
+		if c.Type != name {
+			kept = append(kept, c)
+		}
+	}
+	removed := len(b.Children) - len(kept)
+	b.Children = kept
+	return removed
+}
+
+// WriteTo запись блока вместе с заголовком
+func (b *Box) WriteTo(w io.Writer) (int64, error) {
+	return b.write(w, false)
+}
+
+// write запись блока; toEnd - блок последний в файле и его размер можно указать как 0x0
+func (b *Box) write(w io.Writer, toEnd bool) (n int64, err error) {
+	var header []byte
+	payload := b.payloadSize()
+	switch {
+	case toEnd && b.toEnd && !b.large:
+		header = append([]byte{0, 0, 0, 0}, b.Type...)
+	case b.large:
+		header = binary.BigEndian.AppendUint32(nil, 0x1)
+		header = append(header, b.Type...)
+		header = binary.BigEndian.AppendUint64(header, uint64(payload+16))
+	default:
+		header = appendBoxHeader(nil, b.Type, payload)
+	}
+	m, err := w.Write(header)
+	n += int64(m)
+	if err != nil {
+		return n, err
+	}
+	switch {
+	case b.container:
+		m, err = w.Write(b.Prefix)
+		n += int64(m)
+		for _, c := range b.Children {
+			if err != nil {
+				break
+			}
+			var cn int64
+			cn, err = c.WriteTo(w)
+			n += cn
+		}
+	case b.Data == nil && b.src != nil:
+		var cn int64
+		cn, err = io.Copy(w, io.NewSectionReader(b.src, b.offset+b.headerSizeIn(), payload))
+		n += cn
+	default:
+		m, err = w.Write(b.Data)
+		n += int64(m)
+	}
+	return n, err
+}
+
+// WriteBoxes запись последовательности блоков верхнего уровня
+func WriteBoxes(w io.Writer, boxes []*Box) error {
+	for i, b := range boxes {
+		if _, err := b.write(w, i == len(boxes)-1); err != nil {
+			return NewAPIError("ошибка записи видеофайла", err)
+		}
+	}
+	return nil
+}
+
+// findBox поиск первого блока с указанным наименованием среди блоков верхнего уровня
+func findBox(boxes []*Box, name string) int {
+	for i, b := range boxes {
+		if b.Type == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// trackHandler тип медиадорожки из блока mdia/hdlr ('vide', 'soun', ...)
+func trackHandler(trak *Box) string {
+	hdlr := trak.Find("mdia/hdlr")
+	if hdlr == nil || len(hdlr.Data) < 12 {
+		return ""
+	}
+	return string(hdlr.Data[8:12])
+}
+
+// peek чтение первых n байт содержимого блока без загрузки всего блока в память
+func (b *Box) peek(n int) ([]byte, error) {
+	if b.container || b.Data != nil || b.src == nil {
+		data, err := b.Payload()
+		if len(data) > n {
+			data = data[:n]
+		}
+		return data, err
+	}
+	if size := b.payloadSize(); int64(n) > size {
+		n = int(size)
+	}
+	data := make([]byte, n)
+	if _, err := b.src.ReadAt(data, b.offset+b.headerSizeIn()); err != nil {
+		return nil, NewAPIError("ошибка чтения блока "+b.Type, err)
+	}
+	return data, nil
+}
+
+// boxName наименование блока для отображения: байты наименования трактуются как символы Latin-1
+// (в частности, байт 0xA9 в наименованиях тегов iTunes - это символ ©)
+func boxName(name string) string {
+	runes := make([]rune, len(name))
+	for i := 0; i < len(name); i++ {
+		runes[i] = rune(name[i])
+	}
+	return string(runes)
+}
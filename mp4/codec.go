@@ -0,0 +1,521 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор заголовков элементарных потоков (H.264, HEVC, MPEG видео и звук, AAC, AC-3)
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// bitReader побитовое чтение (старшие биты первыми)
+type bitReader struct {
+	data []byte
+	pos  int // позиция (бит)
+	err  bool
+}
+
+// bits чтение n бит (n <= 32); при выходе за границу данных устанавливается признак ошибки
+func (b *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if b.pos >= len(b.data)*8 {
+			b.err = true
+			return 0
+		}
+		v = v<<1 | uint32(b.data[b.pos/8]>>(7-b.pos%8)&0x1)
+		b.pos++
+	}
+	return v
+}
+
+// flag чтение одного бита
+func (b *bitReader) flag() bool {
+	return b.bits(1) == 1
+}
+
+// ue чтение беззнакового числа в коде Голомба
+func (b *bitReader) ue() uint32 {
+	zeros := 0
+	for !b.flag() {
+		if b.err || zeros > 31 {
+			b.err = true
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + b.bits(zeros)
+}
+
+// se чтение числа со знаком в коде Голомба
+func (b *bitReader) se() int32 {
+	v := b.ue()
+	if v&0x1 == 1 {
+		return int32(v/2) + 1
+	}
+	return -int32(v / 2)
+}
+
+// codecInfo параметры элементарного потока, извлеченные из его заголовков
+type codecInfo struct {
+	Format     string  // формат сжатия
+	Profile    string  // профиль и уровень
+	Width      uint32  // ширина (пиксель)
+	Height     uint32  // высота (пиксель)
+	ColorDepth uint16  // глубина цвета (бит)
+	FrameRate  float64 // частота кадров (кадров в секунду)
+	SampleRate uint32  // частота дискретизации (Гц)
+	Channels   uint16  // количество каналов
+}
+
+// h264Profiles наименования профилей H.264
+var h264Profiles = map[uint32]string{
+	66: "Baseline", 77: "Main", 88: "Extended", 100: "High", 110: "High 10",
+	122: "High 4:2:2", 244: "High 4:4:4", 44: "CAVLC 4:4:4",
+}
+
+// hevcProfiles наименования профилей HEVC
+var hevcProfiles = map[uint32]string{1: "Main", 2: "Main 10", 3: "Main Still Picture", 4: "Range Extensions"}
+
+// unescapeRBSP удаление байтов защиты от эмуляции префикса (00 00 03)
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 0x3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// annexBUnits NAL-блоки потока в формате Annex B
+func annexBUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// parseH264SPS разбор набора параметров последовательности H.264 (NAL-блок вместе с заголовком)
+func parseH264SPS(nal []byte) (codecInfo, bool) {
+	info := codecInfo{Format: "H.264"}
+	if len(nal) < 4 {
+		return info, false
+	}
+	b := &bitReader{data: unescapeRBSP(nal[1:])}
+	profile := b.bits(8)
+	b.bits(8) // ограничения профиля
+	level := b.bits(8)
+	b.ue() // seq_parameter_set_id
+	chroma, depth := uint32(1), uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chroma = b.ue(); chroma == 3 {
+			b.flag() // separate_colour_plane_flag
+		}
+		depth = b.ue()
+		b.ue()   // bit_depth_chroma_minus8
+		b.flag() // qpprime_y_zero_transform_bypass_flag
+		if b.flag() {
+			// матрицы квантования пропускаются
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !b.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + b.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	b.ue() // log2_max_frame_num_minus4
+	switch b.ue() {
+	case 0:
+		b.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		b.flag()
+		b.se()
+		b.se()
+		for i := b.ue(); i > 0 && !b.err; i-- {
+			b.se()
+		}
+	}
+	b.ue()   // max_num_ref_frames
+	b.flag() // gaps_in_frame_num_value_allowed_flag
+	width := (b.ue() + 1) * 16
+	height := b.ue() + 1
+	frameMBsOnly := b.flag()
+	if !frameMBsOnly {
+		b.flag() // mb_adaptive_frame_field_flag
+		height *= 2
+	}
+	height *= 16
+	b.flag() // direct_8x8_inference_flag
+	if b.flag() {
+		// обрезка кадра в единицах, зависящих от цветовой субдискретизации
+		unitX, unitY := uint32(1), uint32(1)
+		if chroma == 1 || chroma == 2 {
+			unitX = 2
+		}
+		if chroma == 1 {
+			unitY = 2
+		}
+		if !frameMBsOnly {
+			unitY *= 2
+		}
+		left, right, top, bottom := b.ue(), b.ue(), b.ue(), b.ue()
+		width -= (left + right) * unitX
+		height -= (top + bottom) * unitY
+	}
+	if b.err {
+		return info, false
+	}
+	name, ok := h264Profiles[profile]
+	if !ok {
+		name = fmt.Sprint(profile)
+	}
+	info.Profile = fmt.Sprintf("%s@L%d.%d", name, level/10, level%10)
+	info.Width, info.Height = width, height
+	info.ColorDepth = uint16(depth+8) * 3
+	return info, true
+}
+
+// parseHEVCSPS разбор набора параметров последовательности HEVC (NAL-блок вместе с заголовком)
+func parseHEVCSPS(nal []byte) (codecInfo, bool) {
+	info := codecInfo{Format: "HEVC"}
+	if len(nal) < 3 {
+		return info, false
+	}
+	b := &bitReader{data: unescapeRBSP(nal[2:])}
+	b.bits(4) // sps_video_parameter_set_id
+	subLayers := int(b.bits(3))
+	b.flag() // sps_temporal_id_nesting_flag
+	// profile_tier_level
+	b.bits(2)
+	tier := b.bits(1)
+	profile := b.bits(5)
+	b.bits(32) // признаки совместимости профилей
+	b.bits(24) // ограничения профиля (48 бит)
+	b.bits(24)
+	level := b.bits(8)
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i], levelPresent[i] = b.flag(), b.flag()
+	}
+	if subLayers > 0 {
+		for i := subLayers; i < 8; i++ {
+			b.bits(2)
+		}
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			b.bits(32)
+			b.bits(32)
+			b.bits(24)
+		}
+		if levelPresent[i] {
+			b.bits(8)
+		}
+	}
+	b.ue() // sps_seq_parameter_set_id
+	chroma := b.ue()
+	if chroma == 3 {
+		b.flag()
+	}
+	width, height := b.ue(), b.ue()
+	if b.flag() {
+		unitX, unitY := uint32(1), uint32(1)
+		if chroma == 1 || chroma == 2 {
+			unitX = 2
+		}
+		if chroma == 1 {
+			unitY = 2
+		}
+		left, right, top, bottom := b.ue(), b.ue(), b.ue(), b.ue()
+		width -= (left + right) * unitX
+		height -= (top + bottom) * unitY
+	}
+	depth := b.ue()
+	if b.err {
+		return info, false
+	}
+	name, ok := hevcProfiles[profile]
+	if !ok {
+		name = fmt.Sprint(profile)
+	}
+	tiers := []string{"Main", "High"}
+	info.Profile = fmt.Sprintf("%s@L%g@%s", name, float64(level)/30, tiers[tier])
+	info.Width, info.Height = width, height
+	info.ColorDepth = uint16(depth+8) * 3
+	return info, true
+}
+
+// parseDecoderConfig разбор набора параметров последовательности из записи конфигурации декодера (avcC или hvcC)
+func parseDecoderConfig(config *Box, hevc bool) (codecInfo, bool) {
+	s, err := newNALStream(config, hevc)
+	if err != nil {
+		return codecInfo{}, false
+	}
+	for _, ps := range s.parameterSets {
+		if len(ps) == 0 {
+			continue
+		}
+		if hevc && ps[0]>>1&0x3F == 33 {
+			return parseHEVCSPS(ps)
+		}
+		if !hevc && ps[0]&0x1F == 7 {
+			return parseH264SPS(ps)
+		}
+	}
+	return codecInfo{}, false
+}
+
+// av1Profiles наименования профилей AV1
+var av1Profiles = []string{"Main", "High", "Professional"}
+
+// parseAV1Config разбор записи конфигурации декодера AV1 (av1C): профиль, уровень и разрядность
+func parseAV1Config(config []byte) (codecInfo, bool) {
+	info := codecInfo{Format: "AV1"}
+	if len(config) < 4 || config[0] != 0x81 {
+		return info, false
+	}
+	profile, level := int(config[1]>>5), int(config[1]&0x1F)
+	name := fmt.Sprint(profile)
+	if profile < len(av1Profiles) {
+		name = av1Profiles[profile]
+	}
+	tiers := []string{"Main", "High"}
+	info.Profile = fmt.Sprintf("%s@L%d.%d@%s", name, 2+level>>2, level&0x3, tiers[config[2]>>7])
+	depth := uint16(8)
+	if config[2]&0x40 != 0 {
+		depth = 10
+		if profile == 2 && config[2]&0x20 != 0 {
+			depth = 12
+		}
+	}
+	channels := uint16(3)
+	if config[2]&0x10 != 0 {
+		channels = 1
+	}
+	info.ColorDepth = depth * channels
+	return info, true
+}
+
+// parseVideoElementaryStream поиск набора параметров в начале видеопотока формата Annex B
+func parseVideoElementaryStream(data []byte, hevc bool) (codecInfo, bool) {
+	for _, nal := range annexBUnits(data) {
+		if len(nal) == 0 {
+			continue
+		}
+		if hevc && nal[0]>>1&0x3F == 33 {
+			return parseHEVCSPS(nal)
+		}
+		if !hevc && nal[0]&0x1F == 7 {
+			return parseH264SPS(nal)
+		}
+	}
+	return codecInfo{}, false
+}
+
+// mpegVideoFrameRates частота кадров MPEG-1/2 видео по коду frame_rate_code
+var mpegVideoFrameRates = []float64{0, 24000.0 / 1001, 24, 25, 30000.0 / 1001, 30, 50, 60000.0 / 1001, 60}
+
+// parseMPEGVideo разбор заголовка последовательности MPEG-1/2 видео (00 00 01 B3)
+func parseMPEGVideo(data []byte) (codecInfo, bool) {
+	i := bytes.Index(data, []byte{0, 0, 1, 0xB3})
+	if i < 0 || len(data) < i+8 {
+		return codecInfo{}, false
+	}
+	h := data[i+4:]
+	info := codecInfo{Format: "MPEG Video", ColorDepth: 24}
+	info.Width = uint32(h[0])<<4 | uint32(h[1]>>4)
+	info.Height = uint32(h[1]&0xF)<<8 | uint32(h[2])
+	if code := int(h[3] & 0xF); code < len(mpegVideoFrameRates) {
+		info.FrameRate = mpegVideoFrameRates[code]
+	}
+	return info, true
+}
+
+// mpegAudioRates частоты дискретизации MPEG-1 звука; для MPEG-2 - вдвое, для MPEG-2.5 - вчетверо меньше
+var mpegAudioRates = []uint32{44100, 48000, 32000}
+
+// parseMPEGAudio поиск и разбор заголовка кадра MPEG звука (Layer I-III)
+func parseMPEGAudio(data []byte) (codecInfo, bool) {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xFF || data[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version, layer := data[i+1]>>3&0x3, data[i+1]>>1&0x3
+		rate := data[i+2] >> 2 & 0x3
+		if version == 1 || layer == 0 || rate == 3 || data[i+2]>>4 == 0xF {
+			continue
+		}
+		info := codecInfo{Format: fmt.Sprintf("MPEG Audio Layer %d", 4-layer), Channels: 2}
+		info.SampleRate = mpegAudioRates[rate]
+		switch version {
+		case 0:
+			info.Profile = "MPEG-2.5"
+			info.SampleRate /= 4
+		case 2:
+			info.Profile = "MPEG-2"
+			info.SampleRate /= 2
+		default:
+			info.Profile = "MPEG-1"
+		}
+		if data[i+3]>>6 == 3 {
+			info.Channels = 1
+		}
+		return info, true
+	}
+	return codecInfo{}, false
+}
+
+// aacProfiles наименования профилей AAC по типу объекта
+var aacProfiles = map[byte]string{1: "Main", 2: "LC", 3: "SSR", 4: "LTP", 5: "HE-AAC", 29: "HE-AACv2"}
+
+// parseADTS поиск и разбор заголовка кадра ADTS
+func parseADTS(data []byte) (codecInfo, bool) {
+	for i := 0; i+7 <= len(data); i++ {
+		if data[i] != 0xFF || data[i+1]&0xF6 != 0xF0 {
+			continue
+		}
+		frequency := data[i+2] >> 2 & 0xF
+		if int(frequency) >= len(adtsFrequencies) {
+			continue
+		}
+		info := codecInfo{Format: "AAC", SampleRate: adtsFrequencies[frequency]}
+		info.Profile = aacProfiles[data[i+2]>>6+1]
+		info.Channels = uint16(data[i+2]&0x1<<2 | data[i+3]>>6)
+		if info.Channels == 7 {
+			info.Channels = 8
+		}
+		return info, true
+	}
+	return codecInfo{}, false
+}
+
+// ac3Rates частоты дискретизации AC-3 по коду fscod
+var ac3Rates = []uint32{48000, 44100, 32000}
+
+// ac3Channels количество основных каналов AC-3 по коду acmod
+var ac3Channels = []uint16{2, 1, 2, 3, 3, 4, 4, 5}
+
+// parseAC3 поиск и разбор заголовка синхрокадра AC-3 или E-AC-3
+func parseAC3(data []byte) (codecInfo, bool) {
+	i := bytes.Index(data, []byte{0x0B, 0x77})
+	if i < 0 || len(data) < i+8 {
+		return codecInfo{}, false
+	}
+	b := &bitReader{data: data[i+2:]}
+	info := codecInfo{Format: "AC-3"}
+	// bsid располагается в одной и той же позиции в обоих вариантах заголовка
+	if bsid := data[i+5] >> 3; bsid > 10 {
+		info.Format = "E-AC-3"
+		b.bits(2)  // strmtyp
+		b.bits(3)  // substreamid
+		b.bits(11) // frmsiz
+		fscod := b.bits(2)
+		if fscod == 3 {
+			info.SampleRate = ac3Rates[b.bits(2)] / 2
+		} else {
+			b.bits(2) // numblkscod
+			info.SampleRate = ac3Rates[fscod]
+		}
+		acmod := b.bits(3)
+		info.Channels = ac3Channels[acmod]
+		if b.flag() {
+			info.Channels++
+		}
+		return info, !b.err
+	}
+	b.bits(16) // crc1
+	fscod := b.bits(2)
+	if fscod == 3 {
+		return codecInfo{}, false
+	}
+	info.SampleRate = ac3Rates[fscod]
+	b.bits(6) // frmsizecod
+	b.bits(5) // bsid
+	b.bits(3) // bsmod
+	acmod := b.bits(3)
+	if acmod&0x1 != 0 && acmod != 1 {
+		b.bits(2) // cmixlev
+	}
+	if acmod&0x4 != 0 {
+		b.bits(2) // surmixlev
+	}
+	if acmod == 2 {
+		b.bits(2) // dsurmod
+	}
+	info.Channels = ac3Channels[acmod]
+	if b.flag() {
+		info.Channels++
+	}
+	return info, !b.err
+}
+
+// channelLayout описание количества каналов звука
+func channelLayout(channels uint16) string {
+	switch channels {
+	case 1:
+		return "Mono"
+	case 2:
+		return "Stereo"
+	}
+	return "undefined"
+}
+
+// parseAudioSpecificConfig разбор AudioSpecificConfig AAC (тип объекта, частота, конфигурация каналов)
+func parseAudioSpecificConfig(asc []byte) (codecInfo, bool) {
+	b := &bitReader{data: asc}
+	objectType := b.bits(5)
+	if objectType == 31 {
+		objectType = 32 + b.bits(6)
+	}
+	info := codecInfo{Format: "AAC", Profile: aacProfiles[byte(objectType)]}
+	if index := b.bits(4); index == 0xF {
+		info.SampleRate = b.bits(24)
+	} else if int(index) < len(adtsFrequencies) {
+		info.SampleRate = adtsFrequencies[index]
+	}
+	info.Channels = uint16(b.bits(4))
+	if info.Channels == 7 {
+		info.Channels = 8
+	}
+	return info, !b.err && info.SampleRate > 0
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Склеивание совместимых файлов MP4 без перекодирования
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// multiReaderAt последовательное объединение нескольких источников в одно адресное пространство
+type multiReaderAt struct {
+	parts []io.ReaderAt
+	bases []int64 // позиция начала каждого источника
+}
+
+// ReadAt чтение из источника, которому принадлежит позиция off (чтение не пересекает границ источников)
+func (m *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(m.bases), func(i int) bool { return m.bases[i] > off }) - 1
+	if i < 0 {
+		return 0, io.EOF
+	}
+	return m.parts[i].ReadAt(p, off-m.bases[i])
+}
+
+// Concat склеивание файлов inputs в файл w: сэмплы дорожек следуют друг за другом с непрерывным
+// временем, описание файла (moov) берется из первого файла. Файлы должны совпадать по составу дорожек,
+// единицам времени и описаниям сэмплов (формат сжатия, параметры декодера, разрешение), иначе
+// возвращается ошибка с перечнем различий
+func Concat(w io.Writer, inputs ...io.ReadSeeker) error {
+	if len(inputs) == 0 {
+		return NewAPIError("не указаны файлы для склеивания", nil)
+	}
+	src := &multiReaderAt{}
+	var files []*movieFile
+	var base int64
+	for _, r := range inputs {
+		m, err := readMovieFile(r)
+		if err != nil {
+			return err
+		}
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return NewAPIError("ошибка чтения видеофайла", err)
+		}
+		src.parts = append(src.parts, m.src)
+		src.bases = append(src.bases, base)
+		for _, t := range m.tracks {
+			for i := range t.Samples {
+				t.Samples[i].Offset += base
+			}
+		}
+		files = append(files, m)
+		base += size
+	}
+	first := files[0]
+	var problems []string
+	for i, m := range files[1:] {
+		problems = append(problems, checkCompatible(first, m, i+2)...)
+	}
+	if len(problems) > 0 {
+		return NewAPIError("файлы несовместимы: "+strings.Join(problems, "; "), nil)
+	}
+	mvhd := first.movie.Child("mvhd")
+	if mvhd == nil {
+		return ErrFileIsNotValid
+	}
+	timeScale, ok := versionedField(mvhd.Data, 12, 20)
+	if !ok || timeScale == 0 {
+		return ErrFileIsNotValid
+	}
+	// время начала очередного файла (в единицах времени первого файла) - конец самой продолжительной
+	// дорожки предыдущих файлов; более короткие дорожки выравниваются удлинением последнего сэмпла
+	var start uint64
+	for n, m := range files {
+		var length uint64
+		for i, t := range m.tracks {
+			target := first.tracks[i]
+			if n > 0 {
+				target.appendSamples(t.Samples, rescaleTime(start, timeScale, t.TimeScale))
+			}
+			if d := rescaleTime(t.duration(), t.TimeScale, timeScale); d > length {
+				length = d
+			}
+		}
+		start += length
+	}
+	for _, t := range first.tracks {
+		// список редактирования первого файла распространяется на всю продолжительность дорожки
+		if t.trak.Child("edts") == nil {
+			continue
+		}
+		mediaTime := editMediaTime(t.trak)
+		var duration uint64
+		if end := t.presentationEnd(); end > mediaTime {
+			duration = rescaleTime(uint64(end-mediaTime), t.TimeScale, timeScale)
+		}
+		setEditList(t.trak, duration, mediaTime)
+	}
+	return writeProgressive(w, src, first.fileType(), first.movie, first.tracks)
+}
+
+// appendSamples добавление сэмплов, начинающихся в момент start (в единицах времени медиадорожки)
+func (t *mediaTrack) appendSamples(samples []Sample, start uint64) {
+	if n := len(t.Samples); n > 0 {
+		if end := t.duration(); end < start {
+			t.Samples[n-1].Duration += uint32(start - end)
+		}
+	}
+	dts := t.duration()
+	for _, s := range samples {
+		s.DTS = dts
+		dts += uint64(s.Duration)
+		t.Samples = append(t.Samples, s)
+	}
+}
+
+// checkCompatible сравнение дорожек файла m (номер number) с дорожками первого файла
+func checkCompatible(first, m *movieFile, number int) (problems []string) {
+	if len(m.tracks) != len(first.tracks) {
+		return []string{fmt.Sprintf("файл %d: количество дорожек %d вместо %d", number, len(m.tracks), len(first.tracks))}
+	}
+	for i, t := range m.tracks {
+		ref := first.tracks[i]
+		prefix := fmt.Sprintf("файл %d, дорожка %d: ", number, i+1)
+		if t.Handler != ref.Handler {
+			problems = append(problems, prefix+fmt.Sprintf("тип %q вместо %q", t.Handler, ref.Handler))
+			continue
+		}
+		if t.TimeScale != ref.TimeScale {
+			problems = append(problems, prefix+fmt.Sprintf("единица времени %d вместо %d", t.TimeScale, ref.TimeScale))
+		}
+		if difference := compareSampleDescriptions(ref.trak.Find("mdia/minf/stbl/stsd"), t.trak.Find("mdia/minf/stbl/stsd")); difference != "" {
+			problems = append(problems, prefix+difference)
+		}
+	}
+	return problems
+}
+
+// compareSampleDescriptions сравнение описаний сэмплов (stsd), возвращает описание различия
+func compareSampleDescriptions(ref, stsd *Box) string {
+	if ref == nil || stsd == nil || len(ref.Children) != len(stsd.Children) {
+		return "различается количество описаний сэмплов"
+	}
+	for i, entry := range stsd.Children {
+		refEntry := ref.Children[i]
+		if entry.Type != refEntry.Type {
+			return fmt.Sprintf("формат сжатия %s вместо %s", boxName(entry.Type), boxName(refEntry.Type))
+		}
+		params, refParams := sampleEntryParams(entry), sampleEntryParams(refEntry)
+		if params != refParams {
+			return fmt.Sprintf("параметры %s вместо %s", params, refParams)
+		}
+		var a, b bytes.Buffer
+		if _, err := entry.WriteTo(&a); err != nil {
+			return "описание сэмплов не читается"
+		}
+		if _, err := refEntry.WriteTo(&b); err != nil {
+			return "описание сэмплов не читается"
+		}
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			return "различаются параметры декодера " + boxName(entry.Type)
+		}
+	}
+	return ""
+}
+
+// sampleEntryParams основные параметры описания сэмпла: разрешение видео или число каналов и частота звука
+func sampleEntryParams(entry *Box) string {
+	data := entry.Prefix
+	if !entry.IsContainer() {
+		data = entry.Data
+	}
+	switch {
+	case visualSampleEntries[entry.Type] && len(data) >= 28:
+		return fmt.Sprintf("%dx%d", binary.BigEndian.Uint16(data[24:]), binary.BigEndian.Uint16(data[26:]))
+	case audioSampleEntries[entry.Type] && len(data) >= 28:
+		return fmt.Sprintf("%d каналов, %d Гц", binary.BigEndian.Uint16(data[16:]), binary.BigEndian.Uint16(data[24:]))
+	}
+	return ""
+}
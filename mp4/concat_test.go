@@ -0,0 +1,47 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка склеивания файлов
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConcatRoundTrip(t *testing.T) {
+	data := testMovie(t)
+	want := readTestMovie(t, data)
+	var out bytes.Buffer
+	if err := Concat(&out, bytes.NewReader(data), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestMovie(t, out.Bytes())
+	if len(got.tracks) != len(want.tracks) {
+		t.Fatalf("%d дорожек вместо %d", len(got.tracks), len(want.tracks))
+	}
+	for i, track := range got.tracks {
+		source := want.tracks[i].Samples
+		n := len(source)
+		if len(track.Samples) != 2*n {
+			t.Fatalf("дорожка %d: %d сэмплов вместо %d", i+1, len(track.Samples), 2*n)
+		}
+		// последний сэмпл первого файла может быть удлинен до конца самой продолжительной дорожки (4 с)
+		compareSamples(t, i+1, want, source[:n-1], got, track.Samples[:n-1])
+		compareSamples(t, i+1, want, source, got, track.Samples[n:])
+		if start := track.Samples[n].DTS; start != uint64(4*track.TimeScale) {
+			t.Fatalf("дорожка %d: второй файл начинается в %d вместо %d", i+1, start, 4*track.TimeScale)
+		}
+	}
+}
+
+func TestConcatIncompatible(t *testing.T) {
+	data := testMovie(t)
+	video := testTrack{handler: "vide", timeScale: 12800, duration: 512, sizes: []uint32{100, 100}}
+	other := buildTestMovie(t, video)
+	var out bytes.Buffer
+	if err := Concat(&out, bytes.NewReader(data), bytes.NewReader(other)); err == nil {
+		t.Fatal("склеены файлы с разным количеством дорожек")
+	}
+}
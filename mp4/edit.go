@@ -0,0 +1,384 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Изменение метаданных видеофайла (теги iTunes, время создания, поворот изображения) без перекодирования
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Типы значений тегов iTunes (блок data)
+const (
+	tagTypeUTF8 uint32 = 1  // строка в кодировке UTF-8
+	tagTypeJPEG uint32 = 13 // изображение JPEG
+	tagTypePNG  uint32 = 14 // изображение PNG
+)
+
+// MetadataEdit изменения метаданных видеофайла, поля со значением nil не изменяются
+type MetadataEdit struct {
+	Title       *string    // название (тег ©nam), пустая строка удаляет тег
+	Description *string    // описание (тег desc), пустая строка удаляет тег
+	CoverArt    []byte     // обложка в формате JPEG или PNG (тег covr)
+	Created     *time.Time // время создания контейнера и всех медиадорожек (блоки mvhd, tkhd, mdhd)
+	Rotation    *int       // угол поворота изображения видеодорожек по часовой стрелке (0, 90, 180 или 270 градусов)
+}
+
+// Edit изменение метаданных файла r с записью результата в w
+// Если рядом с блоком moov есть блок free, изменение размера moov компенсируется за его счет
+// и медиаданные остаются на прежних позициях, иначе смещения чанков пересчитываются
+func (f *VideoFile) Edit(r io.ReadSeeker, w io.Writer, e MetadataEdit) error {
+	boxes, err := ReadBoxes(r)
+	if err != nil {
+		return err
+	}
+	layout, _, err := f.applyEdit(boxes, e)
+	if err != nil {
+		return err
+	}
+	if err = writeRelocated(w, layout); err != nil {
+		return err
+	}
+	return f.loadMetaData(layout)
+}
+
+// EditFile изменение метаданных файла на диске
+// Если измененный блок moov помещается на место исходного (с учетом блока free за ним) или располагается
+// в конце файла, перезаписывается только блок moov, иначе файл переписывается целиком через временный файл
+func (f *VideoFile) EditFile(path string, e MetadataEdit) (err error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return NewAPIError("ошибка при открытии файла", err)
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = NewAPIError("ошибка записи видеофайла", closeErr)
+		}
+	}()
+	boxes, err := ReadBoxes(file)
+	if err != nil {
+		return err
+	}
+	layout, region, err := f.applyEdit(boxes, e)
+	if err != nil {
+		return err
+	}
+	if region != nil {
+		// изменения укладываются в участок файла, занимаемый moov и блоком free
+		var buf bytes.Buffer
+		for _, b := range region {
+			if _, err = b.WriteTo(&buf); err != nil {
+				return NewAPIError("ошибка записи видеофайла", err)
+			}
+		}
+		start := region[0].offset
+		if _, err = file.WriteAt(buf.Bytes(), start); err != nil {
+			return NewAPIError("ошибка записи видеофайла", err)
+		}
+		if region[len(region)-1] == layout[len(layout)-1] {
+			// участок завершает файл - отсекаем остаток прежнего блока moov
+			if err = file.Truncate(start + int64(buf.Len())); err != nil {
+				return NewAPIError("ошибка записи видеофайла", err)
+			}
+		}
+		return f.loadMetaData(layout)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".edit-*.mp4")
+	if err != nil {
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	defer os.Remove(temp.Name())
+	// временный файл создается с правами 0600, права исходного файла сохраняются
+	info, err := file.Stat()
+	if err == nil {
+		err = temp.Chmod(info.Mode().Perm())
+	}
+	if err != nil {
+		temp.Close()
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	if err = writeRelocated(temp, layout); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	if err = os.Rename(temp.Name(), path); err != nil {
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	return f.loadMetaData(layout)
+}
+
+// applyEdit применение изменений к блоку moov; возвращает новый порядок блоков верхнего уровня
+// и, если размещение медиаданных не изменилось, участок файла (moov и блок free), который требуется перезаписать
+func (f *VideoFile) applyEdit(boxes []*Box, e MetadataEdit) (layout, region []*Box, err error) {
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		return nil, nil, ErrMovieNotFound
+	}
+	movie := boxes[index]
+	oldSize := movie.Size()
+	if err = e.apply(movie); err != nil {
+		return nil, nil, err
+	}
+	layout, region = usePadding(boxes, index, oldSize)
+	return layout, region, nil
+}
+
+// usePadding компенсация изменения размера блока moov за счет следующего за ним блока free/skip
+// Возвращает новый порядок блоков верхнего уровня и участок из блока moov и блоков free, который
+// можно записать на место исходного без сдвига медиаданных (nil, если это невозможно);
+// если участок завершает файл, его размер может отличаться от исходного
+func usePadding(boxes []*Box, index int, oldSize int64) (layout, region []*Box) {
+	delta := boxes[index].Size() - oldSize
+	layout = boxes
+	if delta == 0 {
+		return layout, boxes[index : index+1]
+	}
+	next := index + 1
+	if next < len(boxes) && isPadding(boxes[next]) {
+		free := boxes[next]
+		switch rest := free.Size() - delta; {
+		case rest >= headerBlockSize:
+			free.SetData(make([]byte, rest-free.headerSize()))
+			return layout, boxes[index : next+1]
+		case rest == 0:
+			// блок free поглощается полностью
+			layout = append(append([]*Box{}, boxes[:next]...), boxes[next+1:]...)
+			return layout, layout[index:next]
+		}
+	}
+	if next == len(boxes) || next == len(boxes)-1 && isPadding(boxes[next]) {
+		// moov располагается в конце файла, медиаданные не сдвигаются
+		return layout, boxes[index:]
+	}
+	if delta <= -headerBlockSize {
+		// moov уменьшился - освободившееся место занимает новый блок free
+		free := NewBox("free", make([]byte, -delta-headerBlockSize))
+		layout = append(append(append([]*Box{}, boxes[:next]...), free), boxes[next:]...)
+		return layout, layout[index : next+1]
+	}
+	return layout, nil
+}
+
+// isPadding является ли блок заполнителем (free/skip)
+func isPadding(b *Box) bool {
+	return b.Type == "free" || b.Type == "skip"
+}
+
+// loadMetaData обновление метаданных по блокам ftyp и moov
+func (f *VideoFile) loadMetaData(boxes []*Box) error {
+	var buf bytes.Buffer
+	f.Size = 0
+	for _, b := range boxes {
+		f.Size += int(b.Size())
+		if b.Type != "ftyp" && b.Type != "moov" {
+			continue
+		}
+		if _, err := b.WriteTo(&buf); err != nil {
+			return NewAPIError("ошибка на стороне сервера", err)
+		}
+	}
+	f.metaDataBuf = bytes.NewReader(buf.Bytes())
+	f.Movie = Container{}
+	return f.Parse()
+}
+
+// apply применение изменений к блоку moov
+func (e MetadataEdit) apply(movie *Box) error {
+	if e.Title != nil {
+		if err := setTextTag(movie, "\xa9nam", *e.Title); err != nil {
+			return err
+		}
+	}
+	if e.Description != nil {
+		if err := setTextTag(movie, "desc", *e.Description); err != nil {
+			return err
+		}
+	}
+	if e.CoverArt != nil {
+		dataType := tagTypeJPEG
+		switch {
+		case bytes.HasPrefix(e.CoverArt, []byte{0x89, 'P', 'N', 'G'}):
+			dataType = tagTypePNG
+		case !bytes.HasPrefix(e.CoverArt, []byte{0xFF, 0xD8}):
+			return ErrCoverArtFormat
+		}
+		if err := setTag(movie, "covr", dataType, e.CoverArt); err != nil {
+			return err
+		}
+	}
+	if e.Created != nil {
+		headers := []*Box{movie.Child("mvhd")}
+		headers = append(headers, movie.FindAll("trak/tkhd")...)
+		headers = append(headers, movie.FindAll("trak/mdia/mdhd")...)
+		for _, b := range headers {
+			if err := setCreationTime(b, *e.Created); err != nil {
+				return err
+			}
+		}
+	}
+	if e.Rotation != nil {
+		for _, trak := range movie.FindAll("trak") {
+			if trackHandler(trak) != "vide" {
+				continue
+			}
+			if err := setRotation(trak.Child("tkhd"), *e.Rotation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// itemList получение списка тегов iTunes (moov/udta/meta/ilst), при отсутствии список создается
+func itemList(movie *Box) (*Box, error) {
+	udta := movie.Child("udta")
+	if udta == nil {
+		udta = NewContainer("udta", nil)
+		movie.Children = append(movie.Children, udta)
+	}
+	if !udta.IsContainer() {
+		return nil, NewAPIError("не удалось разобрать блок пользовательских данных (udta)", nil)
+	}
+	if ilst := findItemList(movie); ilst != nil {
+		return ilst, nil
+	}
+	hdlr := NewBox("hdlr", append(make([]byte, 8), "mdirappl\x00\x00\x00\x00\x00\x00\x00\x00\x00"...))
+	ilst := NewContainer("ilst", nil)
+	udta.Children = append(udta.Children, NewContainer("meta", make([]byte, 4), hdlr, ilst))
+	return ilst, nil
+}
+
+// findItemList поиск списка тегов iTunes (moov/udta/meta/ilst) без его создания
+func findItemList(movie *Box) *Box {
+	udta := movie.Child("udta")
+	if udta == nil {
+		return nil
+	}
+	for _, meta := range udta.FindAll("meta") {
+		if ilst := meta.Child("ilst"); ilst != nil && metaHandler(meta) == "mdir" {
+			return ilst
+		}
+	}
+	return nil
+}
+
+// metaHandler тип метаданных блока meta ('mdir' для тегов iTunes)
+func metaHandler(meta *Box) string {
+	hdlr := meta.Child("hdlr")
+	if hdlr == nil || len(hdlr.Data) < 12 {
+		return ""
+	}
+	return string(hdlr.Data[8:12])
+}
+
+// setTextTag установка текстового тега, пустая строка удаляет тег
+func setTextTag(movie *Box, name, value string) error {
+	if value == "" {
+		if ilst := findItemList(movie); ilst != nil {
+			ilst.Remove(name)
+		}
+		return nil
+	}
+	return setTag(movie, name, tagTypeUTF8, []byte(value))
+}
+
+// setTag установка значения тега iTunes
+func setTag(movie *Box, name string, dataType uint32, value []byte) error {
+	ilst, err := itemList(movie)
+	if err != nil {
+		return err
+	}
+	data := binary.BigEndian.AppendUint32(nil, dataType)
+	data = append(data, 0, 0, 0, 0) // язык и страна не указаны
+	item := NewContainer(name, nil, NewBox("data", append(data, value...)))
+	for i, c := range ilst.Children {
+		if c.Type == name {
+			ilst.Children[i] = item
+			return nil
+		}
+	}
+	ilst.Children = append(ilst.Children, item)
+	return nil
+}
+
+// setCreationTime установка времени создания в блоке mvhd, tkhd или mdhd
+func setCreationTime(b *Box, t time.Time) error {
+	if b == nil || len(b.Data) < 12 {
+		return ErrFileIsNotValid
+	}
+	seconds := t.Sub(time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)) / time.Second
+	if seconds < 0 {
+		return ErrDateOutOfRange
+	}
+	data := append([]byte{}, b.Data...)
+	if data[0] == 0x1 {
+		binary.BigEndian.PutUint64(data[4:12], uint64(seconds))
+	} else {
+		if seconds > math.MaxUint32 {
+			return ErrDateOutOfRange
+		}
+		binary.BigEndian.PutUint32(data[4:8], uint32(seconds))
+	}
+	b.SetData(data)
+	return nil
+}
+
+// setRotation запись матрицы преобразования изображения в блок tkhd
+func setRotation(tkhd *Box, degrees int) error {
+	// матрица хранится после полей времени, идентификатора дорожки, продолжительности и 16 байт
+	// (зарезервированные поля, слой, группа, громкость), ширина и высота - после матрицы
+	offset := 40
+	if tkhd != nil && len(tkhd.Data) > 0 && tkhd.Data[0] == 0x1 {
+		offset = 52
+	}
+	if tkhd == nil || len(tkhd.Data) < offset+44 {
+		return ErrFileIsNotValid
+	}
+	data := append([]byte{}, tkhd.Data...)
+	width := int32(binary.BigEndian.Uint32(data[offset+36:]))
+	height := int32(binary.BigEndian.Uint32(data[offset+40:]))
+	// элементы матрицы a, b, u, c, d, v, x, y, w; a..d, x, y - числа 16.16, u, v, w - 2.30
+	var matrix [9]int32
+	switch degrees % 360 {
+	case 0:
+		matrix = [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+	case 90, -270:
+		matrix = [9]int32{0, 0x10000, 0, -0x10000, 0, 0, height, 0, 0x40000000}
+	case 180, -180:
+		matrix = [9]int32{-0x10000, 0, 0, 0, -0x10000, 0, width, height, 0x40000000}
+	case 270, -90:
+		matrix = [9]int32{0, -0x10000, 0, 0x10000, 0, 0, 0, width, 0x40000000}
+	default:
+		return ErrRotationNotSupported
+	}
+	for i, v := range matrix {
+		binary.BigEndian.PutUint32(data[offset+4*i:], uint32(v))
+	}
+	tkhd.SetData(data)
+	return nil
+}
+
+// rotationFromMatrix угол поворота изображения по матрице преобразования блока tkhd
+func rotationFromMatrix(matrix []byte) int {
+	a := int32(binary.BigEndian.Uint32(matrix[0:4]))
+	b := int32(binary.BigEndian.Uint32(matrix[4:8]))
+	switch {
+	case a == 0 && b > 0:
+		return 90
+	case a < 0 && b == 0:
+		return 180
+	case a == 0 && b < 0:
+		return 270
+	}
+	return 0
+}
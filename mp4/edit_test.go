@@ -0,0 +1,146 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка изменения метаданных: пересчет смещений чанков и сохранение медиаданных
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// faststartMovie тестовый файл с блоком moov перед медиаданными
+func faststartMovie(t *testing.T) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Faststart(bytes.NewReader(testMovie(t)), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// movieBox блок moov файла
+func movieBox(t *testing.T, data []byte) *Box {
+	t.Helper()
+	boxes, err := ReadBoxes(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		t.Fatal("нет блока moov")
+	}
+	return boxes[index]
+}
+
+func TestEditRelocatesChunks(t *testing.T) {
+	// moov перед медиаданными без блока free: после увеличения moov медиаданные сдвигаются
+	data := faststartMovie(t)
+	title := "Новое название"
+	created := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	rotation := 90
+	var out bytes.Buffer
+	var f VideoFile
+	if err := f.Edit(bytes.NewReader(data), &out, MetadataEdit{Title: &title, Created: &created, Rotation: &rotation}); err != nil {
+		t.Fatal(err)
+	}
+	if ilst := movieBox(t, out.Bytes()).Find("udta/meta/ilst"); ilst == nil || ilst.Child("\xa9nam") == nil {
+		t.Fatal("тег названия не записан")
+	}
+	if !f.Movie.Created.Equal(created) {
+		t.Fatalf("время создания %v вместо %v", f.Movie.Created, created)
+	}
+	if video := f.Movie.Tracks[0]; video.Rotation != rotation || video.Width != 640 || video.Height != 360 {
+		t.Fatalf("поворот %d, размер %dx%d вместо %d, 640x360", video.Rotation, video.Width, video.Height, rotation)
+	}
+	compareChunks(t, data, out.Bytes())
+}
+
+func TestEditFileInPlace(t *testing.T) {
+	// moov в конце файла перезаписывается на месте, медиаданные не сдвигаются
+	data := testMovie(t)
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	description := "Описание"
+	var f VideoFile
+	if err := f.EditFile(path, MetadataEdit{Description: &description}); err != nil {
+		t.Fatal(err)
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size != len(edited) {
+		t.Fatalf("размер файла в метаданных %d вместо %d", f.Size, len(edited))
+	}
+	if ilst := movieBox(t, edited).Find("udta/meta/ilst"); ilst == nil || ilst.Child("desc") == nil {
+		t.Fatal("тег описания не записан")
+	}
+	compareChunks(t, data, edited)
+	// повторное удаление тега уменьшает moov, файл укорачивается
+	empty := ""
+	if err = f.EditFile(path, MetadataEdit{Description: &empty}); err != nil {
+		t.Fatal(err)
+	}
+	if edited, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if ilst := movieBox(t, edited).Find("udta/meta/ilst"); ilst != nil && ilst.Child("desc") != nil {
+		t.Fatal("тег описания не удален")
+	}
+	compareChunks(t, data, edited)
+}
+
+func TestEditCoverArtFormat(t *testing.T) {
+	var out bytes.Buffer
+	var f VideoFile
+	if err := f.Edit(bytes.NewReader(testMovie(t)), &out, MetadataEdit{CoverArt: []byte("GIF89a")}); err != ErrCoverArtFormat {
+		t.Fatalf("ошибка %v вместо %v", err, ErrCoverArtFormat)
+	}
+}
+
+func TestEditDeleteMissingTag(t *testing.T) {
+	// удаление отсутствующего тега не добавляет пустой список тегов и не меняет файл
+	data := faststartMovie(t)
+	empty := ""
+	var out bytes.Buffer
+	var f VideoFile
+	if err := f.Edit(bytes.NewReader(data), &out, MetadataEdit{Title: &empty, Description: &empty}); err != nil {
+		t.Fatal(err)
+	}
+	if findItemList(movieBox(t, out.Bytes())) != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("файл изменен при удалении отсутствующих тегов")
+	}
+}
+
+func TestEditFileKeepsMode(t *testing.T) {
+	data := faststartMovie(t)
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// moov перед медиаданными без блока free - файл переписывается целиком через временный файл
+	title := "Новое название"
+	var f VideoFile
+	if err := f.EditFile(path, MetadataEdit{Title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("права файла %v вместо %v", info.Mode().Perm(), os.FileMode(0644))
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareChunks(t, data, edited)
+}
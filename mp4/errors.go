@@ -0,0 +1,146 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Функции работы с ошибками сервиса
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrFileIsNotValid ошибка - обрабатываемый файл не соответствует поддерживаемым форматам
+var ErrFileIsNotValid = NewAPIError("формат файла неизвестен или не поддерживается", nil)
+
+// ErrFileCodecNotSupported ошибка - обрабатываемый файл имеет неподдерживаемый алгоритм сжатия медиаданных
+var ErrFileCodecNotSupported = NewAPIError("неподдерживаемый формат сжатия видеофайла", nil)
+
+// ErrMovieNotFound ошибка - в файле отсутствует блок описания контейнера (moov)
+var ErrMovieNotFound = NewAPIError("в файле отсутствует описание видеоконтейнера", nil)
+
+// ErrFragmentedNotSupported ошибка - операция не применима к фрагментированному файлу (с блоками moof)
+var ErrFragmentedNotSupported = NewAPIError("операция не поддерживается для фрагментированных файлов", nil)
+
+// ErrChunkOffsetOutOfRange ошибка - смещение чанка медиаданных указывает за пределы файла
+var ErrChunkOffsetOutOfRange = NewAPIError("смещение блока медиаданных за пределами файла", nil)
+
+// ErrCoverArtFormat ошибка - обложка должна быть изображением в формате JPEG или PNG
+var ErrCoverArtFormat = NewAPIError("обложка должна быть изображением в формате JPEG или PNG", nil)
+
+// ErrDateOutOfRange ошибка - дата не может быть записана в метаданные файла
+var ErrDateOutOfRange = NewAPIError("дата вне допустимого диапазона", nil)
+
+// ErrRotationNotSupported ошибка - угол поворота изображения не кратен 90 градусам
+var ErrRotationNotSupported = NewAPIError("угол поворота должен быть кратен 90 градусам", nil)
+
+// ErrBadSampleTable ошибка - таблица сэмплов медиадорожки повреждена
+var ErrBadSampleTable = NewAPIError("таблица сэмплов медиадорожки повреждена", nil)
+
+// ErrNoSamples ошибка - в файле нет ни одного сэмпла медиаданных
+var ErrNoSamples = NewAPIError("в файле отсутствуют медиаданные", nil)
+
+// ErrTrackNotFound ошибка - в файле нет выбранных медиадорожек
+var ErrTrackNotFound = NewAPIError("выбранные медиадорожки в файле не найдены", nil)
+
+// ErrTrimRange ошибка - интервал времени для вырезания фрагмента задан неверно
+var ErrTrimRange = NewAPIError("неверный интервал времени: начало должно быть меньше конца и продолжительности файла", nil)
+
+// ErrBadFragment ошибка - описание фрагмента (moof) повреждено
+var ErrBadFragment = NewAPIError("описание фрагмента медиаданных повреждено", nil)
+
+// ErrBitrateWindow ошибка - окно расчета битрейта слишком мало
+var ErrBitrateWindow = NewAPIError("окно расчета битрейта должно быть не меньше 10 мс", nil)
+
+// ErrValidationFailed ошибка - при проверке структуры файла найдены ошибки
+var ErrValidationFailed = NewAPIError("при проверке файла найдены ошибки", nil)
+
+// ErrBitrateTooLong ошибка - продолжительность файла слишком велика для выбранного окна расчета битрейта
+var ErrBitrateTooLong = NewAPIError("слишком много окон расчета битрейта, увеличьте окно", nil)
+
+// ErrTooManySamples ошибка - таблицы сэмплов слишком велики для анализа при разборе метаданных
+var ErrTooManySamples = NewAPIError("слишком много сэмплов для анализа", nil)
+
+// restoreAndPanic автовозврат ошибки и снова вызов паники
+func restoreAndPanic(msg string) {
+	if r := recover(); r != nil {
+		err := r.(error)
+		panic(NewAPIError(msg, err))
+	}
+}
+
+// restore автовозврат ошибки
+func restore(err *error, msg string) {
+	if err == nil || *err == nil {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = r.(error)
+		*err = NewAPIError(msg, *err)
+	}
+}
+
+// fatal автопаника при ошибке
+func fatal(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// APIError ошибка веб-сервиса
+type APIError struct {
+	APIMsg string
+	msg    string
+	err    error
+}
+
+// sysLog стек ошибок
+func (e APIError) sysLog() string {
+	var tempErr APIError
+	err := e.err
+	msg := e.msg
+	for errors.As(err, &tempErr) {
+		msg = msg + "; " + tempErr.Error()
+		err = tempErr.err
+	}
+	// если объект внутренней ошибки существует - добавляем его содержимое
+	if err != nil {
+		msg += "; " + err.Error()
+	}
+	return msg
+}
+
+// Error текст ошибки
+func (e APIError) Error() string {
+	return e.APIMsg
+}
+
+// UnWrap извлечение ошибки
+func (e APIError) UnWrap() error {
+	return e.err
+}
+
+// MarshalJSON сериализация сведений об ошибке в формате JSON
+func (e APIError) MarshalJSON() (b []byte, err error) {
+	s := fmt.Sprintf("{\"%s\":\"%s\",\"%s\":\"%s\"}",
+		"Error",
+		e.APIMsg,
+		"Time",
+		time.Now().Format(time.RFC822))
+	return []byte(s), nil
+}
+
+// DescribeError подробное описание ошибки вместе с вложенными ошибками
+func DescribeError(err error) string {
+	var errAPI APIError
+	if errors.As(err, &errAPI) {
+		return errAPI.sysLog()
+	}
+	return err.Error()
+}
+
+// NewAPIError создание новой ошибки
+func NewAPIError(msg string, err error) (e APIError) {
+	return APIError{APIMsg: msg, msg: msg, err: err}
+}
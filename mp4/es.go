@@ -0,0 +1,308 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Выгрузка элементарных потоков: H.264/HEVC в формате Annex B, AAC с заголовками ADTS
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// annexBStartCode префикс NAL-блока в формате Annex B
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// adtsFrequencies частоты дискретизации AAC по их индексам
+var adtsFrequencies = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// streamConverter преобразование сэмпла медиадорожки в кадр элементарного потока
+type streamConverter interface {
+	convert(dst, sample []byte, sync bool) ([]byte, error)
+}
+
+// ExportStream запись сэмплов дорожки trackID файла r в виде элементарного потока: H.264/HEVC - Annex B
+// с наборами параметров (VPS, SPS, PPS) перед ключевыми кадрами, AAC - кадры с заголовками ADTS.
+// При trackID = 0 выгружается первая дорожка поддерживаемого формата
+func ExportStream(r io.ReadSeeker, w io.Writer, trackID uint32) error {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return err
+	}
+	for _, t := range m.tracks {
+		if trackID != 0 && t.ID != trackID {
+			continue
+		}
+		converters, err := newStreamConverters(t.trak.Find("mdia/minf/stbl/stsd"))
+		if err == ErrFileCodecNotSupported && trackID == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return writeStream(w, m.src, t.Samples, converters)
+	}
+	if trackID == 0 {
+		return ErrFileCodecNotSupported
+	}
+	return ErrTrackNotFound
+}
+
+// newStreamConverters преобразователи сэмплов для каждого описания сэмплов блока stsd
+func newStreamConverters(stsd *Box) ([]streamConverter, error) {
+	if stsd == nil || len(stsd.Children) == 0 {
+		return nil, ErrBadSampleTable
+	}
+	converters := make([]streamConverter, len(stsd.Children))
+	for i, entry := range stsd.Children {
+		var err error
+		switch entry.Type {
+		case "avc1", "avc2", "avc3", "avc4":
+			converters[i], err = newNALStream(entry.Child("avcC"), false)
+		case "hvc1", "hev1":
+			converters[i], err = newNALStream(entry.Child("hvcC"), true)
+		case "mp4a":
+			esds := entry.Child("esds")
+			if esds == nil {
+				// в QuickTime описание потока вложено в блок wave
+				esds = entry.Find("wave/esds")
+			}
+			converters[i], err = newADTSStream(esds)
+		default:
+			err = ErrFileCodecNotSupported
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return converters, nil
+}
+
+// writeStream последовательное чтение сэмплов из src, преобразование и запись в w
+func writeStream(w io.Writer, src io.ReaderAt, samples []Sample, converters []streamConverter) error {
+	out := bufio.NewWriter(w)
+	var sample, frame []byte
+	for _, s := range samples {
+		if s.Description < 1 || int(s.Description) > len(converters) {
+			return ErrBadSampleTable
+		}
+		if cap(sample) < int(s.Size) {
+			sample = make([]byte, s.Size)
+		}
+		sample = sample[:s.Size]
+		if _, err := src.ReadAt(sample, s.Offset); err != nil {
+			return NewAPIError("ошибка чтения видеофайла", err)
+		}
+		var err error
+		if frame, err = converters[s.Description-1].convert(frame[:0], sample, s.Sync); err != nil {
+			return err
+		}
+		if _, err = out.Write(frame); err != nil {
+			return NewAPIError("ошибка записи элементарного потока", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return NewAPIError("ошибка записи элементарного потока", err)
+	}
+	return nil
+}
+
+// nalStream преобразование сэмплов H.264/HEVC (NAL-блоки с полем длины) в формат Annex B
+type nalStream struct {
+	lengthSize    int      // размер поля длины NAL-блока (байт)
+	parameterSets [][]byte // наборы параметров из avcC/hvcC
+	hevc          bool
+}
+
+// newNALStream разбор записи конфигурации декодера (avcC или hvcC)
+func newNALStream(config *Box, hevc bool) (*nalStream, error) {
+	if config == nil {
+		return nil, ErrFileCodecNotSupported
+	}
+	data := config.Data
+	s := &nalStream{hevc: hevc}
+	if hevc {
+		if len(data) < 23 {
+			return nil, ErrFileIsNotValid
+		}
+		s.lengthSize = int(data[21]&0x3) + 1
+		// массивы NAL-блоков: тип, количество и сами блоки
+		arrays := int(data[22])
+		data = data[23:]
+		for i := 0; i < arrays; i++ {
+			if len(data) < 3 {
+				return nil, ErrFileIsNotValid
+			}
+			count := int(binary.BigEndian.Uint16(data[1:]))
+			var err error
+			if data, err = s.readParameterSets(data[3:], count); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	if len(data) < 6 {
+		return nil, ErrFileIsNotValid
+	}
+	s.lengthSize = int(data[4]&0x3) + 1
+	data, err := s.readParameterSets(data[6:], int(data[5]&0x1F))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 {
+		return nil, ErrFileIsNotValid
+	}
+	if _, err = s.readParameterSets(data[1:], int(data[0])); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readParameterSets чтение count наборов параметров с 16-битной длиной, возвращает оставшиеся данные
+func (s *nalStream) readParameterSets(data []byte, count int) ([]byte, error) {
+	for i := 0; i < count; i++ {
+		if len(data) < 2 {
+			return nil, ErrFileIsNotValid
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+size {
+			return nil, ErrFileIsNotValid
+		}
+		s.parameterSets = append(s.parameterSets, data[2:2+size])
+		data = data[2+size:]
+	}
+	return data, nil
+}
+
+// isParameterSet является ли NAL-блок набором параметров (H.264: SPS, PPS; HEVC: VPS, SPS, PPS)
+func (s *nalStream) isParameterSet(nal []byte) bool {
+	if s.hevc {
+		kind := nal[0] >> 1 & 0x3F
+		return kind >= 32 && kind <= 34
+	}
+	kind := nal[0] & 0x1F
+	return kind == 7 || kind == 8
+}
+
+// convert замена полей длины NAL-блоков префиксами Annex B; перед ключевым кадром без собственных
+// наборов параметров вставляются наборы из конфигурации декодера
+func (s *nalStream) convert(dst, sample []byte, sync bool) ([]byte, error) {
+	var nals [][]byte
+	inBand := false
+	for data := sample; len(data) > 0; {
+		if len(data) < s.lengthSize {
+			return nil, ErrFileIsNotValid
+		}
+		var size int
+		for _, b := range data[:s.lengthSize] {
+			size = size<<8 | int(b)
+		}
+		data = data[s.lengthSize:]
+		if size == 0 || size > len(data) {
+			return nil, ErrFileIsNotValid
+		}
+		nals = append(nals, data[:size])
+		inBand = inBand || s.isParameterSet(data[:size])
+		data = data[size:]
+	}
+	if sync && !inBand {
+		for _, ps := range s.parameterSets {
+			dst = append(append(dst, annexBStartCode...), ps...)
+		}
+	}
+	for _, nal := range nals {
+		dst = append(append(dst, annexBStartCode...), nal...)
+	}
+	return dst, nil
+}
+
+// adtsStream добавление к сэмплам AAC заголовков ADTS
+type adtsStream struct {
+	profile   byte // профиль AAC (тип объекта минус 1)
+	frequency byte // индекс частоты дискретизации
+	channels  byte // конфигурация каналов
+}
+
+// newADTSStream разбор AudioSpecificConfig из дескриптора потока MPEG-4 (esds)
+func newADTSStream(esds *Box) (*adtsStream, error) {
+	if esds == nil || len(esds.Data) < 4 {
+		return nil, ErrFileCodecNotSupported
+	}
+	tag, es, ok := readDescriptor(esds.Data[4:])
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return nil, ErrFileIsNotValid
+	}
+	// ES_Descriptor: идентификатор потока, флаги и необязательные поля
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 && len(es) >= 2 {
+		es = es[2:]
+	}
+	if flags&0x40 != 0 && len(es) >= 1 && len(es) >= 1+int(es[0]) {
+		es = es[1+int(es[0]):]
+	}
+	if flags&0x20 != 0 && len(es) >= 2 {
+		es = es[2:]
+	}
+	tag, config, ok := readDescriptor(es)
+	if !ok || tag != 0x04 || len(config) < 13 {
+		return nil, ErrFileIsNotValid
+	}
+	// DecoderConfigDescriptor: 0x40 - звук MPEG-4 (AAC)
+	if config[0] != 0x40 {
+		return nil, ErrFileCodecNotSupported
+	}
+	tag, asc, ok := readDescriptor(config[13:])
+	if !ok || tag != 0x05 || len(asc) < 2 {
+		return nil, ErrFileIsNotValid
+	}
+	objectType := asc[0] >> 3
+	frequency := (asc[0]&0x7)<<1 | asc[1]>>7
+	channels := asc[1] >> 3 & 0xF
+	// в заголовке ADTS профиль занимает 2 бита, частота задается только индексом
+	if objectType < 1 || objectType > 4 || int(frequency) >= len(adtsFrequencies) || channels > 7 {
+		return nil, ErrFileCodecNotSupported
+	}
+	return &adtsStream{profile: objectType - 1, frequency: frequency, channels: channels}, nil
+}
+
+// readDescriptor чтение дескриптора MPEG-4 (тег, длина переменного размера, содержимое)
+func readDescriptor(data []byte) (tag byte, body []byte, ok bool) {
+	if len(data) < 2 {
+		return 0, nil, false
+	}
+	tag = data[0]
+	// длина занимает не более 4 байтов, в последнем байте длины старший бит сброшен
+	size, i, last := 0, 1, false
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7F)
+		if data[i]&0x80 == 0 {
+			last = true
+			break
+		}
+	}
+	i++
+	if !last || size > len(data)-i {
+		return 0, nil, false
+	}
+	return tag, data[i : i+size], true
+}
+
+// convert добавление 7-байтного заголовка ADTS (без контрольной суммы)
+func (a *adtsStream) convert(dst, sample []byte, sync bool) ([]byte, error) {
+	size := len(sample) + 7
+	if size > 0x1FFF {
+		return nil, ErrFileIsNotValid
+	}
+	dst = append(dst,
+		0xFF,
+		0xF1, // MPEG-4, без контрольной суммы
+		a.profile<<6|a.frequency<<2|a.channels>>2,
+		a.channels&0x3<<6|byte(size>>11),
+		byte(size>>3),
+		byte(size&0x7)<<5|0x1F, // заполненность буфера 0x7FF - переменный битрейт
+		0xFC,                   // один блок AAC в кадре
+	)
+	return append(dst, sample...), nil
+}
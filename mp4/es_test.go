@@ -0,0 +1,116 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка выгрузки элементарных потоков H.264 (Annex B) и AAC (ADTS)
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}
+	testPPS = []byte{0x68, 0xEE, 0x3C, 0x80}
+)
+
+// testStreamMovie файл из дорожки H.264 с конфигурацией avcC (4-байтные поля длины NAL-блоков)
+// и дорожки AAC-LC 44100 Гц, стерео с дескриптором esds
+func testStreamMovie(t *testing.T) []byte {
+	avcC := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, byte(len(testSPS))}
+	avcC = append(append(avcC, testSPS...), 0x01, 0x00, byte(len(testPPS)))
+	avcC = append(avcC, testPPS...)
+	video := testTrack{handler: "vide", timeScale: 12800, duration: 512, syncEvery: 2, config: NewBox("avcC", avcC),
+		payloads: [][]byte{
+			// ключевой кадр без наборов параметров
+			{0, 0, 0, 3, 0x65, 0x88, 0x84},
+			// два среза неключевого кадра
+			{0, 0, 0, 2, 0x41, 0x9A, 0, 0, 0, 2, 0x41, 0x9B},
+			// ключевой кадр с собственным SPS
+			{0, 0, 0, 2, 0x67, 0x42, 0, 0, 0, 2, 0x65, 0x11},
+		}}
+	esds := []byte{
+		0, 0, 0, 0,
+		0x03, 25, 0x00, 0x01, 0x00, // ES_Descriptor
+		0x04, 17, 0x40, 0x15, 0, 0, 0, 0, 0x01, 0xF4, 0x00, 0, 0x01, 0xF4, 0x00, // DecoderConfigDescriptor
+		0x05, 2, 0x12, 0x10, // AudioSpecificConfig: AAC-LC, 44100 Гц, 2 канала
+		0x06, 1, 0x02, // SLConfigDescriptor
+	}
+	audio := testTrack{handler: "soun", timeScale: 44100, duration: 1024, config: NewBox("esds", esds),
+		payloads: [][]byte{{0x21, 0x10, 0x05}, {0x21, 0x1B, 0x94, 0x00}}}
+	for _, track := range []*testTrack{&video, &audio} {
+		for _, p := range track.payloads {
+			track.sizes = append(track.sizes, uint32(len(p)))
+		}
+	}
+	return buildTestMovie(t, video, audio)
+}
+
+func TestExportStream(t *testing.T) {
+	data := testStreamMovie(t)
+	annexB := []byte{
+		0, 0, 0, 1, 0x67, 0x64, 0x00, 0x1F, 0xAC,
+		0, 0, 0, 1, 0x68, 0xEE, 0x3C, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84,
+		0, 0, 0, 1, 0x41, 0x9A,
+		0, 0, 0, 1, 0x41, 0x9B,
+		0, 0, 0, 1, 0x67, 0x42,
+		0, 0, 0, 1, 0x65, 0x11,
+	}
+	adts := []byte{
+		0xFF, 0xF1, 0x50, 0x80, 0x01, 0x5F, 0xFC, 0x21, 0x10, 0x05,
+		0xFF, 0xF1, 0x50, 0x80, 0x01, 0x7F, 0xFC, 0x21, 0x1B, 0x94, 0x00,
+	}
+	tests := []struct {
+		trackID uint32
+		want    []byte
+	}{
+		{0, annexB},
+		{1, annexB},
+		{2, adts},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := ExportStream(bytes.NewReader(data), &out, test.trackID); err != nil {
+			t.Fatalf("дорожка %d: %v", test.trackID, err)
+		}
+		if !bytes.Equal(out.Bytes(), test.want) {
+			t.Fatalf("дорожка %d:\n% X\nвместо\n% X", test.trackID, out.Bytes(), test.want)
+		}
+	}
+}
+
+func TestExportStreamErrors(t *testing.T) {
+	// описания сэмплов testMovie не содержат конфигурации декодера
+	if err := ExportStream(bytes.NewReader(testMovie(t)), new(bytes.Buffer), 0); err != ErrFileCodecNotSupported {
+		t.Fatalf("ошибка %v вместо %v", err, ErrFileCodecNotSupported)
+	}
+	if err := ExportStream(bytes.NewReader(testStreamMovie(t)), new(bytes.Buffer), 3); err != ErrTrackNotFound {
+		t.Fatalf("ошибка %v вместо %v", err, ErrTrackNotFound)
+	}
+}
+
+func TestReadDescriptor(t *testing.T) {
+	tests := []struct {
+		data []byte
+		tag  byte
+		body []byte
+		ok   bool
+	}{
+		{[]byte{0x05, 0x02, 0x12, 0x10}, 0x05, []byte{0x12, 0x10}, true},
+		// длина в расширенной записи 0x80 0x80 0x80 0x02
+		{[]byte{0x05, 0x80, 0x80, 0x80, 0x02, 0x12, 0x10}, 0x05, []byte{0x12, 0x10}, true},
+		{[]byte{0x05, 0x03, 0x12, 0x10}, 0, nil, false},
+		{[]byte{0x05}, 0, nil, false},
+		// длина длиннее 4 байтов и длина без последнего байта
+		{[]byte{0x05, 0x80, 0x80, 0x80, 0x80, 0x00, 0x12}, 0, nil, false},
+		{[]byte{0x05, 0x81}, 0, nil, false},
+	}
+	for _, test := range tests {
+		tag, body, ok := readDescriptor(test.data)
+		if tag != test.tag || !bytes.Equal(body, test.body) || ok != test.ok {
+			t.Fatalf("% X: %X % X %v вместо %X % X %v", test.data, tag, body, ok, test.tag, test.body, test.ok)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор метаданных Exif: каталоги TIFF основного изображения, Exif и GPS
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Типы значений полей TIFF
+const (
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+// Указатели на вложенные каталоги
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// exifTags наименования выводимых полей основного каталога и каталога Exif
+var exifTags = map[uint16]string{
+	0x010F: "Make", 0x0110: "Model", 0x0112: "Orientation", 0x0131: "Software", 0x0132: "DateTime",
+	0x013B: "Artist", 0x8298: "Copyright", 0x829A: "ExposureTime", 0x829D: "FNumber", 0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal", 0x9004: "DateTimeDigitized", 0x9010: "OffsetTime", 0x920A: "FocalLength",
+	0xA002: "PixelXDimension", 0xA003: "PixelYDimension", 0xA433: "LensMake", 0xA434: "LensModel",
+}
+
+// gpsTags наименования выводимых полей каталога GPS
+var gpsTags = map[uint16]string{
+	0x0001: "GPSLatitudeRef", 0x0002: "GPSLatitude", 0x0003: "GPSLongitudeRef", 0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef", 0x0006: "GPSAltitude", 0x001D: "GPSDateStamp",
+}
+
+// tiffSizes размеры значений по типу поля (байт)
+var tiffSizes = map[uint16]int{1: 1, tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8, 7: 1, tiffSLong: 4, tiffSRational: 8}
+
+// exifReader разбор данных TIFF с учетом порядка байтов
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+	tags  map[string]string
+	seen  map[uint32]bool // разобранные каталоги (защита от зацикливания ссылок)
+}
+
+// parseExif разбор данных Exif, начинающихся с заголовка TIFF
+func parseExif(data []byte) map[string]string {
+	if len(data) < 8 {
+		return nil
+	}
+	e := &exifReader{data: data, tags: make(map[string]string), seen: make(map[uint32]bool)}
+	switch string(data[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil
+	}
+	if e.order.Uint16(data[2:]) != 42 {
+		return nil
+	}
+	e.readIFD(e.order.Uint32(data[4:]), exifTags)
+	if len(e.tags) == 0 {
+		return nil
+	}
+	return e.tags
+}
+
+// readIFD разбор каталога по смещению от начала заголовка TIFF
+func (e *exifReader) readIFD(offset uint32, names map[uint16]string) {
+	if e.seen[offset] || uint64(offset)+2 > uint64(len(e.data)) {
+		return
+	}
+	e.seen[offset] = true
+	count := int(e.order.Uint16(e.data[offset:]))
+	entries := e.data[offset+2:]
+	for i := 0; i < count && len(entries) >= 12; i, entries = i+1, entries[12:] {
+		tag := e.order.Uint16(entries)
+		switch tag {
+		case exifIFDPointer:
+			e.readIFD(e.order.Uint32(entries[8:]), exifTags)
+			continue
+		case gpsIFDPointer:
+			e.readIFD(e.order.Uint32(entries[8:]), gpsTags)
+			continue
+		}
+		name, ok := names[tag]
+		if !ok {
+			continue
+		}
+		if value, ok := e.value(entries); ok {
+			e.tags[name] = value
+		}
+	}
+}
+
+// value значение поля в текстовом виде (несколько значений - через пробел)
+func (e *exifReader) value(entry []byte) (string, bool) {
+	kind := e.order.Uint16(entry[2:])
+	count := e.order.Uint32(entry[4:])
+	size, ok := tiffSizes[kind]
+	if !ok || count == 0 || uint64(count)*uint64(size) > uint64(len(e.data)) {
+		return "", false
+	}
+	// значения размером до 4 байт хранятся в самом поле, иначе - по смещению
+	data := entry[8:12]
+	if total := int(count) * size; total > 4 {
+		offset := e.order.Uint32(entry[8:])
+		if uint64(offset)+uint64(total) > uint64(len(e.data)) {
+			return "", false
+		}
+		data = e.data[offset : int(offset)+total]
+	}
+	if kind == tiffASCII {
+		return strings.TrimRight(string(data[:count]), "\x00 "), true
+	}
+	values := make([]string, 0, count)
+	for i := 0; i < int(count); i++ {
+		item := data[i*size:]
+		switch kind {
+		case tiffShort:
+			values = append(values, fmt.Sprint(e.order.Uint16(item)))
+		case tiffLong:
+			values = append(values, fmt.Sprint(e.order.Uint32(item)))
+		case tiffSLong:
+			values = append(values, fmt.Sprint(int32(e.order.Uint32(item))))
+		case tiffRational, tiffSRational:
+			numerator, denominator := float64(e.order.Uint32(item)), float64(e.order.Uint32(item[4:]))
+			if kind == tiffSRational {
+				numerator, denominator = float64(int32(e.order.Uint32(item))), float64(int32(e.order.Uint32(item[4:])))
+			}
+			if denominator == 0 {
+				return "", false
+			}
+			values = append(values, fmt.Sprintf("%g", numerator/denominator))
+		default:
+			values = append(values, fmt.Sprint(item[0]))
+		}
+	}
+	return strings.Join(values, " "), true
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Извлечение отдельных медиадорожек в самостоятельный файл MP4/M4A
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// trackKinds типы дорожек и соответствующие им обработчики (hdlr)
+var trackKinds = map[string]string{
+	"video":    "vide",
+	"audio":    "soun",
+	"subtitle": "subt",
+	"text":     "text",
+	"hint":     "hint",
+	"meta":     "meta",
+}
+
+// TrackSelection выбор извлекаемых дорожек: по идентификатору (tkhd) или по типу
+type TrackSelection struct {
+	IDs   []uint32 // идентификаторы дорожек
+	Kinds []string // типы дорожек: video, audio, subtitle, text, hint, meta или код обработчика ('vide', 'soun', ...)
+}
+
+// Add добавление в выбор дорожек, перечисленных через запятую: номер - идентификатор дорожки, иначе - тип
+func (s *TrackSelection) Add(list string) error {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(item, 10, 32); err == nil {
+			s.IDs = append(s.IDs, uint32(id))
+			continue
+		}
+		if _, ok := trackKinds[item]; !ok && len(item) != 4 {
+			return NewAPIError("неизвестный тип дорожки: "+item, nil)
+		}
+		s.Kinds = append(s.Kinds, item)
+	}
+	return nil
+}
+
+// matches попадает ли дорожка в выбор
+func (s TrackSelection) matches(t *mediaTrack) bool {
+	for _, id := range s.IDs {
+		if id == t.ID {
+			return true
+		}
+	}
+	for _, kind := range s.Kinds {
+		if handler, ok := trackKinds[kind]; ok && handler == t.Handler || kind == t.Handler {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract копирование выбранных дорожек файла r в новый файл w: moov содержит только выбранные
+// дорожки, mdat - только их сэмплы. Файл только со звуковыми дорожками записывается как M4A
+func Extract(r io.ReadSeeker, w io.Writer, sel TrackSelection) error {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return err
+	}
+	selected := make(map[uint32]bool)
+	var kept []*mediaTrack
+	for _, t := range m.tracks {
+		if sel.matches(t) {
+			kept = append(kept, t)
+			selected[t.ID] = true
+		}
+	}
+	for _, id := range sel.IDs {
+		if !selected[id] {
+			return ErrTrackNotFound
+		}
+	}
+	if len(kept) == 0 {
+		return ErrTrackNotFound
+	}
+	children := m.movie.Children[:0]
+	for _, c := range m.movie.Children {
+		// дескриптор объектов MPEG-4 (iods) ссылается на дорожки исходного файла
+		if c.Type == "iods" || c.Type == "trak" && !isSelectedTrack(c, kept) {
+			continue
+		}
+		children = append(children, c)
+	}
+	m.movie.Children = children
+	for _, t := range kept {
+		filterTrackReferences(t.trak, selected)
+	}
+	ftyp := m.fileType()
+	audioOnly := true
+	for _, t := range kept {
+		audioOnly = audioOnly && t.Handler == "soun"
+	}
+	if audioOnly {
+		ftyp = newFileType("M4A ", "M4A ", "mp42", "isom")
+	}
+	return writeProgressive(w, m.src, ftyp, m.movie, kept)
+}
+
+// isSelectedTrack является ли блок trak одной из выбранных дорожек
+func isSelectedTrack(trak *Box, tracks []*mediaTrack) bool {
+	for _, t := range tracks {
+		if t.trak == trak {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTrackReferences удаление из ссылок на другие дорожки (tref) ссылок на неизвлекаемые дорожки
+func filterTrackReferences(trak *Box, selected map[uint32]bool) {
+	tref := trak.Child("tref")
+	if tref == nil || !tref.IsContainer() {
+		trak.Remove("tref")
+		return
+	}
+	references := tref.Children[:0]
+	for _, ref := range tref.Children {
+		var ids []byte
+		for i := 0; i+4 <= len(ref.Data); i += 4 {
+			if selected[binary.BigEndian.Uint32(ref.Data[i:])] {
+				ids = append(ids, ref.Data[i:i+4]...)
+			}
+		}
+		if len(ids) > 0 {
+			ref.SetData(ids)
+			references = append(references, ref)
+		}
+	}
+	tref.Children = references
+	if len(references) == 0 {
+		trak.Remove("tref")
+	}
+}
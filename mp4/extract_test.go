@@ -0,0 +1,68 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка извлечения отдельных медиадорожек
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtractTracks(t *testing.T) {
+	data := testMovie(t)
+	src := readTestMovie(t, data)
+	tests := []struct {
+		list   string // выбор дорожек
+		tracks []int  // номера извлекаемых дорожек исходного файла (начиная с 1)
+		brand  string // основной бренд результата
+	}{
+		{"video", []int{1}, "isom"},
+		{"audio", []int{2}, "M4A "},
+		{"soun", []int{2}, "M4A "},
+		{"2", []int{2}, "M4A "},
+		{"1, audio", []int{1, 2}, "isom"},
+	}
+	for _, test := range tests {
+		var sel TrackSelection
+		if err := sel.Add(test.list); err != nil {
+			t.Fatalf("%q: %v", test.list, err)
+		}
+		var out bytes.Buffer
+		if err := Extract(bytes.NewReader(data), &out, sel); err != nil {
+			t.Fatalf("%q: %v", test.list, err)
+		}
+		got := readTestMovie(t, out.Bytes())
+		if len(got.tracks) != len(test.tracks) {
+			t.Fatalf("%q: %d дорожек вместо %d", test.list, len(got.tracks), len(test.tracks))
+		}
+		for i, n := range test.tracks {
+			want := src.tracks[n-1]
+			if got.tracks[i].ID != want.ID || got.tracks[i].Handler != want.Handler {
+				t.Fatalf("%q: дорожка %d (%s) вместо %d (%s)", test.list, got.tracks[i].ID, got.tracks[i].Handler, want.ID, want.Handler)
+			}
+			compareSamples(t, n, src, want.Samples, got, got.tracks[i].Samples)
+		}
+		ftyp, err := got.boxes[findBox(got.boxes, "ftyp")].Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if brand := string(ftyp[:4]); brand != test.brand {
+			t.Fatalf("%q: бренд %q вместо %q", test.list, brand, test.brand)
+		}
+	}
+}
+
+func TestExtractUnknownTrack(t *testing.T) {
+	data := testMovie(t)
+	for _, sel := range []TrackSelection{{IDs: []uint32{3}}, {IDs: []uint32{1, 3}}, {Kinds: []string{"subtitle"}}} {
+		if err := Extract(bytes.NewReader(data), new(bytes.Buffer), sel); err != ErrTrackNotFound {
+			t.Fatalf("%+v: ошибка %v вместо %v", sel, err, ErrTrackNotFound)
+		}
+	}
+	var sel TrackSelection
+	if err := sel.Add("video,faces"); err == nil {
+		t.Fatal("неизвестный тип дорожки принят")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Перенос блока описания контейнера (moov) в начало файла для прогрессивного воспроизведения
+package mp4
+
+import (
+	"io"
+)
+
+// seekReaderAt адаптер, позволяющий читать произвольные участки потока с поддержкой перемещения
+type seekReaderAt struct {
+	r io.ReadSeeker
+}
+
+// ReadAt чтение участка потока, начинающегося с позиции off
+func (s seekReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if _, err = s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, p)
+}
+
+// newSource подготовка потока к произвольному доступу, возвращает размер потока (байт)
+func newSource(r io.ReadSeeker) (io.ReaderAt, int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, NewAPIError("ошибка при подготовке файла", err)
+	}
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra, size, nil
+	}
+	return seekReaderAt{r}, size, nil
+}
+
+// Faststart перенос блока moov перед блоками медиаданных (mdat) с пересчетом смещений чанков
+// в таблицах stco/co64. Если смещения перестают помещаться в 32 бита, таблица stco заменяется на co64.
+// Содержимое блоков mdat копируется потоком без загрузки в память
+func Faststart(r io.ReadSeeker, w io.Writer) error {
+	boxes, err := ReadBoxes(r)
+	if err != nil {
+		return err
+	}
+	if findBox(boxes, "moof") >= 0 {
+		return ErrFragmentedNotSupported
+	}
+	movieIndex := findBox(boxes, "moov")
+	if movieIndex < 0 {
+		return ErrMovieNotFound
+	}
+	// новый порядок блоков: moov располагается непосредственно перед первым блоком mdat
+	var layout []*Box
+	placed := false
+	for i, b := range boxes {
+		if i == movieIndex {
+			continue
+		}
+		if b.Type == "mdat" && !placed {
+			layout = append(layout, boxes[movieIndex])
+			placed = true
+		}
+		layout = append(layout, b)
+	}
+	if !placed {
+		// блоков медиаданных нет - оставляем moov на прежнем месте
+		layout = boxes
+	}
+	return writeRelocated(w, layout)
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка записи дерева блоков и переноса блока moov в начало файла
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteBoxesRoundTrip(t *testing.T) {
+	data := testMovie(t)
+	boxes, err := ReadBoxes(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = WriteBoxes(&out, boxes); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("файл после чтения и записи дерева блоков отличается от исходного")
+	}
+}
+
+func TestFaststart(t *testing.T) {
+	data := testMovie(t)
+	var out bytes.Buffer
+	if err := Faststart(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != len(data) {
+		t.Fatalf("размер файла %d вместо %d", out.Len(), len(data))
+	}
+	boxes, err := ReadBoxes(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moov, mdat := findBox(boxes, "moov"), findBox(boxes, "mdat"); moov < 0 || moov > mdat {
+		t.Fatal("блок moov не перенесен в начало файла")
+	}
+	compareChunks(t, data, out.Bytes())
+}
+
+func TestFaststartLargeOffsets(t *testing.T) {
+	// смещения чанков за пределами 4 ГБ не помещаются в stco и записываются в co64
+	boxes, err := ReadBoxes(bytes.NewReader(testMovie(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie := boxes[findBox(boxes, "moov")]
+	tables, err := readChunkOffsetTables(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const shift = 1 << 32
+	for _, table := range tables {
+		if err = table.relocate(func(offset uint64) (uint64, bool) { return offset + shift, true }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	co64 := movie.FindAll("trak/mdia/minf/stbl/co64")
+	if len(co64) != len(tables) {
+		t.Fatal("таблицы stco не заменены на co64")
+	}
+	for i, b := range co64 {
+		offsets, err := parseChunkOffsets(b)
+		if err != nil || len(offsets) != len(tables[i].offsets) || offsets[0] != tables[i].offsets[0]+shift {
+			t.Fatalf("смещения co64: %v, %v", offsets, err)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор файлов FLV: поток тегов, метаданные onMetaData (AMF0), заголовки AVC/HEVC и AAC
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Типы тегов FLV
+const (
+	flvTagAudio  = 8
+	flvTagVideo  = 9
+	flvTagScript = 18
+)
+
+// Коды форматов FLV
+const (
+	flvCodecAVC   = 7  // H.264
+	flvCodecHEVC  = 12 // HEVC (нестандартное расширение)
+	flvFormatAAC  = 10 // AAC
+	flvKeyFrame   = 1  // тип кадра: ключевой
+	flvExHeader   = 0x80
+	flvHeaderSize = 9
+	maxFLVTagSize = 16 << 20 // наибольший размер тега, загружаемого в память (байт)
+	maxAMFDepth   = 16       // наибольшая вложенность значений AMF0
+)
+
+// flvVideoCodecs наименования видеокодеков FLV
+var flvVideoCodecs = map[byte]string{
+	2: "Sorenson H.263", 3: "Screen Video", 4: "On2 VP6", 5: "On2 VP6 Alpha", 6: "Screen Video 2",
+	flvCodecAVC: "H.264", flvCodecHEVC: "HEVC",
+}
+
+// flvAudioFormats наименования аудиоформатов FLV
+var flvAudioFormats = map[byte]string{
+	0: "PCM", 1: "ADPCM", 2: "MP3", 3: "PCM", 4: "Nellymoser", 5: "Nellymoser", 6: "Nellymoser",
+	7: "G.711 A-law", 8: "G.711 mu-law", flvFormatAAC: "AAC", 11: "Speex", 14: "MP3",
+}
+
+// flvAudioRates частоты дискретизации по 2-битному коду заголовка аудиотега (Гц)
+var flvAudioRates = []uint32{5512, 11025, 22050, 44100}
+
+// flvFile состояние разбора файла FLV
+type flvFile struct {
+	r         *bufio.Reader
+	pos       int64                  // количество прочитанных байт
+	metaData  map[string]interface{} // значения onMetaData
+	video     *flvTrack
+	audio     *flvTrack
+	keyFrames []Cue // ключевые кадры по видеотегам
+	lastTime  uint32
+}
+
+// flvTrack сведения о потоке, собранные по тегам
+type flvTrack struct {
+	codec     byte
+	format    string
+	info      codecInfo
+	tags      int
+	keyFrames int
+	bytes     int64
+	first     uint32 // время первого тега (мс)
+	last      uint32 // время последнего тега (мс)
+	stereo    bool
+}
+
+// isFLV является ли начало потока заголовком файла FLV
+func isFLV(header []byte) bool {
+	return len(header) >= 4 && string(header[:3]) == "FLV" && header[3] == 1
+}
+
+// readFLV разбор файла FLV из потока
+func (f *VideoFile) readFLV(r *bufio.Reader) error {
+	fl := &flvFile{r: r}
+	header := make([]byte, flvHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || !isFLV(header) {
+		return ErrFileIsNotValid
+	}
+	fl.pos = flvHeaderSize
+	// заголовок может быть длиннее 9 байт, за ним следует размер предыдущего тега (0)
+	offset := int64(binary.BigEndian.Uint32(header[5:]))
+	if offset < flvHeaderSize {
+		return ErrFileIsNotValid
+	}
+	if err := fl.skip(offset - flvHeaderSize + 4); err != nil {
+		return ErrFileIsNotValid
+	}
+	tagHeader := make([]byte, 11)
+	for {
+		position := fl.pos
+		n, err := io.ReadFull(r, tagHeader)
+		fl.pos += int64(n)
+		// обрезанный последний тег не учитывается
+		if err != nil {
+			break
+		}
+		kind := tagHeader[0] & 0x1F
+		size := int64(tagHeader[1])<<16 | int64(tagHeader[2])<<8 | int64(tagHeader[3])
+		timestamp := uint32(tagHeader[7])<<24 | uint32(tagHeader[4])<<16 | uint32(tagHeader[5])<<8 | uint32(tagHeader[6])
+		// зашифрованные теги (признак фильтра) разбираются только по заголовку
+		filtered := tagHeader[0]&0x20 != 0
+		var data []byte
+		if (kind == flvTagScript || !filtered) && size <= maxFLVTagSize {
+			// из тегов медиаданных нужны только первые байты и заголовки декодера
+			head := size
+			if kind != flvTagScript && head > 512 {
+				head = 512
+			}
+			if data, err = fl.read(head); err != nil {
+				break
+			}
+			size -= head
+		}
+		if err = fl.skip(size + 4); err != nil && err != io.EOF {
+			break
+		}
+		switch kind {
+		case flvTagScript:
+			fl.readScript(data)
+		case flvTagVideo:
+			fl.readVideoTag(data, timestamp, position, size+int64(len(data)))
+		case flvTagAudio:
+			fl.readAudioTag(data, timestamp, size+int64(len(data)))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if fl.video == nil && fl.audio == nil && fl.metaData == nil {
+		return ErrNoSamples
+	}
+	fl.fill(f)
+	f.Codec = "FLV"
+	f.Size = int(fl.pos)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// read чтение size байт
+func (fl *flvFile) read(size int64) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := io.ReadFull(fl.r, data)
+	fl.pos += int64(n)
+	return data, err
+}
+
+// skip пропуск size байт
+func (fl *flvFile) skip(size int64) error {
+	n, err := fl.r.Discard(int(size))
+	fl.pos += int64(n)
+	return err
+}
+
+// track сведения о потоке, создаваемые при первом теге
+func (fl *flvFile) track(t **flvTrack, timestamp uint32) *flvTrack {
+	if *t == nil {
+		*t = &flvTrack{first: timestamp}
+	}
+	return *t
+}
+
+// count учет тега с медиаданными (теги с конфигурацией декодера не учитываются)
+func (fl *flvFile) count(t *flvTrack, timestamp uint32, size int64) {
+	t.tags++
+	t.bytes += size
+	if timestamp > t.last {
+		t.last = timestamp
+	}
+	if timestamp > fl.lastTime {
+		fl.lastTime = timestamp
+	}
+}
+
+// readVideoTag разбор видеотега: тип кадра, кодек и запись конфигурации декодера
+func (fl *flvFile) readVideoTag(data []byte, timestamp uint32, position, size int64) {
+	if len(data) < 1 {
+		return
+	}
+	t := fl.track(&fl.video, timestamp)
+	frameType := data[0] >> 4 & 0x7
+	var config []byte
+	hevc := false
+	if data[0]&flvExHeader != 0 {
+		// расширенный заголовок: тип пакета и код формата (hvc1, av01, vp09)
+		if len(data) < 5 {
+			return
+		}
+		fourCC := string(data[1:5])
+		t.format = fourCC
+		switch fourCC {
+		case "hvc1":
+			t.codec, t.format, hevc = flvCodecHEVC, flvVideoCodecs[flvCodecHEVC], true
+		case "avc1":
+			t.codec, t.format = flvCodecAVC, flvVideoCodecs[flvCodecAVC]
+		}
+		if data[0]&0xF == 0 {
+			config = data[5:]
+		}
+	} else {
+		t.codec = data[0] & 0xF
+		t.format = flvVideoCodecs[t.codec]
+		if t.format == "" {
+			t.format = fmt.Sprintf("codec %d", t.codec)
+		}
+		// AVC/HEVC: тип пакета (0 - конфигурация декодера) и смещение времени отображения
+		if (t.codec == flvCodecAVC || t.codec == flvCodecHEVC) && len(data) >= 5 && data[1] == 0 {
+			config, hevc = data[5:], t.codec == flvCodecHEVC
+		}
+	}
+	if config == nil {
+		fl.count(t, timestamp, size)
+		if frameType == flvKeyFrame {
+			t.keyFrames++
+			fl.keyFrames = append(fl.keyFrames, Cue{Time: float64(timestamp) / 1000, Track: 1, Position: uint64(position)})
+		}
+		return
+	}
+	if t.info.Width != 0 {
+		return
+	}
+	name := "avcC"
+	if hevc {
+		name = "hvcC"
+	}
+	t.info, _ = parseDecoderConfig(NewBox(name, config), hevc)
+}
+
+// readAudioTag разбор аудиотега: формат, частота, каналы и AudioSpecificConfig для AAC
+func (fl *flvFile) readAudioTag(data []byte, timestamp uint32, size int64) {
+	if len(data) < 1 {
+		return
+	}
+	t := fl.track(&fl.audio, timestamp)
+	t.codec = data[0] >> 4
+	t.format = flvAudioFormats[t.codec]
+	if t.format == "" {
+		t.format = fmt.Sprintf("format %d", t.codec)
+	}
+	t.stereo = data[0]&0x1 != 0
+	if t.info.SampleRate == 0 {
+		t.info.SampleRate = flvAudioRates[data[0]>>2&0x3]
+		// частоты Nellymoser 8/16 кГц и MP3 8 кГц задаются кодом формата
+		switch t.codec {
+		case 5, 14:
+			t.info.SampleRate = 8000
+		case 4:
+			t.info.SampleRate = 16000
+		}
+	}
+	// AAC: тип пакета 0 - AudioSpecificConfig, частота в заголовке тега всегда 44 кГц
+	if t.codec == flvFormatAAC && len(data) >= 2 && data[1] == 0 {
+		if info, ok := parseAudioSpecificConfig(data[2:]); ok {
+			t.info = info
+		}
+		return
+	}
+	fl.count(t, timestamp, size)
+}
+
+// readScript разбор тега сценария; используется только onMetaData
+func (fl *flvFile) readScript(data []byte) {
+	a := &amfReader{data: data}
+	name, ok := a.value(0).(string)
+	if !ok || name != "onMetaData" {
+		return
+	}
+	if values, ok := a.value(0).(map[string]interface{}); ok && fl.metaData == nil {
+		fl.metaData = values
+	}
+}
+
+// amfReader чтение значений AMF0
+type amfReader struct {
+	data []byte
+	err  bool
+}
+
+// next чтение n байт
+func (a *amfReader) next(n int) []byte {
+	if a.err || n > len(a.data) {
+		a.err = true
+		return nil
+	}
+	b := a.data[:n]
+	a.data = a.data[n:]
+	return b
+}
+
+// string чтение строки с 16-битной длиной
+func (a *amfReader) string() string {
+	size := a.next(2)
+	if size == nil {
+		return ""
+	}
+	return string(a.next(int(binary.BigEndian.Uint16(size))))
+}
+
+// properties чтение свойств объекта до маркера конца объекта (пустое имя и 0x09)
+func (a *amfReader) properties(depth int) map[string]interface{} {
+	values := make(map[string]interface{})
+	for !a.err && len(a.data) > 0 {
+		key := a.string()
+		if key == "" && len(a.data) > 0 && a.data[0] == 0x09 {
+			a.next(1)
+			break
+		}
+		values[key] = a.value(depth + 1)
+	}
+	return values
+}
+
+// value чтение значения: число, логическое, строка, объект, массив, дата
+func (a *amfReader) value(depth int) interface{} {
+	marker := a.next(1)
+	if marker == nil || depth > maxAMFDepth {
+		a.err = true
+		return nil
+	}
+	switch marker[0] {
+	case 0x00:
+		if b := a.next(8); b != nil {
+			return math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+	case 0x01:
+		if b := a.next(1); b != nil {
+			return b[0] != 0
+		}
+	case 0x02:
+		return a.string()
+	case 0x03:
+		return a.properties(depth)
+	case 0x08:
+		// ассоциативный массив: количество элементов не используется
+		a.next(4)
+		return a.properties(depth)
+	case 0x0A:
+		b := a.next(4)
+		if b == nil {
+			return nil
+		}
+		count := int(binary.BigEndian.Uint32(b))
+		var values []interface{}
+		for i := 0; i < count && !a.err; i++ {
+			values = append(values, a.value(depth+1))
+		}
+		return values
+	case 0x0B:
+		// дата: миллисекунды от 1970-01-01 и часовой пояс (не используется)
+		if b := a.next(10); b != nil {
+			ms := math.Float64frombits(binary.BigEndian.Uint64(b))
+			return time.UnixMilli(int64(ms)).UTC()
+		}
+	case 0x0C:
+		size := a.next(4)
+		if size != nil {
+			return string(a.next(int(binary.BigEndian.Uint32(size))))
+		}
+	case 0x05, 0x06:
+		return nil
+	default:
+		a.err = true
+	}
+	return nil
+}
+
+// number числовое значение метаданных
+func (fl *flvFile) number(key string) float64 {
+	v, _ := fl.metaData[key].(float64)
+	return v
+}
+
+// fill заполнение модели метаданных: значения onMetaData уточняются сведениями из тегов
+func (fl *flvFile) fill(f *VideoFile) {
+	movie := &f.Movie
+	movie.TimeScale = 1000
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	movie.Duration = fl.number("duration")
+	if d := float64(fl.lastTime) / 1000; d > movie.Duration {
+		movie.Duration = d
+	}
+	if created, ok := fl.metaData["creationdate"].(time.Time); ok {
+		movie.Created, movie.Modified = created, created
+	}
+	for key, value := range fl.metaData {
+		switch v := value.(type) {
+		case string:
+			if movie.Tags == nil {
+				movie.Tags = make(map[string]string)
+			}
+			movie.Tags[key] = v
+		case bool:
+			if movie.Tags == nil {
+				movie.Tags = make(map[string]string)
+			}
+			movie.Tags[key] = strconv.FormatBool(v)
+		}
+	}
+	movie.Cues = fl.metaDataKeyFrames()
+	if movie.Cues == nil {
+		movie.Cues = fl.keyFrames
+	}
+	if fl.video != nil || fl.number("width") > 0 {
+		t := fl.video
+		if t == nil {
+			t = &flvTrack{format: flvVideoCodecs[byte(fl.number("videocodecid"))]}
+		}
+		track := fl.newTrack(t, movie.Duration, fl.number("videodatarate"))
+		track.Width, track.Height = t.info.Width, t.info.Height
+		if track.Width == 0 {
+			track.Width, track.Height = uint32(fl.number("width")), uint32(fl.number("height"))
+		}
+		format := t.format
+		if t.info.Format != "" {
+			format = t.info.Format
+		}
+		rate := fl.number("framerate")
+		if rate == 0 && t.last > t.first && t.tags > 1 {
+			rate = float64(t.tags-1) * 1000 / float64(t.last-t.first)
+		}
+		track.Stream = &VideoStream{
+			Stream:     &Stream{TimeScale: 1000, Duration: track.Duration, Type: Video},
+			Format:     format,
+			Profile:    t.info.Profile,
+			ColorDepth: t.info.ColorDepth,
+			FrameRate:  nominalFrameRate(rate),
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+	if fl.audio != nil {
+		t := fl.audio
+		track := fl.newTrack(t, movie.Duration, fl.number("audiodatarate"))
+		channels := t.info.Channels
+		if channels == 0 {
+			channels = 1
+			if t.stereo {
+				channels = 2
+			}
+		}
+		format := t.format
+		if t.info.Format != "" {
+			format = t.info.Format
+		}
+		track.Stream = &AudioStream{
+			Stream:       &Stream{TimeScale: 1000, Duration: track.Duration, Type: Audio},
+			AudioBalance: "normal",
+			Format:       format,
+			Profile:      t.info.Profile,
+			Channels:     channelLayout(channels),
+			SampleRate:   t.info.SampleRate,
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+}
+
+// newTrack дорожка по сведениям из тегов; битрейт метаданных задан в Кбит/с
+func (fl *flvFile) newTrack(t *flvTrack, duration, dataRate float64) Track {
+	track := Track{Created: fl.fileCreated(), Duration: duration, Samples: t.tags, KeyFrames: t.keyFrames}
+	track.Modified = track.Created
+	if t.last > t.first {
+		track.Duration = float64(t.last-t.first) / 1000
+	}
+	switch {
+	case dataRate > 0:
+		track.Bitrate = uint64(dataRate * 1000)
+	case track.Duration > 0:
+		track.Bitrate = uint64(float64(t.bytes*8) / track.Duration)
+	}
+	return track
+}
+
+// fileCreated дата создания из метаданных
+func (fl *flvFile) fileCreated() time.Time {
+	created, _ := fl.metaData["creationdate"].(time.Time)
+	return created
+}
+
+// metaDataKeyFrames индекс ключевых кадров из onMetaData (keyframes: filepositions, times)
+func (fl *flvFile) metaDataKeyFrames() []Cue {
+	keyFrames, ok := fl.metaData["keyframes"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	positions, _ := keyFrames["filepositions"].([]interface{})
+	times, _ := keyFrames["times"].([]interface{})
+	var cues []Cue
+	for i := 0; i < len(positions) && i < len(times); i++ {
+		position, _ := positions[i].(float64)
+		seconds, _ := times[i].(float64)
+		cues = append(cues, Cue{Time: seconds, Track: 1, Position: uint64(position)})
+	}
+	return cues
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора файлов FLV
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// flvTag тег FLV с размером предыдущего тега после него
+func flvTag(kind byte, timestamp uint32, data []byte) []byte {
+	tag := []byte{kind, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	tag = append(tag, data...)
+	return binary.BigEndian.AppendUint32(tag, uint32(len(tag)))
+}
+
+// amfString строка AMF0 без маркера типа (имя свойства)
+func amfString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// amfNumber числовое значение AMF0
+func amfNumber(v float64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{0x00}, math.Float64bits(v))
+}
+
+// testFLV файл FLV: onMetaData, видеотеги Sorenson H.263 (ключевые кадры 0 и 80 мс) и звук AAC-LC 44100 Гц стерео
+func testFLV() (data []byte, keyFrames []uint64) {
+	meta := bytes.Join([][]byte{
+		{0x02}, amfString("onMetaData"),
+		{0x08, 0, 0, 0, 5},
+		amfString("duration"), amfNumber(2),
+		amfString("width"), amfNumber(320),
+		amfString("height"), amfNumber(240),
+		amfString("framerate"), amfNumber(25),
+		amfString("encoder"), {0x02}, amfString("Lavf"),
+		amfString("creationdate"), {0x0B}, binary.BigEndian.AppendUint64(nil, math.Float64bits(1.5e12)), {0, 0},
+		amfString(""), {0x09},
+	}, nil)
+	data = []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	data = append(data, flvTag(flvTagScript, 0, meta)...)
+	video := []struct {
+		timestamp uint32
+		frame     byte
+	}{{0, 0x12}, {40, 0x22}, {80, 0x12}}
+	for _, v := range video {
+		if v.frame>>4 == flvKeyFrame {
+			keyFrames = append(keyFrames, uint64(len(data)))
+		}
+		data = append(data, flvTag(flvTagVideo, v.timestamp, []byte{v.frame, 0, 0, 0, 0})...)
+		// конфигурация декодера AAC в первом аудиотеге
+		if v.timestamp == 0 {
+			data = append(data, flvTag(flvTagAudio, 0, []byte{0xAF, 0x00, 0x12, 0x10})...)
+		}
+		data = append(data, flvTag(flvTagAudio, v.timestamp+23, []byte{0xAF, 0x01, 0x21, 0x10})...)
+	}
+	return data, keyFrames
+}
+
+func TestFLV(t *testing.T) {
+	data, keyFrames := testFLV()
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	movie := f.Movie
+	created := time.UnixMilli(1.5e12).UTC()
+	if f.Codec != "FLV" || f.Size != len(data) || movie.Duration != 2 || !movie.Created.Equal(created) || movie.Tags["encoder"] != "Lavf" {
+		t.Fatalf("формат %q, размер %d, продолжительность %v, дата %v, теги %v", f.Codec, f.Size, movie.Duration, movie.Created, movie.Tags)
+	}
+	// индекс ключевых кадров по видеотегам
+	if len(movie.Cues) != len(keyFrames) {
+		t.Fatalf("%d ключевых кадров вместо %d", len(movie.Cues), len(keyFrames))
+	}
+	for i, cue := range movie.Cues {
+		if cue.Position != keyFrames[i] || cue.Time != float64(i)*0.08 {
+			t.Fatalf("ключевой кадр %d: %+v", i, cue)
+		}
+	}
+	if len(movie.Tracks) != 2 {
+		t.Fatalf("%d дорожек вместо 2", len(movie.Tracks))
+	}
+	track := movie.Tracks[0]
+	video, ok := track.Stream.(*VideoStream)
+	if !ok || track.Width != 320 || track.Height != 240 || track.Samples != 3 || track.KeyFrames != 2 ||
+		track.Duration != 0.08 || video.Format != "Sorenson H.263" || video.FrameRate == nil || video.FrameRate.Nominal != 25 {
+		t.Fatalf("видеодорожка %+v, поток %+v", track, track.Stream)
+	}
+	track = movie.Tracks[1]
+	audio, ok := track.Stream.(*AudioStream)
+	if !ok || track.Samples != 3 || audio.Format != "AAC" || audio.Profile != "LC" || audio.SampleRate != 44100 ||
+		audio.Channels != "Stereo" {
+		t.Fatalf("звуковая дорожка %+v, поток %+v", track, track.Stream)
+	}
+}
+
+func TestAMFDepth(t *testing.T) {
+	// вложенность объектов больше допустимой
+	data := append([]byte{0x03}, bytes.Repeat([]byte{0x00, 0x01, 'a', 0x03}, maxAMFDepth+2)...)
+	a := &amfReader{data: data}
+	a.value(0)
+	if !a.err {
+		t.Fatal("значение с чрезмерной вложенностью прочитано без ошибки")
+	}
+}
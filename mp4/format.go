@@ -0,0 +1,149 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Реестр поддерживаемых форматов контейнеров и выбор формата по первым байтам файла
+package mp4
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Оценки соответствия заголовка формату
+const (
+	ProbeNone     = 0        // заголовок не относится к формату
+	ProbeLow      = 25       // формат возможен, но заголовок не содержит сигнатуры
+	ProbeHigh     = 75       // заголовок содержит сигнатуру семейства форматов
+	ProbeExact    = 100      // заголовок содержит сигнатуру формата
+	probeSize     = 1024     // количество первых байтов файла, по которым выбирается формат
+	probeMinScore = ProbeLow // наименьшая оценка, при которой формат выбирается
+)
+
+// Format формат контейнера
+type Format interface {
+	// Name наименование формата
+	Name() string
+	// Probe оценка соответствия первых байтов файла формату (от ProbeNone до ProbeExact)
+	Probe(header []byte) int
+	// Parse разбор файла и получение его метаданных
+	Parse(r *bufio.Reader) (*VideoFile, error)
+}
+
+// containerFormat встроенный формат, разбираемый методом VideoFile
+type containerFormat struct {
+	name  string
+	probe func(header []byte) int
+	read  func(f *VideoFile, r *bufio.Reader) error
+}
+
+// Name наименование формата
+func (c containerFormat) Name() string {
+	return c.name
+}
+
+// Probe оценка соответствия первых байтов файла формату
+func (c containerFormat) Probe(header []byte) int {
+	return c.probe(header)
+}
+
+// Parse разбор файла и получение его метаданных
+func (c containerFormat) Parse(r *bufio.Reader) (*VideoFile, error) {
+	f := new(VideoFile)
+	if err := c.read(f, r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// signature оценка по наличию сигнатуры формата
+func signature(match func(header []byte) bool) func(header []byte) int {
+	return func(header []byte) int {
+		if match(header) {
+			return ProbeExact
+		}
+		return ProbeNone
+	}
+}
+
+// formats зарегистрированные форматы в порядке регистрации (при равной оценке выбирается первый)
+var (
+	formatsMu sync.RWMutex
+	formats   = []Format{
+		containerFormat{name: "MP4", probe: probeMP4, read: readMP4},
+		containerFormat{name: "Matroska", probe: signature(isMatroska), read: (*VideoFile).readMatroska},
+		containerFormat{name: "MPEG-TS", probe: signature(isTransportStream), read: (*VideoFile).readTransportStream},
+		containerFormat{name: "RIFF", probe: signature(isRIFF), read: (*VideoFile).readRIFF},
+		containerFormat{name: "FLV", probe: signature(isFLV), read: (*VideoFile).readFLV},
+		containerFormat{name: "Ogg", probe: signature(isOgg), read: (*VideoFile).readOgg},
+		containerFormat{name: "MPEG-PS", probe: signature(isProgramStream), read: (*VideoFile).readProgramStream},
+		containerFormat{name: "HEIF", probe: signature(isHEIF), read: (*VideoFile).readHEIF},
+	}
+)
+
+// RegisterFormat регистрация формата контейнера, формат с тем же наименованием заменяется
+func RegisterFormat(format Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	for i, registered := range formats {
+		if registered.Name() == format.Name() {
+			formats[i] = format
+			return
+		}
+	}
+	formats = append(formats, format)
+}
+
+// DetectFormat выбор формата с наибольшей оценкой по первым байтам потока (байты из потока не извлекаются)
+func DetectFormat(r *bufio.Reader) (Format, error) {
+	header, err := r.Peek(probeSize)
+	if err != nil && err != io.EOF {
+		return nil, NewAPIError("ошибка при получении файла", err)
+	}
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	var best Format
+	bestScore := probeMinScore - 1
+	for _, format := range formats {
+		if score := format.Probe(header); score > bestScore {
+			best, bestScore = format, score
+		}
+	}
+	if best == nil {
+		return nil, ErrFileIsNotValid
+	}
+	return best, nil
+}
+
+// probeMP4 оценка по первому блоку ISO BMFF: ftyp и moov - сигнатуры семейства форматов
+// (основанные на нем форматы, например HEIF, оцениваются выше), другие блоки верхнего уровня допустимы
+// (их проверяет CheckFile)
+func probeMP4(header []byte) int {
+	if len(header) < headerBlockSize {
+		return ProbeNone
+	}
+	switch string(header[4:headerBlockSize]) {
+	case "ftyp", "moov":
+		return ProbeHigh
+	case "mdat", "free", "skip", "wide", "pnot":
+		return ProbeLow
+	}
+	return ProbeNone
+}
+
+// readMP4 проверка файла MP4 и разбор блоков с метаданными
+func readMP4(f *VideoFile, r *bufio.Reader) error {
+	if err := f.CheckFile(r); err != nil {
+		return err
+	}
+	if err := f.Parse(); err != nil {
+		return err
+	}
+	// блок ftyp отсутствует в файлах QuickTime ранних версий
+	if f.MajorBrand == "" {
+		f.Codec, f.Profile = codecs["qt  "], brandProfiles["qt  "]
+	}
+	f.analyzeSamples()
+	return nil
+}
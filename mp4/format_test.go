@@ -0,0 +1,99 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка выбора формата контейнера по первым байтам файла
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// testFormat формат с сигнатурой magic, разбор которого возвращает файл с форматом codec
+type testFormat struct {
+	name  string
+	magic string
+	codec string
+}
+
+// Name наименование формата
+func (t testFormat) Name() string {
+	return t.name
+}
+
+// Probe оценка по сигнатуре
+func (t testFormat) Probe(header []byte) int {
+	if bytes.HasPrefix(header, []byte(t.magic)) {
+		return ProbeExact
+	}
+	return ProbeNone
+}
+
+// Parse разбор файла
+func (t testFormat) Parse(r *bufio.Reader) (*VideoFile, error) {
+	return &VideoFile{Codec: t.codec}, nil
+}
+
+// restoreFormats восстановление списка зарегистрированных форматов по окончании теста
+func restoreFormats(t *testing.T) {
+	formatsMu.RLock()
+	saved := append([]Format{}, formats...)
+	formatsMu.RUnlock()
+	t.Cleanup(func() {
+		formatsMu.Lock()
+		formats = saved
+		formatsMu.Unlock()
+	})
+}
+
+func TestDetectFormat(t *testing.T) {
+	flv, _ := testFLV()
+	tests := []struct {
+		data []byte
+		name string
+	}{
+		{testMovie(t), "MP4"},
+		{testWebM(), "Matroska"},
+		{testTransportStream(), "MPEG-TS"},
+		{testWave(), "RIFF"},
+		{flv, "FLV"},
+		{testOgg(), "Ogg"},
+		{testProgramStream(), "MPEG-PS"},
+		// файл MP4, начинающийся с mdat, выбирается по низкой оценке
+		{testMovie(t)[24:], "MP4"},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(test.data))
+		format, err := DetectFormat(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if format.Name() != test.name {
+			t.Fatalf("формат %s вместо %s", format.Name(), test.name)
+		}
+		// байты, по которым выбран формат, остаются в потоке
+		if header, _ := r.Peek(8); !bytes.Equal(header, test.data[:8]) {
+			t.Fatalf("%s: начало потока извлечено при выборе формата", test.name)
+		}
+	}
+	if _, err := DetectFormat(bufio.NewReader(bytes.NewReader([]byte("unknown data")))); err != ErrFileIsNotValid {
+		t.Fatalf("ошибка %v вместо %v", err, ErrFileIsNotValid)
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	restoreFormats(t)
+	RegisterFormat(testFormat{name: "Test", magic: "TEST", codec: "test"})
+	var f VideoFile
+	if err := f.Open(bytes.NewReader([]byte("TEST data"))); err != nil || f.Codec != "test" {
+		t.Fatalf("формат %q, ошибка %v", f.Codec, err)
+	}
+	// формат с тем же наименованием заменяет встроенный
+	RegisterFormat(testFormat{name: "FLV", magic: "FLV", codec: "replaced"})
+	data, _ := testFLV()
+	if err := f.Open(bytes.NewReader(data)); err != nil || f.Codec != "replaced" {
+		t.Fatalf("формат %q, ошибка %v", f.Codec, err)
+	}
+}
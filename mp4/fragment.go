@@ -0,0 +1,392 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Фрагментация файла MP4 (CMAF/fMP4): init-сегмент и медиасегменты из пар блоков moof/mdat
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// DefaultSegmentDuration продолжительность медиасегмента по умолчанию
+const DefaultSegmentDuration = 4 * time.Second
+
+// Флаги сэмплов во фрагментах (поле sample_flags)
+const (
+	syncSampleFlags    uint32 = 0x02000000 // не зависит от других сэмплов
+	nonSyncSampleFlags uint32 = 0x01010000 // зависит от других сэмплов и не является ключевым
+)
+
+// FragmentOptions параметры фрагментации
+type FragmentOptions struct {
+	SegmentDuration time.Duration // целевая продолжительность медиасегмента, сегменты начинаются с ключевых кадров
+	SegmentIndex    bool          // добавлять индекс сегментов (блок sidx)
+}
+
+// fragment медиасегмент: блок moof и сэмплы каждой медиадорожки, попадающие в сегмент
+type fragment struct {
+	moof    *Box       // блок описания фрагмента
+	samples [][]Sample // сэмплы медиадорожек в порядке следования дорожек
+	start   uint64     // время начала сегмента по опорной дорожке
+	end     uint64     // время окончания сегмента по опорной дорожке
+	sap     bool       // сегмент начинается с ключевого кадра опорной дорожки
+}
+
+// fragmenter разбиение файла на медиасегменты
+type fragmenter struct {
+	src       io.ReaderAt
+	movie     *Box
+	tracks    []*mediaTrack
+	reference *mediaTrack // опорная дорожка, по ключевым кадрам которой режутся сегменты
+	fragments []*fragment
+	opts      FragmentOptions
+}
+
+// Fragment преобразование файла r во фрагментированный файл w: init-сегмент (ftyp, moov с блоком mvex),
+// при необходимости индекс сегментов (sidx) и последовательность пар moof/mdat
+func Fragment(r io.ReadSeeker, w io.Writer, opts FragmentOptions) error {
+	fr, err := newFragmenter(r, opts)
+	if err != nil {
+		return err
+	}
+	layout := fr.initSegment()
+	if opts.SegmentIndex {
+		layout = append(layout, fr.segmentIndex(fr.fragments))
+	}
+	if err = WriteBoxes(w, layout); err != nil {
+		return err
+	}
+	for _, frag := range fr.fragments {
+		if err = fr.writeFragment(w, frag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FragmentSegments разбиение файла r на отдельные сегменты для DASH/HLS: init-сегмент записывается в init,
+// каждый медиасегмент (styp, sidx, moof, mdat) - в поток, возвращаемый функцией segment (номера сегментов с 1)
+func FragmentSegments(r io.ReadSeeker, init io.Writer, segment func(number int) (io.WriteCloser, error), opts FragmentOptions) error {
+	fr, err := newFragmenter(r, opts)
+	if err != nil {
+		return err
+	}
+	if err = WriteBoxes(init, fr.initSegment()); err != nil {
+		return err
+	}
+	brands := []string{"msdh"}
+	if opts.SegmentIndex {
+		brands = append(brands, "msix")
+	}
+	for i, frag := range fr.fragments {
+		w, err := segment(i + 1)
+		if err != nil {
+			return NewAPIError("ошибка записи сегмента", err)
+		}
+		layout := []*Box{newFileType("msdh", brands...)}
+		if opts.SegmentIndex {
+			layout = append(layout, fr.segmentIndex(fr.fragments[i:i+1]))
+		}
+		err = WriteBoxes(w, layout)
+		if err == nil {
+			err = fr.writeFragment(w, frag)
+		}
+		if closeErr := w.Close(); err == nil && closeErr != nil {
+			err = NewAPIError("ошибка записи сегмента", closeErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFragmenter чтение таблиц сэмплов и разбиение их на медиасегменты
+func newFragmenter(r io.ReadSeeker, opts FragmentOptions) (*fragmenter, error) {
+	src, size, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := readBoxTree(src, size)
+	if err != nil {
+		return nil, err
+	}
+	if findBox(boxes, "moof") >= 0 {
+		return nil, ErrFragmentedNotSupported
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		return nil, ErrMovieNotFound
+	}
+	if opts.SegmentDuration <= 0 {
+		opts.SegmentDuration = DefaultSegmentDuration
+	}
+	fr := &fragmenter{src: src, movie: boxes[index], opts: opts}
+	if fr.tracks, err = readMediaTracks(fr.movie, mediaDataSize(boxes)); err != nil {
+		return nil, err
+	}
+	for _, t := range fr.tracks {
+		if len(t.Samples) > 0 && (fr.reference == nil || t.Handler == "vide" && fr.reference.Handler != "vide") {
+			fr.reference = t
+		}
+	}
+	if fr.reference == nil {
+		return nil, ErrNoSamples
+	}
+	fr.split()
+	return fr, nil
+}
+
+// split разбиение сэмплов на сегменты: новый сегмент начинается с ключевого кадра опорной дорожки,
+// как только продолжительность текущего сегмента достигает целевой
+func (fr *fragmenter) split() {
+	ref := fr.reference
+	target := uint64(fr.opts.SegmentDuration.Seconds() * float64(ref.TimeScale))
+	var bounds []uint64
+	for i, s := range ref.Samples {
+		if i == 0 || s.Sync && s.DTS-bounds[len(bounds)-1] >= target {
+			bounds = append(bounds, s.DTS)
+		}
+	}
+	bounds = append(bounds, ref.duration())
+	next := make([]int, len(fr.tracks)) // номер первого не распределенного сэмпла каждой дорожки
+	for k := 0; k+1 < len(bounds); k++ {
+		frag := &fragment{start: bounds[k], end: bounds[k+1], samples: make([][]Sample, len(fr.tracks))}
+		last := k+2 == len(bounds)
+		for i, t := range fr.tracks {
+			first := next[i]
+			for next[i] < len(t.Samples) {
+				// сэмпл относится к сегменту, если время его декодирования меньше времени окончания сегмента
+				dts := t.Samples[next[i]].DTS
+				if !last && dts*uint64(ref.TimeScale) >= frag.end*uint64(t.TimeScale) {
+					break
+				}
+				next[i]++
+			}
+			frag.samples[i] = t.Samples[first:next[i]]
+		}
+		frag.sap = ref.Samples[0].Sync || k > 0
+		fr.fragments = append(fr.fragments, frag)
+	}
+	for i, frag := range fr.fragments {
+		frag.moof = fr.buildMovieFragment(uint32(i+1), frag)
+	}
+}
+
+// initSegment формирование init-сегмента: ftyp и moov без таблиц сэмплов, с описанием фрагментов (mvex)
+func (fr *fragmenter) initSegment() []*Box {
+	mvex := NewContainer("mvex", nil)
+	if duration, ok := movieDuration(fr.movie); ok {
+		mvex.Children = append(mvex.Children, NewBox("mehd", binary.BigEndian.AppendUint64([]byte{1, 0, 0, 0}, duration)))
+	}
+	for _, t := range fr.tracks {
+		stbl := t.trak.Find("mdia/minf/stbl")
+		stbl.Children = emptySampleTable(stbl.Child("stsd"))
+		// значения по умолчанию для сэмплов дорожки: описание сэмпла 1, остальное указывается в trun
+		trex := binary.BigEndian.AppendUint32(make([]byte, 4), t.ID)
+		trex = binary.BigEndian.AppendUint32(trex, 1)
+		trex = append(trex, make([]byte, 12)...)
+		mvex.Children = append(mvex.Children, NewBox("trex", trex))
+	}
+	fr.movie.Remove("mvex")
+	fr.movie.Children = append(fr.movie.Children, mvex)
+	return []*Box{newFileType("iso6", "iso6", "cmfc", "dash", "mp41"), fr.movie}
+}
+
+// buildMovieFragment формирование блока moof: mfhd и по одному traf (tfhd, tfdt, trun) на каждую дорожку
+func (fr *fragmenter) buildMovieFragment(sequence uint32, frag *fragment) *Box {
+	moof := NewContainer("moof", nil, NewBox("mfhd", binary.BigEndian.AppendUint32(make([]byte, 4), sequence)))
+	var runs []*Box
+	for i, t := range fr.tracks {
+		samples := frag.samples[i]
+		if len(samples) == 0 {
+			continue
+		}
+		// базовое смещение данных - начало блока moof
+		tfhd := NewBox("tfhd", binary.BigEndian.AppendUint32([]byte{0, 0x02, 0, 0}, t.ID))
+		tfdt := NewBox("tfdt", binary.BigEndian.AppendUint64([]byte{1, 0, 0, 0}, samples[0].DTS))
+		trun := newTrackRun(samples)
+		runs = append(runs, trun)
+		moof.Children = append(moof.Children, NewContainer("traf", nil, tfhd, tfdt, trun))
+	}
+	// смещения данных в trun отсчитываются от начала moof: данные дорожек следуют друг за другом в mdat
+	var dataSize int64
+	for _, samples := range frag.samples {
+		dataSize += samplesSize(samples)
+	}
+	offset := moof.Size() + mediaDataHeaderSize(dataSize)
+	n := 0
+	for _, samples := range frag.samples {
+		if len(samples) == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint32(runs[n].Data[8:], uint32(offset))
+		offset += samplesSize(samples)
+		n++
+	}
+	return moof
+}
+
+// newTrackRun формирование блока trun для последовательности сэмплов
+func newTrackRun(samples []Sample) *Box {
+	// присутствуют смещение данных, продолжительность, размер и флаги каждого сэмпла
+	flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400)
+	var version byte
+	for _, s := range samples {
+		if s.CTSOffset != 0 {
+			flags |= 0x000800
+		}
+		if s.CTSOffset < 0 {
+			version = 1
+		}
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(samples)))
+	data = binary.BigEndian.AppendUint32(data, 0) // смещение данных, заполняется после формирования moof
+	for _, s := range samples {
+		data = binary.BigEndian.AppendUint32(data, s.Duration)
+		data = binary.BigEndian.AppendUint32(data, s.Size)
+		data = binary.BigEndian.AppendUint32(data, s.flags())
+		if flags&0x000800 != 0 {
+			data = binary.BigEndian.AppendUint32(data, uint32(s.CTSOffset))
+		}
+	}
+	return NewBox("trun", data)
+}
+
+// flags флаги сэмпла во фрагменте
+func (s Sample) flags() uint32 {
+	if s.Sync {
+		return syncSampleFlags
+	}
+	return nonSyncSampleFlags
+}
+
+// writeFragment запись блока moof и блока mdat с сэмплами фрагмента, сэмплы копируются из исходного файла
+func (fr *fragmenter) writeFragment(w io.Writer, frag *fragment) error {
+	if _, err := frag.moof.WriteTo(w); err != nil {
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	return writeMediaData(w, fr.src, frag.samples...)
+}
+
+// segmentIndex формирование индекса сегментов (sidx) по опорной дорожке
+func (fr *fragmenter) segmentIndex(fragments []*fragment) *Box {
+	ref := fr.reference
+	index := 0
+	for i, t := range fr.tracks {
+		if t == ref {
+			index = i
+		}
+	}
+	// самое раннее время отображения в первом сегменте
+	earliest := int64(-1)
+	for _, s := range fragments[0].samples[index] {
+		if pts := int64(s.DTS) + int64(s.CTSOffset); earliest < 0 || pts < earliest {
+			earliest = pts
+		}
+	}
+	if earliest < 0 {
+		earliest = int64(fragments[0].start)
+	}
+	data := binary.BigEndian.AppendUint32([]byte{1, 0, 0, 0}, ref.ID)
+	data = binary.BigEndian.AppendUint32(data, ref.TimeScale)
+	data = binary.BigEndian.AppendUint64(data, uint64(earliest))
+	data = binary.BigEndian.AppendUint64(data, 0) // первый сегмент следует сразу за sidx
+	data = binary.BigEndian.AppendUint16(data, 0)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(fragments)))
+	for _, frag := range fragments {
+		var dataSize int64
+		for _, samples := range frag.samples {
+			dataSize += samplesSize(samples)
+		}
+		size := frag.moof.Size() + mediaDataHeaderSize(dataSize) + dataSize
+		data = binary.BigEndian.AppendUint32(data, uint32(size)&0x7FFFFFFF)
+		data = binary.BigEndian.AppendUint32(data, uint32(frag.end-frag.start))
+		sap := uint32(0)
+		if frag.sap {
+			sap = 0x90000000 // сегмент начинается с точки доступа типа 1
+		}
+		data = binary.BigEndian.AppendUint32(data, sap)
+	}
+	return NewBox("sidx", data)
+}
+
+// newFileType формирование блока ftyp (или styp для медиасегментов с основным брендом msdh)
+func newFileType(major string, compatible ...string) *Box {
+	name := "ftyp"
+	if major == "msdh" {
+		name = "styp"
+	}
+	data := append([]byte(major), 0, 0, 0, 0)
+	for _, brand := range compatible {
+		data = append(data, brand...)
+	}
+	return NewBox(name, data)
+}
+
+// emptySampleTable таблица сэмплов без сэмплов (для init-сегмента): описание сэмплов и пустые stts, stsc, stsz, stco
+func emptySampleTable(stsd *Box) []*Box {
+	return []*Box{
+		stsd,
+		NewBox("stts", make([]byte, 8)),
+		NewBox("stsc", make([]byte, 8)),
+		NewBox("stsz", make([]byte, 12)),
+		NewBox("stco", make([]byte, 8)),
+	}
+}
+
+// movieDuration продолжительность контейнера из блока mvhd (в единицах времени контейнера)
+func movieDuration(movie *Box) (uint64, bool) {
+	mvhd := movie.Child("mvhd")
+	if mvhd == nil || len(mvhd.Data) < 20 {
+		return 0, false
+	}
+	if mvhd.Data[0] == 0x1 {
+		if len(mvhd.Data) < 32 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint64(mvhd.Data[24:]), true
+	}
+	return uint64(binary.BigEndian.Uint32(mvhd.Data[16:])), true
+}
+
+// samplesSize суммарный размер сэмплов (байт)
+func samplesSize(samples []Sample) (size int64) {
+	for _, s := range samples {
+		size += int64(s.Size)
+	}
+	return size
+}
+
+// mediaDataHeaderSize размер заголовка блока mdat с содержимым размером dataSize байт
+func mediaDataHeaderSize(dataSize int64) int64 {
+	return int64(len(appendBoxHeader(nil, "mdat", dataSize)))
+}
+
+// writeMediaData запись блока mdat, содержимое которого - сэмплы, скопированные из исходного файла
+// (соседние в исходном файле сэмплы копируются одним участком)
+func writeMediaData(w io.Writer, src io.ReaderAt, tracks ...[]Sample) error {
+	var dataSize int64
+	for _, samples := range tracks {
+		dataSize += samplesSize(samples)
+	}
+	if _, err := w.Write(appendBoxHeader(nil, "mdat", dataSize)); err != nil {
+		return NewAPIError("ошибка записи видеофайла", err)
+	}
+	for _, samples := range tracks {
+		for i := 0; i < len(samples); {
+			start, size := samples[i].Offset, int64(samples[i].Size)
+			for i++; i < len(samples) && samples[i].Offset == start+size; i++ {
+				size += int64(samples[i].Size)
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(src, start, size)); err != nil {
+				return NewAPIError("ошибка записи видеофайла", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка фрагментации: разбиение на сегменты и содержимое фрагментов
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// segmentBuffer медиасегмент, записываемый в память
+type segmentBuffer struct {
+	bytes.Buffer
+}
+
+// Close завершение записи сегмента
+func (s *segmentBuffer) Close() error {
+	return nil
+}
+
+func TestFragmentSplit(t *testing.T) {
+	data := testMovie(t)
+	src := readTestMovie(t, data)
+	fr, err := newFragmenter(bytes.NewReader(data), FragmentOptions{SegmentDuration: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ключевые кадры следуют через 0,4 с, сегменты начинаются с ключевого кадра не ранее чем через 1 с
+	if len(fr.fragments) != 4 {
+		t.Fatalf("%d сегментов вместо 4", len(fr.fragments))
+	}
+	if fr.reference.Handler != "vide" {
+		t.Fatalf("опорная дорожка %q вместо vide", fr.reference.Handler)
+	}
+	// каждый сэмпл попадает ровно в один сегмент, порядок сэмплов сохраняется
+	for i, track := range src.tracks {
+		var samples []Sample
+		for _, frag := range fr.fragments {
+			samples = append(samples, frag.samples[i]...)
+		}
+		compareSamples(t, i+1, src, track.Samples, src, samples)
+	}
+	for k, frag := range fr.fragments {
+		if !frag.samples[0][0].Sync || !frag.sap {
+			t.Fatalf("сегмент %d начинается не с ключевого кадра", k+1)
+		}
+	}
+}
+
+func TestFragmentLayout(t *testing.T) {
+	data := testMovie(t)
+	src := readTestMovie(t, data)
+	opts := FragmentOptions{SegmentDuration: time.Second, SegmentIndex: true}
+	fr, err := newFragmenter(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = Fragment(bytes.NewReader(data), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	boxes, err := ReadBoxes(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.Type)
+	}
+	want := []string{"ftyp", "moov", "sidx", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat"}
+	if len(types) != len(want) {
+		t.Fatalf("блоки верхнего уровня %v вместо %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("блоки верхнего уровня %v вместо %v", types, want)
+		}
+	}
+	// init-сегмент: пустые таблицы сэмплов и значения по умолчанию для каждой дорожки
+	movie := boxes[1]
+	if len(movie.FindAll("mvex/trex")) != len(src.tracks) {
+		t.Fatal("нет описания фрагментов дорожек")
+	}
+	for _, stsz := range movie.FindAll("trak/mdia/minf/stbl/stsz") {
+		if binary.BigEndian.Uint32(stsz.Data[8:]) != 0 {
+			t.Fatal("таблица сэмплов init-сегмента не пуста")
+		}
+	}
+	for k, frag := range fr.fragments {
+		moof, mdat := boxes[3+k*2], boxes[4+k*2]
+		// содержимое mdat - сэмплы дорожек сегмента друг за другом
+		var payload []byte
+		for _, samples := range frag.samples {
+			for _, s := range samples {
+				payload = append(payload, src.sampleData(t, s)...)
+			}
+		}
+		content := out.Bytes()[mdat.offset+headerBlockSize : mdat.offset+mdat.size]
+		if !bytes.Equal(content, payload) {
+			t.Fatalf("сегмент %d: содержимое mdat отличается от сэмплов исходного файла", k+1)
+		}
+		// данные первой дорожки начинаются сразу за заголовком mdat (смещение от начала moof)
+		runs := moof.FindAll("traf/trun")
+		if len(runs) != len(src.tracks) {
+			t.Fatalf("сегмент %d: %d блоков trun вместо %d", k+1, len(runs), len(src.tracks))
+		}
+		if offset := int64(binary.BigEndian.Uint32(runs[0].Data[8:])); moof.offset+offset != mdat.offset+headerBlockSize {
+			t.Fatalf("сегмент %d: смещение данных %d указывает не на начало mdat", k+1, offset)
+		}
+		for i, trun := range runs {
+			if count := int(binary.BigEndian.Uint32(trun.Data[4:])); count != len(frag.samples[i]) {
+				t.Fatalf("сегмент %d, дорожка %d: %d сэмплов вместо %d", k+1, i+1, count, len(frag.samples[i]))
+			}
+		}
+	}
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	data := testMovie(t)
+	for _, index := range []bool{false, true} {
+		var out bytes.Buffer
+		opts := FragmentOptions{SegmentDuration: time.Second, SegmentIndex: index}
+		if err := Fragment(bytes.NewReader(data), &out, opts); err != nil {
+			t.Fatal(err)
+		}
+		compareMovies(t, readTestMovie(t, data), readTestMovie(t, out.Bytes()))
+	}
+}
+
+func TestFragmentSegments(t *testing.T) {
+	data := testMovie(t)
+	var init bytes.Buffer
+	var segments []*segmentBuffer
+	err := FragmentSegments(bytes.NewReader(data), &init, func(number int) (io.WriteCloser, error) {
+		if number != len(segments)+1 {
+			t.Fatalf("сегмент %d вместо %d", number, len(segments)+1)
+		}
+		segments = append(segments, new(segmentBuffer))
+		return segments[number-1], nil
+	}, FragmentOptions{SegmentDuration: time.Second, SegmentIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 {
+		t.Fatalf("%d сегментов вместо 4", len(segments))
+	}
+	file := append([]byte{}, init.Bytes()...)
+	for i, s := range segments {
+		boxes, err := ReadBoxes(bytes.NewReader(s.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(boxes) != 4 || boxes[0].Type != "styp" || boxes[1].Type != "sidx" || boxes[2].Type != "moof" || boxes[3].Type != "mdat" {
+			t.Fatalf("сегмент %d: неверный состав блоков", i+1)
+		}
+		file = append(file, s.Bytes()...)
+	}
+	// init-сегмент и медиасегменты, записанные друг за другом, образуют фрагментированный файл
+	compareMovies(t, readTestMovie(t, data), readTestMovie(t, file))
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Частота кадров видеодорожек по продолжительностям сэмплов (stts, флаги trun): номинальная и переменная
+package mp4
+
+// FrameRateInfo частота кадров видеопотока; кроме номинальной, известна только по продолжительностям сэмплов
+type FrameRateInfo struct {
+	Nominal       float64 // номинальная частота кадров по наиболее частой продолжительности кадра (кадров в секунду)
+	Variable      bool    `json:",omitempty"` // переменная частота кадров (VFR)
+	Min           float64 `json:",omitempty"` // наименьшая частота кадров (кадров в секунду)
+	Max           float64 `json:",omitempty"` // наибольшая частота кадров (кадров в секунду)
+	Avg           float64 `json:",omitempty"` // средняя частота кадров (кадров в секунду)
+	FrameDuration uint32  `json:",omitempty"` // наиболее частая продолжительность кадра (в единицах времени медиадорожки)
+	TimeScale     uint32  `json:",omitempty"` // единица времени медиадорожки (mdhd)
+}
+
+// nominalFrameRate частота кадров из заголовков потока или контейнера (nil, если неизвестна)
+func nominalFrameRate(rate float64) *FrameRateInfo {
+	if rate <= 0 {
+		return nil
+	}
+	return &FrameRateInfo{Nominal: rate}
+}
+
+// analyzeFrameRate расчет частоты кадров по продолжительностям сэмплов дорожки
+func analyzeFrameRate(t *mediaTrack) *FrameRateInfo {
+	samples := t.Samples
+	// продолжительность последнего сэмпла часто задается произвольно и не учитывается
+	if len(samples) > 1 {
+		samples = samples[:len(samples)-1]
+	}
+	counts := make(map[uint32]int)
+	var total uint64
+	var minDuration, maxDuration uint32
+	for _, s := range samples {
+		if s.Duration == 0 {
+			continue
+		}
+		counts[s.Duration]++
+		total += uint64(s.Duration)
+		if minDuration == 0 || s.Duration < minDuration {
+			minDuration = s.Duration
+		}
+		if s.Duration > maxDuration {
+			maxDuration = s.Duration
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	info := &FrameRateInfo{TimeScale: t.TimeScale}
+	for d, n := range counts {
+		if n > counts[info.FrameDuration] || n == counts[info.FrameDuration] && d < info.FrameDuration {
+			info.FrameDuration = d
+		}
+	}
+	scale := float64(t.TimeScale)
+	info.Nominal = scale / float64(info.FrameDuration)
+	info.Min = scale / float64(maxDuration)
+	info.Max = scale / float64(minDuration)
+	frames := 0
+	for _, n := range counts {
+		frames += n
+	}
+	info.Avg = float64(frames) * scale / float64(total)
+	// расхождение на одну единицу времени возникает при округлении (например, 29.97 к/с в миллисекундах)
+	info.Variable = maxDuration > info.FrameDuration+1 || minDuration+1 < info.FrameDuration
+	return info
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка расчета частоты кадров видеодорожек
+package mp4
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeFrameRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeScale uint32
+		durations []uint32
+		want      *FrameRateInfo
+	}{
+		{
+			// 30 к/с в миллисекундах: продолжительности 33 и 34 мс из-за округления, последний сэмпл не учитывается
+			name:      "округление 33/34 мс",
+			timeScale: 1000,
+			durations: []uint32{33, 34, 33, 33, 34, 33, 99},
+			want: &FrameRateInfo{Nominal: 1000.0 / 33, Min: 1000.0 / 34, Max: 1000.0 / 33, Avg: 30,
+				FrameDuration: 33, TimeScale: 1000},
+		},
+		{
+			name:      "переменная частота",
+			timeScale: 1000,
+			durations: []uint32{33, 34, 33, 40, 33},
+			want: &FrameRateInfo{Nominal: 1000.0 / 33, Variable: true, Min: 25, Max: 1000.0 / 33, Avg: 4000.0 / 140,
+				FrameDuration: 33, TimeScale: 1000},
+		},
+		{
+			// при равной частоте выбирается меньшая продолжительность
+			name:      "равная частота продолжительностей",
+			timeScale: 1000,
+			durations: []uint32{40, 20, 20, 40, 40},
+			want: &FrameRateInfo{Nominal: 50, Variable: true, Min: 25, Max: 50, Avg: 4000.0 / 120,
+				FrameDuration: 20, TimeScale: 1000},
+		},
+		{
+			name:      "29,97 к/с",
+			timeScale: 90000,
+			durations: []uint32{3003, 3003, 3003},
+			want: &FrameRateInfo{Nominal: 90000.0 / 3003, Min: 90000.0 / 3003, Max: 90000.0 / 3003, Avg: 90000.0 / 3003,
+				FrameDuration: 3003, TimeScale: 90000},
+		},
+		{
+			name:      "один сэмпл",
+			timeScale: 1000,
+			durations: []uint32{40},
+			want:      &FrameRateInfo{Nominal: 25, Min: 25, Max: 25, Avg: 25, FrameDuration: 40, TimeScale: 1000},
+		},
+		{
+			name:      "нулевые продолжительности",
+			timeScale: 1000,
+			durations: []uint32{0, 0, 0},
+		},
+	}
+	for _, test := range tests {
+		track := &mediaTrack{Handler: "vide", TimeScale: test.timeScale}
+		for _, d := range test.durations {
+			track.Samples = append(track.Samples, Sample{Duration: d})
+		}
+		if got := analyzeFrameRate(track); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: %+v вместо %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFrameRateInStream(t *testing.T) {
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(testMovie(t))); err != nil {
+		t.Fatal(err)
+	}
+	video, ok := f.Movie.Tracks[0].Stream.(*VideoStream)
+	if !ok {
+		t.Fatalf("поток %+v", f.Movie.Tracks[0].Stream)
+	}
+	want := &FrameRateInfo{Nominal: 25, Min: 25, Max: 25, Avg: 25, FrameDuration: 512, TimeScale: 12800}
+	if !reflect.DeepEqual(video.FrameRate, want) {
+		t.Fatalf("частота кадров %+v вместо %+v", video.FrameRate, want)
+	}
+}
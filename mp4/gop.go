@@ -0,0 +1,143 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Структура групп кадров (GOP) видеодорожек по таблицам сэмплов и фрагментам
+package mp4
+
+import (
+	"io"
+	"sort"
+)
+
+// KeyFrame ключевой кадр видеодорожки
+type KeyFrame struct {
+	Sample   int     // номер сэмпла в порядке декодирования (начиная с 1)
+	Time     float64 // время отображения (сек)
+	Position int64   // позиция в файле (байт)
+}
+
+// GOPInfo структура групп кадров видеодорожки
+type GOPInfo struct {
+	TrackID      uint32     // идентификатор дорожки
+	KeyFrames    []KeyFrame `json:",omitempty"` // ключевые кадры (в метаданных файла не выводятся, см. AnalyzeGOP)
+	Count        int        // количество групп кадров
+	MinLength    int        // наименьшая длина группы (кадров)
+	MaxLength    int        // наибольшая длина группы (кадров)
+	AvgLength    float64    // средняя длина группы (кадров)
+	OpenGOPs     int        // группы, кадры которых ссылаются на предыдущую группу
+	ClosedGOPs   int        // группы, декодируемые независимо
+	BFrames      bool       // порядок отображения кадров отличается от порядка декодирования
+	ReorderDepth int        // наибольшее количество кадров, декодируемых раньше и отображаемых позже кадра
+}
+
+// AnalyzeGOP анализ групп кадров видеодорожек файла (в том числе фрагментированного)
+func AnalyzeGOP(r io.ReadSeeker) ([]GOPInfo, error) {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return nil, err
+	}
+	var result []GOPInfo
+	for _, t := range m.tracks {
+		if t.Handler != "vide" || len(t.Samples) == 0 {
+			continue
+		}
+		result = append(result, *analyzeGOP(t))
+	}
+	if len(result) == 0 {
+		return nil, ErrTrackNotFound
+	}
+	return result, nil
+}
+
+// analyzeGOP анализ групп кадров по ключевым сэмплам (stss, флаги trun), времени отображения (ctts)
+// и признакам ведущих сэмплов (sdtp, флаги trun)
+func analyzeGOP(t *mediaTrack) *GOPInfo {
+	info := &GOPInfo{TrackID: t.ID}
+	samples := t.Samples
+	cts := func(i int) int64 {
+		return int64(samples[i].DTS) + int64(samples[i].CTSOffset)
+	}
+	start := -1
+	closeGOP := func(end int) {
+		if start < 0 {
+			return
+		}
+		length := end - start
+		if info.Count == 0 || length < info.MinLength {
+			info.MinLength = length
+		}
+		if length > info.MaxLength {
+			info.MaxLength = length
+		}
+		info.Count++
+		// группа открыта, если ее кадры ссылаются на предыдущую группу: по признаку ведущего сэмпла,
+		// а без него - по отображению раньше ключевого кадра
+		open := false
+		for i := start + 1; i < end && !open; i++ {
+			switch samples[i].Leading {
+			case 1:
+				open = true
+			case 0:
+				open = cts(i) < cts(start)
+			}
+		}
+		if open {
+			info.OpenGOPs++
+		} else {
+			info.ClosedGOPs++
+		}
+	}
+	for i, s := range samples {
+		if !s.Sync {
+			continue
+		}
+		closeGOP(i)
+		start = i
+		info.KeyFrames = append(info.KeyFrames, KeyFrame{
+			Sample:   i + 1,
+			Time:     float64(cts(i)) / float64(t.TimeScale),
+			Position: s.Offset,
+		})
+	}
+	closeGOP(len(samples))
+	if info.Count > 0 {
+		info.AvgLength = float64(len(samples)-info.KeyFrames[0].Sample+1) / float64(info.Count)
+	}
+	info.ReorderDepth = reorderDepth(samples)
+	info.BFrames = info.ReorderDepth > 0
+	return info
+}
+
+// reorderDepth наибольшее количество сэмплов, декодируемых раньше и отображаемых позже сэмпла
+func reorderDepth(samples []Sample) int {
+	// ранги времени отображения и дерево Фенвика для подсчета уже декодированных сэмплов с большим рангом
+	order := make([]int, len(samples))
+	for i := range order {
+		order[i] = i
+	}
+	cts := func(i int) int64 {
+		return int64(samples[i].DTS) + int64(samples[i].CTSOffset)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return cts(order[a]) < cts(order[b]) })
+	rank := make([]int, len(samples))
+	for r, i := range order {
+		rank[i] = r + 1
+	}
+	tree := make([]int, len(samples)+1)
+	depth := 0
+	for i := range samples {
+		// количество декодированных ранее сэмплов с рангом не больше текущего
+		before := 0
+		for r := rank[i]; r > 0; r -= r & -r {
+			before += tree[r]
+		}
+		if later := i - before; later > depth {
+			depth = later
+		}
+		for r := rank[i]; r < len(tree); r += r & -r {
+			tree[r]++
+		}
+	}
+	return depth
+}
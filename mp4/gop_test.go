@@ -0,0 +1,119 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка анализа групп кадров видеодорожек
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+// gopFrame кадр в порядке декодирования: время отображения, ключевой кадр и признак ведущего сэмпла
+type gopFrame struct {
+	pts     int64
+	sync    bool
+	leading byte
+}
+
+// gopTrack видеодорожка из кадров продолжительностью 1 (единица времени 10), время отображения
+// сдвинуто на 1, чтобы смещения были неотрицательными
+func gopTrack(frames ...gopFrame) *mediaTrack {
+	t := &mediaTrack{ID: 1, Handler: "vide", TimeScale: 10}
+	for i, f := range frames {
+		t.Samples = append(t.Samples, Sample{
+			Offset:    int64(i) * 100,
+			Size:      100,
+			DTS:       uint64(i),
+			Duration:  1,
+			CTSOffset: f.pts + 1 - int64(i),
+			Sync:      f.sync,
+			Leading:   f.leading,
+		})
+	}
+	return t
+}
+
+func TestAnalyzeGOP(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   []gopFrame
+		count    int
+		open     int
+		min, max int
+		depth    int
+		keys     []KeyFrame
+	}{
+		{
+			name:   "IPPP",
+			frames: []gopFrame{{0, true, 0}, {1, false, 0}, {2, false, 0}, {3, true, 0}, {4, false, 0}},
+			count:  2, min: 2, max: 3,
+			keys: []KeyFrame{{1, 0.1, 0}, {4, 0.4, 300}},
+		},
+		{
+			// I0 P3 B1 B2 P6 B4 B5: каждый B-кадр отображается раньше одного декодированного до него P-кадра
+			name:   "IBBP",
+			frames: []gopFrame{{0, true, 0}, {3, false, 0}, {1, false, 0}, {2, false, 0}, {6, false, 0}, {4, false, 0}, {5, false, 0}},
+			count:  1, min: 7, max: 7, depth: 1,
+			keys: []KeyFrame{{1, 0.1, 0}},
+		},
+		{
+			// B-кадры 4 и 5 второй группы отображаются раньше ее ключевого кадра 6
+			name: "открытая группа",
+			frames: []gopFrame{{0, true, 0}, {3, false, 0}, {1, false, 0}, {2, false, 0},
+				{6, true, 0}, {4, false, 0}, {5, false, 0}, {9, false, 0}, {7, false, 0}, {8, false, 0}, {10, true, 0}},
+			count: 3, open: 1, min: 1, max: 6, depth: 1,
+			keys: []KeyFrame{{1, 0.1, 0}, {5, 0.7, 400}, {11, 1.1, 1000}},
+		},
+		{
+			// те же кадры, но sdtp отмечает B-кадры второй группы ведущими независимыми
+			name: "ведущие независимые",
+			frames: []gopFrame{{0, true, 0}, {3, false, 0}, {1, false, 0}, {2, false, 0},
+				{6, true, 0}, {4, false, 3}, {5, false, 3}, {9, false, 0}, {7, false, 0}, {8, false, 0}, {10, true, 0}},
+			count: 3, min: 1, max: 6, depth: 1,
+			keys: []KeyFrame{{1, 0.1, 0}, {5, 0.7, 400}, {11, 1.1, 1000}},
+		},
+		{
+			// иерархические B-кадры I0 P4 B2 b1 b3: b1 отображается раньше P4 и B2
+			name:   "иерархия B-кадров",
+			frames: []gopFrame{{0, true, 0}, {4, false, 0}, {2, false, 0}, {1, false, 0}, {3, false, 0}},
+			count:  1, min: 5, max: 5, depth: 2,
+			keys: []KeyFrame{{1, 0.1, 0}},
+		},
+		{
+			// группа до первого ключевого кадра не учитывается
+			name:   "без начального ключевого кадра",
+			frames: []gopFrame{{0, false, 0}, {1, false, 0}, {2, true, 0}, {3, false, 0}},
+			count:  1, min: 2, max: 2,
+			keys: []KeyFrame{{3, 0.3, 200}},
+		},
+	}
+	for _, test := range tests {
+		info := analyzeGOP(gopTrack(test.frames...))
+		if info.Count != test.count || info.OpenGOPs != test.open || info.ClosedGOPs != test.count-test.open ||
+			info.MinLength != test.min || info.MaxLength != test.max ||
+			info.ReorderDepth != test.depth || info.BFrames != (test.depth > 0) {
+			t.Fatalf("%s: %+v", test.name, info)
+		}
+		if len(info.KeyFrames) != len(test.keys) {
+			t.Fatalf("%s: ключевые кадры %v вместо %v", test.name, info.KeyFrames, test.keys)
+		}
+		for i, key := range test.keys {
+			if info.KeyFrames[i] != key {
+				t.Fatalf("%s: ключевой кадр %+v вместо %+v", test.name, info.KeyFrames[i], key)
+			}
+		}
+	}
+}
+
+func TestAnalyzeGOPFile(t *testing.T) {
+	if _, err := AnalyzeGOP(bytes.NewReader(testMovie(t))); err != nil {
+		t.Fatal(err)
+	}
+	// в файле без видеодорожек группы кадров отсутствуют
+	data := buildTestMovie(t, testTrack{handler: "soun", timeScale: 1000, duration: 1000, sizes: []uint32{10, 10}})
+	if _, err := AnalyzeGOP(bytes.NewReader(data)); err != ErrTrackNotFound {
+		t.Fatalf("ошибка %v вместо %v", err, ErrTrackNotFound)
+	}
+}
@@ -0,0 +1,529 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор файлов изображений HEIF/HEIC и AVIF: элементы, их свойства, ссылки и метаданные Exif
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Ограничения на размер данных, загружаемых в память при разборе HEIF (байт)
+const (
+	maxHEIFMetaSize = 16 << 20 // блоки meta и moov
+	maxExifSize     = 1 << 20  // данные элемента Exif
+)
+
+// heifBrands основные бренды файлов изображений и наименования форматов
+var heifBrands = map[string]string{
+	"mif1": "HEIF", "mif2": "HEIF", "heic": "HEIC", "heix": "HEIC", "heim": "HEIC", "heis": "HEIC", "avif": "AVIF",
+}
+
+// Item элемент файла HEIF (изображение, плитка, миниатюра, метаданные)
+type Item struct {
+	ID          uint32
+	Type        string   // тип элемента (hvc1, av01, grid, Exif, mime, ...)
+	Name        string   `json:",omitempty"`
+	Primary     bool     `json:",omitempty"` // основное изображение файла
+	Hidden      bool     `json:",omitempty"` // элемент не предназначен для отображения (например, плитка)
+	Width       uint32   `json:",omitempty"` // ширина изображения (пиксель)
+	Height      uint32   `json:",omitempty"` // высота изображения (пиксель)
+	Rotation    int      `json:",omitempty"` // угол поворота при отображении по часовой стрелке (градусы)
+	Profile     string   `json:",omitempty"` // профиль и уровень сжатия
+	ColorDepth  uint16   `json:",omitempty"` // глубина цвета (бит)
+	Color       string   `json:",omitempty"` // описание цветового пространства (colr)
+	ThumbnailOf uint32   `json:",omitempty"` // изображение, миниатюрой которого является элемент
+	Describes   uint32   `json:",omitempty"` // изображение, к которому относятся метаданные
+	Tiles       []uint32 `json:",omitempty"` // изображения, из которых собирается сетка (grid)
+	Size        int64    `json:",omitempty"` // размер данных элемента (байт)
+}
+
+// heifExtent участок данных элемента
+type heifExtent struct {
+	offset int64
+	length int64
+	data   []byte // загруженное содержимое (только для элементов Exif)
+}
+
+// heifItem элемент вместе с расположением данных и свойствами
+type heifItem struct {
+	Item
+	construction uint16 // 0 - данные в файле, 1 - в блоке idat
+	extents      []*heifExtent
+	properties   []int // номера свойств в ipco (начиная с 1)
+}
+
+// heifFile состояние разбора файла HEIF
+type heifFile struct {
+	r       *bufio.Reader
+	pos     int64
+	items   map[uint32]*heifItem
+	order   []uint32
+	primary uint32
+	idat    []byte
+	ipco    []*Box
+	pending []*heifExtent // участки в блоках mdat, которые нужно загрузить, по возрастанию смещения
+}
+
+// isHEIF является ли начало потока блоком ftyp файла изображений HEIF/AVIF
+func isHEIF(header []byte) bool {
+	return len(header) >= 12 && string(header[4:8]) == "ftyp" && heifBrands[string(header[8:12])] != ""
+}
+
+// readHEIF разбор файла HEIF/AVIF из потока
+// Данные элементов Exif загружаются из mdat, только если блок meta расположен раньше
+func (f *VideoFile) readHEIF(r *bufio.Reader) error {
+	h := &heifFile{r: r, items: make(map[uint32]*heifItem)}
+	var movie []byte
+	for {
+		name, size, headerSize, err := h.readHeader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start := h.pos - headerSize
+		switch name {
+		case "ftyp", "meta", "moov":
+			if size < 0 || size-headerSize > maxHEIFMetaSize {
+				return ErrFileIsNotValid
+			}
+			data, err := h.read(int(size - headerSize))
+			if err != nil {
+				return err
+			}
+			switch name {
+			case "ftyp":
+				f.readFileType(data)
+				f.Codec = heifBrands[f.MajorBrand]
+			case "meta":
+				if err = h.readMeta(data); err != nil {
+					return err
+				}
+			case "moov":
+				// последовательность изображений описывается как обычный контейнер MP4
+				movie = append(appendBoxHeader(nil, name, int64(len(data))), data...)
+			}
+		default:
+			if err = h.skip(start, size); err != nil {
+				return err
+			}
+		}
+	}
+	if len(h.items) == 0 {
+		return ErrNoSamples
+	}
+	f.Size = int(h.pos)
+	f.metaDataBuf = bytes.NewReader(movie)
+	if err := f.Parse(); err != nil {
+		return err
+	}
+	h.fill(&f.Movie)
+	return nil
+}
+
+// readHeader чтение заголовка блока верхнего уровня; size = -1 - блок продолжается до конца файла
+func (h *heifFile) readHeader() (name string, size, headerSize int64, err error) {
+	header, err := h.read(headerBlockSize)
+	if err != nil {
+		if len(header) == 0 {
+			err = io.EOF
+		}
+		return
+	}
+	name, size, headerSize = string(header[4:]), int64(binary.BigEndian.Uint32(header)), headerBlockSize
+	switch size {
+	case 0:
+		size = -1
+	case 1:
+		if header, err = h.read(8); err != nil {
+			return
+		}
+		size, headerSize = int64(binary.BigEndian.Uint64(header)), 16
+	}
+	if size >= 0 && size < headerSize {
+		err = ErrFileIsNotValid
+	}
+	return
+}
+
+// read чтение size байт
+func (h *heifFile) read(size int) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := io.ReadFull(h.r, data)
+	h.pos += int64(n)
+	if err != nil {
+		return data[:n], ErrFileIsNotValid
+	}
+	return data, nil
+}
+
+// skip пропуск содержимого блока с загрузкой попавших в него участков данных элементов
+func (h *heifFile) skip(start, size int64) error {
+	end := start + size
+	for len(h.pending) > 0 && h.pending[0].offset < h.pos {
+		h.pending = h.pending[1:]
+	}
+	for len(h.pending) > 0 && (size < 0 || h.pending[0].offset+h.pending[0].length <= end) {
+		extent := h.pending[0]
+		h.pending = h.pending[1:]
+		// участок, перекрывающийся с уже прочитанным, не загружается
+		if extent.offset < h.pos {
+			continue
+		}
+		if err := h.discard(extent.offset - h.pos); err != nil {
+			return err
+		}
+		data, err := h.read(int(extent.length))
+		if err != nil {
+			return err
+		}
+		extent.data = data
+	}
+	if size < 0 {
+		return h.discard(-1)
+	}
+	return h.discard(end - h.pos)
+}
+
+// discard пропуск n байт (n < 0 - до конца потока)
+func (h *heifFile) discard(n int64) error {
+	if n < 0 {
+		rest, err := io.Copy(io.Discard, h.r)
+		h.pos += rest
+		if err != nil {
+			return NewAPIError("ошибка при получении файла", err)
+		}
+		return nil
+	}
+	skipped, err := io.CopyN(io.Discard, h.r, n)
+	h.pos += skipped
+	if err != nil {
+		return ErrFileIsNotValid
+	}
+	return nil
+}
+
+// readMeta разбор блока meta: обработчик, основной элемент, элементы, их расположение, свойства и ссылки
+func (h *heifFile) readMeta(data []byte) error {
+	meta := &Box{Type: "meta", offset: -1}
+	meta.parsePayload(data, "")
+	if hdlr := meta.Child("hdlr"); hdlr == nil || len(hdlr.Data) < 12 || string(hdlr.Data[8:12]) != "pict" {
+		return ErrFileCodecNotSupported
+	}
+	if pitm := meta.Child("pitm"); pitm != nil && len(pitm.Data) >= 4 {
+		b := &bitReader{data: pitm.Data[4:]}
+		if pitm.Data[0] == 0 {
+			h.primary = b.bits(16)
+		} else {
+			h.primary = b.bits(32)
+		}
+	}
+	if iinf := meta.Child("iinf"); iinf != nil {
+		h.readItemInfo(iinf.Data)
+	}
+	if idat := meta.Child("idat"); idat != nil {
+		h.idat = idat.Data
+	}
+	if iloc := meta.Child("iloc"); iloc != nil {
+		if err := h.readItemLocations(iloc.Data); err != nil {
+			return err
+		}
+	}
+	if ipco := meta.Find("iprp/ipco"); ipco != nil {
+		h.ipco = ipco.Children
+	}
+	if ipma := meta.Find("iprp/ipma"); ipma != nil {
+		h.readPropertyAssociations(ipma.Data)
+	}
+	if iref := meta.Child("iref"); iref != nil {
+		h.readReferences(iref.Data)
+	}
+	return nil
+}
+
+// item элемент по идентификатору (создается при первом обращении)
+func (h *heifFile) item(id uint32) *heifItem {
+	item, ok := h.items[id]
+	if !ok {
+		item = &heifItem{Item: Item{ID: id}}
+		h.items[id] = item
+		h.order = append(h.order, id)
+	}
+	return item
+}
+
+// readItemInfo разбор блока iinf: записи infe с типом и наименованием элементов
+func (h *heifFile) readItemInfo(data []byte) {
+	prefix := 6
+	if len(data) > 0 && data[0] != 0 {
+		prefix = 8
+	}
+	if len(data) < prefix {
+		return
+	}
+	entries, ok := parseBoxes(data[prefix:], "iinf")
+	if !ok {
+		return
+	}
+	for _, infe := range entries {
+		d := infe.Data
+		if infe.Type != "infe" || len(d) < 4 || d[0] < 2 {
+			continue
+		}
+		idSize := 2
+		if d[0] >= 3 {
+			idSize = 4
+		}
+		if len(d) < 4+idSize+6 {
+			continue
+		}
+		b := &bitReader{data: d[4:]}
+		item := h.item(b.bits(idSize * 8))
+		item.Hidden = d[3]&0x1 != 0
+		rest := d[4+idSize+2:]
+		item.Type = string(rest[:4])
+		item.Name, _, _ = strings.Cut(string(rest[4:]), "\x00")
+	}
+}
+
+// readItemLocations разбор блока iloc: способ хранения и участки данных элементов
+func (h *heifFile) readItemLocations(data []byte) error {
+	if len(data) < 8 {
+		return ErrFileIsNotValid
+	}
+	version := data[0]
+	offsetSize, lengthSize := int(data[4]>>4), int(data[4]&0xF)
+	baseSize, indexSize := int(data[5]>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[5] & 0xF)
+	}
+	b := &bitReader{data: data[6:]}
+	count := b.bits(16)
+	if version == 2 {
+		count = b.bits(32)
+	}
+	for i := uint32(0); i < count && !b.err; i++ {
+		id := b.bits(16)
+		if version == 2 {
+			id = b.bits(32)
+		}
+		item := h.item(id)
+		if version == 1 || version == 2 {
+			item.construction = uint16(b.bits(16) & 0xF)
+		}
+		b.bits(16) // data_reference_index
+		base := sizedField(b, baseSize)
+		extents := int(b.bits(16))
+		for j := 0; j < extents && !b.err; j++ {
+			sizedField(b, indexSize)
+			offset, length := base+sizedField(b, offsetSize), sizedField(b, lengthSize)
+			// 64-битные поля не должны переполнять позицию и суммарный размер элемента
+			if offset < base || length > math.MaxInt64 || offset > math.MaxInt64-length || uint64(item.Size) > math.MaxInt64-length {
+				return ErrFileIsNotValid
+			}
+			item.extents = append(item.extents, &heifExtent{offset: int64(offset), length: int64(length)})
+			item.Size += int64(length)
+		}
+	}
+	if b.err {
+		return ErrFileIsNotValid
+	}
+	// данные Exif, хранящиеся в файле, загружаются при чтении блоков mdat
+	for _, id := range h.order {
+		item := h.items[id]
+		if item.Type != "Exif" || item.construction != 0 || item.Size > maxExifSize {
+			continue
+		}
+		h.pending = append(h.pending, item.extents...)
+	}
+	sort.Slice(h.pending, func(i, j int) bool { return h.pending[i].offset < h.pending[j].offset })
+	return nil
+}
+
+// sizedField чтение поля iloc размером size байт (0, 4 или 8)
+func sizedField(b *bitReader, size int) uint64 {
+	var v uint64
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint64(b.bits(8))
+	}
+	return v
+}
+
+// readPropertyAssociations разбор блока ipma: номера свойств ipco каждого элемента
+func (h *heifFile) readPropertyAssociations(data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	version, wide := data[0], data[3]&0x1 != 0
+	b := &bitReader{data: data[4:]}
+	count := b.bits(32)
+	for i := uint32(0); i < count && !b.err; i++ {
+		id := b.bits(16)
+		if version >= 1 {
+			id = b.bits(32)
+		}
+		item := h.item(id)
+		associations := int(b.bits(8))
+		for j := 0; j < associations && !b.err; j++ {
+			b.flag() // essential
+			if wide {
+				item.properties = append(item.properties, int(b.bits(15)))
+			} else {
+				item.properties = append(item.properties, int(b.bits(7)))
+			}
+		}
+	}
+}
+
+// readReferences разбор блока iref: миниатюры (thmb), плитки сетки (dimg) и описания (cdsc)
+func (h *heifFile) readReferences(data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	idSize := 16
+	if data[0] != 0 {
+		idSize = 32
+	}
+	references, ok := parseBoxes(data[4:], "iref")
+	if !ok {
+		return
+	}
+	for _, ref := range references {
+		b := &bitReader{data: ref.Data}
+		from := h.item(b.bits(idSize))
+		count := int(b.bits(16))
+		for i := 0; i < count && !b.err; i++ {
+			to := b.bits(idSize)
+			switch ref.Type {
+			case "thmb":
+				from.ThumbnailOf = to
+			case "cdsc":
+				from.Describes = to
+			case "dimg":
+				from.Tiles = append(from.Tiles, to)
+			}
+		}
+	}
+}
+
+// data содержимое элемента (из блока idat или загруженное из mdat)
+func (h *heifFile) data(item *heifItem) []byte {
+	var data []byte
+	for _, extent := range item.extents {
+		switch {
+		case item.construction == 1 && extent.offset+extent.length <= int64(len(h.idat)):
+			data = append(data, h.idat[extent.offset:extent.offset+extent.length]...)
+		case item.construction == 0 && extent.data != nil:
+			data = append(data, extent.data...)
+		default:
+			return nil
+		}
+	}
+	return data
+}
+
+// applyProperty заполнение описания элемента по свойству из ipco
+func (item *heifItem) applyProperty(p *Box) {
+	d := p.Data
+	switch p.Type {
+	case "ispe":
+		if len(d) >= 12 {
+			item.Width, item.Height = binary.BigEndian.Uint32(d[4:]), binary.BigEndian.Uint32(d[8:])
+		}
+	case "irot":
+		// поворот задается против часовой стрелки
+		if len(d) >= 1 {
+			item.Rotation = (4 - int(d[0]&0x3)) % 4 * 90
+		}
+	case "hvcC", "avcC":
+		if info, ok := parseDecoderConfig(p, p.Type == "hvcC"); ok {
+			item.Profile, item.ColorDepth = info.Profile, info.ColorDepth
+		}
+	case "av1C":
+		if info, ok := parseAV1Config(d); ok {
+			item.Profile, item.ColorDepth = info.Profile, info.ColorDepth
+		}
+	case "pixi":
+		// количество каналов и разрядность каждого
+		if len(d) >= 5 && len(d) >= 5+int(d[4]) {
+			item.ColorDepth = 0
+			for _, bits := range d[5 : 5+int(d[4])] {
+				item.ColorDepth += uint16(bits)
+			}
+		}
+	case "colr":
+		item.Color = colorDescription(d)
+	}
+}
+
+// colorDescription описание цветового пространства по блоку colr
+func colorDescription(d []byte) string {
+	if len(d) < 4 {
+		return ""
+	}
+	switch kind := string(d[:4]); kind {
+	case "nclx", "nclc":
+		// основные цвета, передаточная характеристика и матрица коэффициентов
+		if len(d) < 10 {
+			return kind
+		}
+		description := fmt.Sprintf("%s %d/%d/%d", kind, binary.BigEndian.Uint16(d[4:]),
+			binary.BigEndian.Uint16(d[6:]), binary.BigEndian.Uint16(d[8:]))
+		if kind == "nclx" && len(d) >= 11 && d[10]&0x80 != 0 {
+			description += " full range"
+		}
+		return description
+	case "prof", "rICC":
+		return "ICC"
+	default:
+		return kind
+	}
+}
+
+// fill заполнение модели метаданных: список элементов и Exif основного изображения
+func (h *heifFile) fill(movie *Container) {
+	sort.Slice(h.order, func(i, j int) bool { return h.order[i] < h.order[j] })
+	for _, id := range h.order {
+		item := h.items[id]
+		item.Primary = id == h.primary
+		for _, index := range item.properties {
+			if index > 0 && index <= len(h.ipco) {
+				item.applyProperty(h.ipco[index-1])
+			}
+		}
+		if item.Type == "grid" && item.Width == 0 {
+			item.readGrid(h.data(item))
+		}
+		if item.Type == "Exif" && (movie.Exif == nil || item.Describes == h.primary) {
+			if data := h.data(item); len(data) >= 4 {
+				// данные Exif предваряются смещением заголовка TIFF
+				if offset := 4 + int64(binary.BigEndian.Uint32(data)); offset < int64(len(data)) {
+					movie.Exif = parseExif(data[offset:])
+				}
+			}
+		}
+		movie.Items = append(movie.Items, item.Item)
+	}
+}
+
+// readGrid размеры сетки изображений по ее описанию
+func (item *heifItem) readGrid(data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	if data[1]&0x1 == 0 {
+		item.Width, item.Height = uint32(binary.BigEndian.Uint16(data[4:])), uint32(binary.BigEndian.Uint16(data[6:]))
+	} else if len(data) >= 12 {
+		item.Width, item.Height = binary.BigEndian.Uint32(data[4:]), binary.BigEndian.Uint32(data[8:])
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора файлов изображений HEIF/AVIF и метаданных Exif
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// fullBox блок с версией и флагами
+func fullBox(name string, version byte, flags uint32, data ...[]byte) *Box {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return NewBox(name, append(header, bytes.Join(data, nil)...))
+}
+
+// testTIFF данные Exif (заголовок TIFF с порядком байтов от старшего к младшему): в основном каталоге
+// производитель, модель и ориентация, во вложенном каталоге Exif - дата съемки
+func testTIFF() []byte {
+	values := []byte("Apple\x00iPhone 12\x002021:05:01 12:00:00\x00")
+	const ifd0, exifIFD, data = 8, 8 + 2 + 4*12 + 4, 8 + 2 + 4*12 + 4 + 2 + 12 + 4
+	entry := func(tag, kind uint16, count, value uint32) []byte {
+		e := binary.BigEndian.AppendUint16(nil, tag)
+		e = binary.BigEndian.AppendUint16(e, kind)
+		e = binary.BigEndian.AppendUint32(e, count)
+		return binary.BigEndian.AppendUint32(e, value)
+	}
+	return bytes.Join([][]byte{
+		{'M', 'M', 0, 42, 0, 0, 0, ifd0},
+		{0, 4},
+		entry(0x010F, tiffASCII, 6, data),
+		entry(0x0110, tiffASCII, 10, data+6),
+		entry(0x0112, tiffShort, 1, 6<<16),
+		entry(exifIFDPointer, tiffLong, 1, exifIFD),
+		{0, 0, 0, 0},
+		{0, 1},
+		entry(0x9003, tiffASCII, 20, data+16),
+		{0, 0, 0, 0},
+		values,
+	}, nil)
+}
+
+// testHEIFMeta блок meta изображения AVIF: сетка 1 (основное изображение, в idat) из плиток 2 и 3,
+// миниатюра 4 и Exif 5; данные плиток, миниатюры и Exif следуют друг за другом с позиции mdat
+func testHEIFMeta(mdat uint32, sizes []uint32) *Box {
+	u16 := func(values ...uint16) []byte {
+		var b []byte
+		for _, v := range values {
+			b = binary.BigEndian.AppendUint16(b, v)
+		}
+		return b
+	}
+	iinf := [][]byte{u16(5)}
+	for _, item := range []struct {
+		id     uint16
+		kind   string
+		name   string
+		hidden uint32
+	}{{1, "grid", "", 0}, {2, "av01", "", 1}, {3, "av01", "", 1}, {4, "av01", "thumb", 0}, {5, "Exif", "", 0}} {
+		infe := fullBox("infe", 2, item.hidden, u16(item.id, 0), []byte(item.kind+item.name+"\x00"))
+		iinf = append(iinf, append(appendBoxHeader(nil, "infe", int64(len(infe.Data))), infe.Data...))
+	}
+	grid := []byte{0, 0, 0, 1, 0x04, 0x00, 0x02, 0x00}
+	iloc := [][]byte{{0x44, 0x00}, u16(5), u16(1, 1, 0, 1), binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(grid)))}
+	offset := mdat
+	for i, size := range sizes {
+		iloc = append(iloc, u16(uint16(i+2), 0, 0, 1), binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, offset), size))
+		offset += size
+	}
+	ispe := func(width, height uint32) *Box {
+		return fullBox("ispe", 0, 0, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, width), height))
+	}
+	// свойства: 1 av1C, 2 ispe 512x512, 3 irot, 4 colr, 5 ispe 256x128, 6 pixi
+	ipco := NewContainer("ipco", nil,
+		NewBox("av1C", []byte{0x81, 0x08, 0x4C, 0x00}),
+		ispe(512, 512),
+		NewBox("irot", []byte{1}),
+		NewBox("colr", append([]byte("nclx"), 0, 1, 0, 13, 0, 6, 0x80)),
+		ispe(256, 128),
+		fullBox("pixi", 0, 0, []byte{3, 8, 8, 8}))
+	ipma := [][]byte{{0, 0, 0, 4}, u16(1), {2, 0x83, 0x84}, u16(2), {2, 0x81, 0x82}, u16(3), {2, 0x81, 0x82}, u16(4), {3, 0x81, 0x85, 0x86}}
+	iref := append(appendBoxHeader(nil, "dimg", 8), u16(1, 2, 2, 3)...)
+	iref = append(append(iref, appendBoxHeader(nil, "thmb", 6)...), u16(4, 1, 1)...)
+	iref = append(append(iref, appendBoxHeader(nil, "cdsc", 6)...), u16(5, 1, 1)...)
+	return NewContainer("meta", []byte{0, 0, 0, 0},
+		fullBox("hdlr", 0, 0, make([]byte, 4), []byte("pict"), make([]byte, 13)),
+		fullBox("pitm", 0, 0, u16(1)),
+		fullBox("iinf", 0, 0, iinf...),
+		fullBox("iloc", 1, 0, iloc...),
+		NewContainer("iprp", nil, ipco, fullBox("ipma", 0, 0, ipma...)),
+		fullBox("iref", 0, 0, iref),
+		NewBox("idat", grid))
+}
+
+// testHEIF файл AVIF из блоков ftyp, meta и mdat
+func testHEIF(t *testing.T) []byte {
+	tile, thumb := bytes.Repeat([]byte{'T'}, 3000), bytes.Repeat([]byte{'S'}, 500)
+	// данные Exif предваряются смещением заголовка TIFF
+	exif := append([]byte{0, 0, 0, 0}, testTIFF()...)
+	sizes := []uint32{uint32(len(tile)), uint32(len(tile)), uint32(len(thumb)), uint32(len(exif))}
+	ftyp := NewBox("ftyp", []byte("avif\x00\x00\x00\x00mif1avif"))
+	// размер meta не зависит от смещений данных
+	start := ftyp.Size() + testHEIFMeta(0, sizes).Size() + headerBlockSize
+	mdat := NewBox("mdat", bytes.Join([][]byte{tile, tile, thumb, exif}, nil))
+	var buf bytes.Buffer
+	if err := WriteBoxes(&buf, []*Box{ftyp, testHEIFMeta(uint32(start), sizes), mdat}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHEIF(t *testing.T) {
+	data := testHEIF(t)
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Codec != "AVIF" || f.Size != len(data) {
+		t.Fatalf("формат %q, размер %d", f.Codec, f.Size)
+	}
+	tile := Item{Type: "av01", Hidden: true, Width: 512, Height: 512, Profile: "Main@L4.0@Main", ColorDepth: 30, Size: 3000}
+	items := []Item{
+		{ID: 1, Type: "grid", Primary: true, Width: 1024, Height: 512, Rotation: 270, Color: "nclx 1/13/6 full range",
+			Tiles: []uint32{2, 3}, Size: 8},
+		tile,
+		tile,
+		{ID: 4, Type: "av01", Name: "thumb", Width: 256, Height: 128, Profile: "Main@L4.0@Main", ColorDepth: 24,
+			ThumbnailOf: 1, Size: 500},
+		{ID: 5, Type: "Exif", Describes: 1, Size: int64(4 + len(testTIFF()))},
+	}
+	items[1].ID, items[2].ID = 2, 3
+	if !reflect.DeepEqual(f.Movie.Items, items) {
+		t.Fatalf("элементы\n%+v\nвместо\n%+v", f.Movie.Items, items)
+	}
+	exif := map[string]string{"Make": "Apple", "Model": "iPhone 12", "Orientation": "6", "DateTimeOriginal": "2021:05:01 12:00:00"}
+	if !reflect.DeepEqual(f.Movie.Exif, exif) {
+		t.Fatalf("Exif %v вместо %v", f.Movie.Exif, exif)
+	}
+}
+
+func TestExifLoop(t *testing.T) {
+	// каталог Exif ссылается сам на себя
+	data := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 2, 0,
+		0x69, 0x87, tiffLong, 0, 1, 0, 0, 0, 8, 0, 0, 0,
+		0x0F, 0x01, tiffASCII, 0, 4, 0, 0, 0, 'A', 'B', 'C', 0}
+	if tags := parseExif(data); !reflect.DeepEqual(tags, map[string]string{"Make": "ABC"}) {
+		t.Fatalf("теги %v", tags)
+	}
+}
+
+func TestItemLocationsOverflow(t *testing.T) {
+	// iloc версии 1 с 8-байтовыми смещением, длиной и базовым смещением
+	location := func(base uint64, extents ...[2]uint64) []byte {
+		data := []byte{1, 0, 0, 0, 0x88, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}
+		data = binary.BigEndian.AppendUint64(data, base)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(extents)))
+		for _, e := range extents {
+			data = binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(data, e[0]), e[1])
+		}
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"допустимые участки", location(100, [2]uint64{0, 10}, [2]uint64{10, 10}), nil},
+		{"переполнение смещения", location(math.MaxUint64-5, [2]uint64{10, 10}), ErrFileIsNotValid},
+		{"длина больше MaxInt64", location(0, [2]uint64{0, math.MaxUint64}), ErrFileIsNotValid},
+		{"конец участка за MaxInt64", location(0, [2]uint64{math.MaxInt64 - 5, 10}), ErrFileIsNotValid},
+		{"переполнение размера элемента", location(0, [2]uint64{0, math.MaxInt64}, [2]uint64{0, 10}), ErrFileIsNotValid},
+	}
+	for _, test := range tests {
+		h := &heifFile{items: make(map[uint32]*heifItem)}
+		if err := h.readItemLocations(test.data); err != test.err {
+			t.Fatalf("%s: ошибка %v вместо %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSkipOverlappingExtents(t *testing.T) {
+	// второй участок перекрывается с первым и не загружается, третий загружается после него
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	extents := []*heifExtent{{offset: 0, length: 10}, {offset: 5, length: 10}, {offset: 20, length: 5}}
+	h := &heifFile{r: bufio.NewReader(bytes.NewReader(data)), pending: append([]*heifExtent{}, extents...)}
+	if err := h.skip(0, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extents[0].data, data[:10]) || extents[1].data != nil || !bytes.Equal(extents[2].data, data[20:25]) ||
+		h.pos != int64(len(data)) {
+		t.Fatalf("участки %v %v %v, позиция %d", extents[0].data, extents[1].data, extents[2].data, h.pos)
+	}
+}
@@ -0,0 +1,775 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор файлов Matroska/WebM (формат EBML) в общую модель метаданных видеофайла
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Идентификаторы элементов EBML/Matroska
+const (
+	ebmlHeaderID  = 0x1A45DFA3 // заголовок EBML
+	ebmlDocTypeID = 0x4282     // тип документа (matroska, webm)
+
+	mkvSegmentID     = 0x18538067 // сегмент - корневой элемент Matroska
+	mkvSeekHeadID    = 0x114D9B74 // индекс элементов сегмента
+	mkvInfoID        = 0x1549A966 // общие сведения о сегменте
+	mkvTracksID      = 0x1654AE6B // описание дорожек
+	mkvClusterID     = 0x1F43B675 // кластер с блоками медиаданных
+	mkvCuesID        = 0x1C53BB6B // индекс ключевых кадров
+	mkvTagsID        = 0x1254C367 // теги
+	mkvChaptersID    = 0x1043A770 // главы
+	mkvAttachmentsID = 0x1941A469 // вложенные файлы
+
+	mkvTimecodeScaleID = 0x2AD7B1 // единица времени сегмента (нс)
+	mkvDurationID      = 0x4489   // продолжительность сегмента (в единицах времени сегмента)
+	mkvDateUTCID       = 0x4461   // дата создания (нс от 2001-01-01)
+	mkvTitleID         = 0x7BA9   // название
+
+	mkvTrackEntryID     = 0xAE     // описание дорожки
+	mkvTrackUIDID       = 0x73C5   // уникальный идентификатор дорожки
+	mkvTrackTypeID      = 0x83     // тип дорожки
+	mkvTrackNameID      = 0x536E   // название дорожки
+	mkvLanguageID       = 0x22B59C // язык (ISO 639-2)
+	mkvLanguageIETFID   = 0x22B59D // язык (BCP 47)
+	mkvCodecIDID        = 0x86     // идентификатор формата сжатия
+	mkvCodecPrivateID   = 0x63A2   // параметры декодера
+	mkvVideoID          = 0xE0     // параметры видео
+	mkvPixelWidthID     = 0xB0     // ширина (пиксель)
+	mkvPixelHeightID    = 0xBA     // высота (пиксель)
+	mkvColourID         = 0x55B0   // параметры цвета
+	mkvBitsPerChannelID = 0x55B2   // глубина цвета на канал (бит)
+	mkvAudioID          = 0xE1     // параметры звука
+	mkvSamplingFreqID   = 0xB5     // частота дискретизации (Гц)
+	mkvChannelsID       = 0x9F     // количество каналов
+
+	mkvTagID          = 0x7373 // тег
+	mkvTargetsID      = 0x63C0 // к чему относится тег
+	mkvTagTrackUIDID  = 0x63C5 // дорожка, к которой относится тег
+	mkvSimpleTagID    = 0x67C8 // значение тега
+	mkvTagNameID      = 0x45A3 // наименование тега
+	mkvTagStringID    = 0x4487 // строковое значение тега
+	mkvEditionEntryID = 0x45B9 // редакция глав
+	mkvChapterAtomID  = 0xB6   // глава
+	mkvChapterStartID = 0x91   // начало главы (нс)
+	mkvChapterEndID   = 0x92   // окончание главы (нс)
+	mkvChapDisplayID  = 0x80   // отображаемое название главы
+	mkvChapStringID   = 0x85   // название главы
+	mkvCuePointID     = 0xBB   // точка индекса
+	mkvCueTimeID      = 0xB3   // время точки индекса
+	mkvCuePositionsID = 0xB7   // расположение точки индекса
+	mkvCueTrackID     = 0xF7   // дорожка точки индекса
+	mkvCueClusterID   = 0xF1   // позиция кластера относительно начала данных сегмента
+	mkvAttachedFileID = 0x61A7 // вложенный файл
+	mkvFileNameID     = 0x466E // имя файла
+	mkvFileMimeTypeID = 0x4660 // тип содержимого файла
+	mkvFileDescID     = 0x467E // описание файла
+	mkvFileDataID     = 0x465C // содержимое файла
+)
+
+// Типы дорожек Matroska
+const (
+	mkvTrackVideo    = 1
+	mkvTrackAudio    = 2
+	mkvTrackSubtitle = 17
+)
+
+// ebmlMagic начало файла EBML
+var ebmlMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+
+// isMatroska является ли начало потока заголовком EBML (Matroska/WebM)
+func isMatroska(header []byte) bool {
+	return bytes.HasPrefix(header, ebmlMagic)
+}
+
+// maxEBMLElementSize наибольший размер элемента EBML, загружаемого в память (байт)
+const maxEBMLElementSize = 64 << 20
+
+// ebmlUnknownSize размер элемента не указан (элемент продолжается до начала следующего элемента верхнего уровня)
+const ebmlUnknownSize = -1
+
+// mkvTopLevel элементы верхнего уровня сегмента, которыми завершается кластер неизвестного размера
+var mkvTopLevel = map[uint32]bool{
+	mkvSeekHeadID: true, mkvInfoID: true, mkvTracksID: true, mkvClusterID: true,
+	mkvCuesID: true, mkvTagsID: true, mkvChaptersID: true, mkvAttachmentsID: true,
+}
+
+// Chapter глава видеофайла
+type Chapter struct {
+	Title string  // название
+	Start float64 // начало (сек)
+	End   float64 `json:",omitempty"` // окончание (сек)
+}
+
+// Cue точка индекса ключевых кадров
+type Cue struct {
+	Time     float64 // время (сек)
+	Track    uint64  // номер дорожки
+	Position uint64  // позиция кластера относительно начала данных сегмента (байт)
+}
+
+// Attachment вложенный файл (шрифты, обложки)
+type Attachment struct {
+	Name        string // имя файла
+	MimeType    string // тип содержимого
+	Description string `json:",omitempty"` // описание
+	Size        int64  // размер (байт)
+}
+
+// ebmlReader последовательное чтение элементов EBML из потока
+type ebmlReader struct {
+	r   *bufio.Reader
+	pos int64 // количество прочитанных байт
+}
+
+// readVint чтение целого числа переменной длины; для размеров маркер длины отбрасывается,
+// для идентификаторов - сохраняется
+func (e *ebmlReader) readVint(keepMarker bool) (value int64, length int, err error) {
+	first, err := e.r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	e.pos++
+	length = 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		if mask == 0x1 {
+			return 0, 0, ErrFileIsNotValid
+		}
+		length++
+	}
+	value = int64(first)
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+	allOnes := value == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := e.r.ReadByte()
+		if err != nil {
+			return 0, 0, ErrFileIsNotValid
+		}
+		e.pos++
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, length, nil
+	}
+	return value, length, nil
+}
+
+// readHeader чтение идентификатора и размера элемента
+func (e *ebmlReader) readHeader() (id uint32, size int64, err error) {
+	value, length, err := e.readVint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if length > 4 {
+		return 0, 0, ErrFileIsNotValid
+	}
+	if size, _, err = e.readVint(false); err != nil {
+		return 0, 0, ErrFileIsNotValid
+	}
+	return uint32(value), size, nil
+}
+
+// readData чтение содержимого элемента
+func (e *ebmlReader) readData(size int64) ([]byte, error) {
+	if size < 0 || size > maxEBMLElementSize {
+		return nil, ErrFileIsNotValid
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(e.r, data)
+	e.pos += int64(n)
+	if err != nil {
+		return nil, ErrFileIsNotValid
+	}
+	return data, nil
+}
+
+// skip пропуск содержимого элемента
+func (e *ebmlReader) skip(size int64) error {
+	if size < 0 {
+		return ErrFileIsNotValid
+	}
+	n, err := e.r.Discard(int(size))
+	e.pos += int64(n)
+	if err != nil {
+		return ErrFileIsNotValid
+	}
+	return nil
+}
+
+// readMaster чтение дочерних элементов элемента размером size; handle должен прочитать
+// или пропустить содержимое каждого дочернего элемента
+func (e *ebmlReader) readMaster(size int64, handle func(id uint32, size int64) error) error {
+	if size < 0 {
+		return ErrFileIsNotValid
+	}
+	end := e.pos + size
+	for e.pos < end {
+		id, childSize, err := e.readHeader()
+		if err != nil {
+			return ErrFileIsNotValid
+		}
+		if childSize < 0 || e.pos+childSize > end {
+			return ErrFileIsNotValid
+		}
+		start := e.pos
+		if err = handle(id, childSize); err != nil {
+			return err
+		}
+		if e.pos != start+childSize {
+			return ErrFileIsNotValid
+		}
+	}
+	return nil
+}
+
+// readUint чтение беззнакового целого
+func (e *ebmlReader) readUint(size int64) (uint64, error) {
+	data, err := e.readData(size)
+	if err != nil || size > 8 {
+		return 0, ErrFileIsNotValid
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+// readInt чтение целого со знаком
+func (e *ebmlReader) readInt(size int64) (int64, error) {
+	value, err := e.readUint(size)
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	shift := 64 - 8*uint(size)
+	return int64(value<<shift) >> shift, nil
+}
+
+// readFloat чтение числа с плавающей точкой (4 или 8 байт)
+func (e *ebmlReader) readFloat(size int64) (float64, error) {
+	data, err := e.readData(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	}
+	return 0, ErrFileIsNotValid
+}
+
+// readString чтение строки (завершающие нули отбрасываются)
+func (e *ebmlReader) readString(size int64) (string, error) {
+	data, err := e.readData(size)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\x00"), nil
+}
+
+// matroskaReader заполнение модели метаданных по элементам сегмента Matroska
+type matroskaReader struct {
+	*ebmlReader
+	file          *VideoFile
+	timecodeScale uint64         // единица времени сегмента (нс)
+	duration      float64        // продолжительность (в единицах времени сегмента)
+	trackUIDs     map[uint64]int // номера дорожек модели по уникальным идентификаторам
+	cues          []Cue          // точки индекса (время - в единицах времени сегмента)
+}
+
+// readMatroska разбор файла Matroska/WebM из потока
+func (f *VideoFile) readMatroska(r *bufio.Reader) error {
+	m := &matroskaReader{
+		ebmlReader:    &ebmlReader{r: r},
+		file:          f,
+		timecodeScale: 1000000,
+		trackUIDs:     make(map[uint64]int),
+	}
+	id, size, err := m.readHeader()
+	if err != nil || id != ebmlHeaderID {
+		return ErrFileIsNotValid
+	}
+	var docType string
+	err = m.readMaster(size, func(id uint32, size int64) (err error) {
+		if id == ebmlDocTypeID {
+			docType, err = m.readString(size)
+			return err
+		}
+		return m.skip(size)
+	})
+	if err != nil {
+		return err
+	}
+	switch docType {
+	case "matroska":
+		f.Codec = "Matroska"
+	case "webm":
+		f.Codec = "WebM"
+	default:
+		return ErrFileCodecNotSupported
+	}
+	if id, size, err = m.readHeader(); err != nil || id != mkvSegmentID {
+		return ErrFileIsNotValid
+	}
+	if err = m.readSegment(size); err != nil {
+		return err
+	}
+	m.finish()
+	// данные после сегмента учитываются только в размере файла
+	rest, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return NewAPIError("ошибка при получении файла", err)
+	}
+	f.Size = int(m.pos + rest)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// readSegment чтение элементов верхнего уровня сегмента; кластеры пропускаются
+func (m *matroskaReader) readSegment(size int64) error {
+	end := int64(math.MaxInt64)
+	if size != ebmlUnknownSize {
+		end = m.pos + size
+	}
+	var pending bool
+	var id uint32
+	var childSize int64
+	for m.pos < end || pending {
+		if !pending {
+			var err error
+			id, childSize, err = m.readHeader()
+			// сегмент неизвестного размера продолжается до конца файла, обрезанный файл разбирается до места обрыва
+			if err == io.EOF || errors.Is(err, ErrFileIsNotValid) && size == ebmlUnknownSize {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		pending = false
+		var err error
+		switch {
+		case id == mkvClusterID && childSize == ebmlUnknownSize:
+			// кластер неизвестного размера заканчивается началом следующего элемента верхнего уровня
+			id, childSize, pending, err = m.skipCluster()
+		case childSize == ebmlUnknownSize:
+			return ErrFileIsNotValid
+		case id == mkvInfoID:
+			err = m.readInfo(childSize)
+		case id == mkvTracksID:
+			err = m.readMaster(childSize, func(id uint32, size int64) error {
+				if id == mkvTrackEntryID {
+					return m.readTrackEntry(size)
+				}
+				return m.skip(size)
+			})
+		case id == mkvTagsID:
+			err = m.readMaster(childSize, func(id uint32, size int64) error {
+				if id == mkvTagID {
+					return m.readTag(size)
+				}
+				return m.skip(size)
+			})
+		case id == mkvChaptersID:
+			err = m.readMaster(childSize, func(id uint32, size int64) error {
+				if id == mkvEditionEntryID {
+					return m.readChapters(size)
+				}
+				return m.skip(size)
+			})
+		case id == mkvCuesID:
+			err = m.readCues(childSize)
+		case id == mkvAttachmentsID:
+			err = m.readAttachments(childSize)
+		default:
+			err = m.skip(childSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipCluster пропуск кластера неизвестного размера, возвращает заголовок следующего элемента верхнего уровня
+func (m *matroskaReader) skipCluster() (id uint32, size int64, found bool, err error) {
+	for {
+		id, size, err = m.readHeader()
+		if err == io.EOF {
+			return 0, 0, false, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if mkvTopLevel[id] {
+			return id, size, true, nil
+		}
+		if err = m.skip(size); err != nil {
+			return 0, 0, false, err
+		}
+	}
+}
+
+// readInfo чтение общих сведений о сегменте
+func (m *matroskaReader) readInfo(size int64) error {
+	return m.readMaster(size, func(id uint32, size int64) (err error) {
+		switch id {
+		case mkvTimecodeScaleID:
+			if m.timecodeScale, err = m.readUint(size); err == nil && m.timecodeScale == 0 {
+				err = ErrFileIsNotValid
+			}
+		case mkvDurationID:
+			m.duration, err = m.readFloat(size)
+		case mkvDateUTCID:
+			var ns int64
+			if ns, err = m.readInt(size); err == nil {
+				created := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(ns))
+				m.file.Movie.Created, m.file.Movie.Modified = created, created
+			}
+		case mkvTitleID:
+			var title string
+			if title, err = m.readString(size); err == nil {
+				m.setTag(&m.file.Movie.Tags, "TITLE", title)
+			}
+		default:
+			err = m.skip(size)
+		}
+		return err
+	})
+}
+
+// setTag установка значения тега
+func (m *matroskaReader) setTag(tags *map[string]string, name, value string) {
+	if *tags == nil {
+		*tags = make(map[string]string)
+	}
+	(*tags)[name] = value
+}
+
+// readTrackEntry чтение описания дорожки
+func (m *matroskaReader) readTrackEntry(size int64) error {
+	var trackType, uid, channels, bits uint64
+	var codecID, language, languageIETF string
+	var samplingFrequency float64
+	track := Track{}
+	err := m.readMaster(size, func(id uint32, size int64) (err error) {
+		switch id {
+		case mkvTrackTypeID:
+			trackType, err = m.readUint(size)
+		case mkvTrackUIDID:
+			uid, err = m.readUint(size)
+		case mkvTrackNameID:
+			track.Name, err = m.readString(size)
+		case mkvLanguageID:
+			language, err = m.readString(size)
+		case mkvLanguageIETFID:
+			languageIETF, err = m.readString(size)
+		case mkvCodecIDID:
+			codecID, err = m.readString(size)
+		case mkvCodecPrivateID:
+			track.CodecPrivate, err = m.readData(size)
+		case mkvVideoID:
+			err = m.readMaster(size, func(id uint32, size int64) (err error) {
+				var value uint64
+				switch id {
+				case mkvPixelWidthID:
+					value, err = m.readUint(size)
+					track.Width = uint32(value)
+				case mkvPixelHeightID:
+					value, err = m.readUint(size)
+					track.Height = uint32(value)
+				case mkvColourID:
+					err = m.readMaster(size, func(id uint32, size int64) (err error) {
+						if id == mkvBitsPerChannelID {
+							bits, err = m.readUint(size)
+							return err
+						}
+						return m.skip(size)
+					})
+				default:
+					err = m.skip(size)
+				}
+				return err
+			})
+		case mkvAudioID:
+			err = m.readMaster(size, func(id uint32, size int64) (err error) {
+				switch id {
+				case mkvSamplingFreqID:
+					samplingFrequency, err = m.readFloat(size)
+				case mkvChannelsID:
+					channels, err = m.readUint(size)
+				default:
+					err = m.skip(size)
+				}
+				return err
+			})
+		default:
+			err = m.skip(size)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// язык по умолчанию - английский
+	track.Language = languageIETF
+	if track.Language == "" {
+		track.Language = language
+	}
+	if track.Language == "" {
+		track.Language = "eng"
+	}
+	stream := new(Stream)
+	switch trackType {
+	case mkvTrackVideo:
+		stream.Type = Video
+		track.Stream = &VideoStream{Stream: stream, Format: codecID, ColorDepth: uint16(bits * 3)}
+	case mkvTrackAudio:
+		stream.Type = Audio
+		// значения по умолчанию: 8000 Гц, один канал
+		if samplingFrequency == 0 {
+			samplingFrequency = 8000
+		}
+		audio := &AudioStream{Stream: stream, AudioBalance: "normal", Format: codecID, SampleRate: uint32(samplingFrequency)}
+		if channels == 0 {
+			channels = 1
+		}
+		audio.Channels = channelLayout(uint16(channels))
+		track.Stream = audio
+	case mkvTrackSubtitle:
+		stream.Type = Subtitle
+		track.Stream = stream
+	default:
+		track.Stream = stream
+	}
+	m.trackUIDs[uid] = len(m.file.Movie.Tracks)
+	m.file.Movie.Tracks = append(m.file.Movie.Tracks, track)
+	return nil
+}
+
+// readTag чтение тега; теги без указания дорожек относятся ко всему файлу
+func (m *matroskaReader) readTag(size int64) error {
+	var uids []uint64
+	tags := make(map[string]string)
+	err := m.readMaster(size, func(id uint32, size int64) (err error) {
+		switch id {
+		case mkvTargetsID:
+			err = m.readMaster(size, func(id uint32, size int64) error {
+				if id == mkvTagTrackUIDID {
+					uid, err := m.readUint(size)
+					if uid != 0 {
+						uids = append(uids, uid)
+					}
+					return err
+				}
+				return m.skip(size)
+			})
+		case mkvSimpleTagID:
+			err = m.readSimpleTag(size, tags)
+		default:
+			err = m.skip(size)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for name, value := range tags {
+		if len(uids) == 0 {
+			m.setTag(&m.file.Movie.Tags, name, value)
+		}
+		for _, uid := range uids {
+			if i, ok := m.trackUIDs[uid]; ok {
+				m.setTag(&m.file.Movie.Tracks[i].Tags, name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// readSimpleTag чтение значения тега; имена вложенных тегов записываются через точку
+func (m *matroskaReader) readSimpleTag(size int64, tags map[string]string) error {
+	var name, value string
+	var hasValue bool
+	nested := make(map[string]string)
+	err := m.readMaster(size, func(id uint32, size int64) (err error) {
+		switch id {
+		case mkvTagNameID:
+			name, err = m.readString(size)
+		case mkvTagStringID:
+			value, err = m.readString(size)
+			hasValue = true
+		case mkvSimpleTagID:
+			err = m.readSimpleTag(size, nested)
+		default:
+			err = m.skip(size)
+		}
+		return err
+	})
+	if err != nil || name == "" {
+		return err
+	}
+	if hasValue {
+		tags[name] = value
+	}
+	for k, v := range nested {
+		tags[name+"."+k] = v
+	}
+	return nil
+}
+
+// readChapters чтение глав редакции (вложенные главы разворачиваются в общий список)
+func (m *matroskaReader) readChapters(size int64) error {
+	return m.readMaster(size, func(id uint32, size int64) error {
+		if id == mkvChapterAtomID {
+			return m.readChapterAtom(size)
+		}
+		return m.skip(size)
+	})
+}
+
+// readChapterAtom чтение главы
+func (m *matroskaReader) readChapterAtom(size int64) error {
+	var chapter Chapter
+	var start, end uint64
+	index := len(m.file.Movie.Chapters)
+	m.file.Movie.Chapters = append(m.file.Movie.Chapters, chapter)
+	err := m.readMaster(size, func(id uint32, size int64) (err error) {
+		switch id {
+		case mkvChapterStartID:
+			start, err = m.readUint(size)
+		case mkvChapterEndID:
+			end, err = m.readUint(size)
+		case mkvChapDisplayID:
+			err = m.readMaster(size, func(id uint32, size int64) (err error) {
+				if id == mkvChapStringID && chapter.Title == "" {
+					chapter.Title, err = m.readString(size)
+					return err
+				}
+				return m.skip(size)
+			})
+		case mkvChapterAtomID:
+			err = m.readChapterAtom(size)
+		default:
+			err = m.skip(size)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	chapter.Start = time.Duration(start).Seconds()
+	chapter.End = time.Duration(end).Seconds()
+	m.file.Movie.Chapters[index] = chapter
+	return nil
+}
+
+// readCues чтение индекса ключевых кадров
+func (m *matroskaReader) readCues(size int64) error {
+	return m.readMaster(size, func(id uint32, size int64) error {
+		if id != mkvCuePointID {
+			return m.skip(size)
+		}
+		var cueTime uint64
+		var positions []Cue
+		err := m.readMaster(size, func(id uint32, size int64) (err error) {
+			switch id {
+			case mkvCueTimeID:
+				cueTime, err = m.readUint(size)
+			case mkvCuePositionsID:
+				var cue Cue
+				err = m.readMaster(size, func(id uint32, size int64) (err error) {
+					switch id {
+					case mkvCueTrackID:
+						cue.Track, err = m.readUint(size)
+					case mkvCueClusterID:
+						cue.Position, err = m.readUint(size)
+					default:
+						err = m.skip(size)
+					}
+					return err
+				})
+				positions = append(positions, cue)
+			default:
+				err = m.skip(size)
+			}
+			return err
+		})
+		for _, cue := range positions {
+			cue.Time = float64(cueTime)
+			m.cues = append(m.cues, cue)
+		}
+		return err
+	})
+}
+
+// readAttachments чтение сведений о вложенных файлах без загрузки их содержимого
+func (m *matroskaReader) readAttachments(size int64) error {
+	return m.readMaster(size, func(id uint32, size int64) error {
+		if id != mkvAttachedFileID {
+			return m.skip(size)
+		}
+		var file Attachment
+		err := m.readMaster(size, func(id uint32, size int64) (err error) {
+			switch id {
+			case mkvFileNameID:
+				file.Name, err = m.readString(size)
+			case mkvFileMimeTypeID:
+				file.MimeType, err = m.readString(size)
+			case mkvFileDescID:
+				file.Description, err = m.readString(size)
+			case mkvFileDataID:
+				file.Size = size
+				err = m.skip(size)
+			default:
+				err = m.skip(size)
+			}
+			return err
+		})
+		m.file.Movie.Attachments = append(m.file.Movie.Attachments, file)
+		return err
+	})
+}
+
+// finish перевод времени из единиц времени сегмента в секунды, единица времени дорожек - единица
+// времени сегмента, известная только после разбора всего сегмента (Info может следовать за Tracks)
+func (m *matroskaReader) finish() {
+	movie := &m.file.Movie
+	movie.TimeScale = uint32(1e9 / m.timecodeScale)
+	movie.Duration = time.Duration(m.duration * float64(m.timecodeScale)).Seconds()
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	for i := range movie.Tracks {
+		movie.Tracks[i].Created, movie.Tracks[i].Modified = movie.Created, movie.Modified
+		movie.Tracks[i].Duration = movie.Duration
+		switch stream := movie.Tracks[i].Stream.(type) {
+		case *Stream:
+			stream.Duration, stream.TimeScale = movie.Duration, movie.TimeScale
+		case *VideoStream:
+			stream.Duration, stream.TimeScale = movie.Duration, movie.TimeScale
+		case *AudioStream:
+			stream.Duration, stream.TimeScale = movie.Duration, movie.TimeScale
+		}
+	}
+	for _, cue := range m.cues {
+		cue.Time = time.Duration(cue.Time * float64(m.timecodeScale)).Seconds()
+		movie.Cues = append(movie.Cues, cue)
+	}
+}
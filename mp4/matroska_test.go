@@ -0,0 +1,161 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора файлов Matroska/WebM
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// ebmlElement элемент EBML с идентификатором id (вместе с маркером длины) и содержимым из частей body
+func ebmlElement(id uint32, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	var e []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(e) > 0 {
+			e = append(e, b)
+		}
+	}
+	// размер - 8-байтное целое переменной длины
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	size[0] = 0x01
+	return append(append(e, size...), data...)
+}
+
+// ebmlUint элемент с беззнаковым целым значением
+func ebmlUint(id uint32, value uint64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+// ebmlFloat элемент с 8-байтным значением с плавающей точкой
+func ebmlFloat(id uint32, value float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+// ebmlString элемент со строковым значением
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+// testWebM файл WebM из видеодорожки VP9 и звуковой дорожки Opus с тегом дорожки, главой, кластером
+// неизвестного размера и индексом ключевых кадров после него
+func testWebM(segment ...[]byte) []byte {
+	header := ebmlElement(ebmlHeaderID, ebmlString(ebmlDocTypeID, "webm"))
+	if segment == nil {
+		segment = [][]byte{
+			ebmlElement(mkvInfoID,
+				ebmlUint(mkvTimecodeScaleID, 1000000),
+				ebmlFloat(mkvDurationID, 2500),
+				ebmlUint(mkvDateUTCID, uint64(24*time.Hour)),
+				ebmlString(mkvTitleID, "Test")),
+			testWebMTracks(),
+			ebmlElement(mkvTagsID, ebmlElement(mkvTagID,
+				ebmlElement(mkvTargetsID, ebmlUint(mkvTagTrackUIDID, 22)),
+				ebmlElement(mkvSimpleTagID, ebmlString(mkvTagNameID, "ARTIST"), ebmlString(mkvTagStringID, "Someone")))),
+			ebmlElement(mkvChaptersID, ebmlElement(mkvEditionEntryID, ebmlElement(mkvChapterAtomID,
+				ebmlUint(mkvChapterStartID, 0),
+				ebmlUint(mkvChapterEndID, uint64(time.Second)),
+				ebmlElement(mkvChapDisplayID, ebmlString(mkvChapStringID, "Intro"))))),
+			// кластер неизвестного размера с одним блоком
+			{0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+			ebmlUint(0xE7, 0),
+			ebmlElement(0xA3, []byte{0x81, 0, 0, 0x80, 1, 2, 3}),
+			ebmlElement(mkvCuesID, ebmlElement(mkvCuePointID,
+				ebmlUint(mkvCueTimeID, 500),
+				ebmlElement(mkvCuePositionsID, ebmlUint(mkvCueTrackID, 1), ebmlUint(mkvCueClusterID, 300)))),
+		}
+	}
+	return append(header, ebmlElement(mkvSegmentID, segment...)...)
+}
+
+// testWebMTracks описание дорожек тестового файла WebM
+func testWebMTracks() []byte {
+	return ebmlElement(mkvTracksID,
+		ebmlElement(mkvTrackEntryID,
+			ebmlUint(mkvTrackTypeID, mkvTrackVideo),
+			ebmlUint(mkvTrackUIDID, 11),
+			ebmlString(mkvCodecIDID, "V_VP9"),
+			ebmlElement(mkvVideoID, ebmlUint(mkvPixelWidthID, 640), ebmlUint(mkvPixelHeightID, 360))),
+		ebmlElement(mkvTrackEntryID,
+			ebmlUint(mkvTrackTypeID, mkvTrackAudio),
+			ebmlUint(mkvTrackUIDID, 22),
+			ebmlString(mkvCodecIDID, "A_OPUS"),
+			ebmlString(mkvLanguageID, "rus"),
+			ebmlElement(mkvAudioID, ebmlFloat(mkvSamplingFreqID, 48000), ebmlUint(mkvChannelsID, 2))))
+}
+
+func TestMatroska(t *testing.T) {
+	data := testWebM()
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Codec != "WebM" || f.Size != len(data) {
+		t.Fatalf("формат %q, размер %d вместо WebM, %d", f.Codec, f.Size, len(data))
+	}
+	movie := f.Movie
+	created := time.Date(2001, 1, 2, 0, 0, 0, 0, time.UTC)
+	if movie.Duration != 2.5 || movie.TimeScale != 1000 || !movie.Created.Equal(created) || movie.Tags["TITLE"] != "Test" {
+		t.Fatalf("сведения о сегменте: %+v", movie)
+	}
+	if len(movie.Tracks) != 2 {
+		t.Fatalf("%d дорожек вместо 2", len(movie.Tracks))
+	}
+	video, ok := movie.Tracks[0].Stream.(*VideoStream)
+	if !ok || video.Format != "V_VP9" || video.Duration != 2.5 {
+		t.Fatalf("видеопоток: %+v", movie.Tracks[0].Stream)
+	}
+	if track := movie.Tracks[0]; track.Width != 640 || track.Height != 360 || track.Language != "eng" {
+		t.Fatalf("видеодорожка: %+v", track)
+	}
+	audio, ok := movie.Tracks[1].Stream.(*AudioStream)
+	if !ok || audio.Format != "A_OPUS" || audio.SampleRate != 48000 || audio.Channels != "Stereo" {
+		t.Fatalf("звуковой поток: %+v", movie.Tracks[1].Stream)
+	}
+	if track := movie.Tracks[1]; track.Language != "rus" || track.Tags["ARTIST"] != "Someone" || movie.Tags["ARTIST"] != "" {
+		t.Fatalf("звуковая дорожка: %+v", track)
+	}
+	if len(movie.Chapters) != 1 || movie.Chapters[0] != (Chapter{Title: "Intro", Start: 0, End: 1}) {
+		t.Fatalf("главы: %+v", movie.Chapters)
+	}
+	// индекс после кластера неизвестного размера
+	if len(movie.Cues) != 1 || movie.Cues[0] != (Cue{Time: 0.5, Track: 1, Position: 300}) {
+		t.Fatalf("индекс: %+v", movie.Cues)
+	}
+}
+
+func TestMatroskaDocType(t *testing.T) {
+	data := append(ebmlElement(ebmlHeaderID, ebmlString(ebmlDocTypeID, "other")), ebmlElement(mkvSegmentID)...)
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != ErrFileCodecNotSupported {
+		t.Fatalf("ошибка %v вместо %v", err, ErrFileCodecNotSupported)
+	}
+}
+
+func TestMatroskaTracksBeforeInfo(t *testing.T) {
+	// единица времени дорожек определяется по Info, следующему за Tracks
+	data := testWebM(testWebMTracks(), ebmlElement(mkvInfoID,
+		ebmlUint(mkvTimecodeScaleID, 100000),
+		ebmlFloat(mkvDurationID, 25000)))
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Movie.TimeScale != 10000 || f.Movie.Duration != 2.5 || len(f.Movie.Tracks) != 2 {
+		t.Fatalf("сведения о сегменте: %+v", f.Movie)
+	}
+	video, ok := f.Movie.Tracks[0].Stream.(*VideoStream)
+	if !ok || video.TimeScale != 10000 {
+		t.Fatalf("видеопоток %+v", f.Movie.Tracks[0].Stream)
+	}
+	audio, ok := f.Movie.Tracks[1].Stream.(*AudioStream)
+	if !ok || audio.TimeScale != 10000 {
+		t.Fatalf("аудиопоток %+v", f.Movie.Tracks[1].Stream)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор фрагментов (moof/traf/trun) и сборка фрагментированного файла в обычный (progressive) MP4
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Флаги блока tfhd
+const (
+	tfhdBaseDataOffset    = 0x000001 // указано базовое смещение данных
+	tfhdDescriptionIndex  = 0x000002 // указан номер описания сэмплов
+	tfhdDefaultDuration   = 0x000008 // указана продолжительность сэмпла по умолчанию
+	tfhdDefaultSize       = 0x000010 // указан размер сэмпла по умолчанию
+	tfhdDefaultFlags      = 0x000020 // указаны флаги сэмпла по умолчанию
+	tfhdDefaultBaseIsMoof = 0x020000 // базовое смещение данных - начало блока moof
+)
+
+// Флаги блока trun
+const (
+	trunDataOffset       = 0x000001 // указано смещение данных
+	trunFirstSampleFlags = 0x000004 // указаны флаги первого сэмпла
+	trunDuration         = 0x000100 // указана продолжительность каждого сэмпла
+	trunSize             = 0x000200 // указан размер каждого сэмпла
+	trunFlags            = 0x000400 // указаны флаги каждого сэмпла
+	trunCTSOffset        = 0x000800 // указано смещение времени отображения каждого сэмпла
+)
+
+// trackDefaults значения по умолчанию для сэмплов дорожки во фрагментах (trex, tfhd)
+type trackDefaults struct {
+	description uint32
+	duration    uint32
+	size        uint32
+	flags       uint32
+}
+
+// Defragment сборка фрагментированного файла r (fMP4) в обычный файл w: сэмплы всех фрагментов
+// переносятся в таблицы сэмплов moov (stts/ctts/stsz/stsc/co64/stss), медиаданные - в единый блок mdat,
+// описание фрагментов (mvex) удаляется
+func Defragment(r io.ReadSeeker, w io.Writer) error {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return err
+	}
+	return writeProgressive(w, m.src, m.fileType(), m.movie, m.tracks)
+}
+
+// readFragments добавление сэмплов из фрагментов (блоков moof верхнего уровня) к сэмплам дорожек
+func readFragments(boxes []*Box, movie *Box, tracks []*mediaTrack) error {
+	defaults := make(map[uint32]trackDefaults)
+	for _, trex := range movie.FindAll("mvex/trex") {
+		if len(trex.Data) < 24 {
+			return ErrBadFragment
+		}
+		defaults[binary.BigEndian.Uint32(trex.Data[4:])] = trackDefaults{
+			description: binary.BigEndian.Uint32(trex.Data[8:]),
+			duration:    binary.BigEndian.Uint32(trex.Data[12:]),
+			size:        binary.BigEndian.Uint32(trex.Data[16:]),
+			flags:       binary.BigEndian.Uint32(trex.Data[20:]),
+		}
+	}
+	byID := make(map[uint32]*mediaTrack, len(tracks))
+	for _, t := range tracks {
+		byID[t.ID] = t
+	}
+	// данные сэмплов не могут выходить за конец файла
+	var fileEnd int64
+	for _, b := range boxes {
+		if end := b.offset + b.size; end > fileEnd {
+			fileEnd = end
+		}
+	}
+	for _, moof := range boxes {
+		if moof.Type != "moof" {
+			continue
+		}
+		if !moof.IsContainer() {
+			return ErrBadFragment
+		}
+		// при отсутствии базового смещения первая дорожка отсчитывает данные от начала moof,
+		// следующие - от конца данных предыдущей дорожки
+		dataEnd := moof.offset
+		for _, traf := range moof.FindAll("traf") {
+			var err error
+			if dataEnd, err = readTrackFragment(traf, moof.offset, dataEnd, fileEnd, defaults, byID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readTrackFragment разбор блока traf, возвращает позицию конца данных фрагмента дорожки
+func readTrackFragment(traf *Box, moofOffset, dataEnd, fileEnd int64, defaults map[uint32]trackDefaults, byID map[uint32]*mediaTrack) (int64, error) {
+	tfhd := traf.Child("tfhd")
+	if tfhd == nil || len(tfhd.Data) < 8 {
+		return 0, ErrBadFragment
+	}
+	flags := binary.BigEndian.Uint32(tfhd.Data) & 0xFFFFFF
+	t := byID[binary.BigEndian.Uint32(tfhd.Data[4:])]
+	if t == nil {
+		return 0, ErrBadFragment
+	}
+	d := defaults[t.ID]
+	base := dataEnd
+	if flags&tfhdDefaultBaseIsMoof != 0 {
+		base = moofOffset
+	}
+	fields := tfhd.Data[8:]
+	if flags&tfhdBaseDataOffset != 0 {
+		if len(fields) < 8 {
+			return 0, ErrBadFragment
+		}
+		base = int64(binary.BigEndian.Uint64(fields))
+		fields = fields[8:]
+	}
+	for _, field := range []struct {
+		flag  uint32
+		value *uint32
+	}{{tfhdDescriptionIndex, &d.description}, {tfhdDefaultDuration, &d.duration}, {tfhdDefaultSize, &d.size}, {tfhdDefaultFlags, &d.flags}} {
+		if flags&field.flag == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return 0, ErrBadFragment
+		}
+		*field.value = binary.BigEndian.Uint32(fields)
+		fields = fields[4:]
+	}
+	if d.description == 0 {
+		d.description = 1
+	}
+	// время декодирования первого сэмпла: из tfdt, либо продолжение предыдущих сэмплов дорожки
+	dts := t.duration()
+	if tfdt := traf.Child("tfdt"); tfdt != nil && len(tfdt.Data) >= 8 {
+		if tfdt.Data[0] == 0x1 && len(tfdt.Data) >= 12 {
+			dts = binary.BigEndian.Uint64(tfdt.Data[4:])
+		} else {
+			dts = uint64(binary.BigEndian.Uint32(tfdt.Data[4:]))
+		}
+	}
+	offset := base
+	for _, trun := range traf.FindAll("trun") {
+		var err error
+		if offset, dts, err = t.readTrackRun(trun.Data, base, offset, fileEnd, dts, d); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// readTrackRun разбор блока trun, возвращает позицию конца данных и время декодирования следующего сэмпла
+func (t *mediaTrack) readTrackRun(data []byte, base, offset, fileEnd int64, dts uint64, d trackDefaults) (int64, uint64, error) {
+	if len(data) < 8 {
+		return 0, 0, ErrBadFragment
+	}
+	version := data[0]
+	flags := binary.BigEndian.Uint32(data) & 0xFFFFFF
+	count := int(binary.BigEndian.Uint32(data[4:]))
+	data = data[8:]
+	if flags&trunDataOffset != 0 {
+		if len(data) < 4 {
+			return 0, 0, ErrBadFragment
+		}
+		offset = base + int64(int32(binary.BigEndian.Uint32(data)))
+		data = data[4:]
+	}
+	firstFlags := d.flags
+	if flags&trunFirstSampleFlags != 0 {
+		if len(data) < 4 {
+			return 0, 0, ErrBadFragment
+		}
+		firstFlags = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+	entrySize := 0
+	for _, flag := range []uint32{trunDuration, trunSize, trunFlags, trunCTSOffset} {
+		if flags&flag != 0 {
+			entrySize += 4
+		}
+	}
+	if entrySize > 0 && count > len(data)/entrySize {
+		return 0, 0, ErrBadFragment
+	}
+	// без записей сэмплов количество ограничивается только данными: сэмплы размера по умолчанию
+	// должны укладываться в файл
+	if entrySize == 0 && count > 0 && (d.size == 0 || offset < 0 || offset > fileEnd ||
+		uint64(count)*uint64(d.size) > uint64(fileEnd-offset)) {
+		return 0, 0, ErrBadFragment
+	}
+	for i := 0; i < count; i++ {
+		s := Sample{Offset: offset, DTS: dts, Duration: d.duration, Size: d.size, Description: d.description}
+		sampleFlags := d.flags
+		if i == 0 {
+			sampleFlags = firstFlags
+		}
+		entry := data[i*entrySize:]
+		if flags&trunDuration != 0 {
+			s.Duration = binary.BigEndian.Uint32(entry)
+			entry = entry[4:]
+		}
+		if flags&trunSize != 0 {
+			s.Size = binary.BigEndian.Uint32(entry)
+			entry = entry[4:]
+		}
+		if flags&trunFlags != 0 {
+			sampleFlags = binary.BigEndian.Uint32(entry)
+			entry = entry[4:]
+		}
+		if flags&trunCTSOffset != 0 {
+			s.CTSOffset = compositionOffset(binary.BigEndian.Uint32(entry), version)
+		}
+		s.Sync = sampleFlags&0x00010000 == 0
+		s.DependsOn = byte(sampleFlags >> 24 & 0x3)
+		s.Leading = byte(sampleFlags >> 26 & 0x3)
+		t.Samples = append(t.Samples, s)
+		offset += int64(s.Size)
+		dts += uint64(s.Duration)
+	}
+	return offset, dts, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора фрагментов и сборки фрагментированного файла в обычный
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestDefragmentRoundTrip(t *testing.T) {
+	data := testMovie(t)
+	var fragmented, out bytes.Buffer
+	if err := Fragment(bytes.NewReader(data), &fragmented, FragmentOptions{SegmentDuration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Defragment(bytes.NewReader(fragmented.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestMovie(t, out.Bytes())
+	if findBox(got.boxes, "moof") >= 0 || got.movie.Child("mvex") != nil {
+		t.Fatal("в собранном файле остались фрагменты")
+	}
+	compareMovies(t, readTestMovie(t, data), got)
+}
+
+func TestDefragmentInterleave(t *testing.T) {
+	// чанки дорожек чередуются по времени: ни один чанк не длиннее progressiveChunkDuration
+	var fragmented, out bytes.Buffer
+	if err := Fragment(bytes.NewReader(testMovie(t)), &fragmented, FragmentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Defragment(bytes.NewReader(fragmented.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestMovie(t, out.Bytes())
+	var chunks [][2]float64 // время начала и позиция чанков обеих дорожек
+	for _, track := range got.tracks {
+		for i, s := range track.Samples {
+			if i == 0 || s.Offset != track.Samples[i-1].Offset+int64(track.Samples[i-1].Size) {
+				chunks = append(chunks, [2]float64{float64(s.DTS) / float64(track.TimeScale), float64(s.Offset)})
+			}
+		}
+	}
+	for _, a := range chunks {
+		for _, b := range chunks {
+			if a[0] < b[0] && a[1] > b[1] {
+				t.Fatalf("чанк %v записан после более позднего чанка %v", a, b)
+			}
+		}
+	}
+	if len(chunks) < 8 {
+		t.Fatalf("%d чанков: дорожки не чередуются", len(chunks))
+	}
+}
+
+func TestTrackRunCompositionOffset(t *testing.T) {
+	// смещение времени отображения в trun версии 0 беззнаковое, в версии 1 - со знаком
+	for _, tc := range []struct {
+		version byte
+		want    int64
+	}{{0, 0xFFFFFC00}, {1, -1024}} {
+		data := []byte{tc.version, 0, byte((trunSize | trunCTSOffset) >> 8), 0, 0, 0, 0, 1}
+		data = binary.BigEndian.AppendUint32(data, 100)
+		data = binary.BigEndian.AppendUint32(data, 0xFFFFFC00)
+		track := &mediaTrack{ID: 1, TimeScale: 1000}
+		if _, _, err := track.readTrackRun(data, 0, 0, 1000, 0, trackDefaults{duration: 40}); err != nil {
+			t.Fatal(err)
+		}
+		if got := track.Samples[0].CTSOffset; got != tc.want {
+			t.Fatalf("версия %d: смещение %d вместо %d", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestTrackRunWithoutEntries(t *testing.T) {
+	// без записей сэмплов количество сэмплов размера по умолчанию ограничено размером файла
+	data := []byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}
+	for _, d := range []trackDefaults{{duration: 40, size: 100}, {duration: 40}} {
+		track := &mediaTrack{ID: 1, TimeScale: 1000}
+		if _, _, err := track.readTrackRun(data, 0, 0, 1<<20, 0, d); err != ErrBadFragment {
+			t.Fatalf("размер по умолчанию %d: ошибка %v вместо %v", d.size, err, ErrBadFragment)
+		}
+	}
+}
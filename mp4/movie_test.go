@@ -0,0 +1,307 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Построение тестовых файлов MP4 в памяти и сравнение сэмплов исходного и записанного файлов
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testTrack описание медиадорожки тестового файла
+type testTrack struct {
+	handler   string   // тип дорожки: vide или soun
+	timeScale uint32   // единица времени дорожки
+	duration  uint32   // продолжительность каждого сэмпла
+	sizes     []uint32 // размеры сэмплов
+	syncEvery int      // ключевым является каждый syncEvery-й сэмпл (0 - все сэмплы)
+	config    *Box     // конфигурация декодера (avcC, esds), добавляемая в описание сэмплов
+	payloads  [][]byte // содержимое сэмплов (если не задано - формируется по размерам)
+}
+
+// testMovie файл из видеодорожки (25 кадров/с, ключевой кадр каждые 10 кадров, смещения времени
+// отображения) и звуковой дорожки, продолжительностью около 4 секунд
+func testMovie(t *testing.T) []byte {
+	video := testTrack{handler: "vide", timeScale: 12800, duration: 512, syncEvery: 10}
+	for i := 0; i < 100; i++ {
+		video.sizes = append(video.sizes, uint32(300+i*7%200))
+	}
+	audio := testTrack{handler: "soun", timeScale: 44100, duration: 1024}
+	for i := 0; i < 172; i++ {
+		audio.sizes = append(audio.sizes, uint32(100+i*13%50))
+	}
+	return buildTestMovie(t, video, audio)
+}
+
+// buildTestMovie файл из блоков ftyp, mdat и moov (moov в конце файла), каждый сэмпл - отдельный чанк,
+// сэмплы дорожек следуют в mdat друг за другом без чередования
+func buildTestMovie(t *testing.T, tracks ...testTrack) []byte {
+	t.Helper()
+	ftyp := NewBox("ftyp", []byte("isom\x00\x00\x00\x00isommp41"))
+	var payload []byte
+	var offsets [][]uint64
+	base := uint64(ftyp.Size() + headerBlockSize)
+	for i, track := range tracks {
+		var chunks []uint64
+		for j, size := range track.sizes {
+			chunks = append(chunks, base+uint64(len(payload)))
+			if track.payloads != nil {
+				payload = append(payload, track.payloads[j]...)
+			} else {
+				payload = append(payload, testPayload(i, j, size)...)
+			}
+		}
+		offsets = append(offsets, chunks)
+	}
+	movie := NewContainer("moov", nil, NewBox("mvhd", testHeader(100, 12, 1000, 16, 0)))
+	var movieDuration uint64
+	for i, track := range tracks {
+		if d := track.movieDuration(); d > movieDuration {
+			movieDuration = d
+		}
+		movie.Children = append(movie.Children, buildTestTrack(uint32(i+1), track, offsets[i]))
+	}
+	binary.BigEndian.PutUint32(movie.Child("mvhd").Data[16:], uint32(movieDuration))
+	var buf bytes.Buffer
+	if err := WriteBoxes(&buf, []*Box{ftyp, NewBox("mdat", payload), movie}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// movieDuration продолжительность дорожки в миллисекундах (единица времени тестового файла)
+func (t testTrack) movieDuration() uint64 {
+	return uint64(len(t.sizes)) * uint64(t.duration) * 1000 / uint64(t.timeScale)
+}
+
+// buildTestTrack блок trak дорожки с номером id и смещениями сэмплов offsets
+func buildTestTrack(id uint32, t testTrack, offsets []uint64) *Box {
+	duration := uint32(len(t.sizes)) * t.duration
+	tkhd := testHeader(84, 12, id, 20, t.movieDuration())
+	var entry, header *Box
+	if t.handler == "vide" {
+		header = NewBox("vmhd", []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+		data := make([]byte, 78)
+		binary.BigEndian.PutUint16(data[6:], 1)
+		binary.BigEndian.PutUint16(data[24:], 640)
+		binary.BigEndian.PutUint16(data[26:], 360)
+		entry = NewBox("avc1", data)
+		binary.BigEndian.PutUint32(tkhd[76:], 640<<16)
+		binary.BigEndian.PutUint32(tkhd[80:], 360<<16)
+	} else {
+		header = NewBox("smhd", make([]byte, 8))
+		data := make([]byte, 28)
+		binary.BigEndian.PutUint16(data[6:], 1)
+		binary.BigEndian.PutUint16(data[16:], 2)
+		binary.BigEndian.PutUint16(data[18:], 16)
+		binary.BigEndian.PutUint32(data[24:], t.timeScale<<16)
+		entry = NewBox("mp4a", data)
+	}
+	if t.config != nil {
+		entry = NewContainer(entry.Type, entry.Data, t.config)
+	}
+	hdlr := append(make([]byte, 8), t.handler...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	// одна запись stts, смещения времени отображения видео повторяются каждые 3 кадра
+	stts := testTable([][2]uint32{{uint32(len(t.sizes)), t.duration}})
+	stsz := binary.BigEndian.AppendUint32(make([]byte, 8), uint32(len(t.sizes)))
+	stco := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(offsets)))
+	var ctts [][2]uint32
+	var stss []byte
+	for i, size := range t.sizes {
+		stsz = binary.BigEndian.AppendUint32(stsz, size)
+		stco = binary.BigEndian.AppendUint32(stco, uint32(offsets[i]))
+		if t.handler == "vide" {
+			ctts = append(ctts, [2]uint32{1, uint32(i%3+1) * t.duration})
+		}
+		if t.syncEvery > 0 && i%t.syncEvery == 0 {
+			stss = binary.BigEndian.AppendUint32(stss, uint32(i+1))
+		}
+	}
+	stbl := NewContainer("stbl", nil,
+		NewContainer("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, entry),
+		NewBox("stts", stts),
+		NewBox("stsz", stsz),
+		NewBox("stsc", []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}),
+		NewBox("stco", stco))
+	if ctts != nil {
+		stbl.Children = append(stbl.Children, NewBox("ctts", testTable(ctts)))
+	}
+	if t.syncEvery > 0 {
+		count := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(stss)/4))
+		stbl.Children = append(stbl.Children, NewBox("stss", append(count, stss...)))
+	}
+	return NewContainer("trak", nil,
+		NewBox("tkhd", tkhd),
+		NewContainer("mdia", nil,
+			NewBox("mdhd", testHeader(24, 12, t.timeScale, 16, uint64(duration))),
+			NewBox("hdlr", hdlr),
+			NewContainer("minf", nil, header, stbl)))
+}
+
+// testHeader содержимое блока-заголовка версии 0 размером size с полями по смещениям field1 и field2
+func testHeader(size, field1 int, value1 uint32, field2 int, value2 uint64) []byte {
+	data := make([]byte, size)
+	binary.BigEndian.PutUint32(data[field1:], value1)
+	binary.BigEndian.PutUint32(data[field2:], uint32(value2))
+	return data
+}
+
+// testTable содержимое таблицы версии 0 из записей по два поля (stts, ctts)
+func testTable(entries [][2]uint32) []byte {
+	data := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(entries)))
+	for _, entry := range entries {
+		data = binary.BigEndian.AppendUint32(data, entry[0])
+		data = binary.BigEndian.AppendUint32(data, entry[1])
+	}
+	return data
+}
+
+// testPayload содержимое сэмпла index дорожки track, различное для разных сэмплов
+func testPayload(track, index int, size uint32) []byte {
+	data := make([]byte, size)
+	binary.BigEndian.PutUint16(data, uint16(track))
+	binary.BigEndian.PutUint16(data[2:], uint16(index))
+	for i := 4; i < len(data); i++ {
+		data[i] = byte(track*31 + index*7 + i)
+	}
+	return data
+}
+
+// testChunk чанк тестового файла из одного сэмпла
+type testChunk struct {
+	offset uint64
+	size   uint32
+}
+
+// readTestChunks чанки медиадорожек файла по таблицам смещений (stco/co64) и размеров (stsz) сэмплов
+func readTestChunks(t *testing.T, data []byte) [][]testChunk {
+	t.Helper()
+	boxes, err := ReadBoxes(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		t.Fatal("нет блока moov")
+	}
+	var tracks [][]testChunk
+	for _, stbl := range boxes[index].FindAll("trak/mdia/minf/stbl") {
+		table := stbl.Child("stco")
+		if table == nil {
+			table = stbl.Child("co64")
+		}
+		stsz := stbl.Child("stsz")
+		if table == nil || stsz == nil || len(stsz.Data) < 12 {
+			t.Fatal("нет таблиц смещений и размеров сэмплов")
+		}
+		offsets, err := parseChunkOffsets(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := int(binary.BigEndian.Uint32(stsz.Data[8:])); count != len(offsets) || len(stsz.Data) < 12+count*4 {
+			t.Fatalf("%d сэмплов в %d чанках", count, len(offsets))
+		}
+		chunks := make([]testChunk, len(offsets))
+		for i, offset := range offsets {
+			chunks[i] = testChunk{offset, binary.BigEndian.Uint32(stsz.Data[12+i*4:])}
+		}
+		tracks = append(tracks, chunks)
+	}
+	return tracks
+}
+
+// compareChunks сравнение чанков исходного файла want и записанного got: количество и размеры
+// сэмплов совпадают, смещения указывают на то же содержимое
+func compareChunks(t *testing.T, want, got []byte) {
+	t.Helper()
+	wantTracks, gotTracks := readTestChunks(t, want), readTestChunks(t, got)
+	if len(gotTracks) != len(wantTracks) {
+		t.Fatalf("%d дорожек вместо %d", len(gotTracks), len(wantTracks))
+	}
+	for i, chunks := range wantTracks {
+		if len(gotTracks[i]) != len(chunks) {
+			t.Fatalf("дорожка %d: %d сэмплов вместо %d", i+1, len(gotTracks[i]), len(chunks))
+		}
+		for j, w := range chunks {
+			g := gotTracks[i][j]
+			if g.size != w.size || g.offset+uint64(g.size) > uint64(len(got)) ||
+				!bytes.Equal(got[g.offset:g.offset+uint64(g.size)], want[w.offset:w.offset+uint64(w.size)]) {
+				t.Fatalf("дорожка %d, сэмпл %d: смещение %d указывает на другие данные", i+1, j, g.offset)
+			}
+		}
+	}
+}
+
+// testFile файл, разобранный до уровня сэмплов медиадорожек
+type testFile struct {
+	data   []byte        // содержимое файла
+	boxes  []*Box        // блоки верхнего уровня
+	movie  *Box          // блок moov
+	tracks []*mediaTrack // медиадорожки
+}
+
+// readTestMovie разбор файла до уровня сэмплов медиадорожек, сэмплы фрагментов добавляются к сэмплам дорожек
+func readTestMovie(t *testing.T, data []byte) *testFile {
+	t.Helper()
+	boxes, err := ReadBoxes(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		t.Fatal("нет блока moov")
+	}
+	f := &testFile{data: data, boxes: boxes, movie: boxes[index]}
+	if f.tracks, err = readMediaTracks(f.movie, mediaDataSize(boxes)); err != nil {
+		t.Fatalf("разбор таблиц сэмплов: %v", err)
+	}
+	if findBox(boxes, "moof") >= 0 {
+		if err = readFragments(boxes, f.movie, f.tracks); err != nil {
+			t.Fatalf("разбор фрагментов: %v", err)
+		}
+	}
+	return f
+}
+
+// sampleData содержимое сэмпла файла
+func (f *testFile) sampleData(t *testing.T, s Sample) []byte {
+	t.Helper()
+	if s.Offset < 0 || s.Offset+int64(s.Size) > int64(len(f.data)) {
+		t.Fatalf("сэмпл размером %d по смещению %d за пределами файла", s.Size, s.Offset)
+	}
+	return f.data[s.Offset : s.Offset+int64(s.Size)]
+}
+
+// compareSamples сравнение сэмплов got файла gotFile с сэмплами want файла wantFile: параметры сэмплов
+// (кроме смещения и времени декодирования) должны совпадать, смещения - указывать на то же содержимое
+func compareSamples(t *testing.T, track int, wantFile *testFile, want []Sample, gotFile *testFile, got []Sample) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("дорожка %d: %d сэмплов вместо %d", track, len(got), len(want))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Size != w.Size || g.Duration != w.Duration || g.CTSOffset != w.CTSOffset || g.Sync != w.Sync ||
+			g.Description != w.Description {
+			t.Fatalf("дорожка %d, сэмпл %d: %+v вместо %+v", track, i, g, w)
+		}
+		if !bytes.Equal(gotFile.sampleData(t, g), wantFile.sampleData(t, w)) {
+			t.Fatalf("дорожка %d, сэмпл %d: смещение %d указывает на другие данные", track, i, g.Offset)
+		}
+	}
+}
+
+// compareMovies сравнение сэмплов всех медиадорожек двух файлов
+func compareMovies(t *testing.T, want, got *testFile) {
+	t.Helper()
+	if len(got.tracks) != len(want.tracks) {
+		t.Fatalf("%d дорожек вместо %d", len(got.tracks), len(want.tracks))
+	}
+	for i, track := range want.tracks {
+		compareSamples(t, i+1, want, track.Samples, got, got.tracks[i].Samples)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор файлов Ogg: страницы, заголовки Theora, Vorbis, Opus и FLAC, комментарии Vorbis
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// Параметры формата Ogg
+const (
+	oggPageHeaderSize = 27      // размер заголовка страницы без таблицы сегментов (байт)
+	oggContinued      = 0x1     // страница продолжает пакет предыдущей страницы
+	oggNoGranule      = -1      // на странице не завершается ни один пакет
+	opusGranuleRate   = 48000   // частота позиций Opus (Гц)
+	maxOggPacketSize  = 1 << 20 // наибольший размер накапливаемого заголовочного пакета (байт)
+)
+
+// oggMagic начало страницы Ogg
+var oggMagic = []byte("OggS")
+
+// oggStream логический поток Ogg
+type oggStream struct {
+	serial     uint32
+	codec      string  // Theora, Vorbis, Opus, FLAC
+	headers    int     // количество разобранных заголовочных пакетов
+	packet     []byte  // накапливаемый пакет
+	rate       float64 // частота позиций (granule position) в секунду
+	timeScale  uint32  // единица времени потока
+	channels   uint16
+	width      uint32
+	height     uint32
+	frameRate  float64
+	preSkip    int64  // пропускаемые в начале сэмплы Opus
+	shift      uint32 // сдвиг номера ключевого кадра в позиции Theora
+	lastGran   int64
+	bytes      int64
+	tags       map[string]string
+	identified bool
+}
+
+// isOgg является ли начало потока страницей Ogg
+func isOgg(header []byte) bool {
+	return bytes.HasPrefix(header, oggMagic)
+}
+
+// readOgg разбор файла Ogg из потока
+func (f *VideoFile) readOgg(r *bufio.Reader) error {
+	streams := make(map[uint32]*oggStream)
+	var order []uint32
+	var pos int64
+	header := make([]byte, oggPageHeaderSize)
+	for {
+		n, err := io.ReadFull(r, header)
+		pos += int64(n)
+		if err != nil {
+			break
+		}
+		if !bytes.HasPrefix(header, oggMagic) {
+			if len(streams) == 0 {
+				return ErrFileIsNotValid
+			}
+			// страница повреждена: разбор останавливается на уже прочитанных страницах
+			break
+		}
+		granule := int64(binary.LittleEndian.Uint64(header[6:]))
+		serial := binary.LittleEndian.Uint32(header[14:])
+		lacing := make([]byte, header[26])
+		n, err = io.ReadFull(r, lacing)
+		pos += int64(n)
+		if err != nil {
+			break
+		}
+		var size int
+		for _, l := range lacing {
+			size += int(l)
+		}
+		body := make([]byte, size)
+		n, err = io.ReadFull(r, body)
+		pos += int64(n)
+		if err != nil {
+			break
+		}
+		s, ok := streams[serial]
+		if !ok {
+			s = &oggStream{serial: serial, lastGran: oggNoGranule}
+			streams[serial] = s
+			order = append(order, serial)
+		}
+		s.bytes += int64(oggPageHeaderSize + len(lacing) + size)
+		if granule != oggNoGranule {
+			s.lastGran = granule
+		}
+		if header[5]&oggContinued == 0 {
+			s.packet = s.packet[:0]
+		}
+		// пакеты собираются из сегментов только до завершения заголовков
+		for _, l := range lacing {
+			if s.headers >= 3 {
+				break
+			}
+			if len(s.packet) < maxOggPacketSize {
+				s.packet = append(s.packet, body[:l]...)
+			}
+			body = body[l:]
+			if l < 255 {
+				s.readHeader(s.packet)
+				s.packet = s.packet[:0]
+			}
+		}
+	}
+	if len(order) == 0 {
+		return ErrFileIsNotValid
+	}
+	movie := &f.Movie
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	for _, serial := range order {
+		s := streams[serial]
+		if !s.identified {
+			continue
+		}
+		track := s.track()
+		if track.Duration > movie.Duration {
+			movie.Duration = track.Duration
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+	f.Codec = "Ogg"
+	for _, serial := range order {
+		if s := streams[serial]; s.identified {
+			movie.TimeScale = s.timeScale
+			break
+		}
+	}
+	// данные после поврежденной страницы учитываются только в размере файла
+	rest, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return NewAPIError("ошибка при получении файла", err)
+	}
+	f.Size = int(pos + rest)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// readHeader разбор заголовочного пакета логического потока
+func (s *oggStream) readHeader(p []byte) {
+	if s.headers == 0 {
+		s.identify(p)
+		s.headers++
+		// заголовки потока неизвестного формата не собираются
+		if !s.identified {
+			s.headers = 3
+		}
+		return
+	}
+	switch {
+	case s.codec == "Vorbis" && bytes.HasPrefix(p, []byte("\x03vorbis")):
+		s.tags = readVorbisComment(p[7:])
+	case s.codec == "Theora" && bytes.HasPrefix(p, []byte("\x81theora")):
+		s.tags = readVorbisComment(p[7:])
+	case s.codec == "Opus" && bytes.HasPrefix(p, []byte("OpusTags")):
+		s.tags = readVorbisComment(p[8:])
+		s.headers = 3
+		return
+	case s.codec == "FLAC" && len(p) >= 4:
+		// блоки метаданных FLAC: тип 4 - комментарии Vorbis, старший бит - последний блок
+		if p[0]&0x7F == 4 {
+			s.tags = readVorbisComment(p[4:])
+		}
+		if p[0]&0x80 != 0 {
+			s.headers = 3
+		}
+		return
+	}
+	s.headers++
+}
+
+// identify определение кодека по первому пакету потока
+func (s *oggStream) identify(p []byte) {
+	switch {
+	case bytes.HasPrefix(p, []byte("\x01vorbis")) && len(p) >= 30:
+		s.codec = "Vorbis"
+		s.channels = uint16(p[11])
+		s.rate = float64(binary.LittleEndian.Uint32(p[12:]))
+	case bytes.HasPrefix(p, []byte("OpusHead")) && len(p) >= 19:
+		s.codec = "Opus"
+		s.channels = uint16(p[9])
+		s.preSkip = int64(binary.LittleEndian.Uint16(p[10:]))
+		// позиция Opus всегда отсчитывается с частотой 48 кГц, в заголовке - частота исходного сигнала
+		s.rate = opusGranuleRate
+	case bytes.HasPrefix(p, []byte("\x80theora")) && len(p) >= 42:
+		s.codec = "Theora"
+		s.width = uint32(p[14])<<16 | uint32(p[15])<<8 | uint32(p[16])
+		s.height = uint32(p[17])<<16 | uint32(p[18])<<8 | uint32(p[19])
+		numerator := binary.BigEndian.Uint32(p[22:])
+		denominator := binary.BigEndian.Uint32(p[26:])
+		if denominator > 0 {
+			s.frameRate = float64(numerator) / float64(denominator)
+		}
+		s.rate = s.frameRate
+		s.shift = uint32(binary.BigEndian.Uint16(p[40:])) >> 5 & 0x1F
+	case bytes.HasPrefix(p, []byte("\x7FFLAC")) && len(p) >= 51:
+		// заголовок отображения FLAC, сигнатура fLaC и блок STREAMINFO
+		info := p[13+4:]
+		s.codec = "FLAC"
+		s.rate = float64(uint32(info[10])<<12 | uint32(info[11])<<4 | uint32(info[12])>>4)
+		s.channels = uint16(info[12]>>1&0x7) + 1
+	default:
+		return
+	}
+	s.timeScale = uint32(s.rate)
+	if s.codec == "Theora" {
+		s.timeScale = binary.BigEndian.Uint32(p[22:])
+	}
+	s.identified = true
+}
+
+// readVorbisComment разбор комментариев Vorbis: производитель и пары ИМЯ=значение
+func readVorbisComment(data []byte) map[string]string {
+	tags := make(map[string]string)
+	next := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		size := binary.LittleEndian.Uint32(data)
+		if uint64(size) > uint64(len(data)-4) {
+			return "", false
+		}
+		value := string(data[4 : 4+size])
+		data = data[4+size:]
+		return value, true
+	}
+	vendor, ok := next()
+	if !ok {
+		return nil
+	}
+	if vendor != "" {
+		tags["ENCODER"] = vendor
+	}
+	if len(data) < 4 {
+		return tags
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		if name, value, found := strings.Cut(comment, "="); found {
+			tags[strings.ToUpper(name)] = value
+		}
+	}
+	return tags
+}
+
+// duration продолжительность потока по позиции (granule position) последней страницы
+func (s *oggStream) duration() float64 {
+	if s.lastGran <= 0 || s.rate == 0 {
+		return 0
+	}
+	position := s.lastGran
+	switch s.codec {
+	case "Theora":
+		// позиция Theora: номер ключевого кадра, сдвинутый на shift, и количество кадров после него
+		position = position>>s.shift + position&(1<<s.shift-1)
+	case "Opus":
+		position -= s.preSkip
+	}
+	return float64(position) / s.rate
+}
+
+// track дорожка логического потока
+func (s *oggStream) track() Track {
+	duration := s.duration()
+	track := Track{ID: s.serial, Duration: duration, Tags: s.tags}
+	if duration > 0 {
+		track.Bitrate = uint64(float64(s.bytes*8) / duration)
+	}
+	stream := &Stream{TimeScale: s.timeScale, Duration: duration}
+	if s.codec == "Theora" {
+		stream.Type = Video
+		track.Width, track.Height = s.width, s.height
+		track.Stream = &VideoStream{Stream: stream, Format: s.codec, FrameRate: nominalFrameRate(s.frameRate), ColorDepth: 24}
+		return track
+	}
+	stream.Type = Audio
+	track.Stream = &AudioStream{
+		Stream:       stream,
+		AudioBalance: "normal",
+		Format:       s.codec,
+		Channels:     channelLayout(s.channels),
+		SampleRate:   uint32(s.rate),
+	}
+	return track
+}
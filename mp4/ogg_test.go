@@ -0,0 +1,117 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора файлов Ogg
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// oggPage страница логического потока serial с позицией granule, пакеты разбиваются на сегменты по 255 байт
+func oggPage(serial uint32, granule int64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		for n := len(p); ; n -= 255 {
+			if n < 255 {
+				lacing = append(lacing, byte(n))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		body = append(body, p...)
+	}
+	page := append([]byte("OggS"), 0, 0)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	// номер страницы и контрольная сумма не проверяются
+	page = append(page, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(lacing)))
+	return append(append(page, lacing...), body...)
+}
+
+// vorbisComment пакет комментариев Vorbis с сигнатурой prefix
+func vorbisComment(prefix, vendor string, comments ...string) []byte {
+	p := binary.LittleEndian.AppendUint32([]byte(prefix), uint32(len(vendor)))
+	p = binary.LittleEndian.AppendUint32(append(p, vendor...), uint32(len(comments)))
+	for _, c := range comments {
+		p = append(binary.LittleEndian.AppendUint32(p, uint32(len(c))), c...)
+	}
+	return p
+}
+
+// testOgg файл Ogg из потока Vorbis (44100 Гц, стерео, 2 с) с комментарием длиннее сегмента
+// и потока Opus (моно, 1 с после пропуска 312 сэмплов)
+func testOgg() []byte {
+	vorbis := append([]byte("\x01vorbis"), 0, 0, 0, 0, 2)
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 44100)
+	vorbis = append(vorbis, make([]byte, 12)...)
+	vorbis = append(vorbis, 0xB8, 0x01)
+	opus := append([]byte("OpusHead"), 1, 1)
+	opus = binary.LittleEndian.AppendUint16(opus, 312)
+	opus = binary.LittleEndian.AppendUint32(opus, 48000)
+	opus = append(opus, 0, 0, 0)
+	return bytes.Join([][]byte{
+		oggPage(1, 0, vorbis),
+		oggPage(2, 0, opus),
+		oggPage(1, 0, vorbisComment("\x03vorbis", "Xiph", "title=Song", "COMMENT="+strings.Repeat("x", 300)), []byte("\x05vorbis")),
+		oggPage(2, 0, vorbisComment("OpusTags", "libopus", "ARTIST=Someone")),
+		oggPage(1, 44100, make([]byte, 100)),
+		oggPage(2, 48000+312, make([]byte, 50)),
+		oggPage(1, 88200, make([]byte, 100)),
+	}, nil)
+}
+
+func TestOgg(t *testing.T) {
+	data := testOgg()
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	movie := f.Movie
+	if f.Codec != "Ogg" || f.Size != len(data) || movie.Duration != 2 || movie.TimeScale != 44100 {
+		t.Fatalf("формат %q, размер %d, продолжительность %v, единица времени %d", f.Codec, f.Size, movie.Duration, movie.TimeScale)
+	}
+	if len(movie.Tracks) != 2 {
+		t.Fatalf("%d дорожек вместо 2", len(movie.Tracks))
+	}
+	tests := []struct {
+		id       uint32
+		format   string
+		channels string
+		rate     uint32
+		duration float64
+		tags     map[string]string
+	}{
+		{1, "Vorbis", "Stereo", 44100, 2, map[string]string{"ENCODER": "Xiph", "TITLE": "Song", "COMMENT": strings.Repeat("x", 300)}},
+		{2, "Opus", "Mono", 48000, 1, map[string]string{"ENCODER": "libopus", "ARTIST": "Someone"}},
+	}
+	for i, test := range tests {
+		track := movie.Tracks[i]
+		audio, ok := track.Stream.(*AudioStream)
+		if !ok || track.ID != test.id || track.Duration != test.duration ||
+			audio.Format != test.format || audio.Channels != test.channels || audio.SampleRate != test.rate {
+			t.Fatalf("дорожка %d: %+v, поток %+v", i+1, track, track.Stream)
+		}
+		if len(track.Tags) != len(test.tags) {
+			t.Fatalf("дорожка %d: теги %v вместо %v", i+1, track.Tags, test.tags)
+		}
+		for name, value := range test.tags {
+			if track.Tags[name] != value {
+				t.Fatalf("дорожка %d: тег %s %q вместо %q", i+1, name, track.Tags[name], value)
+			}
+		}
+	}
+}
+
+func TestVorbisCommentBounds(t *testing.T) {
+	// длина комментария больше оставшихся данных
+	data := vorbisComment("", "Xiph", "TITLE=Song")
+	tags := readVorbisComment(data[:len(data)-2])
+	if len(tags) != 1 || tags["ENCODER"] != "Xiph" {
+		t.Fatalf("теги %v", tags)
+	}
+}
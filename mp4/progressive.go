@@ -0,0 +1,313 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Запись обычного (progressive) файла MP4 по спискам сэмплов медиадорожек
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// progressiveChunkDuration продолжительность чанка при записи медиаданных; чанки дорожек чередуются по времени
+const progressiveChunkDuration = time.Second
+
+// chunk последовательно расположенные в mdat сэмплы одной медиадорожки
+type chunk struct {
+	track   *mediaTrack
+	samples []Sample
+	offset  int64 // позиция чанка относительно начала содержимого mdat
+}
+
+// movieFile файл, разобранный до уровня сэмплов медиадорожек
+type movieFile struct {
+	src    io.ReaderAt   // исходный файл
+	boxes  []*Box        // блоки верхнего уровня
+	movie  *Box          // блок moov
+	tracks []*mediaTrack // медиадорожки
+}
+
+// readMovieFile чтение дерева блоков и таблиц сэмплов; сэмплы фрагментированного файла
+// собираются из фрагментов, описание фрагментов (mvex) удаляется
+func readMovieFile(r io.ReadSeeker) (*movieFile, error) {
+	src, size, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := readBoxTree(src, size)
+	if err != nil {
+		return nil, err
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		return nil, ErrMovieNotFound
+	}
+	m := &movieFile{src: src, boxes: boxes, movie: boxes[index]}
+	if m.tracks, err = readMediaTracks(m.movie, mediaDataSize(boxes)); err != nil {
+		return nil, err
+	}
+	if findBox(boxes, "moof") >= 0 {
+		if err = readFragments(boxes, m.movie, m.tracks); err != nil {
+			return nil, err
+		}
+		m.movie.Remove("mvex")
+	}
+	return m, nil
+}
+
+// fileType блок ftyp файла (nil при отсутствии)
+func (m *movieFile) fileType() *Box {
+	if i := findBox(m.boxes, "ftyp"); i >= 0 {
+		return m.boxes[i]
+	}
+	return nil
+}
+
+// start время начала чанка (секунд)
+func (c *chunk) start() float64 {
+	return float64(c.samples[0].DTS) / float64(c.track.TimeScale)
+}
+
+// writeProgressive запись файла из блоков ftyp и moov и единого блока mdat с сэмплами дорожек tracks,
+// скопированными из src. Таблицы сэмплов и продолжительности в moov формируются заново
+func writeProgressive(w io.Writer, src io.ReaderAt, ftyp *Box, movie *Box, tracks []*mediaTrack) error {
+	if ftyp == nil {
+		ftyp = newFileType("isom", "isom", "iso2", "mp41")
+	}
+	chunks := interleaveChunks(tracks)
+	var dataSize int64
+	trackChunks := make(map[*mediaTrack][]*chunk, len(tracks))
+	for _, c := range chunks {
+		c.offset = dataSize
+		dataSize += samplesSize(c.samples)
+		trackChunks[c.track] = append(trackChunks[c.track], c)
+	}
+	offsetTables := make([]*Box, len(tracks))
+	for i, t := range tracks {
+		stbl := t.trak.Find("mdia/minf/stbl")
+		if stbl == nil || stbl.Child("stsd") == nil {
+			return ErrBadSampleTable
+		}
+		stbl.Children = buildSampleTable(stbl.Child("stsd"), t.Samples, trackChunks[t])
+		offsetTables[i] = stbl.Child("stco")
+	}
+	if err := setDurations(movie, tracks); err != nil {
+		return err
+	}
+	// смещения чанков зависят от размера moov, который в свою очередь зависит от типа таблиц (stco или co64)
+	for {
+		movieSize := movie.Size()
+		base := ftyp.Size() + movieSize + mediaDataHeaderSize(dataSize)
+		for i, t := range tracks {
+			offsets := make([]uint64, len(trackChunks[t]))
+			for j, c := range trackChunks[t] {
+				offsets[j] = uint64(base + c.offset)
+			}
+			setChunkOffsets(offsetTables[i], offsets)
+		}
+		if movie.Size() == movieSize {
+			break
+		}
+	}
+	if err := WriteBoxes(w, []*Box{ftyp, movie}); err != nil {
+		return err
+	}
+	data := make([][]Sample, len(chunks))
+	for i, c := range chunks {
+		data[i] = c.samples
+	}
+	return writeMediaData(w, src, data...)
+}
+
+// interleaveChunks разбиение сэмплов дорожек на чанки и упорядочивание чанков всех дорожек по времени начала
+func interleaveChunks(tracks []*mediaTrack) []*chunk {
+	var chunks []*chunk
+	for _, t := range tracks {
+		limit := uint64(progressiveChunkDuration.Seconds() * float64(t.TimeScale))
+		for i := 0; i < len(t.Samples); {
+			// чанк не может содержать сэмплы с разными описаниями (stsd)
+			j := i + 1
+			for j < len(t.Samples) && t.Samples[j].Description == t.Samples[i].Description &&
+				t.Samples[j].DTS-t.Samples[i].DTS < limit {
+				j++
+			}
+			chunks = append(chunks, &chunk{track: t, samples: t.Samples[i:j]})
+			i = j
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].start() < chunks[j].start()
+	})
+	return chunks
+}
+
+// buildSampleTable формирование дочерних блоков stbl: описание сэмплов stsd сохраняется, таблицы
+// stts, ctts, stss, sdtp, stsz и stsc строятся по сэмплам, таблица stco заполняется позже
+func buildSampleTable(stsd *Box, samples []Sample, chunks []*chunk) []*Box {
+	table := []*Box{stsd}
+	// время декодирования: группы сэмплов одинаковой продолжительности
+	var runs [][2]uint32
+	for i, s := range samples {
+		if i > 0 && runs[len(runs)-1][1] == s.Duration {
+			runs[len(runs)-1][0]++
+		} else {
+			runs = append(runs, [2]uint32{1, s.Duration})
+		}
+	}
+	table = append(table, NewBox("stts", appendRuns(make([]byte, 4), runs)))
+	// смещение времени отображения: версия 1, если есть отрицательные смещения
+	runs = runs[:0]
+	var version byte
+	hasOffsets := false
+	for i, s := range samples {
+		if s.CTSOffset != 0 {
+			hasOffsets = true
+		}
+		if s.CTSOffset < 0 {
+			version = 1
+		}
+		if i > 0 && runs[len(runs)-1][1] == uint32(s.CTSOffset) {
+			runs[len(runs)-1][0]++
+		} else {
+			runs = append(runs, [2]uint32{1, uint32(s.CTSOffset)})
+		}
+	}
+	if hasOffsets {
+		table = append(table, NewBox("ctts", appendRuns([]byte{version, 0, 0, 0}, runs)))
+	}
+	// ключевые сэмплы, таблица не нужна, если ключевыми являются все сэмплы
+	var sync []byte
+	syncCount, dependencies := 0, false
+	for i, s := range samples {
+		if s.Sync {
+			sync = binary.BigEndian.AppendUint32(sync, uint32(i+1))
+			syncCount++
+		}
+		if s.DependsOn != 0 || s.Leading != 0 {
+			dependencies = true
+		}
+	}
+	if syncCount < len(samples) {
+		data := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(syncCount))
+		table = append(table, NewBox("stss", append(data, sync...)))
+	}
+	if dependencies {
+		data := make([]byte, 4, 4+len(samples))
+		for _, s := range samples {
+			data = append(data, s.Leading<<6|s.DependsOn<<4)
+		}
+		table = append(table, NewBox("sdtp", data))
+	}
+	// размеры сэмплов
+	stsz := make([]byte, 8, 12+len(samples)*4)
+	stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(samples)))
+	for _, s := range samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, s.Size)
+	}
+	table = append(table, NewBox("stsz", stsz))
+	// распределение сэмплов по чанкам: запись добавляется при изменении числа сэмплов в чанке или описания
+	var entries []byte
+	count := 0
+	var perChunk, description uint32
+	for i, c := range chunks {
+		n, d := uint32(len(c.samples)), c.samples[0].Description
+		if i > 0 && n == perChunk && d == description {
+			continue
+		}
+		perChunk, description = n, d
+		entries = binary.BigEndian.AppendUint32(entries, uint32(i+1))
+		entries = binary.BigEndian.AppendUint32(entries, n)
+		entries = binary.BigEndian.AppendUint32(entries, d)
+		count++
+	}
+	stsc := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(count))
+	table = append(table, NewBox("stsc", append(stsc, entries...)))
+	return append(table, NewBox("stco", make([]byte, 8)))
+}
+
+// appendRuns добавление к заголовку таблицы (версия и флаги) количества записей и самих записей
+func appendRuns(data []byte, runs [][2]uint32) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(runs)))
+	for _, run := range runs {
+		data = binary.BigEndian.AppendUint32(data, run[0])
+		data = binary.BigEndian.AppendUint32(data, run[1])
+	}
+	return data
+}
+
+// setDurations запись продолжительности медиадорожек (mdhd, tkhd) и файла (mvhd) по их сэмплам
+func setDurations(movie *Box, tracks []*mediaTrack) error {
+	mvhd := movie.Child("mvhd")
+	if mvhd == nil {
+		return ErrFileIsNotValid
+	}
+	timeScale, ok := versionedField(mvhd.Data, 12, 20)
+	if !ok || timeScale == 0 {
+		return ErrFileIsNotValid
+	}
+	var movieDuration uint64
+	for _, t := range tracks {
+		mediaDuration := t.duration()
+		if err := setDuration(t.trak.Find("mdia/mdhd"), 16, 24, mediaDuration); err != nil {
+			return err
+		}
+		// при наличии списка редактирования продолжительность дорожки - сумма продолжительностей правок
+		duration, ok := editListDuration(t.trak.Find("edts/elst"))
+		if !ok {
+			duration = rescaleTime(mediaDuration, t.TimeScale, timeScale)
+		}
+		if err := setDuration(t.trak.Child("tkhd"), 20, 28, duration); err != nil {
+			return err
+		}
+		if duration > movieDuration {
+			movieDuration = duration
+		}
+	}
+	return setDuration(mvhd, 16, 24, movieDuration)
+}
+
+// setDuration запись продолжительности в блок с версией по смещению v0 (версия 0, 32 бита) или v1 (версия 1, 64 бита)
+func setDuration(b *Box, v0, v1 int, duration uint64) error {
+	if b == nil || len(b.Data) < v0+4 {
+		return ErrFileIsNotValid
+	}
+	data := append([]byte{}, b.Data...)
+	if data[0] == 0x1 {
+		if len(data) < v1+8 {
+			return ErrFileIsNotValid
+		}
+		binary.BigEndian.PutUint64(data[v1:], duration)
+	} else {
+		if duration > math.MaxUint32 {
+			duration = math.MaxUint32
+		}
+		binary.BigEndian.PutUint32(data[v0:], uint32(duration))
+	}
+	b.SetData(data)
+	return nil
+}
+
+// editListDuration суммарная продолжительность правок списка редактирования elst (в единицах времени файла)
+func editListDuration(elst *Box) (uint64, bool) {
+	entrySize := 12
+	if elst != nil && len(elst.Data) > 0 && elst.Data[0] == 0x1 {
+		entrySize = 20
+	}
+	count, entries, ok := tableEntries(elst, 4, entrySize)
+	if !ok || count == 0 {
+		return 0, false
+	}
+	var duration uint64
+	for i := 0; i < count; i++ {
+		if entrySize == 20 {
+			duration += binary.BigEndian.Uint64(entries[i*20:])
+		} else {
+			duration += uint64(binary.BigEndian.Uint32(entries[i*12:]))
+		}
+	}
+	return duration, true
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор программного потока MPEG-PS (в том числе DVD VOB): заголовки пакетов, системы и PES
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Коды начала элементов программного потока
+const (
+	psPackStart    = 0xBA // заголовок пакета
+	psSystemHeader = 0xBB // системный заголовок
+	psStreamMap    = 0xBC // карта потоков
+	psPrivate1     = 0xBD // частный поток 1 (AC-3, DTS, LPCM и субтитры DVD)
+	psPadding      = 0xBE // заполнение
+	psPrivate2     = 0xBF // частный поток 2 (навигация DVD)
+	psEndCode      = 0xB9 // конец программного потока
+	psMaxResync    = 1 << 20
+)
+
+// psStartCode префикс кода начала элемента
+var psStartCode = []byte{0, 0, 1}
+
+// lpcmRates частоты дискретизации LPCM DVD по 2-битному коду (Гц)
+var lpcmRates = []uint32{48000, 96000, 44100, 32000}
+
+// psStream состояние разбора элементарного потока программного потока
+type psStream struct {
+	id       uint16 // идентификатор потока; для частного потока 1 - вместе с номером подпотока
+	kind     string
+	format   string
+	firstPTS int64
+	lastPTS  int64
+	bytes    int64
+	probe    streamProbe
+	info     codecInfo
+}
+
+// psDemuxer состояние разбора программного потока
+type psDemuxer struct {
+	r        *bufio.Reader
+	pos      int64
+	streams  map[uint16]*psStream
+	firstSCR int64 // первый отсчет системных часов (90 кГц)
+	lastSCR  int64
+	muxRate  uint64 // скорость потока из заголовка пакета (байт/с)
+	mpeg1    bool
+}
+
+// isProgramStream является ли начало потока заголовком пакета MPEG-PS
+func isProgramStream(header []byte) bool {
+	return len(header) >= 4 && bytes.HasPrefix(header, psStartCode) && header[3] == psPackStart
+}
+
+// readProgramStream разбор программного потока MPEG-PS
+func (f *VideoFile) readProgramStream(r *bufio.Reader) error {
+	d := &psDemuxer{r: r, streams: make(map[uint16]*psStream), firstSCR: tsUnknownPTS, lastSCR: tsUnknownPTS}
+	for {
+		code, err := d.nextStartCode()
+		if err != nil {
+			break
+		}
+		if code == psEndCode {
+			continue
+		}
+		if code == psPackStart {
+			err = d.readPack()
+		} else if code >= psStreamMap {
+			err = d.readPacket(code)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(d.streams) == 0 {
+		return ErrNoSamples
+	}
+	d.fill(f)
+	f.Size = int(d.pos)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// nextStartCode поиск следующего кода начала (00 00 01 xx), возвращает его последний байт
+func (d *psDemuxer) nextStartCode() (byte, error) {
+	var window uint32 = 0xFFFFFFFF
+	for skipped := 0; skipped < psMaxResync; skipped++ {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		d.pos++
+		window = window<<8 | uint32(b)
+		if window&0xFFFFFF00 == 0x00000100 {
+			return b, nil
+		}
+	}
+	return 0, ErrFileIsNotValid
+}
+
+// read чтение size байт
+func (d *psDemuxer) read(size int) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := io.ReadFull(d.r, data)
+	d.pos += int64(n)
+	return data, err
+}
+
+// readPack разбор заголовка пакета: отсчет системных часов (SCR) и скорость потока
+func (d *psDemuxer) readPack() error {
+	first, err := d.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	var scr int64
+	if first[0]&0xC0 == 0x40 {
+		// MPEG-2: 10 байт и заполнение
+		h, err := d.read(10)
+		if err != nil {
+			return err
+		}
+		scr = int64(h[0]>>3&0x7)<<30 | int64(h[0]&0x3)<<28 | int64(h[1])<<20 | int64(h[2]>>3)<<15 |
+			int64(h[2]&0x3)<<13 | int64(h[3])<<5 | int64(h[4]>>3)
+		d.muxRate = uint64(uint32(h[6])<<14|uint32(h[7])<<6|uint32(h[8])>>2) * 50
+		if _, err = d.read(int(h[9] & 0x7)); err != nil {
+			return err
+		}
+	} else {
+		// MPEG-1: 8 байт
+		h, err := d.read(8)
+		if err != nil {
+			return err
+		}
+		d.mpeg1 = true
+		scr = readPTS(h)
+		d.muxRate = uint64(uint32(h[5]&0x7F)<<15|uint32(h[6])<<7|uint32(h[7])>>1) * 50
+	}
+	if d.firstSCR == tsUnknownPTS {
+		d.firstSCR = scr
+	}
+	for scr < d.lastSCR-tsPTSWrap/2 {
+		scr += tsPTSWrap
+	}
+	if scr > d.lastSCR {
+		d.lastSCR = scr
+	}
+	return nil
+}
+
+// readPacket разбор пакета PES (системный заголовок, карта потоков и заполнение пропускаются)
+func (d *psDemuxer) readPacket(code byte) error {
+	header, err := d.read(2)
+	if err != nil {
+		return err
+	}
+	data, err := d.read(int(binary.BigEndian.Uint16(header)))
+	if err != nil {
+		return err
+	}
+	switch {
+	case code == psSystemHeader || code == psStreamMap || code == psPadding || code == psPrivate2:
+		return nil
+	case code == psPrivate1 || code >= 0xC0 && code <= 0xEF:
+		d.readPES(code, data)
+	}
+	return nil
+}
+
+// readPES разбор заголовка PES (MPEG-1 или MPEG-2) и накопление начала потока
+func (d *psDemuxer) readPES(code byte, data []byte) {
+	pts := tsUnknownPTS
+	if len(data) >= 3 && data[0]&0xC0 == 0x80 {
+		// заголовок MPEG-2
+		headerSize := 3 + int(data[2])
+		if headerSize > len(data) {
+			return
+		}
+		if data[1]&0x80 != 0 && headerSize >= 8 {
+			pts = readPTS(data[3:])
+		}
+		data = data[headerSize:]
+	} else {
+		// заголовок MPEG-1: заполнение, размер буфера и метки времени
+		for len(data) > 0 && data[0] == 0xFF {
+			data = data[1:]
+		}
+		if len(data) >= 2 && data[0]&0xC0 == 0x40 {
+			data = data[2:]
+		}
+		switch {
+		case len(data) >= 5 && data[0]&0xF0 == 0x20:
+			pts, data = readPTS(data), data[5:]
+		case len(data) >= 10 && data[0]&0xF0 == 0x30:
+			pts, data = readPTS(data), data[10:]
+		case len(data) >= 1 && data[0] == 0x0F:
+			data = data[1:]
+		}
+	}
+	id := uint16(code)
+	if code == psPrivate1 {
+		// подпоток DVD: номер и служебные байты перед данными
+		if len(data) < 1 {
+			return
+		}
+		id = uint16(code)<<8 | uint16(data[0])
+	}
+	s, ok := d.streams[id]
+	if !ok {
+		s = &psStream{id: id, firstPTS: tsUnknownPTS, lastPTS: tsUnknownPTS}
+		s.describe()
+		d.streams[id] = s
+	}
+	s.bytes += int64(len(data))
+	if pts != tsUnknownPTS {
+		if s.firstPTS == tsUnknownPTS {
+			s.firstPTS, s.lastPTS = pts, pts
+		}
+		for pts < s.lastPTS-tsPTSWrap/2 {
+			pts += tsPTSWrap
+		}
+		if pts > s.lastPTS {
+			s.lastPTS = pts
+		}
+	}
+	s.probe.add(data, s.parse)
+}
+
+// describe определение типа потока по идентификатору
+func (s *psStream) describe() {
+	code, sub := s.id, s.id&0xFF
+	switch {
+	case code >= 0xE0 && code <= 0xEF:
+		s.kind, s.format = Video, "MPEG Video"
+	case code >= 0xC0 && code <= 0xDF:
+		s.kind, s.format = Audio, "MPEG Audio"
+	case sub >= 0x80 && sub <= 0x87:
+		s.kind, s.format = Audio, "AC-3"
+	case sub >= 0x88 && sub <= 0x8F:
+		s.kind, s.format = Audio, "DTS"
+	case sub >= 0xA0 && sub <= 0xA7:
+		s.kind, s.format = Audio, "LPCM"
+	case sub >= 0x20 && sub <= 0x3F:
+		s.kind, s.format = Subtitle, "DVD Subpicture"
+	default:
+		s.format = fmt.Sprintf("private 0x%02X", sub)
+	}
+}
+
+// parse определение параметров потока по накопленным данным
+func (s *psStream) parse(probe []byte) bool {
+	var info codecInfo
+	var ok bool
+	switch s.format {
+	case "MPEG Video":
+		// видео программного потока - MPEG-1/2 или H.264 (без карты потоков тип не указывается)
+		if info, ok = parseMPEGVideo(probe); !ok {
+			info, ok = parseVideoElementaryStream(probe, false)
+		}
+	case "MPEG Audio":
+		if info, ok = parseMPEGAudio(probe); !ok {
+			info, ok = parseADTS(probe)
+		}
+	case "AC-3":
+		// у подпотока 4 служебных байта: номер, количество кадров, указатель на первый кадр
+		if len(probe) > 4 {
+			info, ok = parseAC3(probe[4:])
+		}
+	case "LPCM":
+		// у подпотока LPCM 7 служебных байт; разрядность, частота и количество каналов - в 6-м
+		if len(probe) >= 7 {
+			info = codecInfo{Format: "LPCM", Channels: uint16(probe[5]&0x7) + 1}
+			info.SampleRate = lpcmRates[probe[5]>>4&0x3]
+			info.Profile = fmt.Sprintf("%d бит", 16+4*int(probe[5]>>6))
+			ok = true
+		}
+	default:
+		ok = true
+	}
+	if ok {
+		s.info = info
+	}
+	return ok
+}
+
+// fill заполнение модели метаданных по результатам разбора
+func (d *psDemuxer) fill(f *VideoFile) {
+	f.Codec = "MPEG-PS"
+	if d.mpeg1 {
+		f.Codec = "MPEG-1 System"
+	}
+	movie := &f.Movie
+	movie.TimeScale = tsPTSFrequency
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	if d.lastSCR > d.firstSCR {
+		movie.Duration = float64(d.lastSCR-d.firstSCR) / tsPTSFrequency
+	}
+	movie.Bitrate = d.muxRate * 8
+	ids := make([]int, 0, len(d.streams))
+	for id := range d.streams {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s := d.streams[uint16(id)]
+		s.probe.finish(s.parse)
+		var duration float64
+		if s.lastPTS > s.firstPTS {
+			duration = float64(s.lastPTS-s.firstPTS) / tsPTSFrequency
+		}
+		if duration > movie.Duration {
+			movie.Duration = duration
+		}
+		track := Track{ID: uint32(id), Duration: duration, Width: s.info.Width, Height: s.info.Height}
+		if duration > 0 {
+			track.Bitrate = uint64(float64(s.bytes*8) / duration)
+		}
+		format := s.format
+		if s.info.Format != "" {
+			format = s.info.Format
+		}
+		stream := &Stream{TimeScale: tsPTSFrequency, Duration: duration, Type: s.kind}
+		switch s.kind {
+		case Video:
+			track.Stream = &VideoStream{
+				Stream:     stream,
+				Format:     format,
+				Profile:    s.info.Profile,
+				FrameRate:  nominalFrameRate(s.info.FrameRate),
+				ColorDepth: s.info.ColorDepth,
+			}
+		case Audio:
+			track.Stream = &AudioStream{
+				Stream:       stream,
+				AudioBalance: "normal",
+				Format:       format,
+				Profile:      s.info.Profile,
+				Channels:     channelLayout(s.info.Channels),
+				SampleRate:   s.info.SampleRate,
+			}
+		default:
+			if stream.Type == "" {
+				stream.Type = format
+			}
+			track.Stream = stream
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+}
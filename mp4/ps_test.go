@@ -0,0 +1,76 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора программного потока MPEG-PS
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// psPack заголовок пакета MPEG-2 с отсчетом системных часов scr (90 кГц) и скоростью потока 125000 байт/с
+func psPack(scr int64) []byte {
+	const rate = 2500 // в единицах по 50 байт/с
+	return []byte{0, 0, 1, psPackStart,
+		0x44 | byte(scr>>30&0x7)<<3 | byte(scr>>28&0x3),
+		byte(scr >> 20),
+		byte(scr>>15&0x1F)<<3 | 0x04 | byte(scr>>13&0x3),
+		byte(scr >> 5),
+		byte(scr&0x1F)<<3 | 0x04,
+		0x01,
+		byte(rate >> 14), byte(rate >> 6), byte(rate<<2&0xFC) | 0x3,
+		0xF8}
+}
+
+// psPacket пакет PES программного потока с меткой времени pts
+func psPacket(code byte, pts int64, data []byte) []byte {
+	pes := tsPES(code, pts, data)
+	binary.BigEndian.PutUint16(pes[4:], uint16(len(pes)-6))
+	return pes
+}
+
+// testProgramStream программный поток из видео MPEG-2 720x576 25 кадров/с (2 с)
+// и подпотока LPCM DVD 48 кГц, 16 бит, стерео (1 с)
+func testProgramStream() []byte {
+	sequence := []byte{0, 0, 1, 0xB3, 0x2D, 0x02, 0x40, 0x23, 0xFF, 0xFF}
+	lpcm := []byte{0xA0, 0x01, 0x00, 0x04, 0x00, 0x01, 0x80, 0, 0, 0, 0}
+	return bytes.Join([][]byte{
+		psPack(0),
+		psPacket(0xE0, 0, sequence),
+		psPacket(psPrivate1, 0, lpcm),
+		psPack(180000),
+		psPacket(0xE0, 180000, sequence),
+		psPacket(psPrivate1, 90000, lpcm),
+		{0, 0, 1, psEndCode},
+	}, nil)
+}
+
+func TestProgramStream(t *testing.T) {
+	data := testProgramStream()
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	movie := f.Movie
+	if f.Codec != "MPEG-PS" || f.Size != len(data) || movie.Duration != 2 || movie.Bitrate != 1000000 {
+		t.Fatalf("формат %q, размер %d, продолжительность %v, битрейт %d", f.Codec, f.Size, movie.Duration, movie.Bitrate)
+	}
+	if len(movie.Tracks) != 2 {
+		t.Fatalf("%d дорожек вместо 2", len(movie.Tracks))
+	}
+	track := movie.Tracks[0]
+	video, ok := track.Stream.(*VideoStream)
+	if !ok || track.ID != 0xE0 || track.Width != 720 || track.Height != 576 || track.Duration != 2 ||
+		video.Format != "MPEG Video" || video.FrameRate == nil || video.FrameRate.Nominal != 25 {
+		t.Fatalf("видеодорожка %+v, поток %+v", track, track.Stream)
+	}
+	track = movie.Tracks[1]
+	audio, ok := track.Stream.(*AudioStream)
+	if !ok || track.ID != uint32(psPrivate1)<<8|0xA0 || track.Duration != 1 ||
+		audio.Format != "LPCM" || audio.Profile != "16 бит" || audio.SampleRate != 48000 || audio.Channels != "Stereo" {
+		t.Fatalf("звуковая дорожка %+v, поток %+v", track, track.Stream)
+	}
+}
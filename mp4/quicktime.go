@@ -0,0 +1,164 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Описания сэмплов QuickTime: звук версий 0/1/2, ProRes/DNxHD и расширения видео (gama, fiel, colr)
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// sampleEntryNames наименования форматов сжатия по типу описания сэмплов
+var sampleEntryNames = map[string]string{
+	"avc1": "H.264", "avc3": "H.264", "hvc1": "HEVC", "hev1": "HEVC", "dvh1": "Dolby Vision", "dvhe": "Dolby Vision",
+	"mp4v": "MPEG-4 Visual", "av01": "AV1", "vp08": "VP8", "vp09": "VP9", "s263": "H.263", "jpeg": "Motion JPEG",
+	"mjpa": "Motion JPEG A", "mjpb": "Motion JPEG B",
+	"apch": "Apple ProRes 422 HQ", "apcn": "Apple ProRes 422", "apcs": "Apple ProRes 422 LT",
+	"apco": "Apple ProRes 422 Proxy", "ap4h": "Apple ProRes 4444", "ap4x": "Apple ProRes 4444 XQ",
+	"AVdn": "Avid DNxHD", "AVdh": "Avid DNxHR",
+	"mp4a": "AAC", "ac-3": "AC-3", "ec-3": "E-AC-3", "Opus": "Opus", "fLaC": "FLAC", "alac": "Apple Lossless",
+	".mp3": "MP3", "samr": "AMR", "sawb": "AMR-WB", "ulaw": "G.711 mu-law", "alaw": "G.711 A-law",
+	"lpcm": "Linear PCM", "sowt": "PCM (little-endian)", "twos": "PCM (big-endian)", "in24": "PCM 24-bit integer",
+	"in32": "PCM 32-bit integer", "fl32": "PCM 32-bit float", "fl64": "PCM 64-bit float", "raw ": "PCM 8-bit unsigned",
+}
+
+// pcmBitDepths разрядность несжатого звука по формату (0 - указывается в описании сэмплов)
+var pcmBitDepths = map[string]uint16{
+	"lpcm": 0, "sowt": 0, "twos": 0, "in24": 24, "in32": 32, "fl32": 32, "fl64": 64, "raw ": 8,
+}
+
+// proresBitDepths разрядность компонент цвета ProRes
+var proresBitDepths = map[string]uint16{
+	"apch": 10, "apcn": 10, "apcs": 10, "apco": 10, "ap4h": 12, "ap4x": 12,
+}
+
+// fieldOrders порядок полей по блоку fiel (детализация для чересстрочного изображения)
+var fieldOrders = map[byte]string{1: "top field first", 6: "bottom field first", 9: "top field first", 14: "bottom field first"}
+
+// quickTimeTopLevel блоки верхнего уровня, с которых может начинаться файл MP4/QuickTime
+var quickTimeTopLevel = map[string]bool{"ftyp": true, "moov": true, "mdat": true, "free": true, "skip": true, "wide": true, "pnot": true}
+
+// lpcmFloat признак чисел с плавающей точкой в описании сэмплов LPCM версии 2
+const lpcmFloat = 0x1
+
+// readSampleEntry чтение первого описания сэмплов блока stsd: тип и содержимое без заголовка
+func readSampleEntry(buf *bytes.Reader) (format string, payload []byte) {
+	header := make([]byte, headerBlockSize)
+	_, err := io.ReadFull(buf, header)
+	fatal(err)
+	size := int64(binary.BigEndian.Uint32(header))
+	if size < headerBlockSize || size-headerBlockSize > int64(buf.Len()) {
+		panic(ErrFileIsNotValid)
+	}
+	payload = make([]byte, size-headerBlockSize)
+	_, err = io.ReadFull(buf, payload)
+	fatal(err)
+	return string(header[4:]), payload
+}
+
+// readSampleEntry разбор описания аудиосэмплов MP4/QuickTime (версии 0, 1 и 2)
+func (stream *AudioStream) readSampleEntry(format string, d []byte) {
+	if len(d) < 28 {
+		panic(ErrFileIsNotValid)
+	}
+	stream.Format = format
+	stream.CodecName = sampleEntryNames[format]
+	channels := uint32(binary.BigEndian.Uint16(d[16:]))
+	bitDepth := binary.BigEndian.Uint16(d[18:])
+	stream.SampleRate = binary.BigEndian.Uint32(d[24:]) >> 16
+	var frameSize, flags uint32
+	switch binary.BigEndian.Uint16(d[8:]) {
+	case 1:
+		// размеры пакета и кадра для несжатого звука
+		if len(d) >= 44 {
+			frameSize = binary.BigEndian.Uint32(d[36:])
+			bitDepth = uint16(binary.BigEndian.Uint32(d[40:]) * 8)
+		}
+	case 2:
+		// частота, количество каналов и разрядность вынесены в расширенные поля
+		if len(d) >= 64 {
+			stream.SampleRate = uint32(math.Float64frombits(binary.BigEndian.Uint64(d[32:])))
+			channels = binary.BigEndian.Uint32(d[40:])
+			bitDepth = uint16(binary.BigEndian.Uint32(d[48:]))
+			flags = binary.BigEndian.Uint32(d[52:])
+			frameSize = binary.BigEndian.Uint32(d[56:])
+		}
+	}
+	stream.Channels = channelLayout(uint16(channels))
+	depth, pcm := pcmBitDepths[format]
+	if !pcm {
+		return
+	}
+	if depth != 0 {
+		bitDepth = depth
+	}
+	if format == "lpcm" && flags&lpcmFloat != 0 {
+		stream.CodecName += " (float)"
+	}
+	stream.BitDepth = bitDepth
+	stream.SampleSize = frameSize
+	if frameSize == 0 {
+		stream.SampleSize = channels * uint32(bitDepth) / 8
+	}
+}
+
+// readSampleEntry разбор описания видеосэмплов и его расширений
+func (stream *VideoStream) readSampleEntry(format string, d []byte) {
+	if len(d) < 78 {
+		panic(ErrFileIsNotValid)
+	}
+	stream.Format = format
+	stream.CodecName = sampleEntryNames[format]
+	stream.ResX = binary.BigEndian.Uint16(d[28:])
+	stream.ResY = binary.BigEndian.Uint16(d[32:])
+	stream.ColorDepth = binary.BigEndian.Uint16(d[74:])
+	stream.BitDepth = proresBitDepths[format]
+	extensions, ok := parseBoxes(d[78:], format)
+	if !ok && len(d) >= 82 && bytes.Equal(d[len(d)-4:], []byte{0, 0, 0, 0}) {
+		// описание QuickTime может завершаться 4 нулевыми байтами
+		extensions, ok = parseBoxes(d[78:len(d)-4], format)
+	}
+	if !ok {
+		return
+	}
+	for _, ext := range extensions {
+		e := ext.Data
+		switch ext.Type {
+		case "gama":
+			// гамма в формате с фиксированной точкой 16.16
+			if len(e) >= 4 {
+				stream.Gamma = float64(binary.BigEndian.Uint32(e)) / 0x10000
+			}
+		case "fiel":
+			if len(e) >= 2 {
+				stream.FieldOrder = "progressive"
+				if e[0] == 2 {
+					stream.FieldOrder = "interlaced"
+					if order, ok := fieldOrders[e[1]]; ok {
+						stream.FieldOrder = order
+					}
+				}
+			}
+		case "colr":
+			stream.Color = colorDescription(e)
+		case "avcC", "hvcC":
+			if info, ok := parseDecoderConfig(ext, ext.Type == "hvcC"); ok {
+				stream.Profile = info.Profile
+				stream.BitDepth = info.ColorDepth / 3
+			}
+		case "av1C":
+			if info, ok := parseAV1Config(e); ok {
+				stream.Profile = info.Profile
+				stream.BitDepth = info.ColorDepth
+				// у изображения без цветности одна компонента
+				if e[2]&0x10 == 0 {
+					stream.BitDepth /= 3
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Восстановление файла без описания контейнера (moov) по исправному файлу с того же устройства
+package mp4
+
+import (
+	"io"
+	"math"
+)
+
+// RecoveredTrack сведения о восстановленной медиадорожке
+type RecoveredTrack struct {
+	ID      uint32 // идентификатор дорожки
+	Handler string // тип дорожки ('vide', 'soun')
+	Samples int    // количество найденных сэмплов
+}
+
+// RecoveryReport отчет о восстановлении файла
+type RecoveryReport struct {
+	Tracks       []RecoveredTrack // восстановленные дорожки
+	SkippedBytes int64            // медиаданные в конце файла, не отнесенные ни к одному сэмплу (байт)
+}
+
+// Recover восстановление файла r, в котором есть медиаданные (mdat), но нет описания контейнера,
+// например, после прерывания записи. Из исправного файла reference, записанного тем же устройством
+// с теми же настройками, берутся описания сэмплов и параметры потоков; границы сэмплов H.264/HEVC
+// находятся по NAL-блокам, границы кадров AAC - по размерам и началу кадров исправного файла.
+// Смещения времени отображения (B-кадры) не восстанавливаются
+func Recover(r io.ReadSeeker, reference io.ReadSeeker, w io.Writer) (report RecoveryReport, err error) {
+	report.Tracks = []RecoveredTrack{}
+	ref, err := readMovieFile(reference)
+	if err != nil {
+		return report, err
+	}
+	var video, audio *mediaTrack
+	var nal *nalStream
+	for _, t := range ref.tracks {
+		stsd := t.trak.Find("mdia/minf/stbl/stsd")
+		if stsd == nil || len(stsd.Children) == 0 || len(t.Samples) == 0 {
+			continue
+		}
+		entry := stsd.Children[0]
+		switch {
+		case video == nil && (entry.Type == "avc1" || entry.Type == "avc3"):
+			nal, err = newNALStream(entry.Child("avcC"), false)
+			video = t
+		case video == nil && (entry.Type == "hvc1" || entry.Type == "hev1"):
+			nal, err = newNALStream(entry.Child("hvcC"), true)
+			video = t
+		case audio == nil && entry.Type == "mp4a":
+			audio = t
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	if video == nil {
+		return report, ErrFileCodecNotSupported
+	}
+	src, size, err := newSource(r)
+	if err != nil {
+		return report, err
+	}
+	start, end, err := findMediaData(src, size)
+	if err != nil {
+		return report, err
+	}
+	s := &mediaScanner{src: src, end: end, nal: nal, maxNAL: 4 * int64(maxSampleSize(video.Samples))}
+	if audio != nil {
+		s.audio = newAudioFrameModel(ref.src, audio.Samples)
+	}
+	videoSamples, audioSamples, pos := s.scan(start)
+	report.SkippedBytes = end - pos
+	if len(videoSamples) == 0 {
+		return report, ErrNoSamples
+	}
+	// продолжительность сэмплов - наиболее частая продолжительность в исправном файле
+	setSampleTiming(videoSamples, video.Samples)
+	video.Samples = videoSamples
+	kept := []*mediaTrack{video}
+	if audio != nil && len(audioSamples) > 0 {
+		setSampleTiming(audioSamples, audio.Samples)
+		audio.Samples = audioSamples
+		kept = append(kept, audio)
+	}
+	// из описания исправного файла остаются только восстановленные дорожки без списков редактирования
+	// и без метаданных исправного файла
+	children := ref.movie.Children[:0]
+	for _, c := range ref.movie.Children {
+		if c.Type == "iods" || c.Type == "udta" || c.Type == "meta" || c.Type == "trak" && !isSelectedTrack(c, kept) {
+			continue
+		}
+		children = append(children, c)
+	}
+	ref.movie.Children = children
+	for _, t := range kept {
+		t.trak.Remove("edts")
+		t.trak.Remove("tref")
+		report.Tracks = append(report.Tracks, RecoveredTrack{ID: t.ID, Handler: t.Handler, Samples: len(t.Samples)})
+	}
+	return report, writeProgressive(w, src, ref.fileType(), ref.movie, kept)
+}
+
+// findMediaData поиск блока mdat верхнего уровня, возвращает границы его содержимого;
+// блок, обрезанный вместе с концом файла, считается продолжающимся до конца файла
+func findMediaData(src io.ReaderAt, size int64) (start, end int64, err error) {
+	for offset := int64(0); offset < size; {
+		h, err := readBoxHeader(src, offset, math.MaxInt64)
+		if err != nil {
+			return 0, 0, err
+		}
+		if h.Type == "mdat" {
+			end = offset + h.Size
+			if h.toEnd || end > size {
+				end = size
+			}
+			return offset + h.HeaderSize, end, nil
+		}
+		offset += h.Size
+	}
+	return 0, 0, ErrNoSamples
+}
+
+// maxSampleSize наибольший размер сэмпла
+func maxSampleSize(samples []Sample) (size uint32) {
+	for _, s := range samples {
+		if s.Size > size {
+			size = s.Size
+		}
+	}
+	return size
+}
+
+// mostCommon наиболее часто встречающееся значение
+func mostCommon(values []int) int {
+	counts := make(map[int]int)
+	best := 0
+	for _, v := range values {
+		counts[v]++
+		if counts[v] > counts[best] || counts[v] == counts[best] && v < best {
+			best = v
+		}
+	}
+	return best
+}
+
+// setSampleTiming продолжительность сэмплов по наиболее частой продолжительности сэмплов образца
+func setSampleTiming(samples, model []Sample) {
+	durations := make([]int, len(model))
+	for i, s := range model {
+		durations[i] = int(s.Duration)
+	}
+	duration := uint32(mostCommon(durations))
+	var dts uint64
+	for i := range samples {
+		samples[i].DTS = dts
+		samples[i].Duration = duration
+		samples[i].Description = 1
+		dts += uint64(duration)
+	}
+}
+
+// audioFrameModel признаки кадров AAC, полученные из исправного файла
+type audioFrameModel struct {
+	minSize, maxSize   int64           // допустимые размеры кадра
+	usualMin, usualMax int64           // размеры кадров исправного файла
+	prefixes           map[string]bool // возможные начала кадра
+	prefixSize         int             // размер начала кадра (байт)
+	perChunk           int             // наиболее частое количество кадров между видеосэмплами
+}
+
+// newAudioFrameModel построение модели кадров по сэмплам исправного файла src
+func newAudioFrameModel(src io.ReaderAt, samples []Sample) *audioFrameModel {
+	m := &audioFrameModel{minSize: math.MaxInt64}
+	var runs []int
+	for i, s := range samples {
+		if int64(s.Size) < m.minSize {
+			m.minSize = int64(s.Size)
+		}
+		if int64(s.Size) > m.maxSize {
+			m.maxSize = int64(s.Size)
+		}
+		// количество кадров в непрерывных участках (чанках)
+		if i == 0 || samples[i-1].Offset+int64(samples[i-1].Size) != s.Offset {
+			runs = append(runs, 0)
+		}
+		runs[len(runs)-1]++
+	}
+	// начало кадра длиной в 2 байта, если оно почти не меняется от кадра к кадру, иначе - в 1 байт
+	for m.prefixSize = 2; m.prefixSize > 0; m.prefixSize-- {
+		m.prefixes = make(map[string]bool)
+		buf := make([]byte, m.prefixSize)
+		for _, s := range samples {
+			if int64(s.Size) >= int64(m.prefixSize) {
+				if _, err := src.ReadAt(buf, s.Offset); err == nil {
+					m.prefixes[string(buf)] = true
+				}
+			}
+		}
+		if m.prefixSize == 1 || len(m.prefixes) <= len(samples)/8 {
+			break
+		}
+	}
+	m.usualMin, m.usualMax = m.minSize, m.maxSize
+	if m.minSize = m.minSize / 2; m.minSize < int64(m.prefixSize) {
+		m.minSize = int64(m.prefixSize)
+	}
+	m.maxSize = m.maxSize * 3 / 2
+	m.perChunk = mostCommon(runs)
+	return m
+}
+
+// frameStart начинается ли с позиции i кадр AAC
+func (m *audioFrameModel) frameStart(data []byte, i int) bool {
+	return i+m.prefixSize <= len(data) && m.prefixes[string(data[i:i+m.prefixSize])]
+}
+
+// mediaScanner поиск границ сэмплов в медиаданных
+type mediaScanner struct {
+	src    io.ReaderAt
+	end    int64
+	nal    *nalStream
+	maxNAL int64 // наибольший допустимый размер NAL-блока
+	audio  *audioFrameModel
+}
+
+// nalAt проверка, начинается ли с позиции pos NAL-блок; возвращает его полный размер (с полем длины) и заголовок
+func (s *mediaScanner) nalAt(pos int64) (size int64, header []byte, ok bool) {
+	buf := make([]byte, s.nal.lengthSize+3)
+	if pos+int64(len(buf)) > s.end {
+		return 0, nil, false
+	}
+	if _, err := s.src.ReadAt(buf, pos); err != nil {
+		return 0, nil, false
+	}
+	return s.parseNAL(buf, pos)
+}
+
+// parseNAL проверка поля длины и заголовка NAL-блока buf, расположенного с позиции pos
+func (s *mediaScanner) parseNAL(buf []byte, pos int64) (size int64, header []byte, ok bool) {
+	for _, b := range buf[:s.nal.lengthSize] {
+		size = size<<8 | int64(b)
+	}
+	header = buf[s.nal.lengthSize:]
+	if size < 2 || size > s.maxNAL || pos+int64(s.nal.lengthSize)+size > s.end || header[0]&0x80 != 0 {
+		return 0, nil, false
+	}
+	if s.nal.hevc {
+		// идентификатор слоя 0, идентификатор временного уровня больше 0, тип не из зарезервированных
+		if header[0]&0x1 != 0 || header[1]&0xF8 != 0 || header[1]&0x7 == 0 || header[0]>>1 >= 48 {
+			return 0, nil, false
+		}
+	} else if kind := header[0] & 0x1F; kind == 0 || kind > 23 {
+		return 0, nil, false
+	}
+	return int64(s.nal.lengthSize) + size, header, true
+}
+
+// nalKind признаки NAL-блока: начинает ли новый кадр, содержит ли данные кадра (VCL), ключевой ли кадр
+func (s *mediaScanner) nalKind(header []byte) (starts, vcl, sync bool) {
+	if s.nal.hevc {
+		kind := header[0] >> 1
+		vcl = kind < 32
+		// первый сегмент среза кадра; VPS, SPS, PPS, разделитель кадров, SEI перед кадром
+		starts = vcl && header[2]&0x80 != 0 || kind >= 32 && kind <= 35 || kind == 39
+		return starts, vcl, kind >= 16 && kind <= 21
+	}
+	kind := header[0] & 0x1F
+	vcl = kind >= 1 && kind <= 5
+	// первый срез кадра (first_mb_in_slice = 0); SEI, SPS, PPS, разделитель кадров
+	starts = vcl && header[1]&0x80 != 0 || kind >= 6 && kind <= 9
+	return starts, vcl, kind == 5
+}
+
+// frameStartAt начинается ли с позиции pos видеокадр
+func (s *mediaScanner) frameStartAt(pos int64) bool {
+	_, header, ok := s.nalAt(pos)
+	if !ok {
+		return false
+	}
+	starts, _, _ := s.nalKind(header)
+	return starts
+}
+
+// frameStartIn начинается ли видеокадр с позиции i участка data, прочитанного с позиции pos;
+// файл читается, только если заголовок NAL-блока выходит за конец участка
+func (s *mediaScanner) frameStartIn(data []byte, pos int64, i int) bool {
+	n := s.nal.lengthSize + 3
+	if i+n > len(data) {
+		return s.frameStartAt(pos + int64(i))
+	}
+	_, header, ok := s.parseNAL(data[i:i+n], pos+int64(i))
+	if !ok {
+		return false
+	}
+	starts, _, _ := s.nalKind(header)
+	return starts
+}
+
+// scan последовательный разбор медиаданных с позиции pos: видеокадры - по NAL-блокам, участки
+// между ними - как кадры AAC; возвращает сэмплы и позицию, на которой разбор остановлен
+func (s *mediaScanner) scan(pos int64) (video, audio []Sample, stop int64) {
+	stop = pos
+	var frame *Sample
+	vclSeen := false
+	flush := func() {
+		if frame != nil && vclSeen {
+			video = append(video, *frame)
+		}
+		frame, vclSeen = nil, false
+	}
+	for pos < s.end {
+		if size, header, ok := s.nalAt(pos); ok {
+			starts, vcl, sync := s.nalKind(header)
+			if starts && vclSeen {
+				flush()
+			}
+			if frame == nil {
+				frame = &Sample{Offset: pos}
+			}
+			frame.Size += uint32(size)
+			frame.Sync = frame.Sync || sync
+			vclSeen = vclSeen || vcl
+			pos += size
+			continue
+		}
+		flush()
+		if s.audio == nil {
+			break
+		}
+		frames, next := s.scanAudio(pos)
+		if len(frames) == 0 {
+			break
+		}
+		audio = append(audio, frames...)
+		pos = next
+	}
+	flush()
+	// разбор остановлен в конце последнего найденного сэмпла
+	for _, samples := range [][]Sample{video, audio} {
+		if n := len(samples); n > 0 {
+			if end := samples[n-1].Offset + int64(samples[n-1].Size); end > stop {
+				stop = end
+			}
+		}
+	}
+	return video, audio, stop
+}
+
+// scanAudio разбиение участка медиаданных, начинающегося с pos, на кадры AAC до следующего видеокадра
+// (или до конца медиаданных). Из возможных разбиений выбирается то, количество кадров в котором
+// ближе всего к обычному для исправного файла, а при равенстве - с меньшим числом кадров необычного размера
+func (s *mediaScanner) scanAudio(pos int64) ([]Sample, int64) {
+	m := s.audio
+	limit := pos + int64(2*m.perChunk+2)*m.maxSize
+	if limit > s.end {
+		limit = s.end
+	}
+	data := make([]byte, limit-pos)
+	if _, err := s.src.ReadAt(data, pos); err != nil && err != io.EOF {
+		return nil, pos
+	}
+	// step предыдущая позиция разбиения и число кадров необычного размера на пути к позиции
+	type step struct{ prev, unusual int }
+	// reach[i][n] - лучший путь к позиции pos+i из n кадров
+	reach := map[int]map[int]step{0: {0: {}}}
+	better := func(n, unusual, bestN, bestUnusual int) bool {
+		if d, bestD := abs(n-m.perChunk), abs(bestN-m.perChunk); d != bestD {
+			return d < bestD
+		}
+		return unusual < bestUnusual
+	}
+	best, bestCount, found := -1, 0, false
+	maxCount := 2*m.perChunk + 2
+	for i := 0; i < len(data); i++ {
+		counts, ok := reach[i]
+		if !ok {
+			continue
+		}
+		if i > 0 && s.frameStartIn(data, pos, i) {
+			for n, st := range counts {
+				if !found || better(n, st.unusual, bestCount, reach[best][bestCount].unusual) {
+					best, bestCount, found = i, n, true
+				}
+			}
+			continue
+		}
+		if !m.frameStart(data, i) {
+			continue
+		}
+		for size := m.minSize; size <= m.maxSize && i+int(size) <= len(data); size++ {
+			next := i + int(size)
+			if next < len(data) && !m.frameStart(data, next) && !s.frameStartIn(data, pos, next) {
+				continue
+			}
+			unusual := 0
+			if size < m.usualMin || size > m.usualMax {
+				unusual = 1
+			}
+			for n, st := range counts {
+				if n >= maxCount {
+					continue
+				}
+				if reach[next] == nil {
+					reach[next] = make(map[int]step)
+				}
+				if old, ok := reach[next][n+1]; !ok || st.unusual+unusual < old.unusual {
+					reach[next][n+1] = step{prev: i, unusual: st.unusual + unusual}
+				}
+			}
+		}
+	}
+	if !found {
+		// конец медиаданных: кадры до дальней достижимой позиции, остаток - обрезанный кадр
+		if limit != s.end {
+			return nil, pos
+		}
+		for i, counts := range reach {
+			for n := range counts {
+				if i > best || i == best && n > bestCount {
+					best, bestCount = i, n
+				}
+			}
+		}
+		if best <= 0 {
+			return nil, pos
+		}
+	}
+	frames := make([]Sample, bestCount)
+	for i, n := best, bestCount; n > 0; n-- {
+		prev := reach[i][n].prev
+		frames[n-1] = Sample{Offset: pos + int64(prev), Size: uint32(i - prev), Sync: true}
+		i = prev
+	}
+	return frames, pos + int64(best)
+}
+
+// abs модуль числа
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка восстановления файла без блока moov
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// recoverTestMovie файл из видеодорожки H.264 (по одному NAL-блоку в кадре, ключевой кадр каждые 10 кадров)
+// и дорожки AAC с неизменным началом кадров; содержимое кадров не похоже на начало NAL-блока или кадра AAC
+func recoverTestMovie(t *testing.T) []byte {
+	avcC := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, byte(len(testSPS))}
+	avcC = append(append(avcC, testSPS...), 0x01, 0x00, byte(len(testPPS)))
+	avcC = append(avcC, testPPS...)
+	video := testTrack{handler: "vide", timeScale: 12800, duration: 512, syncEvery: 10, config: NewBox("avcC", avcC)}
+	for i := 0; i < 30; i++ {
+		header := []byte{0x41, 0x9A}
+		if i%10 == 0 {
+			header = []byte{0x65, 0x88}
+		}
+		nal := append(header, bytes.Repeat([]byte{0x11}, 200+i*7%100)...)
+		video.payloads = append(video.payloads, append(binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal...))
+	}
+	audio := testTrack{handler: "soun", timeScale: 44100, duration: 1024}
+	for i := 0; i < 40; i++ {
+		audio.payloads = append(audio.payloads, append([]byte{0x21, 0x10}, bytes.Repeat([]byte{0x55}, 100+i*13%50)...))
+	}
+	for _, track := range []*testTrack{&video, &audio} {
+		for _, p := range track.payloads {
+			track.sizes = append(track.sizes, uint32(len(p)))
+		}
+	}
+	return buildTestMovie(t, video, audio)
+}
+
+func TestRecover(t *testing.T) {
+	data := recoverTestMovie(t)
+	reference := readTestMovie(t, data)
+	// запись прервана до записи moov: в файле остались только ftyp и mdat
+	broken := data[:reference.movie.offset]
+	var out bytes.Buffer
+	report, err := Recover(bytes.NewReader(broken), bytes.NewReader(data), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RecoveredTrack{{1, "vide", 30}, {2, "soun", 40}}
+	if len(report.Tracks) != len(want) || report.Tracks[0] != want[0] || report.Tracks[1] != want[1] || report.SkippedBytes != 0 {
+		t.Fatalf("отчет %+v", report)
+	}
+	// смещения времени отображения не восстанавливаются
+	for _, track := range reference.tracks {
+		for i := range track.Samples {
+			track.Samples[i].CTSOffset = 0
+		}
+	}
+	got := readTestMovie(t, out.Bytes())
+	compareMovies(t, reference, got)
+	for i, track := range got.tracks {
+		for j, s := range track.Samples {
+			if s.DTS != reference.tracks[i].Samples[j].DTS {
+				t.Fatalf("дорожка %d, сэмпл %d: время декодирования %d вместо %d", i+1, j, s.DTS, reference.tracks[i].Samples[j].DTS)
+			}
+		}
+	}
+}
+
+func TestRecoverWithoutVideo(t *testing.T) {
+	data := testMovie(t)
+	// в исправном файле нет конфигурации декодера H.264/HEVC
+	if _, err := Recover(bytes.NewReader(data), bytes.NewReader(data), &bytes.Buffer{}); err != ErrFileCodecNotSupported {
+		t.Fatalf("ошибка %v вместо %v", err, ErrFileCodecNotSupported)
+	}
+}
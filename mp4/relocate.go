@@ -0,0 +1,153 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Пересчет смещений чанков медиаданных при изменении расположения блоков в файле
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+)
+
+// chunkOffsetTable таблица смещений чанков медиадорожки (блок stco или co64)
+type chunkOffsetTable struct {
+	box     *Box
+	offsets []uint64 // смещения чанков в исходном файле
+}
+
+// readChunkOffsetTables чтение таблиц смещений чанков всех медиадорожек контейнера
+func readChunkOffsetTables(movie *Box) ([]chunkOffsetTable, error) {
+	var tables []chunkOffsetTable
+	for _, stbl := range movie.FindAll("trak/mdia/minf/stbl") {
+		for _, b := range stbl.Children {
+			if b.Type != "stco" && b.Type != "co64" {
+				continue
+			}
+			offsets, err := parseChunkOffsets(b)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, chunkOffsetTable{box: b, offsets: offsets})
+		}
+	}
+	return tables, nil
+}
+
+// parseChunkOffsets разбор содержимого блока stco/co64
+func parseChunkOffsets(b *Box) ([]uint64, error) {
+	entrySize := 4
+	if b.Type == "co64" {
+		entrySize = 8
+	}
+	if len(b.Data) < 8 {
+		return nil, ErrFileIsNotValid
+	}
+	count := int(binary.BigEndian.Uint32(b.Data[4:8]))
+	if count > (len(b.Data)-8)/entrySize {
+		return nil, ErrFileIsNotValid
+	}
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		entry := b.Data[8+i*entrySize:]
+		if entrySize == 4 {
+			offsets[i] = uint64(binary.BigEndian.Uint32(entry))
+		} else {
+			offsets[i] = binary.BigEndian.Uint64(entry)
+		}
+	}
+	return offsets, nil
+}
+
+// setChunkOffsets запись смещений в блок stco, либо в co64, если смещения не помещаются в 32 бита
+// (блок co64 обратно в stco не преобразуется)
+func setChunkOffsets(b *Box, offsets []uint64) {
+	if b.Type != "co64" {
+		b.Type = "stco"
+	}
+	for _, offset := range offsets {
+		if offset > math.MaxUint32 {
+			b.Type = "co64"
+			break
+		}
+	}
+	data := make([]byte, 4, 8+len(offsets)*8) // версия и флаги
+	data = binary.BigEndian.AppendUint32(data, uint32(len(offsets)))
+	for _, offset := range offsets {
+		if b.Type == "stco" {
+			data = binary.BigEndian.AppendUint32(data, uint32(offset))
+		} else {
+			data = binary.BigEndian.AppendUint64(data, offset)
+		}
+	}
+	b.SetData(data)
+}
+
+// relocate пересчет исходных смещений таблицы функцией shift
+func (t chunkOffsetTable) relocate(shift func(uint64) (uint64, bool)) error {
+	offsets := make([]uint64, len(t.offsets))
+	for i, old := range t.offsets {
+		var ok bool
+		if offsets[i], ok = shift(old); !ok {
+			return ErrChunkOffsetOutOfRange
+		}
+	}
+	setChunkOffsets(t.box, offsets)
+	return nil
+}
+
+// movedRange участок исходного файла и его новая позиция
+type movedRange struct {
+	offset    int64 // позиция в исходном файле
+	size      int64 // размер участка
+	newOffset int64 // позиция в новом файле
+}
+
+// newOffsetShifter создание функции пересчета смещения в исходном файле в смещение в файле,
+// состоящем из блоков верхнего уровня layout. Пересчитываются только смещения, попадающие
+// в блоки, перенесенные из исходного файла без изменений (блоки медиаданных)
+func newOffsetShifter(layout []*Box) func(uint64) (uint64, bool) {
+	var ranges []movedRange
+	var offset int64
+	for _, b := range layout {
+		if b.src != nil && b.Data == nil {
+			ranges = append(ranges, movedRange{b.offset, b.size, offset})
+		}
+		offset += b.Size()
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].offset < ranges[j].offset })
+	return func(old uint64) (uint64, bool) {
+		i := sort.Search(len(ranges), func(i int) bool {
+			return uint64(ranges[i].offset+ranges[i].size) > old
+		})
+		if i == len(ranges) || uint64(ranges[i].offset) > old {
+			return 0, false
+		}
+		return uint64(ranges[i].newOffset-ranges[i].offset) + old, true
+	}
+}
+
+// writeRelocated запись блоков верхнего уровня layout с пересчетом смещений чанков в блоке moov
+// После замены stco на co64 размер moov растет, что в свою очередь сдвигает медиаданные,
+// поэтому смещения пересчитываются, пока размер блока не перестанет меняться
+func writeRelocated(w io.Writer, layout []*Box) error {
+	if i := findBox(layout, "moov"); i >= 0 {
+		movie := layout[i]
+		tables, err := readChunkOffsetTables(movie)
+		if err != nil {
+			return err
+		}
+		for size := int64(-1); size != movie.Size(); {
+			size = movie.Size()
+			shift := newOffsetShifter(layout)
+			for _, t := range tables {
+				if err = t.relocate(shift); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return WriteBoxes(w, layout)
+}
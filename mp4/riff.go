@@ -0,0 +1,636 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор файлов RIFF: AVI (включая OpenDML) и WAV (включая BWF и RF64)
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Параметры индексов AVI
+const (
+	aviKeyFrame       = 0x10       // признак ключевого кадра в idx1 (AVIIF_KEYFRAME)
+	aviDeltaFrame     = 0x80000000 // признак неключевого кадра в размере записи индекса OpenDML
+	aviIndexOfChunks  = 0x1        // тип индекса OpenDML: индекс блоков данных
+	maxRIFFChunkSize  = 64 << 20   // наибольший размер блока RIFF, загружаемого в память (байт)
+	wavFormatExtended = 0xFFFE     // WAVE_FORMAT_EXTENSIBLE
+	riffUnknownSize   = 0xFFFFFFFF // размер блока RF64 задается в блоке ds64
+)
+
+// waveFormats наименования форматов звука по коду wFormatTag
+var waveFormats = map[uint16]string{
+	0x0001: "PCM", 0x0002: "MS ADPCM", 0x0003: "IEEE Float", 0x0006: "A-law", 0x0007: "mu-law",
+	0x0011: "IMA ADPCM", 0x0050: "MPEG Audio", 0x0055: "MP3", 0x00FF: "AAC", 0x0161: "WMA",
+	0x0162: "WMA Pro", 0x2000: "AC-3", 0x2001: "DTS", 0xF1AC: "FLAC",
+}
+
+// riffInfoTags наименования тегов списка INFO, совпадающие с наименованиями тегов Matroska
+var riffInfoTags = map[string]string{
+	"INAM": "TITLE", "IART": "ARTIST", "ICMT": "COMMENT", "ICRD": "DATE_RECORDED", "ISFT": "ENCODER",
+	"ICOP": "COPYRIGHT", "IGNR": "GENRE", "IPRD": "ALBUM", "IENG": "ENGINEER", "ISBJ": "SUBJECT",
+	"IKEY": "KEYWORDS", "ISRC": "SOURCE", "ITCH": "ENCODED_BY", "ILNG": "LANGUAGE", "IPRT": "PART_NUMBER",
+}
+
+// riffReader последовательное чтение блоков RIFF из потока
+type riffReader struct {
+	r   *bufio.Reader
+	pos int64 // количество прочитанных байт
+}
+
+// readHeader чтение идентификатора и размера блока
+func (rr *riffReader) readHeader() (id string, size int64, err error) {
+	header := make([]byte, 8)
+	n, err := io.ReadFull(rr.r, header)
+	rr.pos += int64(n)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(header[:4]), int64(binary.LittleEndian.Uint32(header[4:])), nil
+}
+
+// readData чтение содержимого блока
+func (rr *riffReader) readData(size int64) ([]byte, error) {
+	if size > maxRIFFChunkSize {
+		return nil, ErrFileIsNotValid
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(rr.r, data)
+	rr.pos += int64(n)
+	if err != nil {
+		return nil, ErrFileIsNotValid
+	}
+	return data, nil
+}
+
+// skip пропуск содержимого блока (при обрыве файла - до конца потока)
+func (rr *riffReader) skip(size int64) error {
+	for size > 0 {
+		step := size
+		if step > 1<<30 {
+			step = 1 << 30
+		}
+		n, err := rr.r.Discard(int(step))
+		rr.pos += int64(n)
+		size -= int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readList чтение вложенных блоков списка размером size. Для вложенных списков (LIST) в handle
+// передается тип списка и признак list, размер - без учета типа. Непрочитанное содержимое блока
+// и байт выравнивания пропускаются
+func (rr *riffReader) readList(size int64, handle func(id string, list bool, size int64) error) error {
+	end := rr.pos + size
+	for rr.pos+8 <= end {
+		id, childSize, err := rr.readHeader()
+		if err != nil {
+			return err
+		}
+		// размер блока не выходит за пределы списка (у обрезанных и незакрытых файлов он бывает больше)
+		if childSize > end-rr.pos {
+			childSize = end - rr.pos
+		}
+		start := rr.pos
+		list := false
+		if id == "LIST" && childSize >= 4 {
+			kind, err := rr.readData(4)
+			if err != nil {
+				return err
+			}
+			id, list = string(kind), true
+			childSize -= 4
+			start += 4
+		}
+		if err = handle(id, list, childSize); err != nil {
+			return err
+		}
+		rest := start + childSize - rr.pos
+		if childSize%2 == 1 && start+childSize < end {
+			rest++
+		}
+		if err = rr.skip(rest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waveFormat описание формата звука (WAVEFORMATEX)
+type waveFormat struct {
+	tag        uint16 // код формата
+	channels   uint16 // количество каналов
+	sampleRate uint32 // частота дискретизации (Гц)
+	byteRate   uint32 // байт в секунду
+	blockAlign uint16 // размер блока сэмплов всех каналов (байт)
+	bits       uint16 // разрядность сэмпла (бит)
+}
+
+// parseWaveFormat разбор WAVEFORMATEX; для WAVE_FORMAT_EXTENSIBLE код формата берется из SubFormat
+func parseWaveFormat(data []byte) (waveFormat, bool) {
+	if len(data) < 14 {
+		return waveFormat{}, false
+	}
+	w := waveFormat{
+		tag:        binary.LittleEndian.Uint16(data),
+		channels:   binary.LittleEndian.Uint16(data[2:]),
+		sampleRate: binary.LittleEndian.Uint32(data[4:]),
+		byteRate:   binary.LittleEndian.Uint32(data[8:]),
+		blockAlign: binary.LittleEndian.Uint16(data[12:]),
+	}
+	if len(data) >= 16 {
+		w.bits = binary.LittleEndian.Uint16(data[14:])
+	}
+	if w.tag == wavFormatExtended && len(data) >= 26 {
+		w.tag = binary.LittleEndian.Uint16(data[24:])
+	}
+	return w, true
+}
+
+// name наименование формата звука
+func (w waveFormat) name() string {
+	if name, ok := waveFormats[w.tag]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", w.tag)
+}
+
+// aviStream описание потока AVI
+type aviStream struct {
+	kind        string // тип потока (vids, auds, txts)
+	handler     string // код кодека из заголовка потока
+	compression string // код кодека из формата изображения
+	scale       uint32 // делитель частоты
+	rate        uint32 // частота (rate/scale - кадров или сэмплов в секунду)
+	length      uint32 // продолжительность (в единицах scale/rate)
+	sampleSize  uint32 // размер сэмпла (0 - сэмплы переменного размера)
+	width       uint32
+	height      uint32
+	bitCount    uint16
+	audio       waveFormat
+	name        string
+	chunks      int   // количество блоков данных по индексу
+	keyFrames   int   // количество ключевых кадров по индексу
+	bytes       int64 // объем данных по индексу (байт)
+	// то же по индексам OpenDML, которые при наличии предпочтительнее idx1
+	odmlChunks    int
+	odmlKeyFrames int
+	odmlBytes     int64
+}
+
+// riffFile состояние разбора файла RIFF
+type riffFile struct {
+	*riffReader
+	file        *VideoFile
+	streams     []*aviStream
+	usPerFrame  uint32 // продолжительность кадра (мкс)
+	totalFrames uint32 // количество кадров (по заголовку OpenDML, если он есть)
+	width       uint32
+	height      uint32
+	openDML     bool
+	wave        waveFormat
+	hasWave     bool
+	dataSize    int64  // размер блока данных WAV (байт)
+	sampleCount uint64 // количество сэмплов WAV по блоку fact или ds64
+	ds64Data    int64  // размер блока данных RF64
+}
+
+// isRIFF является ли начало потока заголовком файла AVI или WAV
+func isRIFF(header []byte) bool {
+	if len(header) < 12 {
+		return false
+	}
+	form := string(header[8:12])
+	return (string(header[:4]) == "RIFF" || string(header[:4]) == "RF64") && (form == "AVI " || form == "WAVE")
+}
+
+// readRIFF разбор файла AVI или WAV из потока
+func (f *VideoFile) readRIFF(r *bufio.Reader) error {
+	rf := &riffFile{riffReader: &riffReader{r: r}, file: f}
+	var form string
+	// файл AVI OpenDML состоит из нескольких блоков RIFF: AVI и следующих за ним AVIX
+	for number := 0; ; number++ {
+		id, size, err := rf.readHeader()
+		if err == io.EOF && number > 0 {
+			break
+		}
+		if err != nil || id != "RIFF" && id != "RF64" || size < 4 {
+			if number > 0 {
+				break
+			}
+			return ErrFileIsNotValid
+		}
+		kind, err := rf.readData(4)
+		if err != nil {
+			return err
+		}
+		if number == 0 {
+			form = string(kind)
+			f.Codec = map[string]string{"AVI ": "AVI", "WAVE": "WAV"}[form]
+			if id == "RF64" {
+				f.Codec = "RF64"
+			}
+		}
+		if size == riffUnknownSize {
+			size = 1<<62 - rf.pos
+		}
+		err = rf.readList(size-4, func(id string, list bool, size int64) error {
+			if form == "WAVE" {
+				return rf.readWaveChunk(id, list, size)
+			}
+			return rf.readAVIChunk(id, list, size)
+		})
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if err != nil || form == "WAVE" {
+			break
+		}
+	}
+	if form == "WAVE" {
+		if !rf.hasWave {
+			return ErrFileIsNotValid
+		}
+		rf.fillWave()
+	} else {
+		if rf.openDML {
+			f.Codec = "AVI (OpenDML)"
+		}
+		rf.fillAVI()
+	}
+	// данные после блоков RIFF учитываются только в размере файла
+	rest, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return NewAPIError("ошибка при получении файла", err)
+	}
+	f.Size = int(rf.pos + rest)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// readAVIChunk разбор блока файла AVI
+func (rf *riffFile) readAVIChunk(id string, list bool, size int64) error {
+	switch {
+	case list && (id == "hdrl" || id == "odml"):
+		return rf.readList(size, rf.readAVIChunk)
+	case list && id == "strl":
+		rf.streams = append(rf.streams, &aviStream{})
+		return rf.readList(size, rf.readAVIChunk)
+	case list && (id == "movi" || id == "rec "):
+		// блоки данных пропускаются, разбираются только индексы OpenDML
+		return rf.readList(size, rf.readAVIChunk)
+	case list && id == "INFO":
+		return rf.readList(size, func(id string, list bool, size int64) error {
+			return rf.readInfoTag(id, size)
+		})
+	case id == "avih":
+		data, err := rf.readData(size)
+		if err != nil || len(data) < 40 {
+			return ErrFileIsNotValid
+		}
+		rf.usPerFrame = binary.LittleEndian.Uint32(data)
+		if rf.totalFrames == 0 {
+			rf.totalFrames = binary.LittleEndian.Uint32(data[16:])
+		}
+		rf.width = binary.LittleEndian.Uint32(data[32:])
+		rf.height = binary.LittleEndian.Uint32(data[36:])
+	case id == "dmlh":
+		// заголовок OpenDML: общее количество кадров во всех блоках RIFF
+		data, err := rf.readData(size)
+		if err != nil || len(data) < 4 {
+			return ErrFileIsNotValid
+		}
+		rf.openDML = true
+		rf.totalFrames = binary.LittleEndian.Uint32(data)
+	case id == "strh" && len(rf.streams) > 0:
+		data, err := rf.readData(size)
+		if err != nil || len(data) < 48 {
+			return ErrFileIsNotValid
+		}
+		s := rf.streams[len(rf.streams)-1]
+		s.kind = string(data[:4])
+		s.handler = strings.TrimRight(string(data[4:8]), "\x00 ")
+		s.scale = binary.LittleEndian.Uint32(data[20:])
+		s.rate = binary.LittleEndian.Uint32(data[24:])
+		s.length = binary.LittleEndian.Uint32(data[32:])
+		s.sampleSize = binary.LittleEndian.Uint32(data[44:])
+	case id == "strf" && len(rf.streams) > 0:
+		data, err := rf.readData(size)
+		if err != nil {
+			return err
+		}
+		s := rf.streams[len(rf.streams)-1]
+		switch s.kind {
+		case "vids":
+			// BITMAPINFOHEADER; высота отрицательна для изображений, записанных сверху вниз
+			if len(data) >= 20 {
+				s.width = binary.LittleEndian.Uint32(data[4:])
+				height := int32(binary.LittleEndian.Uint32(data[8:]))
+				if height < 0 {
+					height = -height
+				}
+				s.height = uint32(height)
+				s.bitCount = binary.LittleEndian.Uint16(data[14:])
+				s.compression = strings.TrimRight(string(data[16:20]), "\x00 ")
+			}
+		case "auds":
+			s.audio, _ = parseWaveFormat(data)
+		}
+	case id == "strn" && len(rf.streams) > 0:
+		data, err := rf.readData(size)
+		if err != nil {
+			return err
+		}
+		rf.streams[len(rf.streams)-1].name = strings.TrimRight(string(data), "\x00")
+	case id == "indx":
+		// супериндекс OpenDML ссылается на блоки ix##, которые разбираются при чтении movi
+		rf.openDML = true
+	case id == "idx1":
+		return rf.readIndex(size)
+	case strings.HasPrefix(id, "ix"):
+		return rf.readStandardIndex(id, size)
+	}
+	return nil
+}
+
+// aviStreamNumber номер потока по идентификатору блока данных (00dc, 01wb, ix00)
+func (rf *riffFile) aviStreamNumber(id string) (*aviStream, bool) {
+	number, err := strconv.Atoi(id[len(id)-2:])
+	if err != nil || number < 0 || number >= len(rf.streams) {
+		return nil, false
+	}
+	return rf.streams[number], true
+}
+
+// readIndex разбор индекса idx1: записи по 16 байт (идентификатор, флаги, смещение, размер)
+func (rf *riffFile) readIndex(size int64) error {
+	entry := make([]byte, 16)
+	for ; size >= 16; size -= 16 {
+		n, err := io.ReadFull(rf.r, entry)
+		rf.pos += int64(n)
+		if err != nil {
+			return err
+		}
+		id := string(entry[:4])
+		s, ok := rf.aviStreamNumber(id[:2])
+		// записи списков rec и блоков без номера потока не учитываются
+		if !ok || strings.HasPrefix(id, "ix") {
+			continue
+		}
+		s.chunks++
+		if binary.LittleEndian.Uint32(entry[4:])&aviKeyFrame != 0 {
+			s.keyFrames++
+		}
+		s.bytes += int64(binary.LittleEndian.Uint32(entry[12:]))
+	}
+	return nil
+}
+
+// readStandardIndex разбор индекса OpenDML ix## (записи смещения и размера блоков данных потока)
+func (rf *riffFile) readStandardIndex(id string, size int64) error {
+	s, ok := rf.aviStreamNumber(id)
+	if !ok || size < 24 {
+		return nil
+	}
+	header, err := rf.readData(24)
+	if err != nil {
+		return err
+	}
+	longsPerEntry := int(binary.LittleEndian.Uint16(header))
+	count := int64(binary.LittleEndian.Uint32(header[4:]))
+	if header[3] != aviIndexOfChunks || longsPerEntry < 2 || count*int64(longsPerEntry)*4 > size-24 {
+		return nil
+	}
+	rf.openDML = true
+	entry := make([]byte, longsPerEntry*4)
+	for i := int64(0); i < count; i++ {
+		n, err := io.ReadFull(rf.r, entry)
+		rf.pos += int64(n)
+		if err != nil {
+			return err
+		}
+		chunkSize := binary.LittleEndian.Uint32(entry[4:])
+		s.odmlChunks++
+		if chunkSize&aviDeltaFrame == 0 {
+			s.odmlKeyFrames++
+		}
+		s.odmlBytes += int64(chunkSize &^ aviDeltaFrame)
+	}
+	return nil
+}
+
+// readInfoTag чтение тега списка INFO
+func (rf *riffFile) readInfoTag(id string, size int64) error {
+	data, err := rf.readData(size)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimRight(string(data), "\x00 ")
+	if value == "" {
+		return nil
+	}
+	name, ok := riffInfoTags[id]
+	if !ok {
+		name = id
+	}
+	movie := &rf.file.Movie
+	if movie.Tags == nil {
+		movie.Tags = make(map[string]string)
+	}
+	movie.Tags[name] = value
+	return nil
+}
+
+// fillAVI заполнение модели метаданных по заголовкам и индексам AVI
+func (rf *riffFile) fillAVI() {
+	movie := &rf.file.Movie
+	movie.TimeScale = uint32(time.Second / time.Microsecond)
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	movie.Duration = float64(uint64(rf.totalFrames)*uint64(rf.usPerFrame)) / 1e6
+	for _, s := range rf.streams {
+		if s.odmlChunks > 0 {
+			s.chunks, s.keyFrames, s.bytes = s.odmlChunks, s.odmlKeyFrames, s.odmlBytes
+		}
+		var duration float64
+		if s.rate > 0 {
+			length := uint64(s.length)
+			// у видео без сэмплов фиксированного размера каждый блок - кадр
+			if s.kind == "vids" && uint64(s.chunks) > length {
+				length = uint64(s.chunks)
+			}
+			duration = float64(length*uint64(s.scale)) / float64(s.rate)
+		}
+		// idx1 файла OpenDML описывает только первый блок RIFF
+		indexed := s.odmlChunks > 0 || !rf.openDML
+		if s.kind == "auds" && indexed && s.sampleSize > 0 && s.audio.byteRate > 0 && s.bytes > 0 {
+			duration = float64(s.bytes) / float64(s.audio.byteRate)
+		}
+		if duration > movie.Duration {
+			movie.Duration = duration
+		}
+		track := Track{
+			Duration:  duration,
+			Name:      s.name,
+			Samples:   s.chunks,
+			KeyFrames: s.keyFrames,
+		}
+		if duration > 0 {
+			track.Bitrate = uint64(float64(s.bytes*8) / duration)
+		}
+		stream := &Stream{TimeScale: s.rate, Duration: duration}
+		switch s.kind {
+		case "vids":
+			stream.Type = Video
+			track.Width, track.Height = s.width, s.height
+			if track.Width == 0 {
+				track.Width, track.Height = rf.width, rf.height
+			}
+			format := s.compression
+			if format == "" {
+				format = s.handler
+			}
+			track.Stream = &VideoStream{Stream: stream, Format: format, ColorDepth: s.bitCount}
+		case "auds":
+			stream.Type = Audio
+			track.Stream = &AudioStream{
+				Stream:       stream,
+				AudioBalance: "normal",
+				Format:       s.audio.name(),
+				Channels:     channelLayout(s.audio.channels),
+				SampleRate:   s.audio.sampleRate,
+			}
+		case "txts":
+			stream.Type = Subtitle
+			track.Stream = stream
+		default:
+			stream.Type = s.kind
+			track.Stream = stream
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+}
+
+// readWaveChunk разбор блока файла WAV
+func (rf *riffFile) readWaveChunk(id string, list bool, size int64) error {
+	switch {
+	case list && id == "INFO":
+		return rf.readList(size, func(id string, list bool, size int64) error {
+			return rf.readInfoTag(id, size)
+		})
+	case id == "ds64":
+		// размеры RF64: файла, блока данных и количество сэмплов
+		data, err := rf.readData(size)
+		if err != nil || len(data) < 24 {
+			return ErrFileIsNotValid
+		}
+		rf.ds64Data = int64(binary.LittleEndian.Uint64(data[8:]))
+		rf.sampleCount = binary.LittleEndian.Uint64(data[16:])
+	case id == "fmt ":
+		data, err := rf.readData(size)
+		if err != nil {
+			return err
+		}
+		if rf.wave, rf.hasWave = parseWaveFormat(data); !rf.hasWave {
+			return ErrFileIsNotValid
+		}
+	case id == "fact":
+		data, err := rf.readData(size)
+		if err != nil || len(data) < 4 {
+			return ErrFileIsNotValid
+		}
+		if rf.sampleCount == 0 {
+			rf.sampleCount = uint64(binary.LittleEndian.Uint32(data))
+		}
+	case id == "data":
+		rf.dataSize = size
+		if rf.ds64Data > 0 {
+			// размер данных RF64 больше 4 Гбайт - блок продолжается до конца файла
+			rf.dataSize = rf.ds64Data
+			return rf.skip(rf.ds64Data)
+		}
+	case id == "bext":
+		return rf.readBroadcastExtension(size)
+	}
+	return nil
+}
+
+// readBroadcastExtension разбор расширения Broadcast Wave (описание, автор, дата и время записи)
+func (rf *riffFile) readBroadcastExtension(size int64) error {
+	data, err := rf.readData(size)
+	if err != nil || len(data) < 346 {
+		return ErrFileIsNotValid
+	}
+	movie := &rf.file.Movie
+	if movie.Tags == nil {
+		movie.Tags = make(map[string]string)
+	}
+	text := func(b []byte) string {
+		return strings.TrimRight(string(b), "\x00 ")
+	}
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"DESCRIPTION", text(data[:256])},
+		{"ORIGINATOR", text(data[256:288])},
+		{"ORIGINATOR_REFERENCE", text(data[288:320])},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			movie.Tags[field.name] = field.value
+		}
+	}
+	// дата и время записи: yyyy-mm-dd и hh:mm:ss (допускаются любые разделители)
+	date, clock := text(data[320:330]), text(data[330:338])
+	if len(date) == 10 && len(clock) == 8 {
+		layout := "2006" + date[4:5] + "01" + date[7:8] + "02 15" + clock[2:3] + "04" + clock[5:6] + "05"
+		if created, err := time.Parse(layout, date+" "+clock); err == nil {
+			movie.Created, movie.Modified = created, created
+		}
+	}
+	// отметка времени - количество сэмплов от полуночи
+	movie.Tags["TIME_REFERENCE"] = strconv.FormatUint(binary.LittleEndian.Uint64(data[338:]), 10)
+	return nil
+}
+
+// fillWave заполнение модели метаданных по заголовкам WAV
+func (rf *riffFile) fillWave() {
+	movie := &rf.file.Movie
+	w := rf.wave
+	var duration float64
+	switch {
+	case rf.sampleCount > 0 && w.sampleRate > 0:
+		duration = float64(rf.sampleCount) / float64(w.sampleRate)
+	case w.byteRate > 0:
+		duration = float64(rf.dataSize) / float64(w.byteRate)
+	}
+	movie.TimeScale = w.sampleRate
+	movie.Duration = duration
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	movie.Bitrate = uint64(w.byteRate) * 8
+	track := Track{Created: movie.Created, Modified: movie.Modified, Duration: duration, Bitrate: movie.Bitrate}
+	if w.blockAlign > 0 {
+		track.Samples = int(rf.dataSize / int64(w.blockAlign))
+	}
+	track.Stream = &AudioStream{
+		Stream:       &Stream{TimeScale: w.sampleRate, Duration: duration, Type: Audio},
+		AudioBalance: "normal",
+		Format:       w.name(),
+		Channels:     channelLayout(w.channels),
+		SampleRate:   w.sampleRate,
+	}
+	movie.Tracks = append(movie.Tracks, track)
+}
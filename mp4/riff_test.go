@@ -0,0 +1,98 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора файлов RIFF (WAV с расширением Broadcast Wave)
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// riffChunk блок RIFF с выравниванием до четного размера
+func riffChunk(id string, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	chunk := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// testBroadcastExtension содержимое блока bext
+func testBroadcastExtension() []byte {
+	data := make([]byte, 602)
+	copy(data, "Interview")
+	copy(data[256:], "Recorder")
+	copy(data[288:], "REF-1")
+	copy(data[320:], "2020-05-17")
+	copy(data[330:], "10:20:30")
+	binary.LittleEndian.PutUint64(data[338:], 12345)
+	return data
+}
+
+// testWave файл WAV: PCM 8000 Гц, стерео, 16 бит, 0,5 с, с блоками bext и LIST INFO
+func testWave() []byte {
+	format := binary.LittleEndian.AppendUint16(nil, 0x0001)
+	format = binary.LittleEndian.AppendUint16(format, 2)
+	format = binary.LittleEndian.AppendUint32(format, 8000)
+	format = binary.LittleEndian.AppendUint32(format, 32000)
+	format = binary.LittleEndian.AppendUint16(format, 4)
+	format = binary.LittleEndian.AppendUint16(format, 16)
+	return riffChunk("RIFF", []byte("WAVE"),
+		riffChunk("fmt ", format),
+		riffChunk("bext", testBroadcastExtension()),
+		// тег нечетного размера с байтом выравнивания
+		riffChunk("LIST", []byte("INFO"), riffChunk("INAM", []byte("Title")), riffChunk("IART", []byte("Artist\x00"))),
+		riffChunk("data", make([]byte, 16000)))
+}
+
+func TestWave(t *testing.T) {
+	data := testWave()
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	movie := f.Movie
+	if f.Codec != "WAV" || f.Size != len(data) || movie.Duration != 0.5 || movie.Bitrate != 256000 || movie.TimeScale != 8000 {
+		t.Fatalf("формат %q, размер %d, продолжительность %v, битрейт %d", f.Codec, f.Size, movie.Duration, movie.Bitrate)
+	}
+	tags := map[string]string{
+		"DESCRIPTION":          "Interview",
+		"ORIGINATOR":           "Recorder",
+		"ORIGINATOR_REFERENCE": "REF-1",
+		"TIME_REFERENCE":       "12345",
+		"TITLE":                "Title",
+		"ARTIST":               "Artist",
+	}
+	for name, value := range tags {
+		if movie.Tags[name] != value {
+			t.Fatalf("тег %s: %q вместо %q", name, movie.Tags[name], value)
+		}
+	}
+	if created := time.Date(2020, 5, 17, 10, 20, 30, 0, time.UTC); !movie.Created.Equal(created) {
+		t.Fatalf("дата записи %v вместо %v", movie.Created, created)
+	}
+	if len(movie.Tracks) != 1 {
+		t.Fatalf("%d дорожек вместо 1", len(movie.Tracks))
+	}
+	track := movie.Tracks[0]
+	audio, ok := track.Stream.(*AudioStream)
+	if !ok || track.Samples != 4000 || track.Duration != 0.5 ||
+		audio.Format != "PCM" || audio.Channels != "Stereo" || audio.SampleRate != 8000 {
+		t.Fatalf("дорожка %+v, поток %+v", track, track.Stream)
+	}
+}
+
+func TestWaveBroadcastExtensionSize(t *testing.T) {
+	// блок bext короче обязательных полей
+	data := riffChunk("RIFF", []byte("WAVE"), riffChunk("bext", make([]byte, 100)))
+	var f VideoFile
+	if err := f.Open(bytes.NewReader(data)); err != ErrFileIsNotValid {
+		t.Fatalf("ошибка %v вместо %v", err, ErrFileIsNotValid)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Таблицы сэмплов медиадорожек (блок stbl): расположение, размеры и время каждого сэмпла
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// maxAnalyzedSamples наибольшее количество сэмплов файла, для которого при разборе метаданных
+// строятся таблицы сэмплов (для больших файлов анализ доступен отдельно, см. AnalyzeGOP)
+const maxAnalyzedSamples = 1 << 20
+
+// Sample сведения о сэмпле (кадре) медиадорожки
+type Sample struct {
+	Offset      int64  // позиция сэмпла в файле (байт)
+	Size        uint32 // размер сэмпла (байт)
+	DTS         uint64 // время декодирования (в единицах времени медиадорожки)
+	Duration    uint32 // продолжительность (в единицах времени медиадорожки)
+	CTSOffset   int64  // смещение времени отображения относительно времени декодирования
+	Sync        bool   // ключевой сэмпл (кадр, с которого можно начать декодирование)
+	DependsOn   byte   // зависимость от других сэмплов по данным sdtp (0 - неизвестно, 1 - зависит, 2 - не зависит)
+	Leading     byte   // ведущий сэмпл по данным sdtp (0 - неизвестно, 1 - ведущий, зависящий от предыдущей группы кадров, 2 - не ведущий, 3 - ведущий независимый)
+	Description uint32 // номер описания сэмпла в блоке stsd (начиная с 1)
+}
+
+// mediaTrack медиадорожка вместе с таблицей сэмплов
+type mediaTrack struct {
+	ID        uint32   // идентификатор дорожки (tkhd)
+	Handler   string   // тип дорожки ('vide', 'soun', ...)
+	TimeScale uint32   // единица времени медиадорожки (mdhd)
+	Samples   []Sample // сэмплы в порядке декодирования
+	trak      *Box     // блок описания дорожки
+}
+
+// readMediaTracks чтение медиадорожек контейнера вместе с таблицами сэмплов,
+// dataSize - объем медиаданных файла (байт), в который должны укладываться сэмплы
+func readMediaTracks(movie *Box, dataSize int64) ([]*mediaTrack, error) {
+	var tracks []*mediaTrack
+	for _, trak := range movie.FindAll("trak") {
+		t, err := readMediaTrack(trak, dataSize)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
+
+// readSampleTables чтение таблиц сэмплов из загруженных метаданных (ftyp, moov);
+// дорожки следуют в том же порядке, что и Movie.Tracks
+func (f *VideoFile) readSampleTables() ([]*mediaTrack, error) {
+	if _, err := f.metaDataBuf.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f.metaDataBuf)
+	if err != nil {
+		return nil, err
+	}
+	boxes, ok := parseBoxes(data, "")
+	if !ok {
+		return nil, ErrFileIsNotValid
+	}
+	index := findBox(boxes, "moov")
+	if index < 0 {
+		return nil, ErrMovieNotFound
+	}
+	if declaredSamples(boxes[index]) > maxAnalyzedSamples {
+		return nil, ErrTooManySamples
+	}
+	var dataSize int64
+	for _, b := range f.Layout {
+		if b.Type == "mdat" {
+			dataSize += b.Size
+		}
+	}
+	return readMediaTracks(boxes[index], dataSize)
+}
+
+// declaredSamples количество сэмплов всех дорожек по заголовкам таблиц stsz/stz2 (без чтения таблиц)
+func declaredSamples(movie *Box) (count uint64) {
+	for _, trak := range movie.FindAll("trak") {
+		stbl := trak.Find("mdia/minf/stbl")
+		if stbl == nil {
+			continue
+		}
+		sizes := stbl.Child("stsz")
+		if sizes == nil {
+			sizes = stbl.Child("stz2")
+		}
+		if sizes != nil && len(sizes.Data) >= 12 {
+			count += uint64(binary.BigEndian.Uint32(sizes.Data[8:]))
+		}
+	}
+	return count
+}
+
+// mediaDataSize объем содержимого блоков mdat верхнего уровня (байт)
+func mediaDataSize(boxes []*Box) (size int64) {
+	for _, b := range boxes {
+		if b.Type == "mdat" {
+			size += b.payloadSize()
+		}
+	}
+	return size
+}
+
+// analyzeSamples дополнение описания дорожек сведениями из таблиц сэмплов
+// (при поврежденных или слишком больших таблицах дорожки остаются без этих сведений)
+func (f *VideoFile) analyzeSamples() {
+	tracks, err := f.readSampleTables()
+	if err != nil || len(tracks) != len(f.Movie.Tracks) {
+		return
+	}
+	for i, t := range tracks {
+		track := &f.Movie.Tracks[i]
+		track.Samples, track.KeyFrames = len(t.Samples), 0
+		for _, s := range t.Samples {
+			if s.Sync {
+				track.KeyFrames++
+			}
+		}
+		if t.Handler == "vide" && len(t.Samples) > 0 {
+			// список ключевых кадров выводится только при отдельном анализе групп кадров
+			track.GOP = analyzeGOP(t)
+			track.GOP.KeyFrames = nil
+			if video, ok := track.Stream.(*VideoStream); ok {
+				video.FrameRate = analyzeFrameRate(t)
+			}
+		}
+	}
+}
+
+// readMediaTrack чтение медиадорожки вместе с таблицей сэмплов
+func readMediaTrack(trak *Box, dataSize int64) (*mediaTrack, error) {
+	t := &mediaTrack{trak: trak, Handler: trackHandler(trak)}
+	tkhd, mdhd := trak.Child("tkhd"), trak.Find("mdia/mdhd")
+	if tkhd == nil || mdhd == nil {
+		return nil, ErrBadSampleTable
+	}
+	var ok bool
+	if t.ID, ok = versionedField(tkhd.Data, 12, 20); !ok {
+		return nil, ErrBadSampleTable
+	}
+	if t.TimeScale, ok = versionedField(mdhd.Data, 12, 20); !ok || t.TimeScale == 0 {
+		return nil, ErrBadSampleTable
+	}
+	stbl := trak.Find("mdia/minf/stbl")
+	if stbl == nil || stbl.Child("stsd") == nil {
+		return nil, ErrBadSampleTable
+	}
+	var err error
+	t.Samples, err = readSampleTable(stbl, dataSize)
+	return t, err
+}
+
+// versionedField чтение 32-битного поля блока с версией, расположенного по смещению v0 (версия 0) или v1 (версия 1)
+func versionedField(data []byte, v0, v1 int) (uint32, bool) {
+	offset := v0
+	if len(data) > 0 && data[0] == 0x1 {
+		offset = v1
+	}
+	if len(data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[offset:]), true
+}
+
+// compositionOffset смещение времени отображения из ctts или trun: в версии 0 беззнаковое, в версии 1 - со знаком
+func compositionOffset(value uint32, version byte) int64 {
+	if version == 0 {
+		return int64(value)
+	}
+	return int64(int32(value))
+}
+
+// tableEntries проверка заголовка таблицы (версия, флаги, количество записей) и получение записей
+func tableEntries(b *Box, offset, entrySize int) (count int, entries []byte, ok bool) {
+	if b == nil || len(b.Data) < offset+4 {
+		return 0, nil, false
+	}
+	count = int(binary.BigEndian.Uint32(b.Data[offset:]))
+	entries = b.Data[offset+4:]
+	if count > len(entries)/entrySize {
+		return 0, nil, false
+	}
+	return count, entries, true
+}
+
+// readSampleTable построение списка сэмплов по таблицам stsz/stz2, stts, ctts, stsc, stco/co64, stss и sdtp
+// Количество сэмплов проверяется до выделения памяти: оно должно совпадать в stts и stsz/stz2,
+// а сэмплы постоянного размера - укладываться в dataSize байт
+func readSampleTable(stbl *Box, dataSize int64) ([]Sample, error) {
+	// время декодирования и продолжительность
+	count, entries, ok := tableEntries(stbl.Child("stts"), 4, 8)
+	if !ok {
+		return nil, ErrBadSampleTable
+	}
+	var total uint64
+	for i := 0; i < count; i++ {
+		total += uint64(binary.BigEndian.Uint32(entries[i*8:]))
+	}
+	samples, err := readSampleSizes(stbl, total, dataSize)
+	if err != nil {
+		return nil, err
+	}
+	var dts uint64
+	n := 0
+	for i := 0; i < count; i++ {
+		runLength := int(binary.BigEndian.Uint32(entries[i*8:]))
+		duration := binary.BigEndian.Uint32(entries[i*8+4:])
+		for j := 0; j < runLength && n < len(samples); j++ {
+			samples[n].DTS = dts
+			samples[n].Duration = duration
+			dts += uint64(duration)
+			n++
+		}
+	}
+	if n != len(samples) {
+		return nil, ErrBadSampleTable
+	}
+	// смещение времени отображения
+	if ctts := stbl.Child("ctts"); ctts != nil {
+		count, entries, ok = tableEntries(ctts, 4, 8)
+		if !ok {
+			return nil, ErrBadSampleTable
+		}
+		n = 0
+		for i := 0; i < count; i++ {
+			runLength := int(binary.BigEndian.Uint32(entries[i*8:]))
+			offset := compositionOffset(binary.BigEndian.Uint32(entries[i*8+4:]), ctts.Data[0])
+			for j := 0; j < runLength && n < len(samples); j++ {
+				samples[n].CTSOffset = offset
+				n++
+			}
+		}
+	}
+	// ключевые сэмплы (при отсутствии таблицы stss ключевыми являются все сэмплы)
+	if stss := stbl.Child("stss"); stss != nil {
+		count, entries, ok = tableEntries(stss, 4, 4)
+		if !ok {
+			return nil, ErrBadSampleTable
+		}
+		for i := 0; i < count; i++ {
+			if n := int(binary.BigEndian.Uint32(entries[i*4:])); n > 0 && n <= len(samples) {
+				samples[n-1].Sync = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].Sync = true
+		}
+	}
+	// зависимости сэмплов
+	if sdtp := stbl.Child("sdtp"); sdtp != nil && len(sdtp.Data) >= 4 {
+		for i, flags := range sdtp.Data[4:] {
+			if i < len(samples) {
+				samples[i].DependsOn = flags >> 4 & 0x3
+				samples[i].Leading = flags >> 6
+			}
+		}
+	}
+	if err = readSampleOffsets(stbl, samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// readSampleSizes чтение размеров сэмплов (stsz или stz2), количество которых должно быть равно expected
+func readSampleSizes(stbl *Box, expected uint64, dataSize int64) ([]Sample, error) {
+	if stsz := stbl.Child("stsz"); stsz != nil {
+		if len(stsz.Data) < 12 {
+			return nil, ErrBadSampleTable
+		}
+		size := binary.BigEndian.Uint32(stsz.Data[4:])
+		count := int(binary.BigEndian.Uint32(stsz.Data[8:]))
+		if uint64(count) != expected {
+			return nil, ErrBadSampleTable
+		}
+		// таблица размеров должна содержать все записи, сэмплы постоянного размера - укладываться в медиаданные
+		if size == 0 && count > (len(stsz.Data)-12)/4 || size != 0 && uint64(count)*uint64(size) > uint64(dataSize) {
+			return nil, ErrBadSampleTable
+		}
+		samples := make([]Sample, count)
+		for i := range samples {
+			samples[i].Size = size
+			if size == 0 {
+				samples[i].Size = binary.BigEndian.Uint32(stsz.Data[12+i*4:])
+			}
+		}
+		return samples, nil
+	}
+	stz2 := stbl.Child("stz2")
+	if stz2 == nil || len(stz2.Data) < 12 {
+		return nil, ErrBadSampleTable
+	}
+	fieldSize := int(stz2.Data[7])
+	count := int(binary.BigEndian.Uint32(stz2.Data[8:]))
+	if fieldSize != 4 && fieldSize != 8 && fieldSize != 16 || count > (len(stz2.Data)-12)*8/fieldSize ||
+		uint64(count) != expected {
+		return nil, ErrBadSampleTable
+	}
+	samples := make([]Sample, count)
+	entries := stz2.Data[12:]
+	for i := range samples {
+		switch fieldSize {
+		case 4:
+			samples[i].Size = uint32(entries[i/2] >> (4 * (1 - i%2)) & 0xF)
+		case 8:
+			samples[i].Size = uint32(entries[i])
+		case 16:
+			samples[i].Size = uint32(binary.BigEndian.Uint16(entries[i*2:]))
+		}
+	}
+	return samples, nil
+}
+
+// readSampleOffsets вычисление позиций сэмплов по смещениям чанков (stco/co64) и распределению сэмплов по чанкам (stsc)
+func readSampleOffsets(stbl *Box, samples []Sample) error {
+	chunkTable := stbl.Child("stco")
+	if chunkTable == nil {
+		chunkTable = stbl.Child("co64")
+	}
+	if chunkTable == nil {
+		return ErrBadSampleTable
+	}
+	chunks, err := parseChunkOffsets(chunkTable)
+	if err != nil {
+		return err
+	}
+	count, entries, ok := tableEntries(stbl.Child("stsc"), 4, 12)
+	if !ok {
+		return ErrBadSampleTable
+	}
+	n := 0
+	for i := 0; i < count; i++ {
+		firstChunk := int(binary.BigEndian.Uint32(entries[i*12:]))
+		perChunk := int(binary.BigEndian.Uint32(entries[i*12+4:]))
+		description := binary.BigEndian.Uint32(entries[i*12+8:])
+		lastChunk := len(chunks)
+		if i+1 < count {
+			lastChunk = int(binary.BigEndian.Uint32(entries[(i+1)*12:])) - 1
+		}
+		if firstChunk < 1 || lastChunk > len(chunks) {
+			return ErrBadSampleTable
+		}
+		for chunk := firstChunk; chunk <= lastChunk; chunk++ {
+			offset := int64(chunks[chunk-1])
+			for j := 0; j < perChunk && n < len(samples); j++ {
+				samples[n].Offset = offset
+				samples[n].Description = description
+				offset += int64(samples[n].Size)
+				n++
+			}
+		}
+	}
+	if n != len(samples) {
+		return ErrBadSampleTable
+	}
+	return nil
+}
+
+// duration продолжительность медиадорожки (в единицах времени медиадорожки)
+func (t *mediaTrack) duration() uint64 {
+	if len(t.Samples) == 0 {
+		return 0
+	}
+	last := t.Samples[len(t.Samples)-1]
+	return last.DTS + uint64(last.Duration)
+}
+
+// rescaleTime перевод времени из одной единицы времени в другую
+func rescaleTime(value uint64, from, to uint32) uint64 {
+	if from == to {
+		return value
+	}
+	return value/uint64(from)*uint64(to) + value%uint64(from)*uint64(to)/uint64(from)
+}
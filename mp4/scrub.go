@@ -0,0 +1,298 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Очистка видеофайла от персональных данных (координаты, сведения об устройстве и владельце, XMP)
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Категории удаляемых сведений
+const (
+	ScrubLocation = "location" // координаты и место съемки
+	ScrubDevice   = "device"   // производитель, модель и серийные номера устройства
+	ScrubOwner    = "owner"    // имена автора и владельца
+	ScrubXMP      = "xmp"      // метаданные XMP
+)
+
+// xmpUUID идентификатор блока uuid с метаданными XMP
+var xmpUUID = []byte{0xBE, 0x7A, 0xCF, 0xCB, 0x97, 0xA9, 0x42, 0xE8, 0x9C, 0x71, 0x99, 0x94, 0x91, 0xE3, 0xAF, 0xAC}
+
+// scrubAtoms блоки пользовательских данных (udta) и теги iTunes (ilst), содержащие персональные данные
+var scrubAtoms = map[string]string{
+	"\xa9xyz": ScrubLocation, // координаты ISO 6709
+	"loci":    ScrubLocation, // место съемки 3GPP
+	"\xa9mak": ScrubDevice,   // производитель устройства
+	"\xa9mod": ScrubDevice,   // модель устройства
+	"CAME":    ScrubDevice,   // серийный номер камеры GoPro
+	"FIRM":    ScrubDevice,   // версия прошивки камеры GoPro
+	"\xa9aut": ScrubOwner,    // автор
+	"auth":    ScrubOwner,    // автор 3GPP
+	"\xa9ART": ScrubOwner,    // исполнитель
+	"XMP_":    ScrubXMP,      // метаданные XMP в блоке udta
+}
+
+// scrubKeys ключи метаданных QuickTime (блок meta с типом mdta), содержащие персональные данные
+var scrubKeys = map[string]string{
+	"com.apple.quicktime.make":              ScrubDevice,
+	"com.apple.quicktime.model":             ScrubDevice,
+	"com.apple.quicktime.camera.identifier": ScrubDevice,
+	"com.apple.quicktime.camera.lens_model": ScrubDevice,
+	"com.android.manufacturer":              ScrubDevice,
+	"com.android.model":                     ScrubDevice,
+	"com.apple.quicktime.author":            ScrubOwner,
+	"com.apple.quicktime.artist":            ScrubOwner,
+}
+
+// locationKeyPrefix общий префикс ключей QuickTime со сведениями о месте съемки
+const locationKeyPrefix = "com.apple.quicktime.location."
+
+// ScrubPolicy категории удаляемых сведений
+type ScrubPolicy struct {
+	Location bool // координаты и место съемки
+	Device   bool // производитель, модель и серийные номера устройства
+	Owner    bool // имена автора и владельца
+	XMP      bool // метаданные XMP
+}
+
+// DefaultScrubPolicy удаление сведений всех категорий
+var DefaultScrubPolicy = ScrubPolicy{Location: true, Device: true, Owner: true, XMP: true}
+
+// Keep сохранение сведений указанной категории
+func (p *ScrubPolicy) Keep(category string) error {
+	switch category {
+	case ScrubLocation:
+		p.Location = false
+	case ScrubDevice:
+		p.Device = false
+	case ScrubOwner:
+		p.Owner = false
+	case ScrubXMP:
+		p.XMP = false
+	default:
+		return NewAPIError("неизвестная категория сведений: "+category, nil)
+	}
+	return nil
+}
+
+// enabled удаляются ли сведения указанной категории
+func (p ScrubPolicy) enabled(category string) bool {
+	switch category {
+	case ScrubLocation:
+		return p.Location
+	case ScrubDevice:
+		return p.Device
+	case ScrubOwner:
+		return p.Owner
+	case ScrubXMP:
+		return p.XMP
+	}
+	return false
+}
+
+// ScrubbedItem сведения об удаленном блоке метаданных
+type ScrubbedItem struct {
+	Category string // категория сведений
+	Path     string // путь к блоку в дереве блоков файла
+	Key      string `json:",omitempty"` // ключ метаданных QuickTime
+	Size     int64  // размер удаленного блока (байт)
+}
+
+// ScrubReport отчет об очистке файла
+type ScrubReport struct {
+	Removed []ScrubbedItem // удаленные блоки
+}
+
+// Summary краткий отчет: количество удаленных блоков по категориям, например "location=1,device=2"
+func (r ScrubReport) Summary() string {
+	var parts []string
+	for _, category := range []string{ScrubLocation, ScrubDevice, ScrubOwner, ScrubXMP} {
+		count := 0
+		for _, item := range r.Removed {
+			if item.Category == category {
+				count++
+			}
+		}
+		if count > 0 {
+			parts = append(parts, category+"="+strconv.Itoa(count))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Scrub очистка файла r от персональных данных с записью результата в w
+// Медиаданные не изменяются, место удаленных из moov блоков по возможности занимает блок free,
+// чтобы не сдвигать медиаданные
+func Scrub(r io.ReadSeeker, w io.Writer, policy ScrubPolicy) (report ScrubReport, err error) {
+	boxes, err := ReadBoxes(r)
+	if err != nil {
+		return report, err
+	}
+	layout, report, err := scrubBoxes(boxes, policy)
+	if err != nil {
+		return report, err
+	}
+	return report, writeRelocated(w, layout)
+}
+
+// scrubBoxes удаление персональных данных из дерева блоков, возвращает новый порядок блоков верхнего уровня
+func scrubBoxes(boxes []*Box, policy ScrubPolicy) (layout []*Box, report ScrubReport, err error) {
+	s := scrubber{policy: policy, removed: []ScrubbedItem{}}
+	movieSize := int64(-1)
+	if i := findBox(boxes, "moov"); i >= 0 {
+		movieSize = boxes[i].Size()
+	}
+	for _, b := range boxes {
+		removed, err := s.remove(b, b.Type)
+		if err != nil {
+			return nil, report, err
+		}
+		if removed {
+			continue
+		}
+		if b.Type == "udta" && !b.IsContainer() {
+			parseUserData(b)
+		}
+		if b.IsContainer() {
+			if err = s.scrub(b, b.Type); err != nil {
+				return nil, report, err
+			}
+		}
+		layout = append(layout, b)
+	}
+	if i := findBox(layout, "moov"); i >= 0 {
+		layout, _ = usePadding(layout, i, movieSize)
+	}
+	report.Removed = s.removed
+	return layout, report, nil
+}
+
+// scrubber обход дерева блоков с удалением персональных данных
+type scrubber struct {
+	policy  ScrubPolicy
+	removed []ScrubbedItem
+}
+
+// remove проверка, подлежит ли блок удалению целиком (блоки XMP); удаленный блок заносится в отчет
+func (s *scrubber) remove(b *Box, path string) (bool, error) {
+	if b.Type != "uuid" || !s.policy.XMP {
+		return false, nil
+	}
+	id, err := b.peek(len(xmpUUID))
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(id, xmpUUID) {
+		return false, nil
+	}
+	s.removed = append(s.removed, ScrubbedItem{Category: ScrubXMP, Path: path, Size: b.Size()})
+	return true, nil
+}
+
+// scrubbedContainers контейнеры, в которых ищутся персональные данные
+var scrubbedContainers = map[string]bool{"moov": true, "trak": true, "udta": true, "meta": true, "ilst": true}
+
+// scrub удаление персональных данных из дочерних блоков контейнера
+func (s *scrubber) scrub(b *Box, path string) error {
+	if b.Type == "meta" && metaHandler(b) == "mdta" {
+		return s.scrubKeyedList(b, path)
+	}
+	kept := b.Children[:0]
+	for _, c := range b.Children {
+		childPath := path + "/" + boxName(c.Type)
+		if category, ok := scrubAtoms[c.Type]; ok && (b.Type == "udta" || b.Type == "ilst") && s.policy.enabled(category) {
+			s.removed = append(s.removed, ScrubbedItem{Category: category, Path: childPath, Size: c.Size()})
+			continue
+		}
+		removed, err := s.remove(c, childPath)
+		if err != nil {
+			return err
+		}
+		if removed {
+			continue
+		}
+		if c.Type == "udta" && !c.IsContainer() {
+			parseUserData(c)
+		}
+		if c.IsContainer() && scrubbedContainers[c.Type] {
+			if err = s.scrub(c, childPath); err != nil {
+				return err
+			}
+		}
+		kept = append(kept, c)
+	}
+	b.Children = kept
+	return nil
+}
+
+// scrubKeyedList удаление значений метаданных QuickTime (meta/keys + meta/ilst) по их ключам
+func (s *scrubber) scrubKeyedList(meta *Box, path string) error {
+	keys, ilst := meta.Child("keys"), meta.Child("ilst")
+	if keys == nil || ilst == nil {
+		return nil
+	}
+	names := parseMetadataKeys(keys.Data)
+	kept := ilst.Children[:0]
+	for _, item := range ilst.Children {
+		var name string
+		// наименование элемента - номер ключа в блоке keys, начиная с 1
+		index := int(binary.BigEndian.Uint32([]byte(item.Type)))
+		if index > 0 && index <= len(names) {
+			name = names[index-1]
+		}
+		category, ok := scrubKeys[name]
+		if strings.HasPrefix(name, locationKeyPrefix) {
+			category, ok = ScrubLocation, true
+		}
+		if ok && s.policy.enabled(category) {
+			s.removed = append(s.removed, ScrubbedItem{
+				Category: category,
+				Path:     path + "/ilst/" + strconv.Itoa(index),
+				Key:      name,
+				Size:     item.Size(),
+			})
+			continue
+		}
+		kept = append(kept, item)
+	}
+	ilst.Children = kept
+	return nil
+}
+
+// parseMetadataKeys разбор списка ключей метаданных QuickTime (блок keys)
+func parseMetadataKeys(data []byte) []string {
+	if len(data) < 8 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	var names []string
+	for offset := 8; len(names) < count && offset+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			break
+		}
+		// запись ключа: размер, пространство имен (обычно mdta) и само наименование
+		names = append(names, string(data[offset+8:offset+size]))
+		offset += size
+	}
+	return names
+}
+
+// parseUserData разбор блока udta QuickTime, завершающегося 32-битным нулем
+func parseUserData(b *Box) {
+	data := b.Data
+	if len(data) < 4 || !bytes.Equal(data[len(data)-4:], []byte{0, 0, 0, 0}) {
+		return
+	}
+	if children, ok := parseBoxes(data[:len(data)-4], b.Type); ok {
+		b.container = true
+		b.Children = children
+		b.Data = nil
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка очистки видеофайла от персональных данных
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Значения персональных данных тестового файла
+const (
+	testLocation = "+55.7558+037.6173/"
+	testMake     = "TestMaker"
+	testModel    = "TestPhone 12"
+	testAuthor   = "Ivan Petrov"
+	testXMP      = "<x:xmpmeta>creator</x:xmpmeta>"
+	testTitle    = "Title stays"
+)
+
+// scrubTestMovie тестовый файл с координатами, сведениями об устройстве и авторе в udta и в метаданных
+// QuickTime (keys/ilst), блоком XMP верхнего уровня и названием, которое не относится к персональным данным
+func scrubTestMovie(t *testing.T) []byte {
+	t.Helper()
+	boxes, err := ReadBoxes(bytes.NewReader(testMovie(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie := boxes[findBox(boxes, "moov")]
+	text := func(s string) []byte {
+		return append([]byte{0, byte(len(s)), 0x15, 0xC7}, s...)
+	}
+	udta := NewContainer("udta", nil,
+		NewBox("\xa9xyz", text(testLocation)),
+		NewBox("\xa9mak", text(testMake)),
+		NewBox("\xa9aut", text(testAuthor)),
+		NewBox("\xa9nam", text(testTitle)))
+	// ключи метаданных QuickTime, элемент списка ilst называется номером ключа
+	keys := []string{"com.apple.quicktime.location.ISO6709", "com.apple.quicktime.model", "com.apple.quicktime.title"}
+	values := []string{testLocation, testModel, testTitle}
+	keysData := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(keys)))
+	ilst := NewContainer("ilst", nil)
+	for i, key := range keys {
+		keysData = binary.BigEndian.AppendUint32(keysData, uint32(8+len(key)))
+		keysData = append(append(keysData, "mdta"...), key...)
+		value := append(make([]byte, 8), values[i]...)
+		value[3] = 1 // строка UTF-8
+		name := string(binary.BigEndian.AppendUint32(nil, uint32(i+1)))
+		ilst.Children = append(ilst.Children, NewContainer(name, nil, NewBox("data", value)))
+	}
+	hdlr := append(make([]byte, 8), "mdta"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	meta := NewContainer("meta", nil, NewBox("hdlr", hdlr), NewBox("keys", keysData), ilst)
+	movie.Children = append(movie.Children, udta, meta)
+	xmp := NewBox("uuid", append(append([]byte{}, xmpUUID...), testXMP...))
+	var buf bytes.Buffer
+	if err = WriteBoxes(&buf, []*Box{boxes[0], boxes[1], xmp, movie}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScrub(t *testing.T) {
+	data := scrubTestMovie(t)
+	var out bytes.Buffer
+	report, err := Scrub(bytes.NewReader(data), &out, DefaultScrubPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{testLocation, testMake, testModel, testAuthor, testXMP} {
+		if bytes.Contains(out.Bytes(), []byte(value)) {
+			t.Errorf("значение %q не удалено", value)
+		}
+	}
+	if bytes.Count(out.Bytes(), []byte(testTitle)) != 2 {
+		t.Error("удалено название, не относящееся к персональным данным")
+	}
+	categories := make(map[string]int)
+	for _, item := range report.Removed {
+		categories[item.Category]++
+	}
+	want := map[string]int{ScrubLocation: 2, ScrubDevice: 2, ScrubOwner: 1, ScrubXMP: 1}
+	for category, count := range want {
+		if categories[category] != count {
+			t.Errorf("категория %s: удалено %d блоков вместо %d (%+v)", category, categories[category], count, report.Removed)
+		}
+	}
+	// краткий отчет для заголовка X-Scrub-Report
+	if summary := report.Summary(); summary != "location=2,device=2,owner=1,xmp=1" {
+		t.Errorf("краткий отчет %q", summary)
+	}
+	if summary := (ScrubReport{}).Summary(); summary != "" {
+		t.Errorf("краткий отчет без удаленных блоков %q", summary)
+	}
+	compareChunks(t, data, out.Bytes())
+}
+
+func TestScrubKeep(t *testing.T) {
+	data := scrubTestMovie(t)
+	policy := DefaultScrubPolicy
+	for _, category := range []string{ScrubLocation, ScrubXMP} {
+		if err := policy.Keep(category); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := policy.Keep("face"); err == nil {
+		t.Fatal("принята неизвестная категория")
+	}
+	var out bytes.Buffer
+	report, err := Scrub(bytes.NewReader(data), &out, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(out.Bytes(), []byte(testLocation)) != 2 || !bytes.Contains(out.Bytes(), []byte(testXMP)) {
+		t.Error("удалены сохраняемые сведения")
+	}
+	for _, value := range []string{testMake, testModel, testAuthor} {
+		if bytes.Contains(out.Bytes(), []byte(value)) {
+			t.Errorf("значение %q не удалено", value)
+		}
+	}
+	for _, item := range report.Removed {
+		if item.Category == ScrubLocation || item.Category == ScrubXMP {
+			t.Errorf("в отчете сохраняемый блок %+v", item)
+		}
+	}
+	if summary := report.Summary(); summary != "device=2,owner=1" {
+		t.Errorf("краткий отчет %q", summary)
+	}
+	compareChunks(t, data, out.Bytes())
+}
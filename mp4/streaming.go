@@ -0,0 +1,154 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Пригодность файла к прогрессивному воспроизведению: расположение moov и чередование данных дорожек
+package mp4
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// streamingMaxDrift наибольшее допустимое расхождение времени дорожек в порядке расположения данных
+const streamingMaxDrift = 2 * time.Second
+
+// BoxPosition расположение блока верхнего уровня в файле
+type BoxPosition struct {
+	Type   string // тип блока
+	Offset int64  // позиция блока (байт)
+	Size   int64  // размер блока вместе с заголовком (байт)
+}
+
+// StreamingInfo пригодность файла к прогрессивному воспроизведению
+type StreamingInfo struct {
+	Layout           []BoxPosition // блоки верхнего уровня в порядке расположения
+	MovieOffset      int64         // позиция блока moov (байт)
+	MovieFirst       bool          // блок moov расположен до медиаданных
+	Fragmented       bool          // файл фрагментирован (fMP4)
+	StartupBytes     int64         // объем данных от начала файла, необходимый для начала воспроизведения (байт)
+	InterleavePeriod float64       // средняя продолжительность непрерывного участка данных одной дорожки (сек)
+	MaxInterleave    float64       // наибольшая продолжительность непрерывного участка данных одной дорожки (сек)
+	MaxDrift         float64       // наибольшее расхождение времени аудио- и видеодорожек в порядке расположения данных (сек)
+	MaxDriftOffset   int64         // позиция в файле, на которой расхождение наибольшее (байт)
+	// для начала воспроизведения без загрузки всего файла нужны запросы диапазонов (moov после медиаданных)
+	NeedsRangeRequests bool
+	// для воспроизведения нужна буферизация более streamingMaxDrift из-за плохого чередования дорожек
+	LargeBuffering bool
+}
+
+// streamingSample сэмпл аудио- или видеодорожки в порядке расположения в файле
+type streamingSample struct {
+	offset int64
+	size   uint32
+	start  float64 // время декодирования (сек)
+	end    float64 // время окончания (сек)
+	track  int
+}
+
+// AnalyzeStreaming анализ расположения moov и чередования данных дорожек по смещениям сэмплов
+// (таблицы stco/co64 и фрагменты)
+func AnalyzeStreaming(r io.ReadSeeker) (*StreamingInfo, error) {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return nil, err
+	}
+	info := &StreamingInfo{MovieFirst: true}
+	for _, b := range m.boxes {
+		info.Layout = append(info.Layout, BoxPosition{Type: b.Type, Offset: b.offset, Size: b.size})
+		switch b.Type {
+		case "moov":
+			info.MovieOffset = b.offset
+			info.StartupBytes = b.offset + b.size
+		case "mdat":
+			if info.StartupBytes == 0 {
+				info.MovieFirst = false
+			}
+		case "moof":
+			info.Fragmented = true
+		}
+	}
+	var samples []streamingSample
+	var tracks int
+	for _, t := range m.tracks {
+		if t.Handler != "vide" && t.Handler != "soun" || len(t.Samples) == 0 {
+			continue
+		}
+		scale := float64(t.TimeScale)
+		for _, s := range t.Samples {
+			samples = append(samples, streamingSample{
+				offset: s.Offset,
+				size:   s.Size,
+				start:  float64(s.DTS) / scale,
+				end:    float64(s.DTS+uint64(s.Duration)) / scale,
+				track:  tracks,
+			})
+		}
+		// воспроизведение начинается после загрузки первого сэмпла каждой дорожки
+		if end := t.Samples[0].Offset + int64(t.Samples[0].Size); end > info.StartupBytes {
+			info.StartupBytes = end
+		}
+		tracks++
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].offset < samples[j].offset })
+	if !info.MovieFirst {
+		info.StartupBytes = info.MovieOffset + m.movie.size
+		info.NeedsRangeRequests = true
+	}
+	info.analyzeInterleave(samples, tracks)
+	info.LargeBuffering = info.MaxDrift > streamingMaxDrift.Seconds()
+	return info, nil
+}
+
+// analyzeInterleave расчет продолжительности участков данных одной дорожки и расхождения времени дорожек
+// при последовательном чтении файла
+func (info *StreamingInfo) analyzeInterleave(samples []streamingSample, tracks int) {
+	// время, до которого загружены данные дорожки, и количество оставшихся сэмплов
+	loaded := make([]float64, tracks)
+	started := make([]bool, tracks)
+	remaining := make([]int, tracks)
+	for _, s := range samples {
+		remaining[s.track]++
+		if !started[s.track] || s.start < loaded[s.track] {
+			loaded[s.track], started[s.track] = s.start, true
+		}
+	}
+	var runs int
+	var runsTotal float64
+	runStart := 0
+	for i, s := range samples {
+		loaded[s.track] = s.end
+		remaining[s.track]--
+		// закончившиеся дорожки не задерживают воспроизведение
+		low, high, active := 0.0, 0.0, 0
+		for k := range loaded {
+			if remaining[k] == 0 && k != s.track {
+				continue
+			}
+			if active == 0 || loaded[k] < low {
+				low = loaded[k]
+			}
+			if active == 0 || loaded[k] > high {
+				high = loaded[k]
+			}
+			active++
+		}
+		if high-low > info.MaxDrift {
+			info.MaxDrift, info.MaxDriftOffset = high-low, s.offset
+		}
+		if i+1 == len(samples) || samples[i+1].track != s.track {
+			period := s.end - samples[runStart].start
+			runs++
+			runsTotal += period
+			if period > info.MaxInterleave {
+				info.MaxInterleave = period
+			}
+			runStart = i + 1
+		}
+	}
+	info.InterleavePeriod = runsTotal / float64(runs)
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка анализа пригодности файла к прогрессивному воспроизведению
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+// interleaveSample сэмпл дорожки track со временем от start до end (сек)
+type interleaveSample struct {
+	track      int
+	start, end float64
+}
+
+func TestAnalyzeInterleave(t *testing.T) {
+	tests := []struct {
+		name      string
+		samples   []interleaveSample
+		period    float64
+		max       float64
+		drift     float64
+		driftAt   int64
+		buffering bool
+	}{
+		{
+			name:    "поочередно",
+			samples: []interleaveSample{{0, 0, 1}, {1, 0, 1}, {0, 1, 2}, {1, 1, 2}},
+			period:  1, max: 1, drift: 1,
+		},
+		{
+			// данные второй дорожки следуют после всех данных первой
+			name: "дорожки подряд",
+			samples: []interleaveSample{{0, 0, 5}, {0, 5, 10}, {0, 10, 15},
+				{1, 0, 5}, {1, 5, 10}, {1, 10, 15}},
+			period: 15, max: 15, drift: 15, driftAt: 200, buffering: true,
+		},
+		{
+			// закончившаяся дорожка не учитывается в расхождении
+			name:    "дорожка начинается позже",
+			samples: []interleaveSample{{0, 0, 1}, {0, 1, 2}, {1, 5, 6}},
+			period:  1.5, max: 2, drift: 4, buffering: true,
+		},
+		{
+			name:    "одна дорожка",
+			samples: []interleaveSample{{0, 0, 1}, {0, 1, 2}},
+			period:  2, max: 2,
+		},
+	}
+	for _, test := range tests {
+		var samples []streamingSample
+		tracks := 0
+		for i, s := range test.samples {
+			samples = append(samples, streamingSample{offset: int64(i) * 100, size: 100, start: s.start, end: s.end, track: s.track})
+			if s.track >= tracks {
+				tracks = s.track + 1
+			}
+		}
+		var info StreamingInfo
+		info.analyzeInterleave(samples, tracks)
+		if info.InterleavePeriod != test.period || info.MaxInterleave != test.max ||
+			info.MaxDrift != test.drift || info.MaxDriftOffset != test.driftAt ||
+			(info.MaxDrift > streamingMaxDrift.Seconds()) != test.buffering {
+			t.Fatalf("%s: %+v", test.name, info)
+		}
+	}
+}
+
+func TestAnalyzeStreaming(t *testing.T) {
+	data := testMovie(t)
+	info, err := AnalyzeStreaming(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// moov в конце файла
+	if info.MovieFirst || !info.NeedsRangeRequests || info.Fragmented || info.StartupBytes != int64(len(data)) ||
+		len(info.Layout) != 3 || info.Layout[2].Type != "moov" || info.MovieOffset != info.Layout[2].Offset {
+		t.Fatalf("%+v", info)
+	}
+	var moved bytes.Buffer
+	if err := Faststart(bytes.NewReader(data), &moved); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = AnalyzeStreaming(bytes.NewReader(moved.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !info.MovieFirst || info.NeedsRangeRequests || info.Layout[1].Type != "moov" || info.StartupBytes >= int64(moved.Len()) {
+		t.Fatalf("%+v", info)
+	}
+}
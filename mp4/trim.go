@@ -0,0 +1,185 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Вырезание фрагмента файла по времени без перекодирования: по ключевым кадрам и списку редактирования
+package mp4
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trim копирование в w фрагмента файла r с момента start до момента end (end = 0 - до конца файла)
+// Сэмплы копируются начиная с ближайшего предшествующего ключевого кадра видеодорожки, а список
+// редактирования (edts/elst) каждой дорожки начинает воспроизведение точно с момента start
+func Trim(r io.ReadSeeker, w io.Writer, start, end time.Duration) error {
+	m, err := readMovieFile(r)
+	if err != nil {
+		return err
+	}
+	mvhd := m.movie.Child("mvhd")
+	if mvhd == nil {
+		return ErrFileIsNotValid
+	}
+	timeScale, ok := versionedField(mvhd.Data, 12, 20)
+	if !ok || timeScale == 0 {
+		return ErrFileIsNotValid
+	}
+	// конец фрагмента не дальше конца самой продолжительной дорожки
+	var length time.Duration
+	for _, t := range m.tracks {
+		if d := time.Duration(rescaleTime(uint64(t.presentationEnd()), t.TimeScale, uint32(time.Second))); d > length {
+			length = d
+		}
+	}
+	if end == 0 || end > length {
+		end = length
+	}
+	if start < 0 || start >= end {
+		return ErrTrimRange
+	}
+	for _, t := range m.tracks {
+		if err = t.trim(start, end, timeScale); err != nil {
+			return err
+		}
+	}
+	return writeProgressive(w, m.src, m.fileType(), m.movie, m.tracks)
+}
+
+// trim оставление сэмплов дорожки, необходимых для воспроизведения с момента start до end,
+// и запись списка редактирования из одной правки
+func (t *mediaTrack) trim(start, end time.Duration, movieTimeScale uint32) error {
+	shift := editMediaTime(t.trak)
+	from := durationToTime(start, t.TimeScale) + shift
+	to := durationToTime(end, t.TimeScale) + shift
+	first, last := -1, -1
+	for i, s := range t.Samples {
+		pts := int64(s.DTS) + int64(s.CTSOffset)
+		// декодирование начинается с последнего ключевого кадра, отображаемого не позже начала фрагмента
+		if s.Sync && (pts <= from || first < 0) {
+			first = i
+		}
+		if pts < to {
+			last = i
+		}
+	}
+	if first < 0 || last < first {
+		t.Samples = nil
+		t.trak.Remove("edts")
+		return nil
+	}
+	samples := append([]Sample{}, t.Samples[first:last+1]...)
+	base := samples[0].DTS
+	for i := range samples {
+		samples[i].DTS -= base
+	}
+	t.Samples = samples
+	mediaTime := from - int64(base)
+	if mediaTime < 0 {
+		mediaTime = 0
+	}
+	// правка не выходит за время отображения оставленных сэмплов дорожки
+	presentationEnd := t.presentationEnd()
+	duration := uint64(durationToTime(end-start, movieTimeScale))
+	var available uint64
+	if presentationEnd > mediaTime {
+		available = rescaleTime(uint64(presentationEnd-mediaTime), t.TimeScale, movieTimeScale)
+	}
+	if available < duration {
+		duration = available
+	}
+	setEditList(t.trak, duration, mediaTime)
+	return nil
+}
+
+// presentationEnd время окончания отображения последнего сэмпла дорожки (в единицах времени медиадорожки)
+func (t *mediaTrack) presentationEnd() (end int64) {
+	for _, s := range t.Samples {
+		if e := int64(s.DTS) + int64(s.CTSOffset) + int64(s.Duration); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// editMediaTime начало воспроизведения медиадорожки по списку редактирования - время первой непустой правки
+func editMediaTime(trak *Box) int64 {
+	elst := trak.Find("edts/elst")
+	entrySize := 12
+	if elst != nil && len(elst.Data) > 0 && elst.Data[0] == 0x1 {
+		entrySize = 20
+	}
+	count, entries, ok := tableEntries(elst, 4, entrySize)
+	if !ok {
+		return 0
+	}
+	for i := 0; i < count; i++ {
+		var mediaTime int64
+		if entrySize == 20 {
+			mediaTime = int64(binary.BigEndian.Uint64(entries[i*20+8:]))
+		} else {
+			mediaTime = int64(int32(binary.BigEndian.Uint32(entries[i*12+4:])))
+		}
+		// -1 - пустая правка (пауза перед началом воспроизведения)
+		if mediaTime >= 0 {
+			return mediaTime
+		}
+	}
+	return 0
+}
+
+// setEditList замена списка редактирования дорожки одной правкой: воспроизведение медиаданных
+// с момента mediaTime (в единицах времени дорожки) продолжительностью duration (в единицах времени файла)
+func setEditList(trak *Box, duration uint64, mediaTime int64) {
+	var data []byte
+	if duration > math.MaxUint32 || mediaTime > math.MaxInt32 {
+		data = binary.BigEndian.AppendUint32([]byte{1, 0, 0, 0}, 1)
+		data = binary.BigEndian.AppendUint64(data, duration)
+		data = binary.BigEndian.AppendUint64(data, uint64(mediaTime))
+	} else {
+		data = binary.BigEndian.AppendUint32(make([]byte, 4), 1)
+		data = binary.BigEndian.AppendUint32(data, uint32(duration))
+		data = binary.BigEndian.AppendUint32(data, uint32(mediaTime))
+	}
+	data = binary.BigEndian.AppendUint32(data, 0x00010000) // скорость воспроизведения 1.0
+	edts := NewContainer("edts", nil, NewBox("elst", data))
+	trak.Remove("edts")
+	// блок edts следует за заголовком дорожки
+	index := 0
+	if i := findBox(trak.Children, "tkhd"); i >= 0 {
+		index = i + 1
+	}
+	trak.Children = append(trak.Children[:index], append([]*Box{edts}, trak.Children[index:]...)...)
+}
+
+// durationToTime перевод продолжительности в единицы времени timeScale
+func durationToTime(d time.Duration, timeScale uint32) int64 {
+	return int64(rescaleTime(uint64(d), uint32(time.Second), timeScale))
+}
+
+// ParseTimecode разбор момента времени: секунды (90.5), [чч:]мм:сс[.ддд] или продолжительность Go (1m30s)
+func ParseTimecode(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, NewAPIError("неверный формат времени: "+s, nil)
+	}
+	var seconds float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		// минуты и секунды после часов (минут) не превышают 59
+		if err != nil || value < 0 || i > 0 && value >= 60 {
+			return 0, NewAPIError("неверный формат времени: "+s, nil)
+		}
+		seconds = seconds*60 + value
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка вырезания фрагмента файла по времени
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestTrimRoundTrip(t *testing.T) {
+	data := testMovie(t)
+	want := readTestMovie(t, data)
+	start, end := time.Second, 2*time.Second
+	var out bytes.Buffer
+	if err := Trim(bytes.NewReader(data), &out, start, end); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestMovie(t, out.Bytes())
+	if len(got.tracks) != len(want.tracks) {
+		t.Fatalf("%d дорожек вместо %d", len(got.tracks), len(want.tracks))
+	}
+	for i, track := range got.tracks {
+		if len(track.Samples) == 0 {
+			t.Fatalf("дорожка %d: нет сэмплов", i+1)
+		}
+		// оставленные сэмплы - непрерывный участок исходной дорожки, номер первого записан в его содержимом
+		first := int(binary.BigEndian.Uint16(got.sampleData(t, track.Samples[0])[2:]))
+		source := want.tracks[i].Samples
+		if first+len(track.Samples) > len(source) {
+			t.Fatalf("дорожка %d: сэмплы %d-%d за пределами исходной дорожки", i+1, first, first+len(track.Samples))
+		}
+		compareSamples(t, i+1, want, source[first:first+len(track.Samples)], got, track.Samples)
+		if !track.Samples[0].Sync {
+			t.Fatalf("дорожка %d: фрагмент начинается не с ключевого сэмпла", i+1)
+		}
+		// воспроизведение начинается точно с момента start и продолжается end-start
+		from := durationToTime(start, track.TimeScale)
+		if mediaTime := editMediaTime(track.trak); mediaTime != from-int64(source[first].DTS) {
+			t.Fatalf("дорожка %d: начало воспроизведения %d вместо %d", i+1, mediaTime, from-int64(source[first].DTS))
+		}
+		if pts := int64(source[first].DTS) + source[first].CTSOffset; pts > from {
+			t.Fatalf("дорожка %d: первый сэмпл отображается позже начала фрагмента", i+1)
+		}
+		if duration, ok := editListDuration(track.trak.Find("edts/elst")); !ok || duration != 1000 {
+			t.Fatalf("дорожка %d: продолжительность правки %d вместо 1000", i+1, duration)
+		}
+	}
+}
+
+func TestTrimRange(t *testing.T) {
+	data := testMovie(t)
+	for _, r := range [][2]time.Duration{{2 * time.Second, time.Second}, {10 * time.Second, 0}, {-time.Second, 0}} {
+		var out bytes.Buffer
+		if err := Trim(bytes.NewReader(data), &out, r[0], r[1]); err != ErrTrimRange {
+			t.Fatalf("фрагмент %v-%v: ошибка %v вместо %v", r[0], r[1], err, ErrTrimRange)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Разбор транспортного потока MPEG-TS: программы (PAT/PMT), элементарные потоки, PCR/PTS/DTS
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Параметры транспортного потока
+const (
+	tsPacketSize    = 188       // размер пакета (байт)
+	tsSyncByte      = 0x47      // байт синхронизации в начале пакета
+	tsPATPID        = 0x0       // идентификатор потока таблицы программ
+	tsNullPID       = 0x1FFF    // идентификатор пустых пакетов
+	tsPCRFrequency  = 27000000  // частота системных часов (Гц)
+	tsPTSFrequency  = 90000     // частота меток времени PES (Гц)
+	tsPTSWrap       = 1 << 33   // переполнение 33-битной метки времени
+	tsProbeSize     = 512 << 10 // наибольший объем начала потока для разбора параметров (байт)
+	tsSyncProbeSize = 3         // количество пакетов подряд для определения размера пакета
+	tsMaxSection    = 1024      // наибольший размер секции PSI (байт)
+	tsUnknownPTS    = int64(-1) // метка времени отсутствует
+	tsMaxResync     = 64 << 10  // наибольший объем данных, пропускаемый при потере синхронизации (байт)
+)
+
+// tsStreamTypes описание типов элементарных потоков (stream_type) таблицы PMT
+var tsStreamTypes = map[byte]string{
+	0x01: "MPEG-1 Video", 0x02: "MPEG-2 Video", 0x03: "MPEG-1 Audio", 0x04: "MPEG-2 Audio",
+	0x06: "PES private data", 0x0F: "AAC ADTS", 0x11: "AAC LATM", 0x15: "Metadata",
+	0x1B: "H.264", 0x24: "HEVC", 0x81: "AC-3", 0x86: "SCTE-35", 0x87: "E-AC-3",
+}
+
+// Program программа транспортного потока
+type Program struct {
+	Number uint16   // номер программы
+	PMTPID uint16   // идентификатор потока таблицы PMT
+	PCRPID uint16   // идентификатор потока с отсчетами системных часов
+	Tracks []uint32 // идентификаторы (PID) элементарных потоков программы
+}
+
+// tsStream состояние разбора элементарного потока
+type tsStream struct {
+	pid        uint16
+	streamType byte
+	kind       string // тип потока (Audio, Video, Subtitle)
+	format     string // формат по дескрипторам PMT
+	language   string
+	firstPTS   int64
+	lastPTS    int64
+	packets    int64
+	continuity int // счетчик непрерывности последнего пакета (-1 - пакетов не было)
+	errors     int // количество нарушений непрерывности
+	probe      streamProbe
+	info       codecInfo
+}
+
+// streamProbe накопленное начало элементарного потока для определения его параметров
+type streamProbe struct {
+	data    []byte
+	scanned int  // объем данных при последней попытке разбора (байт)
+	parsed  bool // параметры определены
+}
+
+// tsDemuxer состояние разбора транспортного потока
+type tsDemuxer struct {
+	packetSize int
+	programs   map[uint16]*Program // программы по номерам
+	pmtPIDs    map[uint16]bool
+	streams    map[uint16]*tsStream
+	order      []uint16          // порядок появления элементарных потоков
+	sections   map[uint16][]byte // накапливаемые секции PSI
+	pcrPID     int               // поток, по которому измеряется продолжительность (-1 - не выбран)
+	firstPCR   int64             // первый отсчет системных часов
+	lastPCR    int64             // последний отсчет системных часов
+	firstPCRAt int64             // позиция пакета с первым отсчетом (байт)
+	lastPCRAt  int64             // позиция пакета с последним отсчетом (байт)
+	pos        int64             // количество прочитанных байт
+}
+
+// tsPacketSizes размеры пакета: обычный, M2TS (с 4-байтной меткой времени), с кодом Рида-Соломона
+var tsPacketSizes = []int{tsPacketSize, 192, 204}
+
+// isTransportStream является ли начало потока последовательностью пакетов MPEG-TS
+func isTransportStream(header []byte) bool {
+	return detectTSPacketSize(header) != 0
+}
+
+// detectTSPacketSize определение размера пакета по началу потока; 0 - поток не является транспортным
+func detectTSPacketSize(header []byte) int {
+	for _, size := range tsPacketSizes {
+		// в пакетах M2TS байт синхронизации следует за меткой времени
+		offset := size - tsPacketSize
+		if size == 204 {
+			offset = 0
+		}
+		ok := len(header) >= offset+size*(tsSyncProbeSize-1)+1
+		for i := 0; ok && i < tsSyncProbeSize; i++ {
+			ok = header[offset+i*size] == tsSyncByte
+		}
+		if ok {
+			return size
+		}
+	}
+	return 0
+}
+
+// readTransportStream разбор транспортного потока MPEG-TS
+func (f *VideoFile) readTransportStream(r *bufio.Reader) error {
+	header, _ := r.Peek(tsSyncProbeSize * 204)
+	d := &tsDemuxer{
+		packetSize: detectTSPacketSize(header),
+		programs:   make(map[uint16]*Program),
+		pmtPIDs:    make(map[uint16]bool),
+		streams:    make(map[uint16]*tsStream),
+		sections:   make(map[uint16][]byte),
+		pcrPID:     -1,
+		firstPCR:   -1,
+	}
+	if d.packetSize == 0 {
+		return ErrFileIsNotValid
+	}
+	packet := make([]byte, d.packetSize)
+	offset := d.packetSize - tsPacketSize
+	if d.packetSize == 204 {
+		offset = 0
+	}
+	for {
+		n, err := io.ReadFull(r, packet)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			d.pos += int64(n)
+			break
+		}
+		if err != nil {
+			return NewAPIError("ошибка при получении файла", err)
+		}
+		if packet[offset] != tsSyncByte {
+			// потеря синхронизации: поиск следующего байта синхронизации
+			found, err := d.resync(r, packet, offset)
+			if err != nil {
+				return err
+			}
+			if !found {
+				d.pos += int64(d.packetSize)
+				break
+			}
+		}
+		d.readPacket(packet[offset:offset+tsPacketSize], d.pos)
+		d.pos += int64(d.packetSize)
+	}
+	if len(d.streams) == 0 {
+		return ErrNoSamples
+	}
+	d.fill(f)
+	f.Size = int(d.pos)
+	f.metaDataBuf = bytes.NewReader(nil)
+	return nil
+}
+
+// resync сдвиг окна пакета по потоку до байта синхронизации, за которым через размер пакета
+// следует еще один. Возвращает false, если до конца потока синхронизация не восстановлена
+func (d *tsDemuxer) resync(r *bufio.Reader, packet []byte, offset int) (bool, error) {
+	for skipped := 0; skipped < tsMaxResync; skipped++ {
+		if packet[offset] == tsSyncByte {
+			next, _ := r.Peek(offset + 1)
+			if len(next) <= offset || next[offset] == tsSyncByte {
+				return true, nil
+			}
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, nil
+		}
+		copy(packet, packet[1:])
+		packet[len(packet)-1] = b
+		d.pos++
+	}
+	return false, ErrFileIsNotValid
+}
+
+// readPacket разбор пакета транспортного потока, расположенного в позиции pos
+func (d *tsDemuxer) readPacket(p []byte, pos int64) {
+	pid := binary.BigEndian.Uint16(p[1:]) & 0x1FFF
+	start := p[1]&0x40 != 0
+	control := p[3] >> 4 & 0x3
+	counter := int(p[3] & 0xF)
+	payload := p[4:]
+	discontinuity := false
+	if control&0x2 != 0 {
+		// поле адаптации: признак разрыва и отсчет системных часов
+		length := int(p[4])
+		if length > len(payload)-1 {
+			return
+		}
+		field := payload[1 : 1+length]
+		if length > 0 {
+			discontinuity = field[0]&0x80 != 0
+			if field[0]&0x10 != 0 && length >= 7 {
+				d.readPCR(pid, field[1:7], pos)
+			}
+		}
+		payload = payload[1+length:]
+	}
+	if control&0x1 == 0 {
+		payload = nil
+	}
+	if pid == tsNullPID {
+		return
+	}
+	if s, ok := d.streams[pid]; ok {
+		s.packets++
+		if control&0x1 != 0 {
+			// счетчик увеличивается только в пакетах с данными, допускается однократный повтор пакета
+			if s.continuity >= 0 && !discontinuity && counter != (s.continuity+1)&0xF && counter != s.continuity {
+				s.errors++
+			}
+			s.continuity = counter
+		}
+		d.readPES(s, payload, start)
+		return
+	}
+	if pid == tsPATPID || d.pmtPIDs[pid] {
+		d.readSection(pid, payload, start)
+	}
+}
+
+// readPCR учет отсчета системных часов (33 бита по 90 кГц и 9 бит расширения по 27 МГц)
+func (d *tsDemuxer) readPCR(pid uint16, data []byte, pos int64) {
+	if d.pcrPID < 0 {
+		d.pcrPID = int(pid)
+	}
+	if int(pid) != d.pcrPID {
+		return
+	}
+	base := int64(binary.BigEndian.Uint32(data))<<1 | int64(data[4]>>7)
+	extension := int64(data[4]&0x1)<<8 | int64(data[5])
+	pcr := base*300 + extension
+	if d.firstPCR < 0 {
+		d.firstPCR, d.firstPCRAt = pcr, pos
+		d.lastPCR, d.lastPCRAt = pcr, pos
+		return
+	}
+	// переполнение счетчика часов учитывается продолжением отсчета
+	for pcr < d.lastPCR-tsPTSWrap*300/2 {
+		pcr += tsPTSWrap * 300
+	}
+	if pcr > d.lastPCR {
+		d.lastPCR, d.lastPCRAt = pcr, pos
+	}
+}
+
+// readSection накопление и разбор секции PSI (таблицы PAT или PMT)
+func (d *tsDemuxer) readSection(pid uint16, payload []byte, start bool) {
+	if start {
+		if len(payload) < 1 || int(payload[0]) >= len(payload) {
+			return
+		}
+		// указатель на начало новой секции
+		payload = payload[1+int(payload[0]):]
+		d.sections[pid] = append([]byte{}, payload...)
+	} else if section, ok := d.sections[pid]; ok && len(section) < tsMaxSection {
+		d.sections[pid] = append(section, payload...)
+	}
+	section := d.sections[pid]
+	if len(section) < 3 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(section[1:]) & 0xFFF)
+	if len(section) < 3+length {
+		return
+	}
+	delete(d.sections, pid)
+	// заголовок секции (8 байт) и контрольная сумма (4 байта)
+	if length < 9 {
+		return
+	}
+	body := section[8 : 3+length-4]
+	switch section[0] {
+	case 0x00:
+		d.readPAT(body)
+	case 0x02:
+		d.readPMT(pid, binary.BigEndian.Uint16(section[3:]), body)
+	}
+}
+
+// readPAT разбор таблицы программ: номер программы и поток ее таблицы PMT
+func (d *tsDemuxer) readPAT(body []byte) {
+	for ; len(body) >= 4; body = body[4:] {
+		number := binary.BigEndian.Uint16(body)
+		pid := binary.BigEndian.Uint16(body[2:]) & 0x1FFF
+		// программа 0 - сетевая информационная таблица
+		if number == 0 {
+			continue
+		}
+		if _, ok := d.programs[number]; !ok {
+			d.programs[number] = &Program{Number: number, PMTPID: pid}
+		}
+		d.pmtPIDs[pid] = true
+	}
+}
+
+// readPMT разбор таблицы состава программы: элементарные потоки и их дескрипторы
+func (d *tsDemuxer) readPMT(pid, number uint16, body []byte) {
+	program, ok := d.programs[number]
+	if !ok || program.PMTPID != pid || len(body) < 4 {
+		return
+	}
+	program.PCRPID = binary.BigEndian.Uint16(body) & 0x1FFF
+	skip := 4 + int(binary.BigEndian.Uint16(body[2:])&0xFFF)
+	if skip > len(body) {
+		return
+	}
+	for body = body[skip:]; len(body) >= 5; {
+		streamType := body[0]
+		esPID := binary.BigEndian.Uint16(body[1:]) & 0x1FFF
+		size := int(binary.BigEndian.Uint16(body[3:]) & 0xFFF)
+		if 5+size > len(body) {
+			return
+		}
+		if _, ok := d.streams[esPID]; !ok {
+			s := &tsStream{pid: esPID, streamType: streamType, firstPTS: tsUnknownPTS, lastPTS: tsUnknownPTS, continuity: -1}
+			s.describe(body[5 : 5+size])
+			d.streams[esPID] = s
+			d.order = append(d.order, esPID)
+			program.Tracks = append(program.Tracks, uint32(esPID))
+		}
+		body = body[5+size:]
+	}
+}
+
+// describe определение типа и формата потока по stream_type и дескрипторам PMT
+func (s *tsStream) describe(descriptors []byte) {
+	s.format = tsStreamTypes[s.streamType]
+	if s.format == "" {
+		s.format = fmt.Sprintf("stream_type 0x%02X", s.streamType)
+	}
+	switch s.streamType {
+	case 0x01, 0x02, 0x1B, 0x24:
+		s.kind = Video
+	case 0x03, 0x04, 0x0F, 0x11, 0x81, 0x87:
+		s.kind = Audio
+	}
+	for len(descriptors) >= 2 {
+		tag, size := descriptors[0], int(descriptors[1])
+		if 2+size > len(descriptors) {
+			return
+		}
+		data := descriptors[2 : 2+size]
+		switch tag {
+		case 0x0A: // язык
+			if size >= 3 {
+				s.language = string(data[:3])
+			}
+		case 0x6A: // AC-3 (DVB)
+			s.kind, s.format = Audio, "AC-3"
+		case 0x7A: // E-AC-3 (DVB)
+			s.kind, s.format = Audio, "E-AC-3"
+		case 0x59: // субтитры DVB
+			s.kind, s.format = Subtitle, "DVB subtitles"
+			if size >= 3 {
+				s.language = string(data[:3])
+			}
+		case 0x56: // телетекст
+			s.kind, s.format = Subtitle, "Teletext"
+			if size >= 3 {
+				s.language = string(data[:3])
+			}
+		}
+		descriptors = descriptors[2+size:]
+	}
+}
+
+// readPES разбор заголовка PES (метки времени) и накопление начала потока для определения параметров
+func (d *tsDemuxer) readPES(s *tsStream, payload []byte, start bool) {
+	if start {
+		if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			return
+		}
+		flags := payload[7]
+		headerSize := 9 + int(payload[8])
+		if headerSize > len(payload) {
+			return
+		}
+		if flags&0x80 != 0 && len(payload) >= 14 {
+			pts := readPTS(payload[9:])
+			// для перемежаемых кадров DTS меньше PTS; длительность определяется по PTS
+			s.addPTS(pts)
+		}
+		payload = payload[headerSize:]
+	} else if s.firstPTS == tsUnknownPTS {
+		// данные до первого заголовка PES не относятся к целому кадру
+		return
+	}
+	s.probe.add(payload, s.parse)
+}
+
+// add накопление данных потока с разбором функцией parse. Разбор повторяется только при удвоении объема
+// с предыдущей попытки и при заполнении буфера, поэтому общий объем разбора линейно зависит от размера буфера
+func (p *streamProbe) add(data []byte, parse func(probe []byte) bool) {
+	if p.parsed || len(p.data) >= tsProbeSize {
+		return
+	}
+	p.data = append(p.data, data...)
+	if len(p.data) >= 2*p.scanned || len(p.data) >= tsProbeSize {
+		p.parse(parse)
+	}
+}
+
+// finish разбор данных, накопленных после последней попытки (по окончании потока)
+func (p *streamProbe) finish(parse func(probe []byte) bool) {
+	if !p.parsed && len(p.data) > p.scanned {
+		p.parse(parse)
+	}
+}
+
+// parse попытка разбора накопленных данных, при успехе буфер освобождается
+func (p *streamProbe) parse(parse func(probe []byte) bool) {
+	p.scanned = len(p.data)
+	if parse(p.data) {
+		p.data, p.parsed = nil, true
+	}
+}
+
+// readPTS чтение 33-битной метки времени PES
+func readPTS(data []byte) int64 {
+	return int64(data[0]>>1&0x7)<<30 | int64(binary.BigEndian.Uint16(data[1:])>>1)<<15 | int64(binary.BigEndian.Uint16(data[3:])>>1)
+}
+
+// addPTS учет метки времени с поправкой на переполнение
+func (s *tsStream) addPTS(pts int64) {
+	if s.firstPTS == tsUnknownPTS {
+		s.firstPTS, s.lastPTS = pts, pts
+		return
+	}
+	for pts < s.lastPTS-tsPTSWrap/2 {
+		pts += tsPTSWrap
+	}
+	if pts > s.lastPTS {
+		s.lastPTS = pts
+	}
+}
+
+// parse определение параметров потока по накопленным данным
+func (s *tsStream) parse(probe []byte) bool {
+	var info codecInfo
+	var ok bool
+	switch {
+	case s.streamType == 0x1B:
+		info, ok = parseVideoElementaryStream(probe, false)
+	case s.streamType == 0x24:
+		info, ok = parseVideoElementaryStream(probe, true)
+	case s.streamType == 0x01 || s.streamType == 0x02:
+		info, ok = parseMPEGVideo(probe)
+	case s.streamType == 0x03 || s.streamType == 0x04:
+		info, ok = parseMPEGAudio(probe)
+	case s.streamType == 0x0F:
+		info, ok = parseADTS(probe)
+	case s.streamType == 0x81 || s.streamType == 0x87 || s.format == "AC-3" || s.format == "E-AC-3":
+		info, ok = parseAC3(probe)
+	default:
+		// параметры прочих потоков не определяются
+		ok = true
+	}
+	if ok {
+		s.info = info
+	}
+	return ok
+}
+
+// fill заполнение модели метаданных по результатам разбора
+func (d *tsDemuxer) fill(f *VideoFile) {
+	f.Codec = "MPEG-TS"
+	if d.packetSize == 192 {
+		f.Codec = "MPEG-TS (M2TS)"
+	}
+	movie := &f.Movie
+	movie.TimeScale = tsPTSFrequency
+	movie.PlayBackSpeed = 1
+	movie.Volume = "normal"
+	// продолжительность по отсчетам системных часов, при их отсутствии - по меткам времени потоков
+	if d.lastPCR > d.firstPCR && d.firstPCR >= 0 {
+		movie.Duration = float64(d.lastPCR-d.firstPCR) / tsPCRFrequency
+		movie.Bitrate = uint64(float64(d.lastPCRAt-d.firstPCRAt) * 8 / movie.Duration)
+	}
+	for _, pid := range d.order {
+		s := d.streams[pid]
+		s.probe.finish(s.parse)
+		duration := 0.0
+		if s.lastPTS > s.firstPTS {
+			duration = float64(s.lastPTS-s.firstPTS) / tsPTSFrequency
+		}
+		if d.lastPCR <= d.firstPCR && duration > movie.Duration {
+			movie.Duration = duration
+		}
+		track := Track{
+			ID:               uint32(pid),
+			Duration:         duration,
+			Width:            s.info.Width,
+			Height:           s.info.Height,
+			Language:         s.language,
+			ContinuityErrors: s.errors,
+		}
+		if duration > 0 {
+			track.Bitrate = uint64(float64(s.packets*tsPacketSize*8) / duration)
+		}
+		format := s.format
+		if s.info.Format != "" {
+			format = s.info.Format
+		}
+		stream := &Stream{TimeScale: tsPTSFrequency, Duration: duration, Type: s.kind}
+		switch s.kind {
+		case Video:
+			track.Stream = &VideoStream{
+				Stream:     stream,
+				Format:     format,
+				Profile:    s.info.Profile,
+				FrameRate:  nominalFrameRate(s.info.FrameRate),
+				ColorDepth: s.info.ColorDepth,
+			}
+		case Audio:
+			track.Stream = &AudioStream{
+				Stream:       stream,
+				AudioBalance: "normal",
+				Format:       format,
+				Profile:      s.info.Profile,
+				Channels:     channelLayout(s.info.Channels),
+				SampleRate:   s.info.SampleRate,
+			}
+		default:
+			stream.Type = s.kind
+			if stream.Type == "" {
+				stream.Type = format
+			}
+			track.Stream = stream
+		}
+		movie.Tracks = append(movie.Tracks, track)
+	}
+	numbers := make([]int, 0, len(d.programs))
+	for number := range d.programs {
+		numbers = append(numbers, int(number))
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		movie.Programs = append(movie.Programs, *d.programs[uint16(number)])
+	}
+}
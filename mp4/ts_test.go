@@ -0,0 +1,138 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка разбора транспортного потока MPEG-TS
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// tsPacket пакет транспортного потока; при pcr >= 0 поле адаптации содержит отсчет системных часов (90 кГц),
+// недостающий до размера пакета объем заполняется полем адаптации
+func tsPacket(pid uint16, start bool, counter byte, pcr int64, payload []byte) []byte {
+	p := []byte{tsSyncByte, byte(pid>>8) & 0x1F, byte(pid), counter & 0xF}
+	if start {
+		p[1] |= 0x40
+	}
+	if payload != nil {
+		p[3] |= 0x10
+	}
+	var field []byte
+	if pcr >= 0 {
+		field = []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr&0x1)<<7 | 0x7E, 0}
+	}
+	if n := tsPacketSize - 5 - len(payload); field != nil || n >= 0 {
+		p[3] |= 0x20
+		if field == nil && n > 0 {
+			field = []byte{0}
+		}
+		for len(field) < n {
+			field = append(field, 0xFF)
+		}
+		p = append(append(p, byte(len(field))), field...)
+	}
+	return append(p, payload...)
+}
+
+// tsSection секция PSI (с указателем на ее начало) с таблицей tableID и содержимым body
+func tsSection(tableID byte, extension uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(length>>8), byte(length)}
+	section = binary.BigEndian.AppendUint16(section, extension)
+	section = append(section, 0xC1, 0, 0)
+	// контрольная сумма не проверяется
+	return append(append(section, body...), 0, 0, 0, 0)
+}
+
+// tsPES начало пакета PES потока streamID с меткой времени pts
+func tsPES(streamID byte, pts int64, data []byte) []byte {
+	pes := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5, 0x21 | byte(pts>>29)&0x0E}
+	pes = binary.BigEndian.AppendUint16(pes, uint16(pts>>14)|0x1)
+	pes = binary.BigEndian.AppendUint16(pes, uint16(pts<<1)|0x1)
+	return append(pes, data...)
+}
+
+// testTransportStream программа 1 из видеопотока MPEG-2 720x576 25 кадров/с (PID 0x100, он же
+// поток отсчетов часов) продолжительностью 2 с и звукового потока AAC-LC 44100 Гц стерео (PID 0x101)
+// с пропуском пакета
+func testTransportStream() []byte {
+	sequence := []byte{0, 0, 1, 0xB3, 0x2D, 0x02, 0x40, 0x23, 0xFF, 0xFF}
+	adts := []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x5F, 0xFC, 0x21, 0x10, 0x05}
+	pmt := []byte{0xE1, 0x00, 0xF0, 0x00,
+		0x02, 0xE1, 0x00, 0xF0, 0x00,
+		0x0F, 0xE1, 0x01, 0xF0, 0x06, 0x0A, 0x04, 'r', 'u', 's', 0x00}
+	return bytes.Join([][]byte{
+		tsPacket(tsPATPID, true, 0, -1, tsSection(0x00, 1, []byte{0x00, 0x01, 0xF0, 0x00})),
+		tsPacket(0x1000, true, 0, -1, tsSection(0x02, 1, pmt)),
+		tsPacket(0x100, true, 0, 0, tsPES(0xE0, 0, sequence)),
+		tsPacket(0x101, true, 0, -1, tsPES(0xC0, 0, adts)),
+		tsPacket(0x101, true, 2, -1, tsPES(0xC0, 90000, adts)),
+		tsPacket(0x100, true, 1, 180000, tsPES(0xE0, 180000, sequence)),
+		tsPacket(tsNullPID, false, 0, -1, nil),
+	}, nil)
+}
+
+func TestTransportStream(t *testing.T) {
+	ts := testTransportStream()
+	// пакеты M2TS предваряются 4-байтной меткой времени
+	var m2ts []byte
+	for i := 0; i < len(ts); i += tsPacketSize {
+		m2ts = append(append(m2ts, 0, 0, 0, 0), ts[i:i+tsPacketSize]...)
+	}
+	tests := []struct {
+		data    []byte
+		codec   string
+		bitrate uint64
+	}{
+		{ts, "MPEG-TS", 3 * 188 * 8 / 2},
+		{m2ts, "MPEG-TS (M2TS)", 3 * 192 * 8 / 2},
+	}
+	for _, test := range tests {
+		var f VideoFile
+		if err := f.Open(bytes.NewReader(test.data)); err != nil {
+			t.Fatal(err)
+		}
+		movie := f.Movie
+		if f.Codec != test.codec || f.Size != len(test.data) || movie.Duration != 2 || movie.Bitrate != test.bitrate {
+			t.Fatalf("%s: формат %q, размер %d, продолжительность %v, битрейт %d", test.codec, f.Codec, f.Size, movie.Duration, movie.Bitrate)
+		}
+		programs := []Program{{Number: 1, PMTPID: 0x1000, PCRPID: 0x100, Tracks: []uint32{0x100, 0x101}}}
+		if !reflect.DeepEqual(movie.Programs, programs) {
+			t.Fatalf("%s: программы %+v вместо %+v", test.codec, movie.Programs, programs)
+		}
+		if len(movie.Tracks) != 2 {
+			t.Fatalf("%s: %d дорожек вместо 2", test.codec, len(movie.Tracks))
+		}
+		track := movie.Tracks[0]
+		video, ok := track.Stream.(*VideoStream)
+		if !ok || track.ID != 0x100 || track.Width != 720 || track.Height != 576 || track.Duration != 2 ||
+			video.Format != "MPEG Video" || video.FrameRate == nil || video.FrameRate.Nominal != 25 || track.ContinuityErrors != 0 {
+			t.Fatalf("%s: видеодорожка %+v, поток %+v", test.codec, track, track.Stream)
+		}
+		track = movie.Tracks[1]
+		audio, ok := track.Stream.(*AudioStream)
+		if !ok || track.ID != 0x101 || track.Language != "rus" || track.Duration != 1 || track.ContinuityErrors != 1 ||
+			audio.Format != "AAC" || audio.Profile != "LC" || audio.SampleRate != 44100 || audio.Channels != "Stereo" {
+			t.Fatalf("%s: звуковая дорожка %+v, поток %+v", test.codec, track, track.Stream)
+		}
+	}
+}
+
+func TestTransportStreamPacketSize(t *testing.T) {
+	ts := testTransportStream()
+	if size := detectTSPacketSize(ts); size != tsPacketSize {
+		t.Fatalf("размер пакета %d вместо %d", size, tsPacketSize)
+	}
+	// два пакета недостаточно для определения размера
+	if size := detectTSPacketSize(ts[:2*tsPacketSize]); size != 0 {
+		t.Fatalf("размер пакета %d вместо 0", size)
+	}
+	if size := detectTSPacketSize(testMovie(t)); size != 0 {
+		t.Fatalf("размер пакета MP4 %d вместо 0", size)
+	}
+}
@@ -0,0 +1,536 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка структуры файла MP4 с перечнем всех найденных проблем (в отличие от разбора, который останавливается на первой)
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Уровни серьезности проблем
+const (
+	SeverityError   = "error"   // нарушение стандарта, воспроизведение может быть невозможно
+	SeverityWarning = "warning" // отклонение от стандарта, которое большинство проигрывателей допускает
+)
+
+// validateMaxLeafSize наибольший размер блока-листа, загружаемого для проверки (байт)
+const validateMaxLeafSize = 64 << 20
+
+// validateMaxDepth наибольшая глубина вложенности блоков, более глубокие блоки не разбираются
+const validateMaxDepth = 16
+
+// validateMaxProblems наибольшее количество проблем в перечне, остальные только подсчитываются
+const validateMaxProblems = 1000
+
+// ValidationProblem проблема, найденная при проверке файла
+type ValidationProblem struct {
+	Severity string // уровень серьезности (error, warning)
+	Path     string // путь к блоку, например moov/trak[2]/mdia/minf/stbl/stco (пустой - файл целиком)
+	Offset   int64  // позиция блока или данных в файле (байт)
+	Message  string // описание проблемы
+}
+
+// ValidationReport результат проверки файла
+type ValidationReport struct {
+	Valid    bool                // ошибок не найдено (предупреждения допускаются)
+	Size     int64               // размер файла (байт)
+	Errors   int                 // количество ошибок
+	Warnings int                 // количество предупреждений
+	Problems []ValidationProblem // найденные проблемы в порядке проверки
+	Omitted  int                 `json:",omitempty"` // проблемы сверх validateMaxProblems, не вошедшие в перечень
+}
+
+// boxVersions наибольшие известные версии блоков с версией и флагами
+var boxVersions = map[string]byte{
+	"mvhd": 1, "tkhd": 1, "mdhd": 1, "hdlr": 0, "elst": 1, "vmhd": 0, "smhd": 0, "dref": 0, "stsd": 0,
+	"stts": 0, "ctts": 1, "stss": 0, "stsz": 0, "stz2": 0, "stsc": 0, "stco": 0, "co64": 0, "sdtp": 0,
+	"mehd": 1, "trex": 0, "mfhd": 0, "tfhd": 0, "tfdt": 1, "trun": 1, "sidx": 1,
+}
+
+// mandatoryBoxes обязательные дочерние блоки контейнеров (через | - взаимозаменяемые)
+var mandatoryBoxes = map[string][]string{
+	"moov": {"mvhd", "trak"},
+	"trak": {"tkhd", "mdia"},
+	"mdia": {"mdhd", "hdlr", "minf"},
+	"minf": {"stbl"},
+	"stbl": {"stsd", "stts", "stsc", "stsz|stz2", "stco|co64"},
+	"mvex": {"trex"},
+	"moof": {"mfhd", "traf"},
+	"traf": {"tfhd"},
+}
+
+// validationBox блок, прочитанный при проверке, с путем и позицией в файле
+type validationBox struct {
+	Type       string
+	name       string         // наименование с номером среди одноименных блоков родителя, например trak[2]
+	parent     *validationBox // родительский блок (nil для блоков верхнего уровня)
+	depth      int            // глубина вложенности (0 для блоков верхнего уровня)
+	offset     int64
+	headerSize int64
+	size       int64
+	data       []byte // содержимое листа или данные контейнера, предшествующие дочерним блокам
+	container  bool
+	truncated  bool // блок усечен до границы родителя или конца файла
+	children   []*validationBox
+}
+
+// validator состояние проверки файла
+type validator struct {
+	src    io.ReaderAt
+	size   int64
+	mdats  [][2]int64 // содержимое блоков mdat верхнего уровня (начало и конец)
+	report *ValidationReport
+	err    error // ошибка чтения файла
+}
+
+// Validate проверка всего файла: размеры и вложенность блоков, обязательные блоки, версии,
+// согласованность таблиц сэмплов и расположение сэмплов в блоках mdat.
+// Ошибка возвращается только при невозможности прочитать файл, проблемы структуры - в отчете
+func Validate(r io.ReadSeeker) (*ValidationReport, error) {
+	src, size, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{src: src, size: size, report: &ValidationReport{Size: size}}
+	boxes := v.walk(0, size, nil, false)
+	if v.err != nil {
+		return nil, v.err
+	}
+	var movies []*validationBox
+	for i, b := range boxes {
+		switch b.Type {
+		case "ftyp":
+			if i > 0 {
+				v.add(SeverityWarning, b, b.offset, "блок ftyp должен быть первым в файле")
+			}
+		case "moov":
+			if len(movies) > 0 {
+				v.add(SeverityError, b, b.offset, "повторный блок moov")
+			}
+			movies = append(movies, b)
+		}
+	}
+	ftyp := findValidationBox(boxes, "ftyp")
+	if ftyp == nil {
+		v.add(SeverityWarning, nil, 0, "отсутствует блок ftyp (допускается только для файлов QuickTime)")
+	}
+	// изображения HEIF/AVIF описываются блоком meta и могут не содержать moov
+	image := ftyp != nil && len(ftyp.data) >= 4 && heifBrands[string(ftyp.data[:4])] != "" &&
+		findValidationBox(boxes, "meta") != nil
+	if len(movies) == 0 && !image {
+		v.add(SeverityError, nil, 0, "отсутствует блок moov")
+	} else if len(movies) > 0 {
+		v.checkTracks(boxes, movies[0])
+	}
+	v.report.Valid = v.report.Errors == 0
+	return v.report, nil
+}
+
+// add добавление проблемы блока b (nil - файла целиком) в отчет
+func (v *validator) add(severity string, b *validationBox, offset int64, message string) {
+	if severity == SeverityError {
+		v.report.Errors++
+	} else {
+		v.report.Warnings++
+	}
+	if len(v.report.Problems) >= validateMaxProblems {
+		v.report.Omitted++
+		return
+	}
+	v.report.Problems = append(v.report.Problems, ValidationProblem{
+		Severity: severity,
+		Path:     b.path(),
+		Offset:   offset,
+		Message:  message,
+	})
+}
+
+// walk чтение последовательности блоков между позициями start и end без остановки на ошибках:
+// блок, выходящий за границу родителя или файла, усекается до нее. Для усеченного родителя (truncated)
+// выход дочерних блоков за его границу является следствием уже найденной проблемы и не сообщается
+func (v *validator) walk(start, end int64, parent *validationBox, truncated bool) []*validationBox {
+	var boxes []*validationBox
+	seen := make(map[string]int)
+	header := make([]byte, 16)
+	for offset := start; offset < end && v.err == nil; {
+		if end-offset < headerBlockSize {
+			if truncated {
+				break
+			}
+			v.add(SeverityError, parent, offset, fmt.Sprintf("%d байт в конце не образуют заголовок блока", end-offset))
+			break
+		}
+		if _, v.err = v.src.ReadAt(header[:headerBlockSize], offset); v.err != nil {
+			break
+		}
+		b := &validationBox{Type: string(header[4:8]), parent: parent, offset: offset, headerSize: headerBlockSize}
+		seen[b.Type]++
+		b.name = b.Type
+		if seen[b.Type] > 1 {
+			b.name = fmt.Sprintf("%s[%d]", b.Type, seen[b.Type])
+		}
+		if parent != nil {
+			b.depth = parent.depth + 1
+		}
+		size := uint64(binary.BigEndian.Uint32(header))
+		switch size {
+		case 0x1:
+			if end-offset < 16 {
+				if truncated {
+					return boxes
+				}
+				v.add(SeverityError, b, offset, "64-битный размер блока обрезан")
+				return boxes
+			}
+			if _, v.err = v.src.ReadAt(header[headerBlockSize:16], offset+headerBlockSize); v.err != nil {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(header[headerBlockSize:16])
+			b.headerSize = 16
+		case 0x0:
+			size = uint64(end - offset)
+			if parent != nil {
+				v.add(SeverityWarning, b, offset, "размер 0 (до конца) допускается только для блоков верхнего уровня")
+			}
+		}
+		if size < uint64(b.headerSize) {
+			v.add(SeverityError, b, offset, fmt.Sprintf("неверный размер блока %d байт", size))
+			return boxes
+		}
+		if size > uint64(end-offset) {
+			b.truncated = true
+			switch {
+			case truncated:
+				// проблема уже сообщена для родителя
+			case parent == nil:
+				v.add(SeverityError, b, offset, fmt.Sprintf("размер блока %d байт выходит за конец файла на %d байт",
+					size, size-uint64(end-offset)))
+			default:
+				v.add(SeverityError, b, offset, fmt.Sprintf("блок выходит за границу блока %s на %d байт и перекрывается со следующими блоками",
+					parent.path(), size-uint64(end-offset)))
+			}
+			size = uint64(end - offset)
+		}
+		b.size = int64(size)
+		v.read(b)
+		boxes = append(boxes, b)
+		offset += b.size
+	}
+	return boxes
+}
+
+// read чтение содержимого блока: дочерних блоков контейнера или данных листа, проверка версии
+// и обязательных дочерних блоков
+func (v *validator) read(b *validationBox) {
+	payload, end := b.offset+b.headerSize, b.offset+b.size
+	if b.Type == "mdat" && b.parent == nil {
+		v.mdats = append(v.mdats, [2]int64{payload, end})
+		return
+	}
+	prefixes, container := containerBoxes[b.Type]
+	if container && b.depth >= validateMaxDepth {
+		v.add(SeverityError, b, b.offset, fmt.Sprintf("вложенность блоков глубже %d уровней, содержимое не проверяется", validateMaxDepth))
+		return
+	}
+	if container {
+		prefix := int64(prefixes[0])
+		if b.Type == "meta" {
+			// в MP4 блок meta начинается с нулевых версии и флагов, в QuickTime - сразу с дочернего блока
+			prefix = 0
+			temp := make([]byte, 4)
+			if end-payload >= 4 {
+				if _, v.err = v.src.ReadAt(temp, payload); v.err == nil && binary.BigEndian.Uint32(temp) == 0 {
+					prefix = 4
+				}
+			}
+		}
+		if end-payload < prefix {
+			v.add(SeverityError, b, b.offset, "блок короче обязательных полей")
+			return
+		}
+		b.container = true
+		b.data = make([]byte, prefix)
+		if _, v.err = v.src.ReadAt(b.data, payload); v.err != nil {
+			return
+		}
+		b.children = v.walk(payload+prefix, end, b, b.truncated)
+	} else if _, versioned := boxVersions[b.Type]; (b.parent != nil || versioned || b.Type == "ftyp") &&
+		end-payload <= validateMaxLeafSize {
+		b.data = make([]byte, end-payload)
+		if _, v.err = v.src.ReadAt(b.data, payload); v.err != nil {
+			return
+		}
+	}
+	if maxVersion, ok := boxVersions[b.Type]; ok && (b.data != nil || b.container) {
+		if len(b.data) < 4 {
+			v.add(SeverityError, b, b.offset, "блок короче полей версии и флагов")
+		} else if b.data[0] > maxVersion {
+			v.add(SeverityError, b, b.offset, fmt.Sprintf("неизвестная версия блока %d (наибольшая известная - %d)", b.data[0], maxVersion))
+		}
+	}
+	for _, required := range mandatoryBoxes[b.Type] {
+		found := false
+		for _, name := range strings.Split(required, "|") {
+			found = found || b.child(name) != nil
+		}
+		if !found {
+			v.add(SeverityError, b, b.offset, "отсутствует обязательный блок "+strings.ReplaceAll(required, "|", " или "))
+		}
+	}
+}
+
+// mediaDataSize объем содержимого блоков mdat верхнего уровня (байт)
+func (v *validator) mediaDataSize() (size int64) {
+	for _, mdat := range v.mdats {
+		size += mdat[1] - mdat[0]
+	}
+	return size
+}
+
+// path путь к блоку от верхнего уровня (пустой для nil - файла целиком)
+func (b *validationBox) path() string {
+	if b == nil {
+		return ""
+	}
+	if b.parent == nil {
+		return b.name
+	}
+	return b.parent.path() + "/" + b.name
+}
+
+// findValidationBox поиск блока по наименованию
+func findValidationBox(boxes []*validationBox, name string) *validationBox {
+	for _, b := range boxes {
+		if b.Type == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// child первый дочерний блок с наименованием name
+func (b *validationBox) child(name string) *validationBox {
+	return findValidationBox(b.children, name)
+}
+
+// find поиск блока по пути из наименований, разделенных /
+func (b *validationBox) find(path string) *validationBox {
+	for _, name := range strings.Split(path, "/") {
+		if b = b.child(name); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// box преобразование в блок дерева для разбора таблиц сэмплов и фрагментов
+func (b *validationBox) box() *Box {
+	if !b.container {
+		box := NewBox(b.Type, b.data)
+		box.offset, box.size = b.offset, b.size
+		return box
+	}
+	children := make([]*Box, len(b.children))
+	for i, c := range b.children {
+		children[i] = c.box()
+	}
+	box := NewContainer(b.Type, b.data, children...)
+	box.offset, box.size = b.offset, b.size
+	return box
+}
+
+// checkTracks проверка таблиц сэмплов дорожек и фрагментов, расположения сэмплов в блоках mdat
+func (v *validator) checkTracks(boxes []*validationBox, moov *validationBox) {
+	movie := moov.box()
+	var tracks []*mediaTrack
+	traks := make(map[*mediaTrack]*validationBox)
+	for _, trak := range moov.children {
+		if trak.Type != "trak" {
+			continue
+		}
+		stbl := trak.find("mdia/minf/stbl")
+		if stbl == nil {
+			continue
+		}
+		v.checkSampleCounts(stbl)
+		t, err := readMediaTrack(trak.box(), v.mediaDataSize())
+		if err != nil {
+			v.add(SeverityError, trak, trak.offset, "таблица сэмплов не разбирается: "+err.Error())
+			continue
+		}
+		tracks = append(tracks, t)
+		traks[t] = trak
+	}
+	if moof := findValidationBox(boxes, "moof"); moof != nil {
+		tops := make([]*Box, len(boxes))
+		for i, b := range boxes {
+			tops[i] = b.box()
+		}
+		if err := readFragments(tops, movie, tracks); err != nil {
+			v.add(SeverityError, moof, moof.offset, "фрагменты не разбираются: "+err.Error())
+			return
+		}
+	}
+	v.checkSampleData(tracks, traks)
+}
+
+// table записи таблицы с количеством записей после версии и флагов (nil, если блока нет или он поврежден)
+func (v *validator) table(b *validationBox, entrySize int) (count int, entries []byte, ok bool) {
+	if b == nil || b.data == nil {
+		return 0, nil, false
+	}
+	if count, entries, ok = tableEntries(NewBox(b.Type, b.data), 4, entrySize); !ok {
+		v.add(SeverityError, b, b.offset, "количество записей превышает размер блока")
+	}
+	return count, entries, ok
+}
+
+// runTotal количество сэмплов, описанных таблицей из записей (количество, значение) - stts, ctts
+func runTotal(count int, entries []byte) (total uint64) {
+	for i := 0; i < count; i++ {
+		total += uint64(binary.BigEndian.Uint32(entries[i*8:]))
+	}
+	return total
+}
+
+// checkSampleCounts сравнение количества сэмплов в таблицах stsz/stz2, stts, ctts, stsc, stss и sdtp
+func (v *validator) checkSampleCounts(stbl *validationBox) {
+	sizes := stbl.child("stsz")
+	if sizes == nil {
+		sizes = stbl.child("stz2")
+	}
+	if sizes == nil || len(sizes.data) < 12 {
+		return
+	}
+	samples := uint64(binary.BigEndian.Uint32(sizes.data[8:]))
+	mismatch := func(b *validationBox, n uint64) {
+		if n != samples {
+			v.add(SeverityError, b, b.offset, fmt.Sprintf("в блоке описано %d сэмплов, в %s - %d", n, sizes.Type, samples))
+		}
+	}
+	if stts := stbl.child("stts"); stts != nil {
+		if count, entries, ok := v.table(stts, 8); ok {
+			mismatch(stts, runTotal(count, entries))
+		}
+	}
+	if ctts := stbl.child("ctts"); ctts != nil {
+		if count, entries, ok := v.table(ctts, 8); ok {
+			mismatch(ctts, runTotal(count, entries))
+		}
+	}
+	if sdtp := stbl.child("sdtp"); sdtp != nil && len(sdtp.data) >= 4 {
+		mismatch(sdtp, uint64(len(sdtp.data)-4))
+	}
+	if stss := stbl.child("stss"); stss != nil {
+		if count, entries, ok := v.table(stss, 4); ok {
+			for i := 0; i < count; i++ {
+				if n := uint64(binary.BigEndian.Uint32(entries[i*4:])); n == 0 || n > samples {
+					v.add(SeverityError, stss, stss.offset, fmt.Sprintf("номер ключевого сэмпла %d вне диапазона 1..%d", n, samples))
+					break
+				}
+			}
+		}
+	}
+	// количество сэмплов по распределению сэмплов по чанкам
+	chunkTable, entrySize := stbl.child("stco"), 4
+	if chunkTable == nil {
+		chunkTable, entrySize = stbl.child("co64"), 8
+	}
+	chunks, _, ok := v.table(chunkTable, entrySize)
+	stsc := stbl.child("stsc")
+	if !ok || stsc == nil {
+		return
+	}
+	count, entries, ok := v.table(stsc, 12)
+	if !ok {
+		return
+	}
+	var total uint64
+	for i := 0; i < count; i++ {
+		first := int(binary.BigEndian.Uint32(entries[i*12:]))
+		last := chunks
+		if i+1 < count {
+			last = int(binary.BigEndian.Uint32(entries[(i+1)*12:])) - 1
+		}
+		if first < 1 || first > last+1 || last > chunks {
+			v.add(SeverityError, stsc, stsc.offset, fmt.Sprintf("запись %d ссылается на несуществующие чанки %d..%d (всего %d)", i+1, first, last, chunks))
+			return
+		}
+		total += uint64(last-first+1) * uint64(binary.BigEndian.Uint32(entries[i*12+4:]))
+	}
+	mismatch(stsc, total)
+}
+
+// checkSampleData проверка расположения сэмплов: в пределах файла, внутри блоков mdat и без перекрытий
+func (v *validator) checkSampleData(tracks []*mediaTrack, traks map[*mediaTrack]*validationBox) {
+	type dataRange struct {
+		start, end int64
+		track      *mediaTrack
+	}
+	var ranges []dataRange
+	for _, t := range tracks {
+		trak := traks[t]
+		location := trak
+		if stco := trak.find("mdia/minf/stbl/stco"); stco != nil {
+			location = stco
+		} else if co64 := trak.find("mdia/minf/stbl/co64"); co64 != nil {
+			location = co64
+		}
+		var outsideFile, outsideData int
+		var firstOutsideFile, firstOutsideData int64
+		for _, s := range t.Samples {
+			start, end := s.Offset, s.Offset+int64(s.Size)
+			ranges = append(ranges, dataRange{start, end, t})
+			if start < 0 || end > v.size {
+				if outsideFile == 0 {
+					firstOutsideFile = start
+				}
+				outsideFile++
+				continue
+			}
+			inside := false
+			for _, mdat := range v.mdats {
+				inside = inside || start >= mdat[0] && end <= mdat[1]
+			}
+			if !inside {
+				if outsideData == 0 {
+					firstOutsideData = start
+				}
+				outsideData++
+			}
+		}
+		if outsideFile > 0 {
+			v.add(SeverityError, location, firstOutsideFile, fmt.Sprintf("%d сэмплов дорожки %d выходят за конец файла (первый - по позиции %d)",
+				outsideFile, t.ID, firstOutsideFile))
+		}
+		if outsideData > 0 {
+			v.add(SeverityError, location, firstOutsideData, fmt.Sprintf("%d сэмплов дорожки %d расположены вне блоков mdat (первый - по позиции %d)",
+				outsideData, t.ID, firstOutsideData))
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	overlaps := 0
+	var first dataRange
+	var end int64
+	for i, r := range ranges {
+		if i > 0 && r.start < end && r.end > r.start {
+			if overlaps == 0 {
+				first = r
+			}
+			overlaps++
+		}
+		if r.end > end {
+			end = r.end
+		}
+	}
+	if overlaps > 0 {
+		v.add(SeverityWarning, traks[first.track], first.start, fmt.Sprintf("данные %d сэмплов перекрываются с данными других сэмплов (первый - сэмпл дорожки %d по позиции %d)",
+			overlaps, first.track.ID, first.start))
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка отчета о структуре файла
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	source := testMovie(t)
+	// позиция первого блока name (блоки видеодорожки предшествуют блокам звуковой)
+	boxAt := func(name string) int {
+		return bytes.Index(source, []byte(name)) - 4
+	}
+	const stbl = "moov/trak/mdia/minf/stbl/"
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		path    string
+		offset  func(data []byte) int64
+	}{
+		{
+			name: "чанк за концом файла",
+			corrupt: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[boxAt("stco")+16:], uint32(len(data)+100))
+				return data
+			},
+			path:   stbl + "stco",
+			offset: func(data []byte) int64 { return int64(len(data) + 100) },
+		},
+		{
+			name: "количество сэмплов stts",
+			corrupt: func(data []byte) []byte {
+				entry := data[boxAt("stts")+16:]
+				binary.BigEndian.PutUint32(entry, binary.BigEndian.Uint32(entry)+3)
+				return data
+			},
+			path:   stbl + "stts",
+			offset: func([]byte) int64 { return int64(boxAt("stts")) },
+		},
+		{
+			name: "количество сэмплов stsz",
+			corrupt: func(data []byte) []byte {
+				count := data[boxAt("stsz")+16:]
+				binary.BigEndian.PutUint32(count, binary.BigEndian.Uint32(count)-1)
+				return data
+			},
+			path:   stbl + "stts",
+			offset: func([]byte) int64 { return int64(boxAt("stts")) },
+		},
+		{
+			name: "дочерний блок за границей родителя",
+			corrupt: func(data []byte) []byte {
+				size := data[boxAt("tkhd"):]
+				binary.BigEndian.PutUint32(size, binary.BigEndian.Uint32(size)+uint32(len(data)))
+				return data
+			},
+			path:   "moov/trak/tkhd",
+			offset: func([]byte) int64 { return int64(boxAt("tkhd")) },
+		},
+		{
+			name:    "усеченный файл",
+			corrupt: func(data []byte) []byte { return data[:len(data)-100] },
+			path:    "moov",
+			offset:  func([]byte) int64 { return int64(boxAt("moov")) },
+		},
+	}
+	for _, test := range tests {
+		data := test.corrupt(append([]byte{}, source...))
+		report, err := Validate(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if report.Valid || report.Errors == 0 || report.Size != int64(len(data)) {
+			t.Fatalf("%s: %+v", test.name, report)
+		}
+		found := false
+		for _, p := range report.Problems {
+			found = found || p.Severity == SeverityError && p.Path == test.path && p.Offset == test.offset(data)
+		}
+		if !found {
+			t.Fatalf("%s: нет ошибки блока %s по позиции %d в %+v", test.name, test.path, test.offset(data), report.Problems)
+		}
+	}
+	report, err := Validate(bytes.NewReader(source))
+	if err != nil || !report.Valid || len(report.Problems) != 0 {
+		t.Fatalf("отчет %+v, ошибка %v", report, err)
+	}
+}
@@ -3,7 +3,7 @@
 // Сведения о лицензии отсутствуют
 
 // Получение метаинформации о видеопотоке/видеофайле, содержимое которого передается как объект Reader
-package main
+package mp4
 
 import (
 	"bufio"
@@ -12,37 +12,76 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"math"
+	"strings"
 	"time"
 )
 
 // Константы типа потоков
 const (
-	Audio string = "Audio Media"  // аудиопоток
-	Video string = "Visual Media" // видеопоток
-	Hint  string = "Hint"         // поток-наводка (подсказка)
+	Audio    string = "Audio Media"    // аудиопоток
+	Video    string = "Visual Media"   // видеопоток
+	Hint     string = "Hint"           // поток-наводка (подсказка)
+	Subtitle string = "Subtitle Media" // поток субтитров
+	Timecode string = "Timecode"       // поток временного кода (QuickTime, gmhd)
 )
 
 // HeaderBlockSize размер заголовка блока
 const headerBlockSize = 0x8
 
 // описание типов потоков
-var streamTypes = map[string]string{"soun": "Audio Media", "vide": "Visual Media"}
+var streamTypes = map[string]string{
+	"soun": "Audio Media", "vide": "Visual Media", "hint": "Hint", "sbtl": "Subtitle Media", "subt": "Subtitle Media",
+	"text": "Subtitle Media", "tmcd": "Timecode",
+}
 
 // наименование блоков, из которых извлекаются метаданные
 var sectors = []string{"ftyp", "moov"}
 
-// стандарты описания алгоритмов сжатия потоков
+// стандарты описания алгоритмов сжатия потоков (бренды блока ftyp)
 var codecs = map[string]string{
 	"isom": "ISO 14496-1 Base Media",
 	"iso2": "ISO 14496-12 Base Media",
+	"iso3": "ISO 14496-12 Base Media vers. 3",
+	"iso4": "ISO 14496-12 Base Media vers. 4",
+	"iso5": "ISO 14496-12 Base Media vers. 5",
+	"iso6": "ISO 14496-12 Base Media vers. 6",
+	"iso8": "ISO 14496-12 Base Media vers. 8",
+	"iso9": "ISO 14496-12 Base Media vers. 9",
 	"mp41": "ISO 14496-1 vers. 1",
 	"mp42": "ISO 14496-1 vers. 2",
+	"avc1": "MP4 Base w/ AVC ext",
 	"qt  ": "QuickTime Movie",
 	"3gp4": "3G MP4 Profile",
+	"3gp5": "3GPP Release 5",
+	"3gp6": "3GPP Release 6",
+	"3g2a": "3GPP2 Media",
 	"mp71": "ISO 14496-12 MPEG-7 Meta Data",
-	"M4A":  "Apple AAC audio w/ iTunes info",
-	"M4B":  "Apple audio w/ iTunes position",
+	"M4A ": "Apple AAC audio w/ iTunes info",
+	"M4B ": "Apple audio w/ iTunes position",
+	"M4P ": "Apple AAC audio w/ iTunes protection",
+	"M4V ": "Apple video",
 	"mmp4": "3G Mobile MP4",
+	"MSNV": "Sony PSP",
+	"msnv": "Sony PSP",
+	"dash": "MPEG-DASH",
+	"msdh": "MPEG-DASH media segment",
+	"cmfc": "CMAF Media",
+	"cmf2": "CMAF Media vers. 2",
+	"f4v ": "Adobe Flash Video",
+	"f4a ": "Adobe Flash Audio",
+}
+
+// brandProfiles профили файла по брендам блока ftyp; общие бренды ISO (isom, mp42, ...) профиль не определяют
+var brandProfiles = map[string]string{
+	"qt  ": "MOV",
+	"3gp4": "3GP", "3gp5": "3GP", "3gp6": "3GP", "3gp7": "3GP", "3ge6": "3GP", "3gg6": "3GP", "3g2a": "3GP", "mmp4": "3GP",
+	"M4A ": "M4A", "M4B ": "M4A", "M4P ": "M4A",
+	"M4V ": "MP4", "MSNV": "MP4", "msnv": "MP4",
+	"cmfc": "CMAF", "cmf2": "CMAF", "cmfs": "CMAF", "cmff": "CMAF", "cmfl": "CMAF",
+	"dash": "DASH", "msdh": "DASH", "msix": "DASH",
+	"f4v ": "F4V", "f4p ": "F4V", "f4a ": "F4V", "f4b ": "F4V",
+	"mif1": "HEIF", "mif2": "HEIF", "heic": "HEIF", "heix": "HEIF", "heim": "HEIF", "heis": "HEIF", "avif": "HEIF",
 }
 
 // VideoFile Структура для хранения метаинформации о видеофайле
@@ -57,35 +96,61 @@ var codecs = map[string]string{
 // Некоторые блоки могут иметь размер более 8 байт
 // Размер блока включает в себя размер заголовка
 type VideoFile struct {
-	metaDataBuf  *bytes.Reader // буфер с метаданными
-	blockSize    int64         // размера текущего блока (байт)
-	startOfBlock int64         // позиция начала блока относительно начала потока данных (байт)
-	Size         int           // размер файла (байт)
-	Codec        string        // стандарт используемого сжатия видео и аудио потоков
-	Movie        Container     // видеоконтейнер
+	metaDataBuf      *bytes.Reader // буфер с метаданными
+	blockSize        int64         // размера текущего блока (байт)
+	startOfBlock     int64         // позиция начала блока относительно начала потока данных (байт)
+	Size             int           // размер файла (байт)
+	Codec            string        // стандарт используемого сжатия видео и аудио потоков
+	MajorBrand       string        `json:",omitempty"` // основной бренд (блок ftyp)
+	MinorVersion     uint32        `json:",omitempty"` // версия основного бренда
+	CompatibleBrands []string      `json:",omitempty"` // совместимые бренды
+	Profile          string        `json:",omitempty"` // профиль файла (MP4, MOV, 3GP, M4A, CMAF, DASH, F4V, HEIF)
+	Layout           []BoxPosition `json:",omitempty"` // блоки верхнего уровня в порядке расположения (см. CheckFile)
+	Movie            Container     // видеоконтейнер
 }
 
 // Container Структура для хранения метаинформации о видеоконтейнере
 type Container struct {
-	durationFlag  byte      // флаг, описывающий формат представления дат в файле (либо 0x0 - дата храниться как 4 байта, либо 0x1 - как 8 байт)
-	Created       time.Time // время создания
-	Modified      time.Time // время изменения
-	TimeScale     uint32    // единица времени, используемая для квантования (обычно доли секунды)
-	Duration      float64   // продолжительность медиа-данных в контейнере (сек)
-	PlayBackSpeed uint16    // скорость воспроизведения (смысл значения мне до сих пор непонятен)
-	Volume        string    // уровень звука (относительный)
-	Tracks        []Track   // медиа-дорожки, содержащиеся в контейнере
+	durationFlag  byte              // флаг, описывающий формат представления дат в файле (либо 0x0 - дата храниться как 4 байта, либо 0x1 - как 8 байт)
+	Created       time.Time         // время создания
+	Modified      time.Time         // время изменения
+	TimeScale     uint32            // единица времени, используемая для квантования (обычно доли секунды)
+	Duration      float64           // продолжительность медиа-данных в контейнере (сек)
+	PlayBackSpeed uint16            // скорость воспроизведения (смысл значения мне до сих пор непонятен)
+	Volume        string            // уровень звука (относительный)
+	Tracks        []Track           // медиа-дорожки, содержащиеся в контейнере
+	Tags          map[string]string `json:",omitempty"` // теги (название, автор, ...)
+	Chapters      []Chapter         `json:",omitempty"` // главы
+	Cues          []Cue             `json:",omitempty"` // индекс ключевых кадров
+	Attachments   []Attachment      `json:",omitempty"` // вложенные файлы
+	Bitrate       uint64            `json:",omitempty"` // общий битрейт (бит/с)
+	Programs      []Program         `json:",omitempty"` // программы транспортного потока
+	Items         []Item            `json:",omitempty"` // элементы файла изображений HEIF/AVIF
+	Exif          map[string]string `json:",omitempty"` // метаданные Exif основного изображения
 }
 
 // Track Структура для хранения метаинформации о медиа-дорожке
 type Track struct {
-	durationFlag byte         // флаг, описывающий формат представления дат в файле (либо 0x0 - дата храниться как 4 байта, либо 0x1 - как 8 байт)
-	Created      time.Time    // время создания
-	Modified     time.Time    // время изменения
-	Duration     float64      // продолжительность медиа-дорожки (сек)
-	Height       uint32       // высота для дорожки видеопотока (пиксель)
-	Width        uint32       // ширина для дорожки видеопотока (пиксель)
-	Stream       StreamReader // медиапоток данных, с которым связана данная дорожка (одна дорожка - один поток)
+	durationFlag byte              // флаг, описывающий формат представления дат в файле (либо 0x0 - дата храниться как 4 байта, либо 0x1 - как 8 байт)
+	Created      time.Time         // время создания
+	Modified     time.Time         // время изменения
+	Duration     float64           // продолжительность медиа-дорожки (сек)
+	Height       uint32            // высота для дорожки видеопотока (пиксель)
+	Width        uint32            // ширина для дорожки видеопотока (пиксель)
+	Rotation     int               // угол поворота изображения по часовой стрелке (градусы)
+	Stream       StreamReader      // медиапоток данных, с которым связана данная дорожка (одна дорожка - один поток)
+	ID           uint32            `json:",omitempty"` // идентификатор дорожки (PID для MPEG-TS)
+	Name         string            `json:",omitempty"` // название дорожки
+	Language     string            `json:",omitempty"` // язык дорожки
+	CodecPrivate []byte            `json:",omitempty"` // параметры декодера
+	Tags         map[string]string `json:",omitempty"` // теги дорожки
+	Bitrate      uint64            `json:",omitempty"` // средний битрейт (бит/с)
+	Samples      int               `json:",omitempty"` // количество сэмплов (кадров) по индексу файла
+	KeyFrames    int               `json:",omitempty"` // количество ключевых кадров по индексу файла
+	// количество нарушений непрерывности (счетчика пакетов MPEG-TS)
+	ContinuityErrors int `json:",omitempty"`
+	// структура групп кадров видеодорожки по таблицам сэмплов
+	GOP *GOPInfo `json:",omitempty"`
 }
 
 // StreamReader интерфейс медиапотока данных (их может быть аж до 10 типов, в нашем случае - только два)
@@ -109,7 +174,7 @@ type StreamReader interface {
 // MPEG-J = 'mjsm';
 type Stream struct {
 	durationFlag byte    // флаг, описывающий формат представления дат в файле (либо 0x0 - дата храниться как 4 байта, либо 0x1 - как 8 байт)
-	TimeScale    uint32  // частота сэмплирования (для видео = количество кадров в секунду; для аудио = количество сэмплов в секунду)
+	TimeScale    uint32  // единица времени потока (количество единиц в секунду; для аудио обычно равна частоте дискретизации)
 	Duration     float64 // продолжительность (сек)
 	Type         string  // тип потока
 }
@@ -119,17 +184,28 @@ type AudioStream struct {
 	*Stream
 	AudioBalance string // баланс
 	Format       string // формат
+	CodecName    string `json:",omitempty"` // наименование формата сжатия
+	Profile      string `json:",omitempty"` // профиль сжатия
 	Channels     string // количество каналов (моно, стерео, ...)
 	SampleRate   uint32 // частота дискретизации (Гц)
+	BitDepth     uint16 `json:",omitempty"` // разрядность несжатого звука (бит)
+	SampleSize   uint32 `json:",omitempty"` // размер сэмпла несжатого звука по всем каналам (байт)
 }
 
 // VideoStream данные видеопотока
 type VideoStream struct {
 	*Stream
-	Format     string // формат
-	ResY       uint16 // разрешение по вертикали (точек на дюйм)
-	ResX       uint16 // разрешение по горизонтали (точек на дюйм)
-	ColorDepth uint16 // глубина цвета (бит)
+	Format     string         // формат
+	CodecName  string         `json:",omitempty"` // наименование формата сжатия
+	Profile    string         `json:",omitempty"` // профиль и уровень сжатия
+	FrameRate  *FrameRateInfo `json:",omitempty"` // частота кадров
+	ResY       uint16         // разрешение по вертикали (точек на дюйм)
+	ResX       uint16         // разрешение по горизонтали (точек на дюйм)
+	ColorDepth uint16         // глубина цвета (бит)
+	BitDepth   uint16         `json:",omitempty"` // разрядность компоненты цвета (бит)
+	Gamma      float64        `json:",omitempty"` // гамма (блок gama)
+	FieldOrder string         `json:",omitempty"` // развертка и порядок полей (блок fiel)
+	Color      string         `json:",omitempty"` // описание цветового пространства (блок colr)
 }
 
 // CheckFile проверка на соответствие формата переданного содержимого стандартам MP4
@@ -143,63 +219,87 @@ func (f *VideoFile) CheckFile(buf *bufio.Reader) (err error) {
 	// текущее смещение от начала потока в байтах
 	var offset int
 	var temp []byte
+	// найден ли блок описания контейнера (без него файл можно только восстановить, см. Recover)
+	var hasMovie bool
 	for {
-		blockInfo, err = buf.Peek(0xF)
-		if err == io.EOF {
+		blockInfo, err = buf.Peek(16)
+		if err == io.EOF && len(blockInfo) < headerBlockSize {
 			break
 		}
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return ErrFileIsNotValid
 		}
 		blockSize = int(binary.BigEndian.Uint32(blockInfo[:4]))
 		blockName = string(blockInfo[4:headerBlockSize])
-		if offset == 0 && !f.isMetaDataBlock(blockName) {
+		if offset == 0 && !quickTimeTopLevel[blockName] {
 			return ErrFileIsNotValid
 		}
-		if f.isMetaDataBlock(blockName) {
-			if blockName == "ftyp" {
-				codec := string(blockInfo[headerBlockSize:12])
-				if !f.isSupported(codec) {
-					return ErrFileCodecNotSupported
-				}
+		// в случае больших блоков под размер отводится не 4, а 8 байтов после наименования,
+		// а размер 0x0 означает, что данные блока продолжаются до конца файла
+		headerSize := headerBlockSize
+		switch blockSize {
+		case 0x1:
+			if len(blockInfo) < 16 {
+				return ErrFileIsNotValid
 			}
-			var blockData = make([]byte, blockSize)
-			_, err = io.ReadFull(buf, blockData)
-			if err != nil {
+			size := binary.BigEndian.Uint64(blockInfo[headerBlockSize:16])
+			if size > math.MaxInt {
 				return ErrFileIsNotValid
 			}
+			blockSize, headerSize = int(size), 16
+		case 0x0:
+			blockSize = -1
+		}
+		// размер меньше заголовка не позволяет перейти к следующему блоку
+		if blockSize >= 0 && blockSize < headerSize {
+			return ErrFileIsNotValid
+		}
+		if f.isMetaDataBlock(blockName) {
+			var blockData []byte
+			if blockSize < 0 {
+				blockData, err = io.ReadAll(buf)
+				if err != nil || len(blockData) > math.MaxUint32 {
+					return ErrFileIsNotValid
+				}
+				// размер до конца файла записывается явно для разбора метаданных
+				blockSize = len(blockData)
+				binary.BigEndian.PutUint32(blockData, uint32(blockSize))
+			} else {
+				blockData = make([]byte, blockSize)
+				if _, err = io.ReadFull(buf, blockData); err != nil {
+					return ErrFileIsNotValid
+				}
+			}
 			temp = append(temp, blockData...)
+			f.Layout = append(f.Layout, BoxPosition{Type: blockName, Offset: int64(offset), Size: int64(blockSize)})
 			offset += blockSize
+			hasMovie = hasMovie || blockName == "moov"
 			continue
 		}
-		// дополнительная обработка блока медиаданных
-		// здесь формат заголовка может быть другим
-		// в случае больших файлов под размер блока может отводиться не 4 а 8 байтов, а
-		// иногда (если длина этого блока указана как 0x0)
-		// данные этого блока продолжаются аж до конца файла
-		if blockName == "mdat" {
-			if blockSize == 0x1 {
-				blockSize = int(binary.BigEndian.Uint64(blockInfo[headerBlockSize:16]))
-			} else if blockSize == 0x0 {
-				var n int
-				// считываем до конца, чтобы узнать размер файла
-				tempBuf := make([]byte, 0xFFFF)
-				for err != io.EOF {
-					n, err = buf.Read(tempBuf)
-					if err != nil {
-						return ErrFileIsNotValid
-					}
-					offset += n
-				}
-				return
+		if blockSize < 0 {
+			// последний блок файла: размер определяется по оставшимся данным
+			rest, err := io.Copy(io.Discard, buf)
+			if err != nil {
+				return ErrFileIsNotValid
 			}
+			f.Layout = append(f.Layout, BoxPosition{Type: blockName, Offset: int64(offset), Size: rest})
+			offset += int(rest)
+			break
 		}
 		_, err = buf.Discard(blockSize)
 		if err != nil {
+			// медиаданные обрезаны, описание контейнера записано не было
+			if !hasMovie && blockName == "mdat" {
+				return ErrMovieNotFound
+			}
 			return ErrFileIsNotValid
 		}
+		f.Layout = append(f.Layout, BoxPosition{Type: blockName, Offset: int64(offset), Size: int64(blockSize)})
 		offset += blockSize
 	}
+	if !hasMovie {
+		return ErrMovieNotFound
+	}
 	f.Size = offset
 	f.metaDataBuf = bytes.NewReader(temp)
 	return nil
@@ -270,10 +370,18 @@ func (f *VideoFile) Parse() (err error) {
 	return f.Parse()
 }
 
-// Open Метод проверки доступности и корректности файла, создание буфера и.т.д
+// Open Метод проверки доступности и корректности файла: выбор формата по первым байтам (см. DetectFormat)
+// и чтение метаданных зарегистрированным для него разборщиком
 func (f *VideoFile) Open(r io.Reader) (err error) {
 	var errAPI APIError
-	err = f.CheckFile(bufio.NewReader(r))
+	var format Format
+	var file *VideoFile
+	buf := bufio.NewReader(r)
+	if format, err = DetectFormat(buf); err == nil {
+		if file, err = format.Parse(buf); err == nil {
+			*f = *file
+		}
+	}
 	if err != nil && !errors.As(err, &errAPI) {
 		err = NewAPIError("ошибка при подготовке файла", err)
 	}
@@ -311,15 +419,40 @@ func (f *VideoFile) seekBlockEnd() {
 }
 
 // readFileInfo Чтение общей информации о видеофайле
-func (f *VideoFile) readFileInfo() (err error) {
-	var temp = make([]byte, 4)
-	_, err = io.ReadFull(f.metaDataBuf, temp)
-	if err != nil {
+func (f *VideoFile) readFileInfo() {
+	defer restoreAndPanic("ошибка чтения типа файла")
+	data := make([]byte, f.blockSize-headerBlockSize)
+	_, err := io.ReadFull(f.metaDataBuf, data)
+	fatal(err)
+	f.readFileType(data)
+}
+
+// readFileType разбор содержимого блока ftyp: основной бренд, его версия и совместимые бренды,
+// профиль файла определяется по основному бренду, а если он общий - по первому подходящему совместимому
+func (f *VideoFile) readFileType(data []byte) {
+	if len(data) < 8 {
 		return
 	}
-	brand := string(temp)
-	f.Codec = codecs[brand]
-	return
+	f.MajorBrand = string(data[:4])
+	f.MinorVersion = binary.BigEndian.Uint32(data[4:8])
+	f.CompatibleBrands = nil
+	for data = data[8:]; len(data) >= 4; data = data[4:] {
+		f.CompatibleBrands = append(f.CompatibleBrands, string(data[:4]))
+	}
+	f.Codec = codecs[f.MajorBrand]
+	if f.Codec == "" {
+		f.Codec = strings.TrimSpace(f.MajorBrand)
+	}
+	f.Profile = brandProfiles[f.MajorBrand]
+	for _, brand := range f.CompatibleBrands {
+		if f.Profile != "" {
+			break
+		}
+		f.Profile = brandProfiles[brand]
+	}
+	if f.Profile == "" {
+		f.Profile = "MP4"
+	}
 }
 
 // isMetaDataBlock Проверка является ли данный блок блоком, содержащим метаданные
@@ -332,12 +465,6 @@ func (f *VideoFile) isMetaDataBlock(blockName string) bool {
 	return false
 }
 
-// isSupported Проверка стандарта сжатия аудио/видеопотоков (поддерживается или нет)
-func (f *VideoFile) isSupported(brand string) bool {
-	_, ok := codecs[brand]
-	return ok
-}
-
 // readContainer Чтение общей информации о видеоконтейнере
 func (f *VideoFile) readContainer() {
 	defer restoreAndPanic("ошибка чтения метаданных контейнера")
@@ -444,12 +571,17 @@ func (f *VideoFile) readTrack() {
 		duration := time.Duration(1000*binary.BigEndian.Uint32(temp4)/f.Movie.TimeScale) * time.Millisecond
 		track.Duration = duration.Seconds()
 	}
-	_, err = f.metaDataBuf.Seek(50, io.SeekCurrent)
+	_, err = f.metaDataBuf.Seek(16, io.SeekCurrent) // пропускаем 16 байт (зарезервированы, слой, группа, громкость)
 	fatal(err)
+	var matrix = make([]byte, 36)
+	_, err = io.ReadFull(f.metaDataBuf, matrix)
+	fatal(err)
+	track.Rotation = rotationFromMatrix(matrix)
 	_, err = io.ReadFull(f.metaDataBuf, temp8)
 	fatal(err)
-	track.Width = binary.BigEndian.Uint32(temp8[:4])
-	track.Height = binary.BigEndian.Uint32(temp8[4:8])
+	// ширина и высота хранятся как числа с фиксированной точкой 16.16
+	track.Width = binary.BigEndian.Uint32(temp8[:4]) >> 16
+	track.Height = binary.BigEndian.Uint32(temp8[4:8]) >> 16
 	f.Movie.Tracks = append(f.Movie.Tracks, track)
 }
 
@@ -467,32 +599,10 @@ func (f *VideoFile) readStreamExtraInfo() {
 	StreamType := f.getCurrentTrack().Stream.getType()
 	if StreamType == Audio {
 		audioStream := f.getCurrentTrack().Stream.(*AudioStream)
-		temp := make([]byte, 4)
-		f.metaDataBuf.Seek(4, io.SeekCurrent)
-		_, err = io.ReadFull(f.metaDataBuf, temp)
-		fatal(err)
-		audioStream.Format = string(temp)
-		_, err = f.metaDataBuf.Seek(16, io.SeekCurrent)
-		fatal(err)
-		temp = make([]byte, 2)
-		_, err = io.ReadFull(f.metaDataBuf, temp)
-		fatal(err)
-		channels := binary.BigEndian.Uint16(temp)
-		audioStream.Channels = "undefined"
-		if channels == 1 {
-			audioStream.Channels = "Mono"
-		} else if channels == 2 {
-			audioStream.Channels = "Stereo"
-		}
-		_, err = f.metaDataBuf.Seek(6, io.SeekCurrent)
-		fatal(err)
-		temp = make([]byte, 4)
-		_, err = io.ReadFull(f.metaDataBuf, temp)
-		fatal(err)
-		audioStream.SampleRate = binary.BigEndian.Uint32(temp) >> 16
+		audioStream.readSampleEntry(readSampleEntry(f.metaDataBuf))
 	} else if StreamType == Video {
 		videoStream := f.getCurrentTrack().Stream.(*VideoStream)
-		videoStream.read(f.metaDataBuf)
+		videoStream.readSampleEntry(readSampleEntry(f.metaDataBuf))
 	}
 }
 
@@ -557,28 +667,3 @@ func (stream *AudioStream) read(buf *bytes.Reader) {
 		stream.AudioBalance = "right"
 	}
 }
-
-// read Чтение информации о видеопотоке
-func (stream *VideoStream) read(buf *bytes.Reader) {
-	defer restoreAndPanic("ошибка чтения метаданных видеопотока")
-	var err error
-	temp := make([]byte, 4)
-	_, err = buf.Seek(4, io.SeekCurrent)
-	fatal(err)
-	_, err = buf.Read(temp)
-	fatal(err)
-	stream.Format = string(temp)
-	_, err = buf.Seek(28, io.SeekCurrent)
-	fatal(err)
-	temp = make([]byte, 8)
-	_, err = buf.Read(temp)
-	fatal(err)
-	stream.ResX = binary.BigEndian.Uint16(temp[:4])
-	stream.ResY = binary.BigEndian.Uint16(temp[4:8])
-	_, err = buf.Seek(38, io.SeekCurrent)
-	fatal(err)
-	temp = make([]byte, 2)
-	_, err = buf.Read(temp)
-	fatal(err)
-	stream.ColorDepth = binary.BigEndian.Uint16(temp)
-}
@@ -0,0 +1,63 @@
+// Copyright 2020 Sergey Sidorenko. All rights not reserved.
+// Пакет с реализацией модудя извлечения метаинформации видеофайла в формате mp4
+// Сведения о лицензии отсутствуют
+
+// Проверка размеров блоков верхнего уровня файла MP4
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCheckFileBoxSize(t *testing.T) {
+	movie, moved := testMovie(t), faststartMovie(t)
+	// moov в конце testMovie, mdat в конце файла после переноса moov в начало
+	withSize := func(data []byte, name string, size uint32) []byte {
+		data = append([]byte{}, data...)
+		binary.BigEndian.PutUint32(data[bytes.LastIndex(data, []byte(name))-4:], size)
+		return data
+	}
+	free64 := []byte{0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 16}
+	tests := []struct {
+		name   string
+		data   []byte
+		err    error
+		layout []string
+		last   int64 // размер последнего блока
+	}{
+		{"размер меньше заголовка", []byte{0, 0, 0, 4, 'f', 't', 'y', 'p', 0, 0, 0, 0}, ErrFileIsNotValid, nil, 0},
+		{"ftyp до конца файла", []byte{0, 0, 0, 0, 'f', 't', 'y', 'p', 'i', 's', 'o', 'm'}, ErrMovieNotFound, nil, 0},
+		{"64-битный размер меньше заголовка", append(append([]byte{}, movie...), append(free64[:15:15], 12)...), ErrFileIsNotValid, nil, 0},
+		{"64-битный размер", append(append([]byte{}, movie...), free64...), nil, []string{"ftyp", "mdat", "moov", "free"}, 16},
+		{"moov до конца файла", withSize(movie, "moov", 0), nil, []string{"ftyp", "mdat", "moov"}, 0},
+		{"mdat до конца файла", withSize(moved, "mdat", 0), nil, []string{"ftyp", "moov", "mdat"}, 0},
+	}
+	for _, test := range tests {
+		var f VideoFile
+		err := f.Open(bytes.NewReader(test.data))
+		if err != test.err {
+			t.Fatalf("%s: ошибка %v вместо %v", test.name, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		if f.Size != len(test.data) || len(f.Layout) != len(test.layout) || len(f.Movie.Tracks) != 2 {
+			t.Fatalf("%s: размер %d, блоки %+v, %d дорожек", test.name, f.Size, f.Layout, len(f.Movie.Tracks))
+		}
+		for i, name := range test.layout {
+			if f.Layout[i].Type != name {
+				t.Fatalf("%s: блоки %+v", test.name, f.Layout)
+			}
+		}
+		// размер блока до конца файла определяется по оставшимся данным
+		last := f.Layout[len(f.Layout)-1]
+		if test.last == 0 {
+			test.last = int64(len(test.data)) - last.Offset
+		}
+		if last.Size != test.last || last.Offset+last.Size != int64(len(test.data)) {
+			t.Fatalf("%s: последний блок %+v", test.name, last)
+		}
+	}
+}